@@ -13,7 +13,7 @@ const http = require('http');
 
 // Protected vendor routes that require vendor role
 const vendorProtectedRoutes = [
-  { path: '/api/event/v1', methods: ['POST'] }
+  { path: '/api/event/v1', methods: ['POST', 'PUT', 'DELETE'] }
 ];
 
 // Middleware to check if user is a vendor
@@ -44,6 +44,7 @@ const targetUserService = process.env.USER_SERVICE_URL;
 const targetAuthService = process.env.AUTH_SERVICE_URL;
 const targetEventService = process.env.EVENT_SERVICE_URL;
 const targetReserveService = process.env.RESERVE_SERVICE_URL;
+const targetWaitingRoom = process.env.WAITING_ROOM_URL;
 
 const app = express();
 const server = http.createServer(app);
@@ -61,6 +62,13 @@ const wsProxy = httpProxy.createProxyServer({
   changeOrigin: true
 });
 
+// Create WebSocket proxy for queue status updates
+const queueWsProxy = httpProxy.createProxyServer({
+  target: targetWaitingRoom,
+  ws: true,
+  changeOrigin: true
+});
+
 const retryOptions = {
   maxRetries: 3,
   initialDelay: 100,
@@ -149,6 +157,10 @@ server.on('upgrade', (req, socket, head) => {
         socket.write('HTTP/1.1 401 Unauthorized\r\n\r\n');
         socket.destroy();
       });
+  } else if (path.startsWith('/api/queue/v1/queue/ws')) {
+    // The queue token in the query string identifies the user
+    req.url = req.url.replace(/^\/api\/queue/, '');
+    queueWsProxy.ws(req, socket, head);
   }
 });
 
@@ -160,6 +172,13 @@ wsProxy.on('error', (err, req, socket) => {
   }
 });
 
+queueWsProxy.on('error', (err, req, socket) => {
+  console.error('Queue WebSocket proxy error:', err);
+  if (socket.writable) {
+    socket.write('HTTP/1.1 502 Bad Gateway\r\n\r\n');
+  }
+});
+
 app.use('/api', concurrencyLimiter);
 app.use('/api', rateLimiter);
 
@@ -231,6 +250,11 @@ app.use('/api/reserve', (req, res) => {
   proxyWithRetry(req, res, targetReserveService);
 });
 
+app.use('/api/queue', (req, res) => {
+  req.url = req.url.replace(/^\/api\/queue/, '');
+  proxyWithRetry(req, res, targetWaitingRoom);
+});
+
 app.get('/api/test', (req, res) => {
   res.json({ message: 'Success! You have not hit the rate limit.' ,
     targetU : targetUserService,
@@ -2,36 +2,211 @@ package broker
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// probeType marks messages published by Probe. Consume drops them, so
+// probing a routing key never reaches application code.
+const probeType = "tixie.probe"
+
+const confirmBuffer = 16
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+var (
+	// ErrNack is returned when the broker refuses to take responsibility
+	// for a published message.
+	ErrNack = errors.New("broker: message was nacked")
+	// ErrConfirmTimeout is returned when the broker does not confirm a
+	// published message in time. The message may or may not have been
+	// delivered.
+	ErrConfirmTimeout = errors.New("broker: timed out waiting for publish confirmation")
+	// ErrConfirmsDisabled is returned by Probe when confirm mode is off.
+	ErrConfirmsDisabled = errors.New("broker: confirm mode is not enabled")
+	// ErrNotConnected is returned while the broker is reconnecting to
+	// RabbitMQ. Callers should retry later.
+	ErrNotConnected = errors.New("broker: not connected to RabbitMQ")
+	// ErrClosed is returned once Close has been called.
+	ErrClosed = errors.New("broker: closed")
+)
+
+// UnroutableError is returned in confirm mode when a message reached the
+// exchange but no queue was bound for its routing key.
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("broker: message to exchange %q with routing key %q is unroutable: %d %s",
+		e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// IsUnroutable reports whether err is an *UnroutableError.
+func IsUnroutable(err error) bool {
+	var unroutable *UnroutableError
+	return errors.As(err, &unroutable)
+}
+
+// Broker is a supervised RabbitMQ connection. When the connection drops it
+// reconnects with backoff, re-declares the exchange and every queue declared
+// through it, and resumes its consumers. It is safe for concurrent use.
 type Broker struct {
-	conn     *amqp.Connection
-	channel  *amqp.Channel
-	exchange string
-	url      string
+	url          string
+	exchange     string
+	exchangeType string
+	dial         func(url string) (amqpConnection, error)
+
+	// mu guards the connection state and the registered topology below.
+	mu      sync.RWMutex
+	conn    amqpConnection
+	channel amqpChannel
+	closed  bool
+	done    chan struct{}
+
+	// Replayed on every (re)connect.
+	declarations  []func(ch amqpChannel) error
+	consumers     []*consumer
+	subscriptions []*subscription
+	qos           *qosSettings
+
+	// Confirm mode, see EnableConfirms.
+	publishMu      sync.Mutex
+	confirms       bool
+	confirmTimeout time.Duration
+	acks           chan amqp.Confirmation
+	returns        chan amqp.Return
+}
+
+type qosSettings struct {
+	prefetchCount int
+	prefetchSize  int
+	global        bool
+}
+
+// amqpConnection is the part of *amqp.Connection the broker uses.
+type amqpConnection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// amqpChannel is the part of *amqp.Channel the broker uses.
+type amqpChannel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	GetNextPublishSeqNo() uint64
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// connection adapts *amqp.Connection to amqpConnection.
+type connection struct {
+	*amqp.Connection
+}
+
+func (c connection) Channel() (amqpChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func dialAMQP(url string) (amqpConnection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return connection{conn}, nil
+}
+
+// consumer is an auto-acknowledging consumer started by Consume. Its
+// deliveries channel outlives the AMQP channel it is fed from.
+type consumer struct {
+	queue      string
+	deliveries chan amqp.Delivery
 }
 
 func NewBroker(rabbitMQURL, exchange string, exchangeType string) (*Broker, error) {
-	conn, err := amqp.Dial(rabbitMQURL)
+	b := &Broker{
+		url:          rabbitMQURL,
+		exchange:     exchange,
+		exchangeType: exchangeType,
+		dial:         dialAMQP,
+		done:         make(chan struct{}),
+	}
+
+	if err := b.connect(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// connect dials RabbitMQ, restores the registered topology and consumers on
+// the new channel and starts supervising the connection.
+func (b *Broker) connect() error {
+	conn, err := b.dial(b.url)
 	if err != nil {
 		log.Printf("Failed to connect to RabbitMQ: %v", err)
-		return nil, err
+		return err
 	}
 
 	ch, err := conn.Channel()
 	if err != nil {
 		log.Printf("Failed to open channel: %v", err)
 		conn.Close()
-		return nil, err
+		return err
 	}
 
-	if exchange != "" {
-		err = ch.ExchangeDeclare(
-			exchange,
-			exchangeType,
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		conn.Close()
+		return ErrClosed
+	}
+
+	if err := b.restore(ch); err != nil {
+		log.Printf("Failed to restore broker topology: %v", err)
+		conn.Close()
+		return err
+	}
+
+	b.conn = conn
+	b.channel = ch
+	go b.supervise(conn, connClosed, chClosed)
+	return nil
+}
+
+// restore declares the exchange and everything registered so far on ch and
+// starts the consumers. It must be called with mu held.
+func (b *Broker) restore(ch amqpChannel) error {
+	if b.exchange != "" {
+		err := ch.ExchangeDeclare(
+			b.exchange,
+			b.exchangeType,
 			true,
 			false,
 			false,
@@ -39,62 +214,152 @@ func NewBroker(rabbitMQURL, exchange string, exchangeType string) (*Broker, erro
 			nil,
 		)
 		if err != nil {
-			log.Printf("Failed to declare exchange: %v", err)
-			ch.Close()
-			conn.Close()
-			return nil, err
+			return fmt.Errorf("failed to declare exchange: %v", err)
 		}
 	}
 
-	return &Broker{
-		conn:     conn,
-		channel:  ch,
-		exchange: exchange,
-		url:      rabbitMQURL,
-	}, nil
-}
+	if b.confirms {
+		if err := b.setupConfirms(ch); err != nil {
+			return fmt.Errorf("failed to enable confirm mode: %v", err)
+		}
+	}
 
-func (b *Broker) ensureConnection() error {
-	if b.conn == nil || b.conn.IsClosed() {
-		conn, err := amqp.Dial(b.url)
-		if err != nil {
-			log.Printf("Failed to reconnect to RabbitMQ: %v", err)
+	for _, declare := range b.declarations {
+		if err := declare(ch); err != nil {
 			return err
 		}
-		b.conn = conn
+	}
+
+	if b.qos != nil {
+		if err := ch.Qos(b.qos.prefetchCount, b.qos.prefetchSize, b.qos.global); err != nil {
+			return fmt.Errorf("failed to set QoS: %v", err)
+		}
+	}
 
-		b.channel, err = conn.Channel()
-		if err != nil {
-			log.Printf("Failed to open channel on reconnect: %v", err)
-			conn.Close()
+	for _, c := range b.consumers {
+		if err := b.startConsumer(ch, c); err != nil {
+			return err
+		}
+	}
+	for _, s := range b.subscriptions {
+		if err := b.startSubscription(ch, s); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (b *Broker) Publish(message interface{}, key string) error {
-	if err := b.ensureConnection(); err != nil {
+// supervise waits for the connection or its channel to close and reconnects
+// unless the broker was closed on purpose.
+func (b *Broker) supervise(conn amqpConnection, connClosed, chClosed <-chan *amqp.Error) {
+	var reason *amqp.Error
+	select {
+	case reason = <-connClosed:
+	case reason = <-chClosed:
+	case <-b.done:
+		return
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.conn = nil
+	b.channel = nil
+	b.mu.Unlock()
+
+	// A channel-level error leaves the connection open; drop it too so that
+	// everything is rebuilt from scratch.
+	conn.Close()
+	log.Printf("Lost connection to RabbitMQ, reconnecting: %v", reason)
+
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-time.After(delay):
+		}
+
+		if err := b.connect(); err == nil {
+			log.Println("Reconnected to RabbitMQ")
+			return
+		} else if errors.Is(err, ErrClosed) {
+			return
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// declare runs fn on the current channel and records it so that it is run
+// again after a reconnect. If the broker is reconnecting, fn only runs once
+// the connection is back.
+func (b *Broker) declare(fn func(ch amqpChannel) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	if b.channel != nil {
+		if err := fn(b.channel); err != nil {
+			return err
+		}
+	}
+	b.declarations = append(b.declarations, fn)
+	return nil
+}
+
+// EnableConfirms puts the broker's channel into confirm mode. From then on
+// every Publish is mandatory and waits up to timeout for the broker to ack
+// it. A nack is reported as ErrNack, a missing ack as ErrConfirmTimeout and
+// a message no queue is bound for as an *UnroutableError.
+func (b *Broker) EnableConfirms(timeout time.Duration) error {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	b.confirms = true
+	b.confirmTimeout = timeout
+	if b.channel == nil {
+		return nil
+	}
+	return b.setupConfirms(b.channel)
+}
+
+func (b *Broker) setupConfirms(ch amqpChannel) error {
+	if err := ch.Confirm(false); err != nil {
 		return err
 	}
+	// Publishes are serialised, so at most one confirmation and one return
+	// are outstanding at a time. The extra room is for stale ones left by
+	// timed out publishes, which must not block the connection.
+	b.acks = ch.NotifyPublish(make(chan amqp.Confirmation, confirmBuffer))
+	b.returns = ch.NotifyReturn(make(chan amqp.Return, confirmBuffer))
+	return nil
+}
 
+func (b *Broker) Publish(message interface{}, key string) error {
 	body, err := json.Marshal(message)
 	if err != nil {
 		log.Printf("Failed to marshal message: %v", err)
 		return err
 	}
 
-	err = b.channel.Publish(
-		b.exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
-	if err != nil {
+	if err := b.publish(b.exchange, key, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+	}); err != nil {
 		log.Printf("Failed to publish message: %v", err)
 		return err
 	}
@@ -102,38 +367,140 @@ func (b *Broker) Publish(message interface{}, key string) error {
 	log.Println("Published message:", string(body))
 	return nil
 }
-func (b *Broker) DeclareAndBindQueue(queueName, routingKey string) error {
-	if err := b.ensureConnection(); err != nil {
-		return err
+
+// Probe checks that a queue is bound for key by publishing an empty probe
+// message in confirm mode. It returns an *UnroutableError if the message
+// would be dropped. Consumers never see probe messages.
+func (b *Broker) Probe(key string) error {
+	b.mu.RLock()
+	confirms := b.confirms
+	b.mu.RUnlock()
+
+	if !confirms {
+		return ErrConfirmsDisabled
 	}
+	return b.publish(b.exchange, key, amqp.Publishing{Type: probeType})
+}
 
-	_, err := b.channel.QueueDeclare(
-		queueName,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
+func (b *Broker) publish(exchange, key string, msg amqp.Publishing) error {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	b.mu.RLock()
+	ch, closed := b.channel, b.closed
+	confirms, timeout, acks, returns := b.confirms, b.confirmTimeout, b.acks, b.returns
+	b.mu.RUnlock()
+
+	if closed {
+		return ErrClosed
+	}
+	if ch == nil {
+		return ErrNotConnected
+	}
+
+	if !confirms {
+		return ch.Publish(exchange, key, false, false, msg)
+	}
+
+	seq := ch.GetNextPublishSeqNo()
+	if err := ch.Publish(exchange, key, true, false, msg); err != nil {
 		return err
 	}
+	return waitForConfirm(seq, timeout, acks, returns)
+}
+
+// waitForConfirm waits for the confirmation of the message published with
+// delivery tag seq. The broker sends basic.return before the ack of an
+// unroutable message, so a return seen before our ack belongs to it, unless
+// it is followed by the stale ack of an earlier, timed out publish.
+func waitForConfirm(seq uint64, timeout time.Duration, acks <-chan amqp.Confirmation, returns <-chan amqp.Return) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var returned *amqp.Return
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			returned = &r
+		case c, ok := <-acks:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			if c.DeliveryTag < seq {
+				returned = nil
+				continue
+			}
+			if !c.Ack {
+				return ErrNack
+			}
+			if returned != nil {
+				return &UnroutableError{
+					Exchange:   returned.Exchange,
+					RoutingKey: returned.RoutingKey,
+					ReplyCode:  returned.ReplyCode,
+					ReplyText:  returned.ReplyText,
+				}
+			}
+			return nil
+		case <-timer.C:
+			return ErrConfirmTimeout
+		}
+	}
+}
 
-	return b.channel.QueueBind(
-		queueName,
-		routingKey,
-		b.exchange,
-		false,
-		nil,
-	)
+func (b *Broker) DeclareAndBindQueue(queueName, routingKey string) error {
+	return b.declare(func(ch amqpChannel) error {
+		_, err := ch.QueueDeclare(
+			queueName,
+			true,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			return err
+		}
+
+		return ch.QueueBind(
+			queueName,
+			routingKey,
+			b.exchange,
+			false,
+			nil,
+		)
+	})
 }
+
+// Consume starts an auto-acknowledging consumer on queueName. Messages are
+// lost if processing them fails; use Subscribe for at-least-once delivery.
+// The returned channel keeps delivering after a reconnect.
 func (b *Broker) Consume(queueName string) (<-chan amqp.Delivery, error) {
-	if err := b.ensureConnection(); err != nil {
-		return nil, err
+	c := &consumer{queue: queueName, deliveries: make(chan amqp.Delivery)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
 	}
+	if b.channel != nil {
+		if err := b.startConsumer(b.channel, c); err != nil {
+			log.Printf("Failed to start consuming: %v", err)
+			return nil, err
+		}
+	}
+	b.consumers = append(b.consumers, c)
+
+	return c.deliveries, nil
+}
 
-	msgs, err := b.channel.Consume(
-		queueName,
+func (b *Broker) startConsumer(ch amqpChannel, c *consumer) error {
+	msgs, err := ch.Consume(
+		c.queue,
 		"",
 		true,
 		false,
@@ -142,14 +509,34 @@ func (b *Broker) Consume(queueName string) (<-chan amqp.Delivery, error) {
 		nil,
 	)
 	if err != nil {
-		log.Printf("Failed to start consuming: %v", err)
-		return nil, err
+		return err
 	}
 
-	return msgs, nil
+	go func() {
+		for msg := range msgs {
+			if msg.Type == probeType {
+				continue
+			}
+			select {
+			case c.deliveries <- msg:
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return nil
 }
 
 func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+
 	if b.channel != nil {
 		if err := b.channel.Close(); err != nil {
 			log.Printf("Failed to close channel: %v", err)
@@ -167,8 +554,15 @@ func (b *Broker) Close() error {
 
 // SetQoS sets the prefetch count for the channel
 func (b *Broker) SetQoS(prefetchCount int, prefetchSize int, global bool) error {
-	if err := b.ensureConnection(); err != nil {
-		return err
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	b.qos = &qosSettings{prefetchCount: prefetchCount, prefetchSize: prefetchSize, global: global}
+	if b.channel == nil {
+		return nil
 	}
 	return b.channel.Qos(prefetchCount, prefetchSize, global)
 }
@@ -0,0 +1,337 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestWaitForConfirm(t *testing.T) {
+	returned := amqp.Return{Exchange: "tixie", RoutingKey: "payment.requested", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+
+	tests := []struct {
+		name string
+		// What the broker sends, in order: amqp.Confirmation or amqp.Return
+		sent []interface{}
+		want error
+	}{
+		{
+			name: "ack",
+			sent: []interface{}{amqp.Confirmation{DeliveryTag: 5, Ack: true}},
+		},
+		{
+			name: "nack",
+			sent: []interface{}{amqp.Confirmation{DeliveryTag: 5, Ack: false}},
+			want: ErrNack,
+		},
+		{
+			name: "return before ack",
+			sent: []interface{}{returned, amqp.Confirmation{DeliveryTag: 5, Ack: true}},
+			want: &UnroutableError{Exchange: "tixie", RoutingKey: "payment.requested", ReplyCode: 312, ReplyText: "NO_ROUTE"},
+		},
+		{
+			name: "stale ack of an earlier publish",
+			sent: []interface{}{amqp.Confirmation{DeliveryTag: 4, Ack: true}, amqp.Confirmation{DeliveryTag: 5, Ack: true}},
+		},
+		{
+			name: "stale nack of an earlier publish",
+			sent: []interface{}{amqp.Confirmation{DeliveryTag: 3, Ack: false}, amqp.Confirmation{DeliveryTag: 5, Ack: true}},
+		},
+		{
+			name: "return of an earlier publish",
+			sent: []interface{}{returned, amqp.Confirmation{DeliveryTag: 4, Ack: true}, amqp.Confirmation{DeliveryTag: 5, Ack: true}},
+		},
+		{
+			name: "return after a stale ack",
+			sent: []interface{}{amqp.Confirmation{DeliveryTag: 4, Ack: true}, returned, amqp.Confirmation{DeliveryTag: 5, Ack: true}},
+			want: &UnroutableError{Exchange: "tixie", RoutingKey: "payment.requested", ReplyCode: 312, ReplyText: "NO_ROUTE"},
+		},
+		{
+			name: "timeout",
+			want: ErrConfirmTimeout,
+		},
+		{
+			name: "only stale acks before the timeout",
+			sent: []interface{}{amqp.Confirmation{DeliveryTag: 4, Ack: true}},
+			want: ErrConfirmTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Unbuffered, so the broker's messages arrive in order
+			acks := make(chan amqp.Confirmation)
+			returns := make(chan amqp.Return)
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for _, msg := range tt.sent {
+					switch msg := msg.(type) {
+					case amqp.Confirmation:
+						select {
+						case acks <- msg:
+						case <-done:
+							return
+						}
+					case amqp.Return:
+						select {
+						case returns <- msg:
+						case <-done:
+							return
+						}
+					}
+				}
+			}()
+
+			err := waitForConfirm(5, 50*time.Millisecond, acks, returns)
+
+			var unroutable *UnroutableError
+			if want, ok := tt.want.(*UnroutableError); ok {
+				if !errors.As(err, &unroutable) || *unroutable != *want {
+					t.Errorf("waitForConfirm = %v, want %v", err, want)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("waitForConfirm = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitForConfirm_ClosedChannel(t *testing.T) {
+	acks := make(chan amqp.Confirmation)
+	close(acks)
+
+	if err := waitForConfirm(1, time.Second, acks, make(chan amqp.Return)); !errors.Is(err, amqp.ErrClosed) {
+		t.Errorf("waitForConfirm = %v, want %v", err, amqp.ErrClosed)
+	}
+}
+
+// fakeConnection hands out a single fakeChannel.
+type fakeConnection struct {
+	ch *fakeChannel
+}
+
+func (c *fakeConnection) Channel() (amqpChannel, error) { return c.ch, nil }
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error { return receiver }
+
+func (c *fakeConnection) Close() error { return c.ch.Close() }
+
+// fakeChannel records the topology calls made on it and feeds each consumer
+// from its own Go channel.
+type fakeChannel struct {
+	mu         sync.Mutex
+	calls      []string
+	consumers  map[string]chan amqp.Delivery
+	notifyLost chan *amqp.Error
+	closeOnce  sync.Once
+}
+
+func newFakeChannel() *fakeChannel {
+	return &fakeChannel{consumers: make(map[string]chan amqp.Delivery)}
+}
+
+func (c *fakeChannel) record(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, fmt.Sprintf(format, args...))
+}
+
+func (c *fakeChannel) recorded() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.calls...)
+}
+
+func (c *fakeChannel) deliver(queue string, msg amqp.Delivery) {
+	c.mu.Lock()
+	deliveries := c.consumers[queue]
+	c.mu.Unlock()
+	deliveries <- msg
+}
+
+func (c *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	c.record("exchange %s %s", name, kind)
+	return nil
+}
+
+func (c *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.record("queue %s", name)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.record("bind %s %s %s", name, key, exchange)
+	return nil
+}
+
+func (c *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	c.record("qos %d", prefetchCount)
+	return nil
+}
+
+func (c *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	c.record("consume %s", queue)
+	deliveries := make(chan amqp.Delivery)
+	c.mu.Lock()
+	c.consumers[queue] = deliveries
+	c.mu.Unlock()
+	return deliveries, nil
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.record("publish %s %s", exchange, key)
+	return nil
+}
+
+func (c *fakeChannel) GetNextPublishSeqNo() uint64 { return 1 }
+
+func (c *fakeChannel) Confirm(noWait bool) error { return nil }
+
+func (c *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	return confirm
+}
+
+func (c *fakeChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return { return returns }
+
+func (c *fakeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.notifyLost = receiver
+	return receiver
+}
+
+func (c *fakeChannel) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, deliveries := range c.consumers {
+			close(deliveries)
+		}
+	})
+	return nil
+}
+
+// waitForChannel waits until the broker has finished restoring onto ch.
+func waitForChannel(t *testing.T, b *Broker, ch amqpChannel) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.RLock()
+		current := b.channel
+		b.mu.RUnlock()
+		if current == ch {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("broker did not switch to the expected channel")
+}
+
+func TestReconnect_ReplaysTopologyAndConsumersInOrder(t *testing.T) {
+	dialed := make(chan *fakeChannel, 2)
+	b := &Broker{
+		exchange:     "tixie",
+		exchangeType: "topic",
+		done:         make(chan struct{}),
+		dial: func(string) (amqpConnection, error) {
+			ch := newFakeChannel()
+			dialed <- ch
+			return &fakeConnection{ch: ch}, nil
+		},
+	}
+	if err := b.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer b.Close()
+	first := <-dialed
+
+	handled := make(chan string, 1)
+	if err := b.DeclareAndBindQueue("ticket_events", "ticket.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetQoS(10, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	events, err := b.Consume("ticket_events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Subscribe("payment_requests", "payment.requested", ConsumerOptions{Workers: 2}, func(msg amqp.Delivery) error {
+		handled <- string(msg.Body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the channel and register one more queue while the broker is down.
+	first.notifyLost <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"}
+	waitForChannel(t, b, nil)
+	if err := b.DeclareAndBindQueue("seat_events", "seat.*"); err != nil {
+		t.Fatalf("declare while reconnecting: %v", err)
+	}
+
+	var second *fakeChannel
+	select {
+	case second = <-dialed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker did not reconnect")
+	}
+	waitForChannel(t, b, second)
+
+	want := []string{
+		"exchange tixie topic",
+		"queue ticket_events",
+		"bind ticket_events ticket.* tixie",
+		"exchange tixie.dlx direct",
+		"queue payment_requests.dlq",
+		"bind payment_requests.dlq payment_requests tixie.dlx",
+		"queue payment_requests.retry",
+		"queue payment_requests",
+		"bind payment_requests payment.requested tixie",
+		"queue seat_events",
+		"bind seat_events seat.* tixie",
+		"qos 10",
+		"consume ticket_events",
+		"qos 2",
+		"consume payment_requests",
+	}
+	if got := second.recorded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed on the new channel:\n%v\nwant:\n%v", got, want)
+	}
+
+	// Both consumers are fed from the new channel.
+	second.deliver("ticket_events", amqp.Delivery{Body: []byte("ticket")})
+	select {
+	case msg := <-events:
+		if string(msg.Body) != "ticket" {
+			t.Errorf("Consume delivered %q, want %q", msg.Body, "ticket")
+		}
+	case <-time.After(time.Second):
+		t.Error("Consume channel did not resume after the reconnect")
+	}
+
+	ack := &fakeAcknowledger{}
+	second.deliver("payment_requests", amqp.Delivery{Acknowledger: ack, Body: []byte("payment")})
+	select {
+	case body := <-handled:
+		if body != "payment" {
+			t.Errorf("subscription handled %q, want %q", body, "payment")
+		}
+	case <-time.After(time.Second):
+		t.Error("subscription did not resume after the reconnect")
+	}
+
+	if err := b.Publish(map[string]int{"ticket_id": 1}, "ticket.created"); err != nil {
+		t.Fatalf("publish after reconnect: %v", err)
+	}
+	if got := second.recorded(); got[len(got)-1] != "publish tixie ticket.created" {
+		t.Errorf("last call on the new channel = %q, want the publish", got[len(got)-1])
+	}
+}
@@ -0,0 +1,252 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RetryCountHeader counts how many times a message has been redelivered after
+// its handler failed.
+const RetryCountHeader = "x-retry-count"
+
+const (
+	defaultMaxAttempts = 5
+	defaultRetryDelay  = 5 * time.Second
+)
+
+// Handler processes one delivery. Returning nil acknowledges the message.
+// Returning an error retries it, or dead-letters it once it has used up its
+// attempts or if the error is wrapped with Permanent.
+type Handler func(msg amqp.Delivery) error
+
+// ConsumerOptions configures Subscribe. Zero values fall back to defaults.
+type ConsumerOptions struct {
+	// MaxAttempts is how many times a message is handled before it is
+	// moved to the dead-letter queue.
+	MaxAttempts int
+	// RetryDelay is how long a failed message waits before it is retried.
+	RetryDelay time.Duration
+	// Workers is the number of messages handled concurrently.
+	Workers int
+	// Prefetch is how many unacknowledged messages the broker sends ahead.
+	// It defaults to Workers.
+	Prefetch int
+}
+
+func (o ConsumerOptions) withDefaults() ConsumerOptions {
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = defaultMaxAttempts
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = defaultRetryDelay
+	}
+	if o.Workers <= 0 {
+		o.Workers = 1
+	}
+	if o.Prefetch < o.Workers {
+		o.Prefetch = o.Workers
+	}
+	return o
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying, e.g. because the message is
+// malformed. The message is dead-lettered straight away.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// DeadLetterExchange returns the name of the exchange that dead-lettered
+// messages from queues on exchange are sent to.
+func DeadLetterExchange(exchange string) string {
+	return exchange + ".dlx"
+}
+
+// DeadLetterQueue returns the name of the queue holding the messages that
+// could not be processed from queueName.
+func DeadLetterQueue(queueName string) string {
+	return queueName + ".dlq"
+}
+
+// RetryQueue returns the name of the queue failed messages from queueName
+// wait in before they are retried.
+func RetryQueue(queueName string) string {
+	return queueName + ".retry"
+}
+
+// DeclareQueueWithDLQ declares queueName bound to routingKey together with
+// its dead-letter and retry queues:
+//
+//   - rejected messages go through the "<exchange>.dlx" exchange to
+//     "<queue>.dlq", where they stay until replayed;
+//   - messages to retry are parked in "<queue>.retry" and return to the
+//     queue once retryDelay has passed.
+func (b *Broker) DeclareQueueWithDLQ(queueName, routingKey string, retryDelay time.Duration) error {
+	return b.declare(func(ch amqpChannel) error {
+		dlx := DeadLetterExchange(b.exchange)
+		if err := ch.ExchangeDeclare(dlx, "direct", true, false, false, false, nil); err != nil {
+			return fmt.Errorf("failed to declare dead-letter exchange: %v", err)
+		}
+
+		dlq := DeadLetterQueue(queueName)
+		if _, err := ch.QueueDeclare(dlq, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("failed to declare dead-letter queue: %v", err)
+		}
+		if err := ch.QueueBind(dlq, queueName, dlx, false, nil); err != nil {
+			return fmt.Errorf("failed to bind dead-letter queue: %v", err)
+		}
+
+		if _, err := ch.QueueDeclare(RetryQueue(queueName), true, false, false, false, amqp.Table{
+			"x-message-ttl":             retryDelay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queueName,
+		}); err != nil {
+			return fmt.Errorf("failed to declare retry queue: %v", err)
+		}
+
+		if _, err := ch.QueueDeclare(queueName, true, false, false, false, amqp.Table{
+			"x-dead-letter-exchange":    dlx,
+			"x-dead-letter-routing-key": queueName,
+		}); err != nil {
+			return fmt.Errorf("failed to declare queue: %v", err)
+		}
+
+		return ch.QueueBind(queueName, routingKey, b.exchange, false, nil)
+	})
+}
+
+// subscription is a consumer started by Subscribe. It is restarted on the
+// new channel after a reconnect.
+type subscription struct {
+	queue   string
+	opts    ConsumerOptions
+	handler Handler
+}
+
+// Subscribe declares queueName with its dead-letter topology, binds it to
+// routingKey and hands every message to handler with manual
+// acknowledgement. Failed messages are retried after opts.RetryDelay and
+// moved to the queue's DLQ after opts.MaxAttempts attempts. Consumption
+// resumes by itself after a reconnect.
+func (b *Broker) Subscribe(queueName, routingKey string, opts ConsumerOptions, handler Handler) error {
+	opts = opts.withDefaults()
+
+	if err := b.DeclareQueueWithDLQ(queueName, routingKey, opts.RetryDelay); err != nil {
+		return err
+	}
+
+	s := &subscription{queue: queueName, opts: opts, handler: handler}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	if b.channel != nil {
+		if err := b.startSubscription(b.channel, s); err != nil {
+			log.Printf("Failed to start consuming: %v", err)
+			return err
+		}
+	}
+	b.subscriptions = append(b.subscriptions, s)
+
+	return nil
+}
+
+func (b *Broker) startSubscription(ch amqpChannel, s *subscription) error {
+	if err := ch.Qos(s.opts.Prefetch, 0, false); err != nil {
+		return fmt.Errorf("failed to set QoS: %v", err)
+	}
+
+	msgs, err := ch.Consume(s.queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	// The workers exit when the channel closes; a reconnect starts new ones.
+	for i := 0; i < s.opts.Workers; i++ {
+		go func() {
+			for msg := range msgs {
+				b.handle(s.queue, msg, s.opts, s.handler)
+			}
+		}()
+	}
+	return nil
+}
+
+func (b *Broker) handle(queueName string, msg amqp.Delivery, opts ConsumerOptions, handler Handler) {
+	if msg.Type == probeType {
+		msg.Ack(false)
+		return
+	}
+
+	err := handler(msg)
+	if err == nil {
+		if err := msg.Ack(false); err != nil {
+			log.Printf("Failed to ack message on %s: %v", queueName, err)
+		}
+		return
+	}
+
+	attempts := RetryCount(msg) + 1
+	var permanent *permanentError
+	if errors.As(err, &permanent) || attempts >= opts.MaxAttempts {
+		log.Printf("Dead-lettering message on %s after %d attempt(s): %v", queueName, attempts, err)
+		if err := msg.Nack(false, false); err != nil {
+			log.Printf("Failed to dead-letter message on %s: %v", queueName, err)
+		}
+		return
+	}
+
+	log.Printf("Retrying message on %s in %s (attempt %d of %d): %v", queueName, opts.RetryDelay, attempts, opts.MaxAttempts, err)
+	if err := b.publish("", RetryQueue(queueName), retryPublishing(msg, attempts)); err != nil {
+		// Requeue rather than lose the message if it cannot be parked.
+		log.Printf("Failed to schedule retry on %s, requeueing: %v", queueName, err)
+		msg.Nack(false, true)
+		return
+	}
+	msg.Ack(false)
+}
+
+// RetryCount returns how many times msg has been retried so far.
+func RetryCount(msg amqp.Delivery) int {
+	switch n := msg.Headers[RetryCountHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+func retryPublishing(msg amqp.Delivery, retries int) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[RetryCountHeader] = int32(retries)
+
+	return amqp.Publishing{
+		Headers:       headers,
+		ContentType:   msg.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: msg.CorrelationId,
+		MessageId:     msg.MessageId,
+		Timestamp:     msg.Timestamp,
+		Type:          msg.Type,
+		Body:          msg.Body,
+	}
+}
@@ -0,0 +1,136 @@
+package broker
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeAcknowledger records how a delivery was settled.
+type fakeAcknowledger struct {
+	acked   bool
+	nacked  bool
+	requeue bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked = true
+	a.requeue = requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestHandle(t *testing.T) {
+	failure := errors.New("payment service unavailable")
+	opts := ConsumerOptions{MaxAttempts: 3}.withDefaults()
+
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		err     error
+		// How the delivery is settled
+		acked, nacked, requeue bool
+	}{
+		{name: "success is acked", acked: true},
+		{name: "permanent error is dead-lettered", err: Permanent(failure), nacked: true},
+		{name: "permanent error is dead-lettered on its first attempt", headers: amqp.Table{RetryCountHeader: int32(0)}, err: Permanent(failure), nacked: true},
+		{name: "last attempt is dead-lettered", headers: amqp.Table{RetryCountHeader: int32(2)}, err: failure, nacked: true},
+		{name: "attempts past the limit are dead-lettered", headers: amqp.Table{RetryCountHeader: int64(7)}, err: failure, nacked: true},
+		// The broker below is not connected, so the retry cannot be parked
+		{name: "retry that cannot be parked is requeued", headers: amqp.Table{RetryCountHeader: int32(1)}, err: failure, nacked: true, requeue: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := &fakeAcknowledger{}
+			msg := amqp.Delivery{Acknowledger: ack, Headers: tt.headers, Body: []byte(`{}`)}
+
+			(&Broker{}).handle("payment_requests", msg, opts, func(amqp.Delivery) error { return tt.err })
+
+			if ack.acked != tt.acked || ack.nacked != tt.nacked || ack.requeue != tt.requeue {
+				t.Errorf("acked %v, nacked %v, requeue %v; want %v, %v, %v",
+					ack.acked, ack.nacked, ack.requeue, tt.acked, tt.nacked, tt.requeue)
+			}
+		})
+	}
+}
+
+func TestHandle_DropsProbes(t *testing.T) {
+	ack := &fakeAcknowledger{}
+	msg := amqp.Delivery{Acknowledger: ack, Type: probeType}
+
+	(&Broker{}).handle("payment_requests", msg, ConsumerOptions{}.withDefaults(), func(amqp.Delivery) error {
+		t.Error("handler called for a probe")
+		return nil
+	})
+
+	if !ack.acked {
+		t.Error("probe was not acked")
+	}
+}
+
+func TestRetryCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    int
+	}{
+		{name: "missing header", want: 0},
+		{name: "other headers only", headers: amqp.Table{"x-other": int32(4)}, want: 0},
+		{name: "int32", headers: amqp.Table{RetryCountHeader: int32(3)}, want: 3},
+		{name: "int64", headers: amqp.Table{RetryCountHeader: int64(4)}, want: 4},
+		{name: "int", headers: amqp.Table{RetryCountHeader: 2}, want: 2},
+		{name: "unexpected type", headers: amqp.Table{RetryCountHeader: "3"}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RetryCount(amqp.Delivery{Headers: tt.headers}); got != tt.want {
+				t.Errorf("RetryCount = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPublishing(t *testing.T) {
+	sentAt := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := amqp.Delivery{
+		Headers:       amqp.Table{"x-trace": "abc", RetryCountHeader: int32(1)},
+		ContentType:   "application/json",
+		CorrelationId: "reservation-saga-7",
+		MessageId:     "msg-1",
+		Timestamp:     sentAt,
+		Type:          "payment.requested",
+		Body:          []byte(`{"ticket_id":1}`),
+	}
+
+	pub := retryPublishing(msg, 2)
+
+	if want := (amqp.Table{"x-trace": "abc", RetryCountHeader: int32(2)}); !reflect.DeepEqual(pub.Headers, want) {
+		t.Errorf("headers = %v, want %v", pub.Headers, want)
+	}
+	if pub.MessageId != "msg-1" || pub.CorrelationId != "reservation-saga-7" || pub.Type != "payment.requested" {
+		t.Errorf("ids = %q, %q, %q; want them carried over", pub.MessageId, pub.CorrelationId, pub.Type)
+	}
+	if pub.ContentType != "application/json" || !pub.Timestamp.Equal(sentAt) || string(pub.Body) != string(msg.Body) {
+		t.Errorf("publishing %+v does not carry over the message", pub)
+	}
+	if pub.DeliveryMode != amqp.Persistent {
+		t.Errorf("delivery mode = %d, want persistent", pub.DeliveryMode)
+	}
+	// The delivery's own headers are left alone
+	if got := RetryCount(msg); got != 1 {
+		t.Errorf("delivery retry count = %d after building the retry, want 1", got)
+	}
+}
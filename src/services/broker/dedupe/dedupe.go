@@ -0,0 +1,55 @@
+// Package dedupe makes message consumers idempotent by remembering which
+// message ids they have already processed.
+package dedupe
+
+import (
+	"log"
+	"time"
+
+	brokerPkg "tixie.local/broker"
+	"tixie.local/broker/events"
+)
+
+// DefaultTTL is how long a processed message id is remembered. It only has
+// to outlast the window in which RabbitMQ may redeliver the message.
+const DefaultTTL = 7 * 24 * time.Hour
+
+// Store records the messages a consumer has processed.
+type Store interface {
+	// Processed reports whether consumer already processed messageID.
+	Processed(consumer, messageID string) (bool, error)
+	// MarkProcessed remembers that consumer processed messageID for ttl.
+	MarkProcessed(consumer, messageID string, ttl time.Duration) error
+}
+
+// Wrap returns an event handler that skips messages consumer has already
+// processed and records the ones next handles successfully. A message is
+// only marked once next has returned, so a crash in between leads to it
+// being processed again; next should still be safe to repeat.
+func Wrap(store Store, consumer string, ttl time.Duration, next brokerPkg.EventHandler) brokerPkg.EventHandler {
+	return func(env events.Envelope, e events.Event) error {
+		if env.ID == "" {
+			return next(env, e)
+		}
+
+		processed, err := store.Processed(consumer, env.ID)
+		if err != nil {
+			log.Printf("Dedupe: failed to look up message %s for %s: %v", env.ID, consumer, err)
+			return err
+		}
+		if processed {
+			log.Printf("Dedupe: skipping message %s, already processed by %s", env.ID, consumer)
+			return nil
+		}
+
+		if err := next(env, e); err != nil {
+			return err
+		}
+
+		// The message was handled, so a failure here must not cause a retry.
+		if err := store.MarkProcessed(consumer, env.ID, ttl); err != nil {
+			log.Printf("Dedupe: failed to mark message %s processed for %s: %v", env.ID, consumer, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,68 @@
+package dedupe
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"tixie.local/broker/events"
+)
+
+func TestWrapSkipsProcessedMessages(t *testing.T) {
+	calls := 0
+	fail := true
+	handler := Wrap(NewMemoryStore(), "test_queue", DefaultTTL, func(env events.Envelope, e events.Event) error {
+		calls++
+		if fail {
+			return errors.New("temporary failure")
+		}
+		return nil
+	})
+
+	env := events.Envelope{ID: "msg-1", Type: events.TypeNotificationEmail}
+
+	if err := handler(env, nil); err == nil {
+		t.Fatal("expected the handler error to be returned")
+	}
+
+	// A failed message must be processed again when it is redelivered.
+	fail = false
+	if err := handler(env, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := handler(env, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("expected the handler to run twice, ran %d times", calls)
+	}
+}
+
+func TestMemoryStoreSweepsExpiredIDsPeriodically(t *testing.T) {
+	s := NewMemoryStore()
+	s.expires["test_queue:old"] = time.Now().Add(-time.Minute)
+
+	if err := s.MarkProcessed("test_queue", "msg-1", DefaultTTL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := s.expires["test_queue:old"]; !ok {
+		t.Fatal("expected the expired id to be kept until the next sweep")
+	}
+	if processed, _ := s.Processed("test_queue", "old"); processed {
+		t.Error("expected an expired id not to count as processed")
+	}
+
+	s.nextSweep = time.Now().Add(-time.Second)
+	if err := s.MarkProcessed("test_queue", "msg-2", DefaultTTL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := s.expires["test_queue:old"]; ok {
+		t.Error("expected the expired id to be swept")
+	}
+	for _, id := range []string{"msg-1", "msg-2"} {
+		if processed, _ := s.Processed("test_queue", id); !processed {
+			t.Errorf("expected %s to still be processed", id)
+		}
+	}
+}
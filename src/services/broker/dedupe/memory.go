@@ -0,0 +1,56 @@
+package dedupe
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often MemoryStore drops expired ids.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps processed message ids in memory. It only protects
+// against redeliveries while the process is running and is meant for
+// services without a database or Redis.
+type MemoryStore struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	nextSweep time.Time
+}
+
+// NewMemoryStore creates a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		expires:   make(map[string]time.Time),
+		nextSweep: time.Now().Add(sweepInterval),
+	}
+}
+
+func (s *MemoryStore) Processed(consumer, messageID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiresAt, ok := s.expires[consumer+":"+messageID]
+	return ok && time.Now().Before(expiresAt), nil
+}
+
+func (s *MemoryStore) MarkProcessed(consumer, messageID string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if !now.Before(s.nextSweep) {
+		s.sweep(now)
+	}
+	s.expires[consumer+":"+messageID] = now.Add(ttl)
+	return nil
+}
+
+// sweep drops the expired ids. It must be called with mu held.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, expiresAt := range s.expires {
+		if !now.Before(expiresAt) {
+			delete(s.expires, key)
+		}
+	}
+	s.nextSweep = now.Add(sweepInterval)
+}
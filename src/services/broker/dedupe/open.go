@@ -0,0 +1,19 @@
+package dedupe
+
+import "log"
+
+// Open returns a RedisStore for redisURL, or a MemoryStore if redisURL is
+// empty or Redis cannot be reached.
+func Open(redisURL string) Store {
+	if redisURL == "" {
+		log.Println("Dedupe: REDIS_URL not set, remembering processed messages in memory only")
+		return NewMemoryStore()
+	}
+
+	store, err := NewRedisStoreFromURL(redisURL)
+	if err != nil {
+		log.Printf("Dedupe: Redis unavailable, remembering processed messages in memory only: %v", err)
+		return NewMemoryStore()
+	}
+	return store
+}
@@ -0,0 +1,54 @@
+package dedupe
+
+import (
+	"database/sql"
+	"time"
+)
+
+// PostgresStore keeps processed message ids in a processed_messages table:
+//
+//	CREATE TABLE processed_messages (
+//	    consumer     TEXT NOT NULL,
+//	    message_id   TEXT NOT NULL,
+//	    processed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+//	    expires_at   TIMESTAMP NOT NULL,
+//	    PRIMARY KEY (consumer, message_id)
+//	);
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore creates a new PostgresStore. db must use a Postgres
+// driver.
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Processed(consumer, messageID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM processed_messages WHERE consumer=$1 AND message_id=$2 AND expires_at > NOW())",
+		consumer, messageID,
+	).Scan(&exists)
+	return exists, err
+}
+
+func (s *PostgresStore) MarkProcessed(consumer, messageID string, ttl time.Duration) error {
+	_, err := s.db.Exec(`
+		INSERT INTO processed_messages (consumer, message_id, expires_at)
+		VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')
+		ON CONFLICT (consumer, message_id)
+		DO UPDATE SET processed_at = NOW(), expires_at = EXCLUDED.expires_at`,
+		consumer, messageID, ttl.Seconds(),
+	)
+	return err
+}
+
+// PurgeExpired deletes the ids whose TTL has run out.
+func (s *PostgresStore) PurgeExpired() (int64, error) {
+	result, err := s.db.Exec("DELETE FROM processed_messages WHERE expires_at <= NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
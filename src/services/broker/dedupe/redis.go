@@ -0,0 +1,47 @@
+package dedupe
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore keeps processed message ids as Redis keys that expire with
+// their TTL.
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore creates a new RedisStore.
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+// NewRedisStoreFromURL connects to the Redis server at url, e.g.
+// "redis://redis-server:6379/0".
+func NewRedisStoreFromURL(url string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return NewRedisStore(client), nil
+}
+
+func (s *RedisStore) Processed(consumer, messageID string) (bool, error) {
+	n, err := s.client.Exists(context.Background(), redisKey(consumer, messageID)).Result()
+	return n > 0, err
+}
+
+func (s *RedisStore) MarkProcessed(consumer, messageID string, ttl time.Duration) error {
+	return s.client.Set(context.Background(), redisKey(consumer, messageID), 1, ttl).Err()
+}
+
+func redisKey(consumer, messageID string) string {
+	return "dedupe:" + consumer + ":" + messageID
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"tixie.local/broker/events"
+)
+
+// EventHandler processes one decoded event. Errors are handled as for
+// Handler.
+type EventHandler func(env events.Envelope, e events.Event) error
+
+// PublishEvent wraps e in a new envelope from producer and publishes it with
+// the routing key of its event type.
+func (b *Broker) PublishEvent(producer, correlationID string, e events.Event) error {
+	env, err := events.New(producer, correlationID, e)
+	if err != nil {
+		return err
+	}
+	return b.PublishEnvelope(env)
+}
+
+// PublishEnvelope publishes an already built envelope, e.g. one stored in an
+// outbox, with the routing key of its event type.
+func (b *Broker) PublishEnvelope(env events.Envelope) error {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s envelope: %v", env.Type, err)
+	}
+
+	if err := b.publish(b.exchange, events.RoutingKey(env.Type), amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     env.ID,
+		CorrelationId: env.CorrelationID,
+		Timestamp:     env.Timestamp,
+		Type:          env.Type,
+		AppId:         env.Producer,
+		Body:          body,
+	}); err != nil {
+		log.Printf("Failed to publish %s %s: %v", env.Type, env.ID, err)
+		return err
+	}
+
+	log.Printf("Published %s %s", env.Type, env.ID)
+	return nil
+}
+
+// SubscribeEvents subscribes queueName to eventType like Subscribe and
+// decodes every message before handing it to handler. Messages that cannot
+// be decoded, including unknown event versions, are dead-lettered without
+// retrying.
+func (b *Broker) SubscribeEvents(queueName, eventType string, opts ConsumerOptions, handler EventHandler) error {
+	return b.Subscribe(queueName, events.RoutingKey(eventType), opts, func(msg amqp.Delivery) error {
+		env, e, err := events.Decode(msg.Body)
+		if err != nil {
+			log.Printf("Failed to decode message %s on %s: %v", msg.MessageId, queueName, err)
+			return Permanent(err)
+		}
+		return handler(env, e)
+	})
+}
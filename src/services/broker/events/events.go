@@ -0,0 +1,141 @@
+// Package events defines the messages Tixie services exchange over
+// RabbitMQ. Every message is an Envelope whose Data holds one of the
+// registered, versioned event types.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownType is returned when decoding an event type that is not
+	// registered.
+	ErrUnknownType = errors.New("events: unknown event type")
+	// ErrUnsupportedVersion is returned when decoding a registered event
+	// type with a version this build does not understand.
+	ErrUnsupportedVersion = errors.New("events: unsupported event version")
+)
+
+// Event is implemented by every event type carried in an Envelope.
+type Event interface {
+	EventType() string
+	EventVersion() int
+}
+
+// Envelope wraps an event with the metadata shared by all messages.
+type Envelope struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	Version       int             `json:"version"`
+	Timestamp     time.Time       `json:"timestamp"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Producer      string          `json:"producer"`
+	Data          json.RawMessage `json:"data"`
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]map[int]func() Event{}
+)
+
+// Register makes an event type known to Decode. newEvent must return a
+// pointer to a zero value of the type.
+func Register(newEvent func() Event) {
+	e := newEvent()
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	versions, ok := registry[e.EventType()]
+	if !ok {
+		versions = map[int]func() Event{}
+		registry[e.EventType()] = versions
+	}
+	versions[e.EventVersion()] = newEvent
+}
+
+// New wraps e in a new envelope. correlationID ties together the messages
+// that belong to the same business operation and may be empty.
+func New(producer, correlationID string, e Event) (Envelope, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("events: failed to marshal %s: %v", e.EventType(), err)
+	}
+
+	return Envelope{
+		ID:            newID(),
+		Type:          e.EventType(),
+		Version:       e.EventVersion(),
+		Timestamp:     time.Now().UTC(),
+		CorrelationID: correlationID,
+		Producer:      producer,
+		Data:          data,
+	}, nil
+}
+
+// Encode wraps e in a new envelope and marshals it.
+func Encode(producer, correlationID string, e Event) ([]byte, error) {
+	env, err := New(producer, correlationID, e)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// DecodeEnvelope unmarshals an envelope without decoding its data.
+func DecodeEnvelope(body []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return Envelope{}, fmt.Errorf("events: malformed envelope: %v", err)
+	}
+	if env.Type == "" {
+		return Envelope{}, fmt.Errorf("events: malformed envelope: missing type")
+	}
+	return env, nil
+}
+
+// Decode unmarshals an envelope and its event. It rejects event types and
+// versions that are not registered.
+func Decode(body []byte) (Envelope, Event, error) {
+	env, err := DecodeEnvelope(body)
+	if err != nil {
+		return Envelope{}, nil, err
+	}
+
+	registryMu.RLock()
+	versions, known := registry[env.Type]
+	newEvent, supported := versions[env.Version]
+	registryMu.RUnlock()
+
+	if !known {
+		return env, nil, fmt.Errorf("%w: %q", ErrUnknownType, env.Type)
+	}
+	if !supported {
+		return env, nil, fmt.Errorf("%w: %s v%d", ErrUnsupportedVersion, env.Type, env.Version)
+	}
+
+	e := newEvent()
+	if err := json.Unmarshal(env.Data, e); err != nil {
+		return env, nil, fmt.Errorf("events: malformed %s v%d: %v", env.Type, env.Version, err)
+	}
+	return env, e, nil
+}
+
+// newID returns a random version 4 UUID.
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("events: failed to generate id: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	s := hex.EncodeToString(b[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
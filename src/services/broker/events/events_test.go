@@ -0,0 +1,54 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	body, err := Encode("payment-service", "reservation-saga-7", &PaymentConfirmed{TicketID: 42, Amount: 1999})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	env, e, err := Decode(body)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if env.Type != TypePaymentConfirmed || env.Version != 1 || env.Producer != "payment-service" || env.CorrelationID != "reservation-saga-7" {
+		t.Errorf("unexpected envelope: %+v", env)
+	}
+	if env.ID == "" || env.Timestamp.IsZero() {
+		t.Errorf("envelope is missing id or timestamp: %+v", env)
+	}
+
+	confirmed, ok := e.(*PaymentConfirmed)
+	if !ok {
+		t.Fatalf("expected *PaymentConfirmed, got %T", e)
+	}
+	if confirmed.TicketID != 42 || confirmed.Amount != 1999 {
+		t.Errorf("unexpected event: %+v", confirmed)
+	}
+}
+
+func TestDecodeRejectsUnknownVersion(t *testing.T) {
+	env, err := New("reservation-service", "", &PaymentRequested{TicketID: 1, Amount: 500})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	env.Version = 99
+	body, _ := json.Marshal(env)
+
+	if _, _, err := Decode(body); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestDecodeRejectsUnknownType(t *testing.T) {
+	body := []byte(`{"id":"1","type":"ticket.teleported","version":1,"data":{}}`)
+
+	if _, _, err := Decode(body); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("expected ErrUnknownType, got %v", err)
+	}
+}
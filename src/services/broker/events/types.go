@@ -0,0 +1,229 @@
+package events
+
+import (
+	"fmt"
+	"time"
+)
+
+// Event types.
+const (
+	TypePaymentRequested  = "payment.requested"
+	TypePaymentConfirmed  = "payment.confirmed"
+	TypePaymentFailed     = "payment.failed"
+	TypePaymentDeferred   = "payment.deferred"
+	TypeNotificationEmail = "notification.email"
+	TypePurchaseCancelled = "purchase.cancelled"
+	TypeTicketCheckedIn   = "ticket.checked_in"
+	TypeResaleSettled     = "resale.settled"
+	TypeWaitlistOffered   = "waitlist.offered"
+)
+
+// routingKeys maps event types to the routing keys their messages are
+// published with, where those predate the event types.
+var routingKeys = map[string]string{
+	TypePaymentRequested:  "topay",
+	TypeNotificationEmail: "email",
+}
+
+// RoutingKey returns the routing key messages of eventType are published
+// with.
+func RoutingKey(eventType string) string {
+	if key, ok := routingKeys[eventType]; ok {
+		return key
+	}
+	return eventType
+}
+
+func init() {
+	Register(func() Event { return &PaymentRequested{} })
+	Register(func() Event { return &PaymentConfirmed{} })
+	Register(func() Event { return &PaymentFailed{} })
+	Register(func() Event { return &PaymentDeferred{} })
+	Register(func() Event { return &NotificationEmail{} })
+	Register(func() Event { return &PurchaseCancelled{} })
+	Register(func() Event { return &TicketCheckedIn{} })
+	Register(func() Event { return &ResaleSettled{} })
+	Register(func() Event { return &WaitlistOffered{} })
+}
+
+// PaymentRequested asks the payment service to charge for a held ticket.
+// Amount is in the minor units of Currency, an ISO 4217 code. Requests
+// without a currency predate it and are in USD. PaymentMethod is one of the
+// paymentmethod constants, card when empty. A request for an order has no
+// TicketID and lists the order's tickets in Items instead.
+type PaymentRequested struct {
+	TicketID       int           `json:"ticket_id"`
+	Amount         int64         `json:"amount"`
+	Currency       string        `json:"currency,omitempty"`
+	PaymentMethod  string        `json:"payment_method,omitempty"`
+	ReservationKey string        `json:"reservation_key"`
+	Items          []PaymentItem `json:"items,omitempty"`
+}
+
+// PaymentItem is a ticket of an order and its share of the order's amount.
+type PaymentItem struct {
+	TicketID int   `json:"ticket_id"`
+	Amount   int64 `json:"amount"`
+}
+
+func (*PaymentRequested) EventType() string { return TypePaymentRequested }
+func (*PaymentRequested) EventVersion() int { return 1 }
+
+// IdempotencyKey returns the key the payment provider should deduplicate
+// charges for this request with, so that a redelivered request never
+// charges twice for the same reservation.
+func (p *PaymentRequested) IdempotencyKey() string {
+	if p.ReservationKey != "" {
+		return PaymentIdempotencyKey(p.ReservationKey)
+	}
+	return fmt.Sprintf("payment-ticket-%d", p.TicketID)
+}
+
+// PaymentIdempotencyKey returns the payment idempotency key for a
+// reservation.
+func PaymentIdempotencyKey(reservationKey string) string {
+	return "payment-" + reservationKey
+}
+
+// PaymentConfirmed is published once a ticket has been paid for. Amount is
+// in the minor units of Currency. ReservationKey is the key of the
+// PaymentRequested that was paid; confirmations without one predate it.
+type PaymentConfirmed struct {
+	TicketID        int    `json:"ticket_id"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency,omitempty"`
+	PaymentIntentID string `json:"payment_intent_id,omitempty"`
+	ReservationKey  string `json:"reservation_key,omitempty"`
+}
+
+func (*PaymentConfirmed) EventType() string { return TypePaymentConfirmed }
+func (*PaymentConfirmed) EventVersion() int { return 1 }
+
+// Reasons a payment failed.
+const (
+	PaymentFailureDeclined = "declined"
+	PaymentFailureCanceled = "canceled"
+	PaymentFailureRefunded = "refunded"
+)
+
+// PaymentFailed is published when a payment for a ticket did not go through
+// or was later refunded, so the ticket must not stay paid for.
+// ReservationKey is the key of the PaymentRequested that failed.
+type PaymentFailed struct {
+	TicketID        int    `json:"ticket_id"`
+	PaymentIntentID string `json:"payment_intent_id,omitempty"`
+	ReservationKey  string `json:"reservation_key,omitempty"`
+	Reason          string `json:"reason"`
+	Message         string `json:"message,omitempty"`
+}
+
+func (*PaymentFailed) EventType() string { return TypePaymentFailed }
+func (*PaymentFailed) EventVersion() int { return 1 }
+
+// PaymentDeferred is published when a ticket is paid for at the door. The
+// ticket can be used right away, and payment.confirmed follows once it has
+// been scanned and paid for. Amount is in the minor units of Currency.
+type PaymentDeferred struct {
+	TicketID        int    `json:"ticket_id"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency"`
+	PaymentMethod   string `json:"payment_method"`
+	PaymentIntentID string `json:"payment_intent_id"`
+}
+
+func (*PaymentDeferred) EventType() string { return TypePaymentDeferred }
+func (*PaymentDeferred) EventVersion() int { return 1 }
+
+// Kinds of NotificationEmail.
+const (
+	// EmailTicket sends a ticket to its holder. It is the default kind.
+	EmailTicket = "ticket"
+	// EmailTicketTransferred tells a user their ticket now belongs to
+	// someone else.
+	EmailTicketTransferred = "ticket_transferred"
+)
+
+// NotificationEmail asks the notification service to email a user about a
+// ticket, by default the ticket itself. With TicketID set, a ticket email
+// embeds the ticket's QR code.
+type NotificationEmail struct {
+	RecipientEmail string `json:"recipient_email"`
+	TicketCode     string `json:"ticket_code"`
+	TicketID       int    `json:"ticket_id,omitempty"`
+	Kind           string `json:"kind,omitempty"`
+}
+
+func (*NotificationEmail) EventType() string { return TypeNotificationEmail }
+func (*NotificationEmail) EventVersion() int { return 1 }
+
+// PurchaseCancelled is published once a purchase has been cancelled: the
+// payment refunded, the ticket cancelled and the seat given back. It carries
+// what the notification service needs to tell the buyer. RefundAmount is in
+// the minor units of Currency and zero when nothing was charged.
+type PurchaseCancelled struct {
+	PurchaseID     int    `json:"purchase_id"`
+	TicketID       int    `json:"ticket_id"`
+	EventID        int    `json:"event_id"`
+	UserID         int    `json:"user_id"`
+	RecipientEmail string `json:"recipient_email"`
+	TicketCode     string `json:"ticket_code"`
+	RefundAmount   int64  `json:"refund_amount"`
+	Currency       string `json:"currency,omitempty"`
+	RefundID       string `json:"refund_id,omitempty"`
+}
+
+func (*PurchaseCancelled) EventType() string { return TypePurchaseCancelled }
+func (*PurchaseCancelled) EventVersion() int { return 1 }
+
+// TicketCheckedIn is published when a ticket is scanned at the door. GateID
+// and ScannerID are set when the ticket was checked in by a gate scanner.
+type TicketCheckedIn struct {
+	TicketID    int       `json:"ticket_id"`
+	EventID     int       `json:"event_id"`
+	UserID      int       `json:"user_id"`
+	CheckedInAt time.Time `json:"checked_in_at"`
+	GateID      string    `json:"gate_id,omitempty"`
+	ScannerID   string    `json:"scanner_id,omitempty"`
+}
+
+func (*TicketCheckedIn) EventType() string { return TypeTicketCheckedIn }
+func (*TicketCheckedIn) EventVersion() int { return 1 }
+
+// ResaleSettled is published once a ticket bought on the resale market has
+// been paid for and re-issued to its buyer. The seller is owed Payout, the
+// price less the platform's Fee. Amounts are in the minor units of Currency.
+type ResaleSettled struct {
+	ListingID       int    `json:"listing_id"`
+	TicketID        int    `json:"ticket_id"`
+	EventID         int    `json:"event_id"`
+	SellerUserID    int    `json:"seller_user_id"`
+	BuyerUserID     int    `json:"buyer_user_id"`
+	Price           int64  `json:"price"`
+	Fee             int64  `json:"fee"`
+	Payout          int64  `json:"payout"`
+	Currency        string `json:"currency"`
+	PaymentIntentID string `json:"payment_intent_id"`
+}
+
+func (*ResaleSettled) EventType() string { return TypeResaleSettled }
+func (*ResaleSettled) EventVersion() int { return 1 }
+
+// WaitlistOffered is published when a ticket freed up for a sold-out event
+// is set aside for the next user on its waitlist. The user can buy it until
+// ExpiresAt, after which it is offered to the next user.
+type WaitlistOffered struct {
+	EntryID        int       `json:"entry_id"`
+	EventID        int       `json:"event_id"`
+	UserID         int       `json:"user_id"`
+	RecipientEmail string    `json:"recipient_email"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+func (*WaitlistOffered) EventType() string { return TypeWaitlistOffered }
+func (*WaitlistOffered) EventVersion() int { return 1 }
+
+// RefundIdempotencyKey returns the refund idempotency key for a
+// reservation, so that retrying a cancellation never refunds twice.
+func RefundIdempotencyKey(reservationKey string) string {
+	return "refund-" + reservationKey
+}
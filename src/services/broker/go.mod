@@ -1,5 +1,14 @@
-module broker
+module tixie.local/broker
 
 go 1.23.6
 
-require github.com/rabbitmq/amqp091-go v1.10.0
+require (
+	github.com/lib/pq v1.10.9
+	github.com/rabbitmq/amqp091-go v1.10.0
+	github.com/redis/go-redis/v9 v9.7.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+)
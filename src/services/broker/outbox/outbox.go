@@ -0,0 +1,143 @@
+// Package outbox publishes broker messages reliably. A service writes its
+// messages to an outbox table in the transaction that makes the change they
+// announce, and a Relay publishes them once the transaction has committed.
+package outbox
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"tixie.local/broker/events"
+)
+
+// Message is a broker message stored in the outbox until the relay has
+// published it.
+type Message struct {
+	ID         int
+	RoutingKey string
+	Payload    []byte
+	// Attempts is the number of times publishing it failed so far.
+	Attempts int
+}
+
+// NewMessage builds a message that publishes e in a new envelope.
+func NewMessage(producer, correlationID string, e events.Event) (Message, error) {
+	body, err := events.Encode(producer, correlationID, e)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{RoutingKey: events.RoutingKey(e.EventType()), Payload: body}, nil
+}
+
+// Insert writes messages to the outbox in tx, so they are published if and
+// only if tx commits.
+func Insert(tx *sql.Tx, messages ...Message) error {
+	for _, msg := range messages {
+		_, err := tx.Exec(
+			"INSERT INTO outbox (routing_key, payload) VALUES ($1, $2)",
+			msg.RoutingKey, msg.Payload,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to write outbox message: %v", err)
+		}
+	}
+	return nil
+}
+
+// Store keeps messages in an outbox table:
+//
+//	CREATE TABLE outbox (
+//	    outbox_id SERIAL PRIMARY KEY,
+//	    routing_key VARCHAR(100) NOT NULL,
+//	    payload JSONB NOT NULL,
+//	    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+//	    attempts INTEGER NOT NULL DEFAULT 0,
+//	    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+//	    last_error TEXT NOT NULL DEFAULT '',
+//	    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+//	    sent_at TIMESTAMP,
+//	    CONSTRAINT valid_outbox_status CHECK (status IN ('pending', 'sent'))
+//	);
+//
+//	CREATE INDEX idx_outbox_pending ON outbox (next_attempt_at) WHERE status = 'pending';
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore creates a new Store. db must use a Postgres driver.
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Enqueue stores messages for the relay to publish, for changes that were
+// already committed.
+func (s *Store) Enqueue(messages ...Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := Insert(tx, messages...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ProcessDue locks up to limit pending messages that are due, hands each one
+// to publish and marks it sent. Failed messages are rescheduled after
+// backoff(attempts). Rows locked by another replica are skipped.
+func (s *Store) ProcessDue(limit int, publish func(Message) error, backoff func(attempts int) time.Duration) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT outbox_id, routing_key, payload, attempts FROM outbox
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		ORDER BY outbox_id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`,
+		limit,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.RoutingKey, &msg.Payload, &msg.Attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, msg := range messages {
+		if err := publish(msg); err != nil {
+			attempts := msg.Attempts + 1
+			_, dbErr := tx.Exec(
+				"UPDATE outbox SET attempts=$1, last_error=$2, next_attempt_at=NOW() + $3 * INTERVAL '1 second' WHERE outbox_id=$4",
+				attempts, err.Error(), backoff(attempts).Seconds(), msg.ID,
+			)
+			if dbErr != nil {
+				return sent, dbErr
+			}
+			continue
+		}
+
+		if _, err := tx.Exec("UPDATE outbox SET status='sent', attempts=attempts+1, sent_at=NOW() WHERE outbox_id=$1", msg.ID); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, tx.Commit()
+}
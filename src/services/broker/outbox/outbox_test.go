@@ -0,0 +1,198 @@
+package outbox
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	"tixie.local/broker/events"
+)
+
+// schema is the outbox table documented on Store.
+const schema = `
+CREATE TABLE outbox (
+    outbox_id SERIAL PRIMARY KEY,
+    routing_key VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP,
+    CONSTRAINT valid_outbox_status CHECK (status IN ('pending', 'sent'))
+);`
+
+// openTestDB connects to the database in OUTBOX_TEST_DATABASE_URL and creates
+// an outbox table in a throwaway Postgres schema. The tests are skipped when
+// the variable is not set.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("OUTBOX_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("OUTBOX_TEST_DATABASE_URL not set, skipping database test")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	name := fmt.Sprintf("outbox_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + name); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + name + " CASCADE") })
+
+	db, err := sql.Open("postgres", dsn+" search_path="+name)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatalf("failed to load schema: %v", err)
+	}
+	return db
+}
+
+// fakePublisher records what the relay publishes, failing while err is set.
+type fakePublisher struct {
+	published []events.Envelope
+	attempts  int
+	err       error
+}
+
+func (p *fakePublisher) PublishEnvelope(env events.Envelope) error {
+	p.attempts++
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, env)
+	return nil
+}
+
+func newTestRelay(t *testing.T) (*Relay, *sql.DB, *fakePublisher) {
+	t.Helper()
+	db := openTestDB(t)
+	pub := &fakePublisher{}
+	return &Relay{store: NewStore(db), broker: pub}, db, pub
+}
+
+func enqueueEmail(t *testing.T, relay *Relay, ticketID int) {
+	t.Helper()
+	msg, err := NewMessage("test-service", "test", &events.NotificationEmail{RecipientEmail: "buyer@example.com", TicketID: ticketID})
+	if err != nil {
+		t.Fatalf("NewMessage: %v", err)
+	}
+	if err := relay.store.Enqueue(msg); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+}
+
+func TestRelay_PublishesPendingMessagesOnceInOrder(t *testing.T) {
+	relay, _, pub := newTestRelay(t)
+	enqueueEmail(t, relay, 1)
+	enqueueEmail(t, relay, 2)
+
+	relay.drain()
+	relay.drain()
+
+	if len(pub.published) != 2 {
+		t.Fatalf("published %d messages, want 2", len(pub.published))
+	}
+	for i, env := range pub.published {
+		var email events.NotificationEmail
+		if err := json.Unmarshal(env.Data, &email); err != nil {
+			t.Fatalf("failed to decode message %d: %v", i, err)
+		}
+		if got := email.TicketID; got != i+1 {
+			t.Errorf("message %d is for ticket %d, want %d", i, got, i+1)
+		}
+		if env.Producer != "test-service" || env.CorrelationID != "test" {
+			t.Errorf("message %d came from %q for %q, want test-service for test", i, env.Producer, env.CorrelationID)
+		}
+	}
+}
+
+func TestRelay_FailedPublishIsRetriedAfterBackoff(t *testing.T) {
+	relay, db, pub := newTestRelay(t)
+	enqueueEmail(t, relay, 1)
+
+	pub.err = errors.New("broker unavailable")
+	relay.drain()
+
+	var status string
+	var attempts int
+	var due bool
+	err := db.QueryRow("SELECT status, attempts, next_attempt_at <= NOW() FROM outbox").Scan(&status, &attempts, &due)
+	if err != nil {
+		t.Fatalf("failed to load message: %v", err)
+	}
+	if status != "pending" || attempts != 1 || due {
+		t.Fatalf("after a failed publish: status %s, attempts %d, due %v; want pending, 1, not due", status, attempts, due)
+	}
+
+	// Not retried before its backoff is over
+	pub.err = nil
+	relay.drain()
+	if pub.attempts != 1 {
+		t.Fatalf("publish attempts = %d, want 1 while backing off", pub.attempts)
+	}
+
+	if _, err := db.Exec("UPDATE outbox SET next_attempt_at = NOW() - INTERVAL '1 second'"); err != nil {
+		t.Fatalf("failed to end backoff: %v", err)
+	}
+	relay.drain()
+	if len(pub.published) != 1 {
+		t.Fatalf("published %d messages, want 1", len(pub.published))
+	}
+	if err := db.QueryRow("SELECT status FROM outbox").Scan(&status); err != nil {
+		t.Fatalf("failed to load message: %v", err)
+	}
+	if status != "sent" {
+		t.Errorf("status = %s, want sent", status)
+	}
+}
+
+func TestInsert_OnlyPublishesCommittedMessages(t *testing.T) {
+	relay, db, pub := newTestRelay(t)
+
+	msg, err := NewMessage("test-service", "", &events.NotificationEmail{TicketID: 1})
+	if err != nil {
+		t.Fatalf("NewMessage: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := Insert(tx, msg); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	tx.Rollback()
+
+	relay.drain()
+	if len(pub.published) != 0 {
+		t.Errorf("published %d messages of a rolled back transaction, want none", len(pub.published))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  2 * time.Second,
+		2:  4 * time.Second,
+		5:  32 * time.Second,
+		20: maxBackoff,
+	} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package outbox
+
+import (
+	"log"
+	"time"
+
+	brokerPkg "tixie.local/broker"
+	"tixie.local/broker/events"
+)
+
+const (
+	batchSize      = 50
+	minBackoff     = 2 * time.Second
+	maxBackoff     = 5 * time.Minute
+	confirmTimeout = 5 * time.Second
+)
+
+// publisher is the part of the broker the relay publishes with.
+type publisher interface {
+	PublishEnvelope(env events.Envelope) error
+}
+
+// Relay publishes pending outbox messages to the broker, giving at-least-once
+// delivery even if RabbitMQ was unavailable when the message was written.
+type Relay struct {
+	store        *Store
+	rabbitMQURL  string
+	exchange     string
+	exchangeType string
+	routingKeys  []string
+	broker       publisher
+	interval     time.Duration
+}
+
+// NewRelay creates a new Relay that polls the outbox every interval. It opens
+// its own broker connection lazily, so it keeps working if RabbitMQ is down
+// at startup. routingKeys are the keys the service publishes to; they are
+// probed when the relay connects so that a missing consumer shows up in the
+// logs at startup.
+func NewRelay(store *Store, rabbitMQURL, exchange, exchangeType string, interval time.Duration, routingKeys ...string) *Relay {
+	return &Relay{
+		store:        store,
+		rabbitMQURL:  rabbitMQURL,
+		exchange:     exchange,
+		exchangeType: exchangeType,
+		routingKeys:  routingKeys,
+		interval:     interval,
+	}
+}
+
+// Start runs the relay in a background goroutine.
+func (r *Relay) Start() {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			r.relay()
+		}
+	}()
+	log.Printf("Outbox relay started, polling every %s", r.interval)
+}
+
+func (r *Relay) relay() {
+	if r.broker == nil {
+		broker, err := brokerPkg.NewBroker(r.rabbitMQURL, r.exchange, r.exchangeType)
+		if err != nil {
+			log.Printf("Outbox relay: broker unavailable, will retry: %v", err)
+			return
+		}
+		// Only mark messages sent once RabbitMQ has confirmed them and
+		// routed them to a queue.
+		if err := broker.EnableConfirms(confirmTimeout); err != nil {
+			log.Printf("Outbox relay: failed to enable publisher confirms, will retry: %v", err)
+			broker.Close()
+			return
+		}
+		for _, key := range r.routingKeys {
+			if err := broker.Probe(key); err != nil {
+				log.Printf("Outbox relay: warning: routing key %q is not routable yet: %v", key, err)
+			}
+		}
+		r.broker = broker
+	}
+
+	r.drain()
+}
+
+// drain publishes every due message, a batch at a time.
+func (r *Relay) drain() {
+	for {
+		sent, err := r.store.ProcessDue(batchSize, r.publish, backoff)
+		if err != nil {
+			log.Printf("Outbox relay: failed to process outbox: %v", err)
+			return
+		}
+		if sent < batchSize {
+			return
+		}
+	}
+}
+
+func (r *Relay) publish(msg Message) error {
+	env, err := events.DecodeEnvelope(msg.Payload)
+	if err != nil {
+		log.Printf("Outbox relay: message %d is not a valid envelope: %v", msg.ID, err)
+		return err
+	}
+	if err := r.broker.PublishEnvelope(env); err != nil {
+		log.Printf("Outbox relay: failed to publish message %d (attempt %d): %v", msg.ID, msg.Attempts+1, err)
+		return err
+	}
+	return nil
+}
+
+// backoff doubles the delay with every attempt, capped at maxBackoff.
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,154 @@
+// Package admission issues and checks the tokens of the waiting room that
+// protects high-demand on-sales.
+//
+// A user who joins an event's queue gets a queue token, which holds their
+// place in line. Once the waiting room admits them they get an admission
+// token, which reservation-service requires before selling them a ticket
+// while the on-sale is protected. Tokens read
+// "tixieq1.<key id>.<claims>.<signature>" and are signed with Ed25519 keys
+// in the ticketsig key format, so they are checked without asking the
+// waiting room.
+package admission
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"tixie.local/common/ticketsig"
+)
+
+// Prefix marks waiting room tokens.
+const Prefix = "tixieq1."
+
+// Kinds of token.
+const (
+	// KindQueue holds a user's place in an event's queue.
+	KindQueue = "queue"
+	// KindAdmission lets a user buy tickets to an event.
+	KindAdmission = "admission"
+)
+
+var (
+	// ErrMalformed is returned for strings that are not waiting room tokens.
+	ErrMalformed = errors.New("malformed waiting room token")
+	// ErrExpired is returned for tokens past their expiry.
+	ErrExpired = errors.New("waiting room token has expired")
+	// ErrWrongToken is returned for tokens of another kind, event or user
+	// than the one asked for.
+	ErrWrongToken = errors.New("waiting room token is not valid here")
+)
+
+// Claims is what a token vouches for.
+type Claims struct {
+	Kind    string
+	EventID int
+	UserID  int
+	// Position is the user's number in the event's queue, counting from 1.
+	// It is set on queue tokens only.
+	Position  int64
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+type wireClaims struct {
+	Kind      string `json:"k"`
+	EventID   int    `json:"e"`
+	UserID    int    `json:"u"`
+	Position  int64  `json:"p,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// Issuer signs tokens with one key.
+type Issuer struct {
+	signer *ticketsig.Signer
+}
+
+// NewIssuer returns an Issuer that signs with signer.
+func NewIssuer(signer *ticketsig.Signer) *Issuer {
+	return &Issuer{signer: signer}
+}
+
+// Issue returns the signed token of claims.
+func (i *Issuer) Issue(claims Claims) (string, error) {
+	body, err := json.Marshal(wireClaims{
+		Kind:      claims.Kind,
+		EventID:   claims.EventID,
+		UserID:    claims.UserID,
+		Position:  claims.Position,
+		IssuedAt:  claims.IssuedAt.Unix(),
+		ExpiresAt: claims.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := Prefix + i.signer.KeyID() + "." + encoding.EncodeToString(body)
+	return signed + "." + i.signer.SignDocument([]byte(signed)), nil
+}
+
+// Verifier checks tokens signed with any of the keys of a keyring.
+type Verifier struct {
+	keys *ticketsig.Keyring
+}
+
+// NewVerifier returns a Verifier that trusts the keys of keyring.
+func NewVerifier(keys *ticketsig.Keyring) *Verifier {
+	return &Verifier{keys: keys}
+}
+
+// Verify checks the signature and expiry of a token and returns its claims.
+func (v *Verifier) Verify(token string, now time.Time) (Claims, error) {
+	if !strings.HasPrefix(token, Prefix) {
+		return Claims{}, ErrMalformed
+	}
+	parts := strings.Split(strings.TrimPrefix(token, Prefix), ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrMalformed
+	}
+	keyID, body, sig := parts[0], parts[1], parts[2]
+
+	signed := token[:len(token)-len(sig)-1]
+	if err := v.keys.VerifyDocument(keyID, []byte(signed), sig); err != nil {
+		return Claims{}, err
+	}
+
+	rawBody, err := encoding.DecodeString(body)
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+	var wire wireClaims
+	if err := json.Unmarshal(rawBody, &wire); err != nil {
+		return Claims{}, ErrMalformed
+	}
+	claims := Claims{
+		Kind:      wire.Kind,
+		EventID:   wire.EventID,
+		UserID:    wire.UserID,
+		Position:  wire.Position,
+		IssuedAt:  time.Unix(wire.IssuedAt, 0).UTC(),
+		ExpiresAt: time.Unix(wire.ExpiresAt, 0).UTC(),
+	}
+	if !now.Before(claims.ExpiresAt) {
+		return Claims{}, ErrExpired
+	}
+	return claims, nil
+}
+
+// VerifyFor checks a token like Verify and that it is of kind and was issued
+// for the user and event.
+func (v *Verifier) VerifyFor(token, kind string, eventID, userID int, now time.Time) (Claims, error) {
+	claims, err := v.Verify(token, now)
+	if err != nil {
+		return Claims{}, err
+	}
+	if claims.Kind != kind || claims.EventID != eventID || claims.UserID != userID {
+		return Claims{}, ErrWrongToken
+	}
+	return claims, nil
+}
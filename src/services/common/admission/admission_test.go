@@ -0,0 +1,103 @@
+package admission
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"tixie.local/common/ticketsig"
+)
+
+func newKeys(t *testing.T) (*Issuer, *Verifier) {
+	t.Helper()
+	signingKey, publicKey, err := ticketsig.GenerateKey("room-1")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signer, err := ticketsig.ParseSigner(signingKey)
+	if err != nil {
+		t.Fatalf("ParseSigner: %v", err)
+	}
+	keyring, err := ticketsig.ParseKeyring(publicKey)
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	return NewIssuer(signer), NewVerifier(keyring)
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	issuer, verifier := newKeys(t)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	claims := Claims{
+		Kind:      KindQueue,
+		EventID:   7,
+		UserID:    42,
+		Position:  1234,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+	token, err := issuer.Issue(claims)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if !strings.HasPrefix(token, Prefix) {
+		t.Fatalf("token %q does not start with %q", token, Prefix)
+	}
+
+	got, err := verifier.VerifyFor(token, KindQueue, 7, 42, now)
+	if err != nil {
+		t.Fatalf("VerifyFor: %v", err)
+	}
+	if got != claims {
+		t.Errorf("VerifyFor = %+v, want %+v", got, claims)
+	}
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+	issuer, verifier := newKeys(t)
+	otherIssuer, _ := newKeys(t)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	claims := Claims{Kind: KindAdmission, EventID: 7, UserID: 42, IssuedAt: now, ExpiresAt: now.Add(10 * time.Minute)}
+
+	token, err := issuer.Issue(claims)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	foreign, err := otherIssuer.Issue(claims)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	parts := strings.Split(token, ".")
+	forgedClaims, err := issuer.Issue(Claims{Kind: KindAdmission, EventID: 8, UserID: 42, IssuedAt: now, ExpiresAt: now.Add(10 * time.Minute)})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	tampered := strings.Join([]string{parts[0], parts[1], strings.Split(forgedClaims, ".")[2], parts[3]}, ".")
+
+	tests := []struct {
+		name    string
+		token   string
+		kind    string
+		eventID int
+		userID  int
+		now     time.Time
+		want    error
+	}{
+		{"garbage", "not-a-token", KindAdmission, 7, 42, now, ErrMalformed},
+		{"tampered claims", tampered, KindAdmission, 7, 42, now, ticketsig.ErrBadSignature},
+		{"signed with an untrusted key", foreign, KindAdmission, 7, 42, now, ticketsig.ErrBadSignature},
+		{"expired", token, KindAdmission, 7, 42, now.Add(10 * time.Minute), ErrExpired},
+		{"another event", token, KindAdmission, 8, 42, now, ErrWrongToken},
+		{"another user", token, KindAdmission, 7, 43, now, ErrWrongToken},
+		{"queue token used for admission", token, KindQueue, 7, 42, now, ErrWrongToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifier.VerifyFor(tt.token, tt.kind, tt.eventID, tt.userID, tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("VerifyFor = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -15,6 +15,20 @@ const (
 	StateHalfOpen
 )
 
+// String returns the name of the state
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
 // Counts holds the counts of requests and their results
 type Counts struct {
 	Requests      uint32
@@ -0,0 +1,142 @@
+// Package money represents amounts of money as integer minor units of an
+// ISO 4217 currency, so prices are never rounded through floating point.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultCurrency is the currency of prices and payments that predate
+// per-event currencies.
+const DefaultCurrency = "USD"
+
+var (
+	// ErrInvalidCurrency is returned for currency codes that are not three
+	// letters.
+	ErrInvalidCurrency = errors.New("invalid currency")
+	// ErrInvalidAmount is returned for amounts that are not decimal numbers
+	// or are more precise than their currency allows.
+	ErrInvalidAmount = errors.New("invalid amount")
+)
+
+// exponents lists the currencies whose minor unit is not a hundredth of the
+// major unit. Every other currency has two decimal places.
+var exponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0,
+	"XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// Money is an amount in the minor units of Currency, e.g. cents for USD and
+// yen for JPY.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// New returns amount minor units of currency.
+func New(amount int64, currency string) (Money, error) {
+	code, err := NormalizeCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: amount, Currency: code}, nil
+}
+
+// NormalizeCurrency returns currency as an upper case ISO 4217 code. An empty
+// currency is DefaultCurrency.
+func NormalizeCurrency(currency string) (string, error) {
+	if currency == "" {
+		return DefaultCurrency, nil
+	}
+	code := strings.ToUpper(strings.TrimSpace(currency))
+	if len(code) != 3 {
+		return "", fmt.Errorf("%w: %q", ErrInvalidCurrency, currency)
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return "", fmt.Errorf("%w: %q", ErrInvalidCurrency, currency)
+		}
+	}
+	return code, nil
+}
+
+// Exponent returns the number of decimal places of currency's minor unit.
+func Exponent(currency string) int {
+	if exp, ok := exponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// Parse converts a decimal amount of currency's major unit, such as "19.99",
+// into Money. Amounts with more significant decimal places than the currency
+// has are rejected rather than rounded.
+func Parse(amount, currency string) (Money, error) {
+	code, err := NormalizeCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	exp := Exponent(code)
+
+	s := strings.TrimSpace(amount)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	frac = strings.TrimRight(frac, "0")
+	if whole == "" || len(frac) > exp || !digits(whole) || !digits(frac) {
+		return Money{}, fmt.Errorf("%w: %q in %s", ErrInvalidAmount, amount, code)
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	var minor int64
+	for _, c := range whole + frac {
+		next := minor*10 + int64(c-'0')
+		if next < minor {
+			return Money{}, fmt.Errorf("%w: %q is too large", ErrInvalidAmount, amount)
+		}
+		minor = next
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{Amount: minor, Currency: code}, nil
+}
+
+// Decimal returns the amount in the currency's major unit, e.g. "19.99".
+func (m Money) Decimal() string {
+	exp := Exponent(m.Currency)
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if exp == 0 {
+		return fmt.Sprintf("%s%d", sign, amount)
+	}
+
+	scale := int64(1)
+	for i := 0; i < exp; i++ {
+		scale *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, exp, amount%scale)
+}
+
+// String returns the amount followed by its currency, e.g. "19.99 USD".
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+func digits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
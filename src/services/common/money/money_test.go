@@ -0,0 +1,68 @@
+package money
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		amount, currency string
+		want             Money
+	}{
+		{"19.99", "usd", Money{1999, "USD"}},
+		{"0.29", "USD", Money{29, "USD"}},
+		{"79.990", "EUR", Money{7999, "EUR"}},
+		{"10", "", Money{1000, "USD"}},
+		{"1500", "JPY", Money{1500, "JPY"}},
+		{"1500.0", "JPY", Money{1500, "JPY"}},
+		{"12.345", "KWD", Money{12345, "KWD"}},
+		{"-5.5", "GBP", Money{-550, "GBP"}},
+	}
+	for _, c := range cases {
+		got, err := Parse(c.amount, c.currency)
+		if err != nil {
+			t.Errorf("Parse(%q, %q) failed: %v", c.amount, c.currency, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("Parse(%q, %q) = %+v, want %+v", c.amount, c.currency, got, c.want)
+		}
+	}
+}
+
+func TestParse_Rejects(t *testing.T) {
+	cases := []struct {
+		amount, currency string
+		want             error
+	}{
+		{"19.999", "USD", ErrInvalidAmount},
+		{"1500.5", "JPY", ErrInvalidAmount},
+		{"1e3", "USD", ErrInvalidAmount},
+		{".5", "USD", ErrInvalidAmount},
+		{"", "USD", ErrInvalidAmount},
+		{"99999999999999999999", "USD", ErrInvalidAmount},
+		{"10", "US", ErrInvalidCurrency},
+		{"10", "U$D", ErrInvalidCurrency},
+	}
+	for _, c := range cases {
+		if _, err := Parse(c.amount, c.currency); !errors.Is(err, c.want) {
+			t.Errorf("Parse(%q, %q) error = %v, want %v", c.amount, c.currency, err, c.want)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	cases := map[Money]string{
+		{1999, "USD"}:  "19.99",
+		{5, "EUR"}:     "0.05",
+		{-550, "GBP"}:  "-5.50",
+		{1500, "JPY"}:  "1500",
+		{12345, "KWD"}: "12.345",
+	}
+	for m, want := range cases {
+		if got := m.Decimal(); got != want {
+			t.Errorf("%+v.Decimal() = %q, want %q", m, got, want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Package paymentmethod lists the ways buyers can pay for tickets. Vendors
+// choose which of them each event accepts.
+package paymentmethod
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Payment methods.
+const (
+	// Card is paid online through the payment provider.
+	Card = "card"
+	// CashOnArrival is paid at the door. The purchase stays pending until
+	// the ticket is scanned.
+	CashOnArrival = "cash_on_arrival"
+)
+
+// ErrUnknown is returned for payment methods that are not supported.
+var ErrUnknown = errors.New("unknown payment method")
+
+// Default is what events that did not choose their payment methods accept.
+var Default = []string{Card}
+
+// Parse returns method in its canonical form. An empty method is Card.
+func Parse(method string) (string, error) {
+	m := strings.ToLower(strings.TrimSpace(method))
+	switch m {
+	case "":
+		return Card, nil
+	case Card, CashOnArrival:
+		return m, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknown, method)
+}
+
+// ParseAll parses a list of payment methods, dropping duplicates. An empty
+// list is Default.
+func ParseAll(methods []string) ([]string, error) {
+	if len(methods) == 0 {
+		return append([]string(nil), Default...), nil
+	}
+
+	parsed := make([]string, 0, len(methods))
+	for _, method := range methods {
+		m, err := Parse(method)
+		if err != nil {
+			return nil, err
+		}
+		if !contains(parsed, m) {
+			parsed = append(parsed, m)
+		}
+	}
+	return parsed, nil
+}
+
+// Allowed reports whether method is one of allowed. An empty allowed list
+// is Default.
+func Allowed(allowed []string, method string) bool {
+	if len(allowed) == 0 {
+		allowed = Default
+	}
+	return contains(allowed, method)
+}
+
+func contains(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package paymentmethod
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseAll(t *testing.T) {
+	got, err := ParseAll([]string{"Cash_On_Arrival", "card", "cash_on_arrival"})
+	if err != nil {
+		t.Fatalf("ParseAll failed: %v", err)
+	}
+	if want := []string{CashOnArrival, Card}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseAll = %v, want %v", got, want)
+	}
+
+	got, err = ParseAll(nil)
+	if err != nil || !reflect.DeepEqual(got, Default) {
+		t.Errorf("ParseAll(nil) = %v, %v, want %v", got, err, Default)
+	}
+
+	if _, err := ParseAll([]string{"card", "bitcoin"}); !errors.Is(err, ErrUnknown) {
+		t.Errorf("expected ErrUnknown, got %v", err)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	if !Allowed(nil, Card) || Allowed(nil, CashOnArrival) {
+		t.Error("events without payment methods should only accept cards")
+	}
+	if !Allowed([]string{CashOnArrival}, CashOnArrival) || Allowed([]string{CashOnArrival}, Card) {
+		t.Error("events should only accept the payment methods they list")
+	}
+}
@@ -0,0 +1,131 @@
+package ticketsig
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newKeys(t *testing.T, keyID string) (*Signer, string) {
+	t.Helper()
+	signingKey, publicKey, err := GenerateKey(keyID)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signer, err := ParseSigner(signingKey)
+	if err != nil {
+		t.Fatalf("ParseSigner: %v", err)
+	}
+	return signer, publicKey
+}
+
+func TestSignAndVerify(t *testing.T) {
+	signer, publicKey := newKeys(t, "2026-10")
+	keyring, err := ParseKeyring(publicKey)
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+
+	claims := Claims{
+		TicketID:     42,
+		EventID:      7,
+		TicketTypeID: 3,
+		TicketCode:   "0b7e6f1e-3c1a-4f5e-9d55-5a4b1f0e2c3d",
+		IssuedAt:     time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+	}
+	payload, err := signer.Sign(claims)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if !IsSigned(payload) {
+		t.Fatalf("payload %q is not marked as signed", payload)
+	}
+
+	got, err := keyring.Verify(payload)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got != claims {
+		t.Errorf("Verify = %+v, want %+v", got, claims)
+	}
+}
+
+func TestVerifyRejectsForgeries(t *testing.T) {
+	signer, publicKey := newKeys(t, "current")
+	keyring, err := ParseKeyring(publicKey)
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	payload, err := signer.Sign(Claims{TicketID: 1, EventID: 1, TicketCode: "a", IssuedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	other, _ := newKeys(t, "current")
+	forged, err := other.Sign(Claims{TicketID: 2, EventID: 1, TicketCode: "b", IssuedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	parts := strings.Split(payload, ".")
+	otherClaims := strings.Split(forged, ".")[2]
+	tampered := strings.Join([]string{parts[0], parts[1], otherClaims, parts[3]}, ".")
+
+	for name, tc := range map[string]struct {
+		payload string
+		want    error
+	}{
+		"wrong key":      {forged, ErrBadSignature},
+		"tampered":       {tampered, ErrBadSignature},
+		"unknown key id": {strings.Replace(payload, "current", "retired", 1), ErrUnknownKey},
+		"unsigned":       {"ticket_code:0b7e6f1e-3c1a-4f5e-9d55-5a4b1f0e2c3d", ErrMalformed},
+		"truncated":      {strings.Join(parts[:3], "."), ErrMalformed},
+	} {
+		if _, err := keyring.Verify(tc.payload); !errors.Is(err, tc.want) {
+			t.Errorf("%s: Verify error = %v, want %v", name, err, tc.want)
+		}
+	}
+}
+
+func TestKeyringAcceptsRotatedKeys(t *testing.T) {
+	previous, previousPublic := newKeys(t, "2026-09")
+	current, currentPublic := newKeys(t, "2026-10")
+	keyring, err := ParseKeyring(currentPublic + "," + previousPublic)
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	if keyring.Len() != 2 {
+		t.Fatalf("keyring has %d keys, want 2", keyring.Len())
+	}
+
+	for _, signer := range []*Signer{previous, current} {
+		payload, err := signer.Sign(Claims{TicketID: 1, EventID: 1, TicketCode: "a", IssuedAt: time.Now()})
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		if _, err := keyring.Verify(payload); err != nil {
+			t.Errorf("payload signed with %s was rejected: %v", signer.KeyID(), err)
+		}
+	}
+}
+
+func TestSignDocument(t *testing.T) {
+	signer, publicKey := newKeys(t, "2026-10")
+	keyring, err := ParseKeyring(publicKey)
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+
+	doc := []byte(`{"event_id":1,"version":7}`)
+	sig := signer.SignDocument(doc)
+	if err := keyring.VerifyDocument(signer.KeyID(), doc, sig); err != nil {
+		t.Fatalf("VerifyDocument: %v", err)
+	}
+	if err := keyring.VerifyDocument(signer.KeyID(), []byte(`{"event_id":1,"version":8}`), sig); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("altered document: error = %v, want %v", err, ErrBadSignature)
+	}
+	if err := keyring.VerifyDocument("retired", doc, sig); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unknown key: error = %v, want %v", err, ErrUnknownKey)
+	}
+}
@@ -2,6 +2,7 @@ package circuitbreaker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 )
@@ -75,15 +76,15 @@ func (b *Breaker) ExecuteContext(ctx context.Context, call ServiceCall) Result {
 
 // IsCircuitBreakerError checks if the error is from the circuit breaker
 func IsCircuitBreakerError(err error) bool {
-	return err == ErrCircuitBreakerOpen || err == ErrTooManyRequests
+	return errors.Is(err, ErrCircuitBreakerOpen) || errors.Is(err, ErrTooManyRequests)
 }
 
 // HandleCircuitBreakerError returns appropriate HTTP status code for circuit breaker errors
 func HandleCircuitBreakerError(err error) (int, string) {
-	if err == ErrCircuitBreakerOpen {
+	if errors.Is(err, ErrCircuitBreakerOpen) {
 		return http.StatusServiceUnavailable, "Service is temporarily unavailable"
 	}
-	if err == ErrTooManyRequests {
+	if errors.Is(err, ErrTooManyRequests) {
 		return http.StatusTooManyRequests, "Too many requests"
 	}
 	return http.StatusInternalServerError, "Internal server error"
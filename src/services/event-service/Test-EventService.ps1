@@ -58,3 +58,19 @@ if ($response) {
 } else {
     Write-Host " Failed to update tickets sold."
 }
+
+Start-Sleep -Seconds 1
+
+Write-Host "`nReleasing tickets..."
+$ticketRelease = @{
+    tickets_to_release = 5
+}
+$releaseJson = $ticketRelease | ConvertTo-Json -Depth 2
+
+$response = Invoke-RestMethod -Uri "$baseUrl/$eventId/tickets/release" -Method Patch -Body $releaseJson -ContentType "application/json" -ErrorAction SilentlyContinue
+
+if ($response) {
+    Write-Host " Tickets released. Tickets left: $($response.tickets_left)"
+} else {
+    Write-Host " Failed to release tickets."
+}
@@ -1,12 +1,18 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"event-service/internal/db/models"
 	"event-service/internal/db/repos"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	circuitbreaker "tixie.local/common"
+	"tixie.local/common/money"
+	"tixie.local/common/paymentmethod"
 
 	"log"
 	"os"
@@ -37,7 +43,7 @@ func NewEventHandler(repo *repos.EventRepository) *EventHandler {
 func (h *EventHandler) GetEvents(c *gin.Context) {
 	events, err := h.Repo.GetAllEvents()
 	if err != nil {
-		logger.Printf("error:", err.Error())
+		logger.Printf("error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -47,13 +53,42 @@ func (h *EventHandler) GetEvents(c *gin.Context) {
 func (h *EventHandler) CreateEvent(c *gin.Context) {
 	var event models.Event
 	if err := c.ShouldBindJSON(&event); err != nil {
-		logger.Printf("error:", err.Error())
+		logger.Printf("error: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
 
+	// Prices are checked against the currency's minor unit, so a price can
+	// always be charged exactly. Every ticket is paid for, the payment
+	// service cannot charge nothing.
+	price, err := money.Parse(event.Price.String(), event.Currency)
+	if err != nil || price.Amount <= 0 {
+		logger.Printf("error: invalid price %q %q: %v", event.Price, event.Currency, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid price %s for currency %q", event.Price, event.Currency)})
+		return
+	}
+	event.Price = json.Number(price.Decimal())
+	event.Currency = price.Currency
+
+	methods, err := paymentmethod.ParseAll(event.PaymentMethods)
+	if err != nil {
+		logger.Printf("error: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	event.PaymentMethods = methods
+
+	if (event.QueueRatePerMinute == nil) != (event.QueueUntil == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "queue_rate_per_minute and queue_until must be set together"})
+		return
+	}
+	if event.QueueRatePerMinute != nil && *event.QueueRatePerMinute <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "queue_rate_per_minute must be greater than zero"})
+		return
+	}
+
 	if err := h.Repo.CreateEvent(event); err != nil {
-		logger.Printf("error:", err.Error())
+		logger.Printf("error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create event"})
 		return
 	}
@@ -80,9 +115,16 @@ func (h *EventHandler) GetEventByID(c *gin.Context) {
 }
 
 func (h *EventHandler) UpdateTicketsSold(c *gin.Context) {
-	eventID := c.Param("id")
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
 	var input struct {
-		TicketsToBuy int `json:"tickets_to_buy"`
+		TicketsToBuy   int    `json:"tickets_to_buy"`
+		TicketTypeID   int    `json:"ticket_type_id"`
+		ReservationKey string `json:"reservation_key"`
 	}
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
@@ -90,14 +132,92 @@ func (h *EventHandler) UpdateTicketsSold(c *gin.Context) {
 	}
 
 	if input.TicketsToBuy <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no tickets left"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tickets_to_buy must be greater than zero"})
 		return
 	}
 
-	err := h.Repo.UpdateTicketsSold(eventID, input.TicketsToBuy)
+	ticketsLeft, err := h.Repo.ReserveTickets(eventID, input.TicketTypeID, input.TicketsToBuy, input.ReservationKey)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		logger.Printf("error: %v", err)
+		c.JSON(inventoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Tickets sold updated successfully", "tickets_left": ticketsLeft})
+}
+
+func (h *EventHandler) ReleaseTickets(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var input struct {
+		TicketsToRelease int    `json:"tickets_to_release"`
+		ReservationKey   string `json:"reservation_key"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	if input.ReservationKey == "" && input.TicketsToRelease <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tickets_to_release or reservation_key is required"})
+		return
+	}
+
+	ticketsLeft, err := h.Repo.ReleaseTickets(eventID, input.TicketsToRelease, input.ReservationKey)
+	if err != nil {
+		logger.Printf("error: %v", err)
+		c.JSON(inventoryErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Tickets sold updated successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Tickets released successfully", "tickets_left": ticketsLeft})
+}
+
+// AddTickets raises an event's capacity. Users on the event's waitlist in
+// reservation-service are offered the new tickets first.
+func (h *EventHandler) AddTickets(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var input struct {
+		TicketsToAdd int `json:"tickets_to_add"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	if input.TicketsToAdd <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tickets_to_add must be greater than zero"})
+		return
+	}
+
+	ticketsLeft, err := h.Repo.AddTickets(eventID, input.TicketsToAdd)
+	if err != nil {
+		logger.Printf("error: %v", err)
+		c.JSON(inventoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Tickets added successfully", "tickets_left": ticketsLeft})
+}
+
+func inventoryErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, repos.ErrEventNotFound), errors.Is(err, repos.ErrTicketTypeNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, repos.ErrNotEnoughTickets), errors.Is(err, repos.ErrTicketTypeNotOnSale),
+		errors.Is(err, repos.ErrTicketTypeExists), errors.Is(err, repos.ErrTicketTypeInUse),
+		errors.Is(err, repos.ErrCapacityBelowSold):
+		return http.StatusConflict
+	case circuitbreaker.IsCircuitBreakerError(err):
+		status, _ := circuitbreaker.HandleCircuitBreakerError(err)
+		return status
+	default:
+		return http.StatusBadRequest
+	}
 }
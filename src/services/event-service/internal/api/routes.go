@@ -14,6 +14,13 @@ func SetupRoutes(r *gin.Engine, repo *repos.EventRepository) {
 		events.GET("", handler.GetEvents)
 		events.POST("", handler.CreateEvent)
 		events.GET("/:id", handler.GetEventByID)
-		events.PATCH("/:id/tickets", handler.UpdateTicketsSold) 
+		events.PATCH("/:id/tickets", handler.UpdateTicketsSold)
+		events.PATCH("/:id/tickets/release", handler.ReleaseTickets)
+		events.PATCH("/:id/tickets/add", handler.AddTickets)
+		events.GET("/:id/ticket-types", handler.GetTicketTypes)
+		events.POST("/:id/ticket-types", handler.CreateTicketType)
+		events.GET("/:id/ticket-types/:type_id", handler.GetTicketType)
+		events.PUT("/:id/ticket-types/:type_id", handler.UpdateTicketType)
+		events.DELETE("/:id/ticket-types/:type_id", handler.DeleteTicketType)
 	}
 }
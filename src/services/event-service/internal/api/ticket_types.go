@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"event-service/internal/db/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"tixie.local/common/money"
+)
+
+// ticketTypeInput is what vendors send to create or replace a ticket type.
+type ticketTypeInput struct {
+	Name         string      `json:"name" binding:"required"`
+	Price        json.Number `json:"price" binding:"required"`
+	TotalTickets int         `json:"total_tickets" binding:"required,gt=0"`
+	SaleStartsAt *time.Time  `json:"sale_starts_at"`
+	SaleEndsAt   *time.Time  `json:"sale_ends_at"`
+	PerUserLimit *int        `json:"per_user_limit"`
+}
+
+func (h *EventHandler) GetTicketTypes(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if _, err := h.Repo.GetEventByID(eventID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+
+	types, err := h.Repo.GetTicketTypes(eventID)
+	if err != nil {
+		logger.Printf("error: %v", err)
+		c.JSON(inventoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, types)
+}
+
+func (h *EventHandler) GetTicketType(c *gin.Context) {
+	eventID, ticketTypeID, ok := ticketTypeParams(c)
+	if !ok {
+		return
+	}
+
+	ticketType, err := h.Repo.GetTicketType(eventID, ticketTypeID)
+	if err != nil {
+		logger.Printf("error: %v", err)
+		c.JSON(inventoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ticketType)
+}
+
+// CreateTicketType adds a ticket type to an event. Its tickets are sold out
+// of the event's capacity as well as its own.
+func (h *EventHandler) CreateTicketType(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	ticketType, ok := h.bindTicketType(c, eventID)
+	if !ok {
+		return
+	}
+
+	created, err := h.Repo.CreateTicketType(ticketType)
+	if err != nil {
+		logger.Printf("error: %v", err)
+		c.JSON(inventoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+// UpdateTicketType replaces the settings of a ticket type. The tickets it
+// already sold keep their price.
+func (h *EventHandler) UpdateTicketType(c *gin.Context) {
+	eventID, ticketTypeID, ok := ticketTypeParams(c)
+	if !ok {
+		return
+	}
+	ticketType, ok := h.bindTicketType(c, eventID)
+	if !ok {
+		return
+	}
+	ticketType.ID = ticketTypeID
+
+	updated, err := h.Repo.UpdateTicketType(ticketType)
+	if err != nil {
+		logger.Printf("error: %v", err)
+		c.JSON(inventoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteTicketType removes a ticket type that never sold. A type that did
+// is taken off sale by ending its sale window instead.
+func (h *EventHandler) DeleteTicketType(c *gin.Context) {
+	eventID, ticketTypeID, ok := ticketTypeParams(c)
+	if !ok {
+		return
+	}
+
+	if err := h.Repo.DeleteTicketType(eventID, ticketTypeID); err != nil {
+		logger.Printf("error: %v", err)
+		c.JSON(inventoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// bindTicketType reads and validates a ticket type of eventID from the
+// request, writing the error response if it is invalid.
+func (h *EventHandler) bindTicketType(c *gin.Context, eventID int) (models.TicketType, bool) {
+	var input ticketTypeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		logger.Printf("error: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return models.TicketType{}, false
+	}
+
+	event, err := h.Repo.GetEventByID(eventID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return models.TicketType{}, false
+	}
+
+	// Ticket types are priced in their event's currency, and like events
+	// cannot be free.
+	price, err := money.Parse(input.Price.String(), event.Currency)
+	if err != nil || price.Amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid price %s for currency %q", input.Price, event.Currency)})
+		return models.TicketType{}, false
+	}
+	if input.SaleStartsAt != nil && input.SaleEndsAt != nil && !input.SaleStartsAt.Before(*input.SaleEndsAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sale_starts_at must be before sale_ends_at"})
+		return models.TicketType{}, false
+	}
+	if input.PerUserLimit != nil && *input.PerUserLimit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "per_user_limit must be greater than zero"})
+		return models.TicketType{}, false
+	}
+
+	return models.TicketType{
+		EventID:      eventID,
+		Name:         input.Name,
+		Price:        json.Number(price.Decimal()),
+		TotalTickets: input.TotalTickets,
+		SaleStartsAt: input.SaleStartsAt,
+		SaleEndsAt:   input.SaleEndsAt,
+		PerUserLimit: input.PerUserLimit,
+	}, true
+}
+
+func ticketTypeParams(c *gin.Context) (int, int, bool) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return 0, 0, false
+	}
+	ticketTypeID, err := strconv.Atoi(c.Param("type_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket type ID"})
+		return 0, 0, false
+	}
+	return eventID, ticketTypeID, true
+}
@@ -5,9 +5,31 @@ CREATE TABLE IF NOT EXISTS events (
     venue TEXT NOT NULL,
     total_tickets INT NOT NULL,
     vendor_id INT NOT NULL,
-    price NUMERIC(10, 2) NOT NULL,
+    -- Price in the major unit of currency. Three decimal places fit every
+    -- ISO 4217 currency; the service rejects prices more precise than the
+    -- currency allows. Tickets are never free.
+    price NUMERIC(12, 3) NOT NULL CHECK (price > 0),
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
     sold_tickets INT NOT NULL DEFAULT 0,
-    tickets_left INT
+    tickets_left INT,
+    -- Hours before the event until which purchases may be cancelled and
+    -- refunded. NULL means they cannot be cancelled.
+    cancellation_window_hours INT CHECK (cancellation_window_hours >= 0),
+    -- Hours before the event until which tickets may be transferred to
+    -- another user. NULL means they cannot be transferred.
+    transfer_cutoff_hours INT CHECK (transfer_cutoff_hours >= 0),
+    -- Highest resale price as a percentage of the face value, e.g. 110.
+    -- NULL means tickets cannot be resold.
+    resale_price_cap_percent INT CHECK (resale_price_cap_percent > 0),
+    -- Tickets of a high-demand on-sale are only sold to users the waiting
+    -- room admitted, at queue_rate_per_minute users a minute, until
+    -- queue_until. NULL means anyone may buy right away.
+    queue_rate_per_minute INT CHECK (queue_rate_per_minute > 0),
+    queue_until TIMESTAMPTZ,
+    -- How buyers may pay, e.g. card or cash_on_arrival.
+    payment_methods TEXT[] NOT NULL DEFAULT '{card}',
+    CONSTRAINT queue_configured CHECK ((queue_rate_per_minute IS NULL) = (queue_until IS NULL)),
+    CONSTRAINT sold_within_capacity CHECK (sold_tickets >= 0 AND sold_tickets <= total_tickets)
 );
 
 
@@ -35,4 +57,39 @@ VALUES (
     249.50, 
     320, 
     500 - 320
-);
\ No newline at end of file
+);
+
+-- Ticket types sell part of an event's capacity under their own name and
+-- price, e.g. early bird, GA and VIP. Their tickets count towards the
+-- event's total_tickets as well as their own.
+CREATE TABLE IF NOT EXISTS ticket_types (
+    id SERIAL PRIMARY KEY,
+    event_id INT NOT NULL REFERENCES events (id),
+    name TEXT NOT NULL,
+    -- Price in the major unit of the event's currency, like events.price.
+    price NUMERIC(12, 3) NOT NULL CHECK (price > 0),
+    total_tickets INT NOT NULL,
+    sold_tickets INT NOT NULL DEFAULT 0,
+    -- The type is only sold from sale_starts_at until sale_ends_at. NULL
+    -- leaves that end of the window open.
+    sale_starts_at TIMESTAMPTZ,
+    sale_ends_at TIMESTAMPTZ,
+    -- Most tickets of the type a single user may buy. NULL means no limit.
+    per_user_limit INT CHECK (per_user_limit > 0),
+    UNIQUE (event_id, name),
+    CONSTRAINT sale_window CHECK (sale_starts_at IS NULL OR sale_ends_at IS NULL OR sale_starts_at < sale_ends_at),
+    CONSTRAINT type_sold_within_capacity CHECK (sold_tickets >= 0 AND sold_tickets <= total_tickets)
+);
+
+-- Capacity taken by a single reservation, so reserve and release can be
+-- retried safely with the same key.
+CREATE TABLE IF NOT EXISTS inventory_reservations (
+    reservation_key TEXT PRIMARY KEY,
+    event_id INT NOT NULL REFERENCES events (id),
+    -- Set when the tickets are of a ticket type.
+    ticket_type_id INT REFERENCES ticket_types (id),
+    quantity INT NOT NULL CHECK (quantity > 0),
+    status TEXT NOT NULL DEFAULT 'reserved' CHECK (status IN ('reserved', 'released')),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    released_at TIMESTAMP
+);
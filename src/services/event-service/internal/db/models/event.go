@@ -1,5 +1,10 @@
 package models
 
+import (
+    "encoding/json"
+    "time"
+)
+
 type Event struct {
     ID           int    `json:"id"`
     Name         string `json:"name"`
@@ -7,7 +12,30 @@ type Event struct {
     Venue        string `json:"venue"`
     TotalTickets int    `json:"total_tickets"`
     VendorID     int    `json:"vendor_id"`
-    Price        float64 `json:"price"`
+    // Price is a decimal amount of Currency, e.g. 79.99. It is kept as a
+    // json.Number so it is never rounded through a float.
+    Price        json.Number `json:"price"`
+    Currency     string      `json:"currency"`
     SoldTickets   int     `json:"sold_tickets"`
     TicketsLeft   int     `json:"tickets_left"`
+    // CancellationWindowHours is how many hours before the event buyers
+    // may still cancel. Nil means purchases cannot be cancelled.
+    CancellationWindowHours *int `json:"cancellation_window_hours"`
+    // TransferCutoffHours is how many hours before the event tickets may
+    // still be transferred to another user. Nil means they cannot be.
+    TransferCutoffHours *int `json:"transfer_cutoff_hours"`
+    // ResalePriceCapPercent caps resale prices as a percentage of Price,
+    // e.g. 110. Nil means tickets cannot be resold.
+    ResalePriceCapPercent *int `json:"resale_price_cap_percent"`
+    // QueueRatePerMinute and QueueUntil protect a high-demand on-sale:
+    // until QueueUntil tickets are only sold to users the waiting room
+    // admitted, QueueRatePerMinute of them a minute. Both are nil for
+    // events without a waiting room.
+    QueueRatePerMinute *int       `json:"queue_rate_per_minute"`
+    QueueUntil         *time.Time `json:"queue_until"`
+    // PaymentMethods are the paymentmethod constants buyers may pay with.
+    PaymentMethods []string `json:"payment_methods"`
+    // TicketTypes are the types the event's tickets are sold as. An event
+    // without any sells its tickets at Price.
+    TicketTypes []TicketType `json:"ticket_types"`
 }
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// TicketType sells part of an event's capacity under its own name and
+// price, e.g. early bird, GA or VIP.
+type TicketType struct {
+	ID      int    `json:"id"`
+	EventID int    `json:"event_id"`
+	Name    string `json:"name"`
+	// Price is a decimal amount of the event's currency, like Event.Price.
+	Price        json.Number `json:"price"`
+	TotalTickets int         `json:"total_tickets"`
+	SoldTickets  int         `json:"sold_tickets"`
+	TicketsLeft  int         `json:"tickets_left"`
+	// SaleStartsAt and SaleEndsAt bound when the type is sold. Nil leaves
+	// that end of the window open.
+	SaleStartsAt *time.Time `json:"sale_starts_at"`
+	SaleEndsAt   *time.Time `json:"sale_ends_at"`
+	// PerUserLimit is the most tickets of the type a single user may buy.
+	// Nil means there is no limit.
+	PerUserLimit *int `json:"per_user_limit"`
+}
+
+// OnSale reports whether the type is sold at now.
+func (t *TicketType) OnSale(now time.Time) bool {
+	if t.SaleStartsAt != nil && now.Before(*t.SaleStartsAt) {
+		return false
+	}
+	return t.SaleEndsAt == nil || now.Before(*t.SaleEndsAt)
+}
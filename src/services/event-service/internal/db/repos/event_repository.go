@@ -2,10 +2,22 @@ package repos
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"event-service/internal/db/models"
 	"fmt"
 
+	"github.com/lib/pq"
 	circuitbreaker "tixie.local/common"
+	"tixie.local/common/money"
+	"tixie.local/common/paymentmethod"
+)
+
+var (
+	// ErrEventNotFound is returned when the event does not exist
+	ErrEventNotFound = errors.New("event not found")
+	// ErrNotEnoughTickets is returned when a reservation would exceed the event's capacity
+	ErrNotEnoughTickets = errors.New("not enough tickets available")
 )
 
 type EventRepository struct {
@@ -23,32 +35,47 @@ func NewEventRepository(db *sql.DB) *EventRepository {
 func (r *EventRepository) GetAllEvents() ([]models.Event, error) {
 	var events []models.Event
 	err := r.breaker.Execute(func() error {
-		query := `SELECT id, name, date, venue, total_tickets, vendor_id, price FROM events`
+		query := `SELECT id, name, date, venue, total_tickets, vendor_id, price, currency, sold_tickets, total_tickets - sold_tickets, cancellation_window_hours, transfer_cutoff_hours, resale_price_cap_percent, payment_methods, queue_rate_per_minute, queue_until FROM events`
 		rows, err := r.DB.Query(query)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
+		types, err := r.getAllTicketTypes()
+		if err != nil {
+			return err
+		}
+
 		for rows.Next() {
 			var e models.Event
-			if err := rows.Scan(&e.ID, &e.Name, &e.Date, &e.Venue, &e.TotalTickets, &e.VendorID, &e.Price); err != nil {
+			if err := rows.Scan(&e.ID, &e.Name, &e.Date, &e.Venue, &e.TotalTickets, &e.VendorID, &e.Price, &e.Currency, &e.SoldTickets, &e.TicketsLeft, &e.CancellationWindowHours, &e.TransferCutoffHours, &e.ResalePriceCapPercent, pq.Array(&e.PaymentMethods), &e.QueueRatePerMinute, &e.QueueUntil); err != nil {
+				return err
+			}
+			if err := normalizePrice(&e); err != nil {
 				return err
 			}
+			e.TicketTypes = types[e.ID]
+			if e.TicketTypes == nil {
+				e.TicketTypes = []models.TicketType{}
+			}
 			events = append(events, e)
 		}
-		return nil
+		return rows.Err()
 	})
 	return events, err
 }
 
 func (r *EventRepository) CreateEvent(event models.Event) error {
+	if len(event.PaymentMethods) == 0 {
+		event.PaymentMethods = paymentmethod.Default
+	}
 	return r.breaker.Execute(func() error {
 		query := `
-            INSERT INTO events (name, date, venue, total_tickets, vendor_id, price)
-            VALUES ($1, $2, $3, $4, $5, $6)
+            INSERT INTO events (name, date, venue, total_tickets, vendor_id, price, currency, tickets_left, cancellation_window_hours, transfer_cutoff_hours, resale_price_cap_percent, payment_methods, queue_rate_per_minute, queue_until)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $4, $8, $9, $10, $11, $12, $13)
         `
-		_, err := r.DB.Exec(query, event.Name, event.Date, event.Venue, event.TotalTickets, event.VendorID, event.Price)
+		_, err := r.DB.Exec(query, event.Name, event.Date, event.Venue, event.TotalTickets, event.VendorID, event.Price.String(), event.Currency, event.CancellationWindowHours, event.TransferCutoffHours, event.ResalePriceCapPercent, pq.Array(event.PaymentMethods), event.QueueRatePerMinute, event.QueueUntil)
 		return err
 	})
 }
@@ -56,41 +83,218 @@ func (r *EventRepository) CreateEvent(event models.Event) error {
 func (r *EventRepository) GetEventByID(id int) (models.Event, error) {
 	var e models.Event
 	err := r.breaker.Execute(func() error {
-		query := `SELECT id, name, date, venue, total_tickets, vendor_id, price FROM events WHERE id = $1`
-		return r.DB.QueryRow(query, id).Scan(&e.ID, &e.Name, &e.Date, &e.Venue, &e.TotalTickets, &e.VendorID, &e.Price)
+		query := `SELECT id, name, date, venue, total_tickets, vendor_id, price, currency, sold_tickets, total_tickets - sold_tickets, cancellation_window_hours, transfer_cutoff_hours, resale_price_cap_percent, payment_methods, queue_rate_per_minute, queue_until FROM events WHERE id = $1`
+		if err := r.DB.QueryRow(query, id).Scan(&e.ID, &e.Name, &e.Date, &e.Venue, &e.TotalTickets, &e.VendorID, &e.Price, &e.Currency, &e.SoldTickets, &e.TicketsLeft, &e.CancellationWindowHours, &e.TransferCutoffHours, &e.ResalePriceCapPercent, pq.Array(&e.PaymentMethods), &e.QueueRatePerMinute, &e.QueueUntil); err != nil {
+			return err
+		}
+		if err := normalizePrice(&e); err != nil {
+			return err
+		}
+		types, err := r.queryTicketTypes(`SELECT `+ticketTypeColumns+` FROM ticket_types t JOIN events e ON e.id = t.event_id WHERE t.event_id = $1 ORDER BY t.id`, id)
+		if err != nil {
+			return err
+		}
+		e.TicketTypes = types
+		return nil
 	})
 	return e, err
 }
 
-func (r *EventRepository) UpdateTicketsSold(eventID string, ticketsToBuy int) error {
-	return r.breaker.Execute(func() error {
-		var event struct {
-			TotalTickets int `json:"total_tickets"`
-			SoldTickets  int `json:"sold_tickets"`
+// normalizePrice formats a stored price with exactly as many decimal places
+// as the event's currency has, e.g. 79.990 as 79.99 and 1500.000 JPY as 1500.
+func normalizePrice(e *models.Event) error {
+	price, err := money.Parse(e.Price.String(), e.Currency)
+	if err != nil {
+		return err
+	}
+	e.Price = json.Number(price.Decimal())
+	e.Currency = price.Currency
+	return nil
+}
+
+// ReserveTickets atomically takes ticketsToBuy tickets out of the event's
+// inventory and returns how many are left. The capacity check and the
+// decrement happen in a single UPDATE, so concurrent buyers can never
+// oversell. When ticketTypeID is set the tickets are taken out of that
+// ticket type's inventory too, which must be on sale. When reservationKey is
+// set the call is idempotent: repeating it with the same key does not take
+// the tickets a second time.
+func (r *EventRepository) ReserveTickets(eventID, ticketTypeID, ticketsToBuy int, reservationKey string) (int, error) {
+	if ticketsToBuy <= 0 {
+		return 0, fmt.Errorf("tickets to buy must be greater than zero")
+	}
+
+	var ticketsLeft int
+	var outcome error
+	err := r.breaker.Execute(func() error {
+		tx, err := r.DB.Begin()
+		if err != nil {
+			return err
 		}
+		defer tx.Rollback()
 
-		query := `SELECT total_tickets, sold_tickets FROM events WHERE id = $1`
-		err := r.DB.QueryRow(query, eventID).Scan(&event.TotalTickets, &event.SoldTickets)
+		if reservationKey != "" {
+			res, err := tx.Exec(`
+				INSERT INTO inventory_reservations (reservation_key, event_id, ticket_type_id, quantity)
+				VALUES ($1, $2, NULLIF($3, 0), $4)
+				ON CONFLICT (reservation_key) DO NOTHING`,
+				reservationKey, eventID, ticketTypeID, ticketsToBuy,
+			)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				// Already reserved under this key.
+				ticketsLeft, outcome = r.ticketsLeft(tx, eventID)
+				return nil
+			}
+		}
+
+		if ticketTypeID != 0 {
+			if outcome, err = r.reserveTicketType(tx, eventID, ticketTypeID, ticketsToBuy); err != nil || outcome != nil {
+				return err
+			}
+		}
+
+		err = tx.QueryRow(`
+			UPDATE events
+			SET sold_tickets = sold_tickets + $1,
+			    tickets_left = total_tickets - (sold_tickets + $1)
+			WHERE id = $2 AND sold_tickets + $1 <= total_tickets
+			RETURNING tickets_left`,
+			ticketsToBuy, eventID,
+		).Scan(&ticketsLeft)
+		if err == sql.ErrNoRows {
+			if _, outcome = r.ticketsLeft(tx, eventID); outcome == nil {
+				outcome = ErrNotEnoughTickets
+			}
+			return nil
+		}
 		if err != nil {
-			return fmt.Errorf("event not found: %v", err)
+			return fmt.Errorf("failed to reserve tickets: %v", err)
 		}
 
-		if ticketsToBuy <= 0 {
-			return fmt.Errorf("tickets to buy must be greater than zero")
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return ticketsLeft, outcome
+}
+
+// ReleaseTickets returns tickets to the event's inventory, e.g. after a
+// cancellation, and returns how many are left. When reservationKey is set only
+// the quantity reserved under that key is released, and only once, along
+// with the ticket type it was reserved as.
+func (r *EventRepository) ReleaseTickets(eventID int, ticketsToRelease int, reservationKey string) (int, error) {
+	var ticketsLeft int
+	var outcome error
+	err := r.breaker.Execute(func() error {
+		tx, err := r.DB.Begin()
+		if err != nil {
+			return err
 		}
-		if event.SoldTickets+ticketsToBuy > event.TotalTickets {
-			return fmt.Errorf("not enough tickets available")
+		defer tx.Rollback()
+
+		var ticketTypeID sql.NullInt64
+		if reservationKey != "" {
+			err := tx.QueryRow(`
+				UPDATE inventory_reservations
+				SET status = 'released', released_at = NOW()
+				WHERE reservation_key = $1 AND event_id = $2 AND status = 'reserved'
+				RETURNING quantity, ticket_type_id`,
+				reservationKey, eventID,
+			).Scan(&ticketsToRelease, &ticketTypeID)
+			if err == sql.ErrNoRows {
+				// Never reserved or already released.
+				ticketsLeft, outcome = r.ticketsLeft(tx, eventID)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
 		}
 
-		newSoldTickets := event.SoldTickets + ticketsToBuy
-		ticketsLeft := event.TotalTickets - newSoldTickets
+		if ticketsToRelease <= 0 {
+			outcome = fmt.Errorf("tickets to release must be greater than zero")
+			return nil
+		}
 
-		query = `UPDATE events SET sold_tickets = $1, tickets_left = $2 WHERE id = $3`
-		_, err = r.DB.Exec(query, newSoldTickets, ticketsLeft, eventID)
+		if ticketTypeID.Valid {
+			_, err := tx.Exec(`
+				UPDATE ticket_types SET sold_tickets = sold_tickets - $1
+				WHERE id = $2 AND sold_tickets - $1 >= 0`,
+				ticketsToRelease, ticketTypeID.Int64,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to release tickets: %v", err)
+			}
+		}
+
+		err = tx.QueryRow(`
+			UPDATE events
+			SET sold_tickets = sold_tickets - $1,
+			    tickets_left = total_tickets - (sold_tickets - $1)
+			WHERE id = $2 AND sold_tickets - $1 >= 0
+			RETURNING tickets_left`,
+			ticketsToRelease, eventID,
+		).Scan(&ticketsLeft)
+		if err == sql.ErrNoRows {
+			if _, outcome = r.ticketsLeft(tx, eventID); outcome == nil {
+				outcome = fmt.Errorf("cannot release more tickets than were sold")
+			}
+			return nil
+		}
 		if err != nil {
-			return fmt.Errorf("failed to update tickets sold: %v", err)
+			return fmt.Errorf("failed to release tickets: %v", err)
 		}
 
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return ticketsLeft, outcome
+}
+
+// AddTickets raises the event's capacity, e.g. when the vendor opens more
+// seats, and returns how many tickets are left.
+func (r *EventRepository) AddTickets(eventID int, ticketsToAdd int) (int, error) {
+	if ticketsToAdd <= 0 {
+		return 0, fmt.Errorf("tickets to add must be greater than zero")
+	}
+
+	var ticketsLeft int
+	var outcome error
+	err := r.breaker.Execute(func() error {
+		err := r.DB.QueryRow(`
+			UPDATE events
+			SET total_tickets = total_tickets + $1,
+			    tickets_left = total_tickets + $1 - sold_tickets
+			WHERE id = $2
+			RETURNING tickets_left`,
+			ticketsToAdd, eventID,
+		).Scan(&ticketsLeft)
+		if err == sql.ErrNoRows {
+			outcome = ErrEventNotFound
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add tickets: %v", err)
+		}
 		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
+	return ticketsLeft, outcome
+}
+
+func (r *EventRepository) ticketsLeft(tx *sql.Tx, eventID int) (int, error) {
+	var ticketsLeft int
+	err := tx.QueryRow(`SELECT total_tickets - sold_tickets FROM events WHERE id = $1`, eventID).Scan(&ticketsLeft)
+	if err == sql.ErrNoRows {
+		return 0, ErrEventNotFound
+	}
+	return ticketsLeft, err
 }
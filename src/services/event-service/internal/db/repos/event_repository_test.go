@@ -0,0 +1,297 @@
+package repos
+
+import (
+	"database/sql"
+	"errors"
+	"event-service/internal/db/models"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// newTestRepository connects to the database in EVENT_TEST_DATABASE_URL and
+// loads the schema into a throwaway Postgres schema. The tests are skipped
+// when the variable is not set.
+func newTestRepository(t *testing.T) *EventRepository {
+	t.Helper()
+
+	dsn := os.Getenv("EVENT_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("EVENT_TEST_DATABASE_URL not set, skipping database test")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("event_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	db, err := sql.Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ddl, err := os.ReadFile("../init/event.sql")
+	if err != nil {
+		t.Fatalf("failed to read schema: %v", err)
+	}
+	if _, err := db.Exec(string(ddl)); err != nil {
+		t.Fatalf("failed to load schema: %v", err)
+	}
+
+	return NewEventRepository(db)
+}
+
+func createTestEvent(t *testing.T, repo *EventRepository, totalTickets int) int {
+	t.Helper()
+
+	var id int
+	err := repo.DB.QueryRow(
+		`INSERT INTO events (name, date, venue, total_tickets, vendor_id, price, tickets_left)
+		 VALUES ('Test Event', '2030-01-01', 'Test Venue', $1, 1, 10, $1) RETURNING id`,
+		totalTickets,
+	).Scan(&id)
+	if err != nil {
+		t.Fatalf("failed to create event: %v", err)
+	}
+	return id
+}
+
+func TestReserveTickets_ConcurrentBuyersNeverOversell(t *testing.T) {
+	repo := newTestRepository(t)
+	const capacity = 10
+	const buyers = 50
+	eventID := createTestEvent(t, repo, capacity)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sold, rejected := 0, 0
+	start := make(chan struct{})
+
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, err := repo.ReserveTickets(eventID, 0, 1, fmt.Sprintf("buyer-%d", i))
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				sold++
+			case errors.Is(err, ErrNotEnoughTickets):
+				rejected++
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	if sold != capacity {
+		t.Errorf("expected %d successful reservations, got %d", capacity, sold)
+	}
+	if rejected != buyers-capacity {
+		t.Errorf("expected %d rejected reservations, got %d", buyers-capacity, rejected)
+	}
+
+	event, err := repo.GetEventByID(eventID)
+	if err != nil {
+		t.Fatalf("failed to load event: %v", err)
+	}
+	assertInventory(t, event, capacity, 0)
+}
+
+func TestReserveAndReleaseTickets_IdempotentWithKey(t *testing.T) {
+	repo := newTestRepository(t)
+	eventID := createTestEvent(t, repo, 5)
+
+	for i := 0; i < 2; i++ {
+		left, err := repo.ReserveTickets(eventID, 0, 2, "order-1")
+		if err != nil {
+			t.Fatalf("reserve attempt %d failed: %v", i+1, err)
+		}
+		if left != 3 {
+			t.Errorf("reserve attempt %d: expected 3 tickets left, got %d", i+1, left)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		left, err := repo.ReleaseTickets(eventID, 0, "order-1")
+		if err != nil {
+			t.Fatalf("release attempt %d failed: %v", i+1, err)
+		}
+		if left != 5 {
+			t.Errorf("release attempt %d: expected 5 tickets left, got %d", i+1, left)
+		}
+	}
+
+	event, err := repo.GetEventByID(eventID)
+	if err != nil {
+		t.Fatalf("failed to load event: %v", err)
+	}
+	assertInventory(t, event, 0, 5)
+}
+
+func TestAddTickets_ReopensSoldOutEvent(t *testing.T) {
+	repo := newTestRepository(t)
+	eventID := createTestEvent(t, repo, 2)
+
+	if _, err := repo.ReserveTickets(eventID, 0, 2, ""); err != nil {
+		t.Fatalf("failed to sell out event: %v", err)
+	}
+	left, err := repo.AddTickets(eventID, 3)
+	if err != nil {
+		t.Fatalf("failed to add tickets: %v", err)
+	}
+	if left != 3 {
+		t.Errorf("expected 3 tickets left, got %d", left)
+	}
+	if _, err := repo.ReserveTickets(eventID, 0, 3, ""); err != nil {
+		t.Errorf("expected the added tickets to be for sale, got %v", err)
+	}
+
+	if _, err := repo.AddTickets(999999, 1); !errors.Is(err, ErrEventNotFound) {
+		t.Errorf("expected ErrEventNotFound, got %v", err)
+	}
+}
+
+func TestReserveTickets_UnknownEvent(t *testing.T) {
+	repo := newTestRepository(t)
+
+	if _, err := repo.ReserveTickets(999999, 0, 1, ""); !errors.Is(err, ErrEventNotFound) {
+		t.Errorf("expected ErrEventNotFound, got %v", err)
+	}
+}
+
+func assertInventory(t *testing.T, event models.Event, sold, left int) {
+	t.Helper()
+	if event.SoldTickets != sold {
+		t.Errorf("expected sold_tickets %d, got %d", sold, event.SoldTickets)
+	}
+	if event.TicketsLeft != left {
+		t.Errorf("expected tickets_left %d, got %d", left, event.TicketsLeft)
+	}
+}
+
+func TestCreateEvent_KeepsPriceExactInItsCurrency(t *testing.T) {
+	repo := newTestRepository(t)
+
+	if err := repo.CreateEvent(models.Event{
+		Name: "Tokyo Show", Date: "2030-01-01", Venue: "Budokan",
+		TotalTickets: 10, VendorID: 1, Price: "1500", Currency: "JPY",
+	}); err != nil {
+		t.Fatalf("failed to create event: %v", err)
+	}
+
+	var id int
+	if err := repo.DB.QueryRow("SELECT id FROM events WHERE name = 'Tokyo Show'").Scan(&id); err != nil {
+		t.Fatalf("failed to find event: %v", err)
+	}
+	event, err := repo.GetEventByID(id)
+	if err != nil {
+		t.Fatalf("failed to load event: %v", err)
+	}
+	if event.Price != "1500" || event.Currency != "JPY" {
+		t.Errorf("expected 1500 JPY, got %s %s", event.Price, event.Currency)
+	}
+	if len(event.PaymentMethods) != 1 || event.PaymentMethods[0] != "card" {
+		t.Errorf("expected events to accept cards by default, got %v", event.PaymentMethods)
+	}
+}
+
+func createTestTicketType(t *testing.T, repo *EventRepository, eventID, totalTickets int) models.TicketType {
+	t.Helper()
+
+	ticketType, err := repo.CreateTicketType(models.TicketType{EventID: eventID, Name: "VIP", Price: "25", TotalTickets: totalTickets})
+	if err != nil {
+		t.Fatalf("failed to create ticket type: %v", err)
+	}
+	return ticketType
+}
+
+func TestReserveTickets_TicketTypeHasItsOwnCapacity(t *testing.T) {
+	repo := newTestRepository(t)
+	eventID := createTestEvent(t, repo, 10)
+	vip := createTestTicketType(t, repo, eventID, 2)
+
+	if _, err := repo.ReserveTickets(eventID, vip.ID, 2, "vip-1"); err != nil {
+		t.Fatalf("failed to reserve VIP tickets: %v", err)
+	}
+	if _, err := repo.ReserveTickets(eventID, vip.ID, 1, "vip-2"); !errors.Is(err, ErrNotEnoughTickets) {
+		t.Errorf("expected ErrNotEnoughTickets once the type sold out, got %v", err)
+	}
+	if _, err := repo.ReserveTickets(eventID, 0, 1, "plain"); err != nil {
+		t.Errorf("expected the rest of the event to be for sale, got %v", err)
+	}
+
+	event, err := repo.GetEventByID(eventID)
+	if err != nil {
+		t.Fatalf("failed to load event: %v", err)
+	}
+	assertInventory(t, event, 3, 7)
+
+	if _, err := repo.ReleaseTickets(eventID, 0, "vip-1"); err != nil {
+		t.Fatalf("failed to release VIP tickets: %v", err)
+	}
+	released, err := repo.GetTicketType(eventID, vip.ID)
+	if err != nil {
+		t.Fatalf("failed to load ticket type: %v", err)
+	}
+	if released.SoldTickets != 0 || released.TicketsLeft != 2 {
+		t.Errorf("expected the release to give the type its tickets back, got %+v", released)
+	}
+}
+
+func TestReserveTickets_TicketTypeSaleWindow(t *testing.T) {
+	repo := newTestRepository(t)
+	eventID := createTestEvent(t, repo, 10)
+	vip := createTestTicketType(t, repo, eventID, 5)
+
+	ended := time.Now().Add(-time.Hour)
+	vip.SaleEndsAt = &ended
+	if _, err := repo.UpdateTicketType(vip); err != nil {
+		t.Fatalf("failed to end the sale: %v", err)
+	}
+
+	if _, err := repo.ReserveTickets(eventID, vip.ID, 1, ""); !errors.Is(err, ErrTicketTypeNotOnSale) {
+		t.Errorf("expected ErrTicketTypeNotOnSale, got %v", err)
+	}
+	if _, err := repo.ReserveTickets(eventID, 999999, 1, ""); !errors.Is(err, ErrTicketTypeNotFound) {
+		t.Errorf("expected ErrTicketTypeNotFound, got %v", err)
+	}
+}
+
+func TestTicketTypes_CannotLoseSoldTickets(t *testing.T) {
+	repo := newTestRepository(t)
+	eventID := createTestEvent(t, repo, 10)
+	vip := createTestTicketType(t, repo, eventID, 5)
+
+	if _, err := repo.CreateTicketType(models.TicketType{EventID: eventID, Name: "VIP", Price: "30", TotalTickets: 1}); !errors.Is(err, ErrTicketTypeExists) {
+		t.Errorf("expected ErrTicketTypeExists, got %v", err)
+	}
+	if _, err := repo.ReserveTickets(eventID, vip.ID, 3, "vip"); err != nil {
+		t.Fatalf("failed to reserve VIP tickets: %v", err)
+	}
+
+	vip.TotalTickets = 2
+	if _, err := repo.UpdateTicketType(vip); !errors.Is(err, ErrCapacityBelowSold) {
+		t.Errorf("expected ErrCapacityBelowSold, got %v", err)
+	}
+	if err := repo.DeleteTicketType(eventID, vip.ID); !errors.Is(err, ErrTicketTypeInUse) {
+		t.Errorf("expected ErrTicketTypeInUse, got %v", err)
+	}
+}
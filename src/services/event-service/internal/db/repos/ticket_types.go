@@ -0,0 +1,257 @@
+package repos
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"event-service/internal/db/models"
+
+	"github.com/lib/pq"
+	"tixie.local/common/money"
+)
+
+var (
+	// ErrTicketTypeNotFound is returned when the event has no such ticket type
+	ErrTicketTypeNotFound = errors.New("ticket type not found")
+	// ErrTicketTypeExists is returned when the event already has a ticket type with the name
+	ErrTicketTypeExists = errors.New("event already has a ticket type with this name")
+	// ErrTicketTypeNotOnSale is returned when a ticket type is reserved outside its sale window
+	ErrTicketTypeNotOnSale = errors.New("ticket type is not on sale")
+	// ErrTicketTypeInUse is returned when a ticket type that tickets were reserved as is deleted
+	ErrTicketTypeInUse = errors.New("tickets were reserved as this ticket type")
+	// ErrCapacityBelowSold is returned when a ticket type's capacity would drop below what it sold
+	ErrCapacityBelowSold = errors.New("capacity cannot be lower than the tickets already sold")
+)
+
+const ticketTypeColumns = `t.id, t.event_id, t.name, t.price, e.currency, t.total_tickets, t.sold_tickets, t.total_tickets - t.sold_tickets, t.sale_starts_at, t.sale_ends_at, t.per_user_limit`
+
+// GetTicketTypes returns the ticket types of an event, oldest first.
+func (r *EventRepository) GetTicketTypes(eventID int) ([]models.TicketType, error) {
+	var types []models.TicketType
+	err := r.breaker.Execute(func() error {
+		var err error
+		types, err = r.queryTicketTypes(`SELECT `+ticketTypeColumns+` FROM ticket_types t JOIN events e ON e.id = t.event_id WHERE t.event_id = $1 ORDER BY t.id`, eventID)
+		return err
+	})
+	return types, err
+}
+
+// GetTicketType returns one of an event's ticket types.
+func (r *EventRepository) GetTicketType(eventID, ticketTypeID int) (models.TicketType, error) {
+	var t models.TicketType
+	var outcome error
+	err := r.breaker.Execute(func() error {
+		types, err := r.queryTicketTypes(`SELECT `+ticketTypeColumns+` FROM ticket_types t JOIN events e ON e.id = t.event_id WHERE t.event_id = $1 AND t.id = $2`, eventID, ticketTypeID)
+		if err != nil {
+			return err
+		}
+		if len(types) == 0 {
+			outcome = ErrTicketTypeNotFound
+			return nil
+		}
+		t = types[0]
+		return nil
+	})
+	if err != nil {
+		return t, err
+	}
+	return t, outcome
+}
+
+// CreateTicketType adds a ticket type to an event and returns it.
+func (r *EventRepository) CreateTicketType(t models.TicketType) (models.TicketType, error) {
+	var created models.TicketType
+	var outcome error
+	err := r.breaker.Execute(func() error {
+		var id int
+		err := r.DB.QueryRow(`
+			INSERT INTO ticket_types (event_id, name, price, total_tickets, sale_starts_at, sale_ends_at, per_user_limit)
+			SELECT id, $2::text, $3::numeric, $4::int, $5::timestamptz, $6::timestamptz, $7::int FROM events WHERE id = $1
+			RETURNING id`,
+			t.EventID, t.Name, t.Price.String(), t.TotalTickets, t.SaleStartsAt, t.SaleEndsAt, t.PerUserLimit,
+		).Scan(&id)
+		if err == sql.ErrNoRows {
+			outcome = ErrEventNotFound
+			return nil
+		}
+		if outcome = ticketTypeConstraintError(err); outcome != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		types, err := r.queryTicketTypes(`SELECT `+ticketTypeColumns+` FROM ticket_types t JOIN events e ON e.id = t.event_id WHERE t.id = $1`, id)
+		if err != nil {
+			return err
+		}
+		created = types[0]
+		return nil
+	})
+	if err != nil {
+		return created, err
+	}
+	return created, outcome
+}
+
+// UpdateTicketType replaces a ticket type's settings and returns it. The
+// tickets it sold so far are kept, so its capacity cannot drop below them.
+func (r *EventRepository) UpdateTicketType(t models.TicketType) (models.TicketType, error) {
+	var updated models.TicketType
+	var outcome error
+	err := r.breaker.Execute(func() error {
+		res, err := r.DB.Exec(`
+			UPDATE ticket_types
+			SET name = $3, price = $4, total_tickets = $5, sale_starts_at = $6, sale_ends_at = $7, per_user_limit = $8
+			WHERE event_id = $1 AND id = $2`,
+			t.EventID, t.ID, t.Name, t.Price.String(), t.TotalTickets, t.SaleStartsAt, t.SaleEndsAt, t.PerUserLimit,
+		)
+		if outcome = ticketTypeConstraintError(err); outcome != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			outcome = ErrTicketTypeNotFound
+			return nil
+		}
+
+		types, err := r.queryTicketTypes(`SELECT `+ticketTypeColumns+` FROM ticket_types t JOIN events e ON e.id = t.event_id WHERE t.id = $1`, t.ID)
+		if err != nil {
+			return err
+		}
+		updated = types[0]
+		return nil
+	})
+	if err != nil {
+		return updated, err
+	}
+	return updated, outcome
+}
+
+// DeleteTicketType removes a ticket type that no ticket was ever reserved
+// as. A type that did sell is taken off sale by ending its sale window
+// instead, so the tickets sold as it keep their type.
+func (r *EventRepository) DeleteTicketType(eventID, ticketTypeID int) error {
+	var outcome error
+	err := r.breaker.Execute(func() error {
+		res, err := r.DB.Exec(`DELETE FROM ticket_types WHERE event_id = $1 AND id = $2 AND sold_tickets = 0`, eventID, ticketTypeID)
+		if outcome = ticketTypeConstraintError(err); outcome != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return nil
+		}
+
+		var sold int
+		err = r.DB.QueryRow(`SELECT sold_tickets FROM ticket_types WHERE event_id = $1 AND id = $2`, eventID, ticketTypeID).Scan(&sold)
+		if err == sql.ErrNoRows {
+			outcome = ErrTicketTypeNotFound
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		outcome = ErrTicketTypeInUse
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return outcome
+}
+
+// getAllTicketTypes returns the ticket types of every event by event id.
+func (r *EventRepository) getAllTicketTypes() (map[int][]models.TicketType, error) {
+	types, err := r.queryTicketTypes(`SELECT ` + ticketTypeColumns + ` FROM ticket_types t JOIN events e ON e.id = t.event_id ORDER BY t.id`)
+	if err != nil {
+		return nil, err
+	}
+	byEvent := make(map[int][]models.TicketType)
+	for _, t := range types {
+		byEvent[t.EventID] = append(byEvent[t.EventID], t)
+	}
+	return byEvent, nil
+}
+
+func (r *EventRepository) queryTicketTypes(query string, args ...interface{}) ([]models.TicketType, error) {
+	rows, err := r.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := []models.TicketType{}
+	for rows.Next() {
+		var t models.TicketType
+		var currency string
+		if err := rows.Scan(&t.ID, &t.EventID, &t.Name, &t.Price, &currency, &t.TotalTickets, &t.SoldTickets, &t.TicketsLeft, &t.SaleStartsAt, &t.SaleEndsAt, &t.PerUserLimit); err != nil {
+			return nil, err
+		}
+		price, err := money.Parse(t.Price.String(), currency)
+		if err != nil {
+			return nil, err
+		}
+		t.Price = json.Number(price.Decimal())
+		types = append(types, t)
+	}
+	return types, rows.Err()
+}
+
+// reserveTicketType takes quantity tickets of a ticket type within tx. A type
+// that is not on sale, or has too few tickets left, is reported as outcome.
+func (r *EventRepository) reserveTicketType(tx *sql.Tx, eventID, ticketTypeID, quantity int) (outcome error, err error) {
+	res, err := tx.Exec(`
+		UPDATE ticket_types
+		SET sold_tickets = sold_tickets + $1
+		WHERE id = $2 AND event_id = $3 AND sold_tickets + $1 <= total_tickets
+		  AND (sale_starts_at IS NULL OR sale_starts_at <= NOW())
+		  AND (sale_ends_at IS NULL OR NOW() < sale_ends_at)`,
+		quantity, ticketTypeID, eventID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil, nil
+	}
+
+	var onSale bool
+	err = tx.QueryRow(`
+		SELECT (sale_starts_at IS NULL OR sale_starts_at <= NOW()) AND (sale_ends_at IS NULL OR NOW() < sale_ends_at)
+		FROM ticket_types WHERE id = $1 AND event_id = $2`,
+		ticketTypeID, eventID,
+	).Scan(&onSale)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrTicketTypeNotFound, nil
+	case err != nil:
+		return nil, err
+	case !onSale:
+		return ErrTicketTypeNotOnSale, nil
+	default:
+		return ErrNotEnoughTickets, nil
+	}
+}
+
+// ticketTypeConstraintError maps the constraint violations of ticket type
+// writes onto the errors callers act on. It returns nil for anything else.
+func ticketTypeConstraintError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return nil
+	}
+	switch {
+	case pqErr.Code == "23505":
+		return ErrTicketTypeExists
+	case pqErr.Code == "23503":
+		return ErrTicketTypeInUse
+	case pqErr.Constraint == "type_sold_within_capacity":
+		return ErrCapacityBelowSold
+	}
+	return nil
+}
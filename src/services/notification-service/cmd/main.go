@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
 	mailer "notification-service/internal/api"
 	"os"
@@ -9,14 +9,11 @@ import (
 	"syscall"
 
 	brokerPkg "tixie.local/broker"
+	"tixie.local/broker/dedupe"
+	"tixie.local/broker/events"
+	"tixie.local/common/money"
 )
 
-// EmailMessage represents the expected format of incoming email messages
-type EmailMessage struct {
-	RecipientEmail string `json:"recipient_email"`
-	TicketID       string `json:"ticket_id"`
-}
-
 func main() {
 	apiKey := os.Getenv("MAILERSEND_API_KEY")
 	templateID := os.Getenv("MAILERSEND_TEMPLATE_ID")
@@ -29,43 +26,106 @@ func main() {
 
 	mailerService := mailer.NewMailerService(apiKey, "Ticket Notifier", fromEmail, templateID)
 
-	b, err := brokerPkg.NewBroker(rabbitmqURL, "notification", "topic")
+	b, err := brokerPkg.NewBroker(rabbitmqURL, "tixie", "topic")
 	if err != nil {
 		log.Fatalf("Failed to create broker: %v", err)
 	}
 	defer b.Close()
 
 	queueName := "email_notifications"
-	err = b.DeclareAndBindQueue(queueName, "email")
-	if err != nil {
-		log.Fatalf("Failed to declare and bind queue: %v", err)
-	}
+	// Skip emails that were already sent when RabbitMQ redelivers them
+	processed := dedupe.Open(os.Getenv("REDIS_URL"))
 
-	messages, err := b.Consume(queueName)
-	if err != nil {
-		log.Fatalf("Failed to start consuming messages: %v", err)
-	}
+	err = b.SubscribeEvents(queueName, events.TypeNotificationEmail, brokerPkg.ConsumerOptions{}, dedupe.Wrap(processed, queueName, dedupe.DefaultTTL, func(env events.Envelope, e events.Event) error {
+		log.Printf("Received message %s from %s", env.ID, env.Producer)
 
-	go func() {
-		for msg := range messages {
-			log.Printf("Received message: %s", msg.Body)
+		emailMsg, ok := e.(*events.NotificationEmail)
+		if !ok {
+			return brokerPkg.Permanent(fmt.Errorf("unexpected event type %s", env.Type))
+		}
 
-			var emailMsg EmailMessage
-			err := json.Unmarshal(msg.Body, &emailMsg)
-			if err != nil {
-				log.Printf("Error unmarshaling message: %v", err)
-				continue
+		if emailMsg.Kind == events.EmailTicketTransferred {
+			if err := mailerService.SendTransferEmail(emailMsg.RecipientEmail, emailMsg.TicketID); err != nil {
+				log.Printf("Error sending transfer email: %v", err)
+				return err
 			}
+			log.Printf("Successfully sent transfer email for ticket %d", emailMsg.TicketID)
+			return nil
+		}
 
-			err = mailerService.SendTicketEmail(emailMsg.RecipientEmail, emailMsg.TicketID)
+		// The QR code is rendered by ticket-service, never by a third party
+		var qrPNG []byte
+		if emailMsg.TicketID > 0 {
+			qrPNG, err = mailer.FetchTicketQR(os.Getenv("TICKET_SERVICE_URL"), emailMsg.TicketID)
 			if err != nil {
-				log.Printf("Error sending email: %v", err)
-				continue
+				log.Printf("Error fetching QR code of ticket %d: %v", emailMsg.TicketID, err)
+				return err
 			}
+		}
+
+		if err := mailerService.SendTicketEmail(emailMsg.RecipientEmail, emailMsg.TicketCode, qrPNG); err != nil {
+			log.Printf("Error sending email: %v", err)
+			return err
+		}
+
+		log.Printf("Successfully processed message for recipient: %s", emailMsg.RecipientEmail)
+		return nil
+	}))
+	if err != nil {
+		log.Fatalf("Failed to subscribe to queue: %v", err)
+	}
+
+	cancellationQueue := "cancellation_notifications"
+	err = b.SubscribeEvents(cancellationQueue, events.TypePurchaseCancelled, brokerPkg.ConsumerOptions{}, dedupe.Wrap(processed, cancellationQueue, dedupe.DefaultTTL, func(env events.Envelope, e events.Event) error {
+		log.Printf("Received message %s from %s", env.ID, env.Producer)
 
-			log.Printf("Successfully processed message for recipient: %s", emailMsg.RecipientEmail)
+		cancelled, ok := e.(*events.PurchaseCancelled)
+		if !ok {
+			return brokerPkg.Permanent(fmt.Errorf("unexpected event type %s", env.Type))
 		}
-	}()
+		if cancelled.RecipientEmail == "" {
+			return brokerPkg.Permanent(fmt.Errorf("cancellation of purchase %d has no recipient", cancelled.PurchaseID))
+		}
+
+		refund, err := money.New(cancelled.RefundAmount, cancelled.Currency)
+		if err != nil {
+			return brokerPkg.Permanent(err)
+		}
+		if err := mailerService.SendCancellationEmail(cancelled.RecipientEmail, cancelled.TicketCode, refund); err != nil {
+			log.Printf("Error sending cancellation email: %v", err)
+			return err
+		}
+
+		log.Printf("Successfully sent cancellation email for purchase %d", cancelled.PurchaseID)
+		return nil
+	}))
+	if err != nil {
+		log.Fatalf("Failed to subscribe to queue: %v", err)
+	}
+
+	waitlistQueue := "waitlist_notifications"
+	err = b.SubscribeEvents(waitlistQueue, events.TypeWaitlistOffered, brokerPkg.ConsumerOptions{}, dedupe.Wrap(processed, waitlistQueue, dedupe.DefaultTTL, func(env events.Envelope, e events.Event) error {
+		log.Printf("Received message %s from %s", env.ID, env.Producer)
+
+		offer, ok := e.(*events.WaitlistOffered)
+		if !ok {
+			return brokerPkg.Permanent(fmt.Errorf("unexpected event type %s", env.Type))
+		}
+		if offer.RecipientEmail == "" {
+			return brokerPkg.Permanent(fmt.Errorf("waitlist offer %d has no recipient", offer.EntryID))
+		}
+
+		if err := mailerService.SendWaitlistOfferEmail(offer.RecipientEmail, offer.EventID, offer.EntryID, offer.ExpiresAt); err != nil {
+			log.Printf("Error sending waitlist offer email: %v", err)
+			return err
+		}
+
+		log.Printf("Successfully sent waitlist offer email for entry %d", offer.EntryID)
+		return nil
+	}))
+	if err != nil {
+		log.Fatalf("Failed to subscribe to queue: %v", err)
+	}
 
 	log.Println("Notification service started. Waiting for messages...")
 
@@ -7,11 +7,17 @@ toolchain go1.24.0
 require (
 	github.com/mailersend/mailersend-go v1.6.1
 	tixie.local/broker v0.0.0
+	tixie.local/common v0.0.0
 )
 
 require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
 	github.com/rabbitmq/amqp091-go v1.10.0 // indirect
+	github.com/redis/go-redis/v9 v9.7.0 // indirect
 )
 
 replace tixie.local/broker => ../broker
+
+replace tixie.local/common => ../common
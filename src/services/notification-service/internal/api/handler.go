@@ -2,12 +2,14 @@ package mailer
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"os"
 	"time"
 
 	"github.com/mailersend/mailersend-go"
+	"tixie.local/common/money"
 )
 
 type MailerService struct {
@@ -26,7 +28,13 @@ func NewMailerService(apiKey, fromName, fromEmail, templateID string) *MailerSer
 	}
 }
 
-func (m *MailerService) SendTicketEmail(to, ticketID string) error {
+// ticketQRID is the content id the ticket QR code is embedded under, so the
+// template can show it with <img src="cid:ticket-qr">.
+const ticketQRID = "ticket-qr"
+
+// SendTicketEmail sends a ticket code to its buyer. qrPNG, when not empty,
+// is embedded as the ticket's QR code.
+func (m *MailerService) SendTicketEmail(to, ticketID string, qrPNG []byte) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -49,6 +57,9 @@ func (m *MailerService) SendTicketEmail(to, ticketID string) error {
 			},
 		},
 	}
+	if len(qrPNG) > 0 {
+		personalization[0].Data["qr_cid"] = "cid:" + ticketQRID
+	}
 
 	message := m.Client.Email.NewMessage()
 	message.SetFrom(from)
@@ -56,6 +67,14 @@ func (m *MailerService) SendTicketEmail(to, ticketID string) error {
 	message.SetSubject("Your QR Code Ticket")
 	message.SetTemplateID(m.TemplateID)
 	message.SetPersonalization(personalization)
+	if len(qrPNG) > 0 {
+		message.AddAttachment(mailersend.Attachment{
+			Content:     base64.StdEncoding.EncodeToString(qrPNG),
+			Filename:    "ticket-qr.png",
+			Disposition: "inline",
+			ID:          ticketQRID,
+		})
+	}
 
 	res, err := m.Client.Email.Send(ctx, message)
 	if err != nil {
@@ -65,3 +84,107 @@ func (m *MailerService) SendTicketEmail(to, ticketID string) error {
 	log.Println("Email sent. Message ID:", res.Header.Get("X-Message-Id"))
 	return nil
 }
+
+// SendCancellationEmail tells a buyer their ticket was cancelled and how
+// much was refunded.
+func (m *MailerService) SendCancellationEmail(to, ticketCode string, refund money.Money) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	from := mailersend.From{
+		Name:  "Tixie",
+		Email: os.Getenv("MAILERSEND_EMAIL"),
+	}
+
+	recipients := []mailersend.Recipient{
+		{
+			Email: to,
+		},
+	}
+
+	text := fmt.Sprintf("Your ticket %s has been cancelled.", ticketCode)
+	if refund.Amount > 0 {
+		text += fmt.Sprintf(" A refund of %s is on its way to your original payment method.", refund)
+	}
+
+	message := m.Client.Email.NewMessage()
+	message.SetFrom(from)
+	message.SetRecipients(recipients)
+	message.SetSubject("Your ticket has been cancelled")
+	message.SetText(text)
+
+	res, err := m.Client.Email.Send(ctx, message)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	log.Println("Cancellation email sent. Message ID:", res.Header.Get("X-Message-Id"))
+	return nil
+}
+
+// SendTransferEmail tells a user their ticket was transferred to someone
+// else, which also retired its QR code.
+func (m *MailerService) SendTransferEmail(to string, ticketID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	from := mailersend.From{
+		Name:  "Tixie",
+		Email: os.Getenv("MAILERSEND_EMAIL"),
+	}
+
+	recipients := []mailersend.Recipient{
+		{
+			Email: to,
+		},
+	}
+
+	message := m.Client.Email.NewMessage()
+	message.SetFrom(from)
+	message.SetRecipients(recipients)
+	message.SetSubject("Your ticket has been transferred")
+	message.SetText(fmt.Sprintf("Your ticket #%d has been transferred to another user. Its QR code is no longer valid.", ticketID))
+
+	res, err := m.Client.Email.Send(ctx, message)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	log.Println("Transfer email sent. Message ID:", res.Header.Get("X-Message-Id"))
+	return nil
+}
+
+// SendWaitlistOfferEmail tells a user on an event's waitlist that a ticket
+// is set aside for them until expiresAt.
+func (m *MailerService) SendWaitlistOfferEmail(to string, eventID, entryID int, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	from := mailersend.From{
+		Name:  "Tixie",
+		Email: os.Getenv("MAILERSEND_EMAIL"),
+	}
+
+	recipients := []mailersend.Recipient{
+		{
+			Email: to,
+		},
+	}
+
+	message := m.Client.Email.NewMessage()
+	message.SetFrom(from)
+	message.SetRecipients(recipients)
+	message.SetSubject("A ticket is waiting for you")
+	message.SetText(fmt.Sprintf(
+		"A ticket for event #%d has freed up and is set aside for you until %s. Accept waitlist offer #%d before then to buy it, or it goes to the next person in line.",
+		eventID, expiresAt.UTC().Format("2006-01-02 15:04 MST"), entryID,
+	))
+
+	res, err := m.Client.Email.Send(ctx, message)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	log.Println("Waitlist offer email sent. Message ID:", res.Header.Get("X-Message-Id"))
+	return nil
+}
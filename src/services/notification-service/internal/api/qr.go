@@ -0,0 +1,32 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxQRBytes bounds the size of a QR code image read from ticket-service.
+const maxQRBytes = 1 << 20
+
+var qrClient = &http.Client{Timeout: 5 * time.Second}
+
+// FetchTicketQR fetches the PNG QR code of a ticket from the ticket service
+// at ticketServiceURL.
+func FetchTicketQR(ticketServiceURL string, ticketID int) ([]byte, error) {
+	if ticketServiceURL == "" {
+		return nil, fmt.Errorf("TICKET_SERVICE_URL is not set")
+	}
+
+	resp, err := qrClient.Get(fmt.Sprintf("%s/v1/%d/qr?format=png", ticketServiceURL, ticketID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ticket service returned status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxQRBytes))
+}
@@ -1,99 +1,295 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"payment/handlers"
+	"payment/internal/db"
+	"payment/internal/db/models"
+	"payment/internal/db/repos"
+	"payment/internal/provider"
 	"payment/routes"
+	"strconv"
 	"syscall"
+	"time"
 
-	"github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/paymentintent"
 	brokerPkg "tixie.local/broker"
+	"tixie.local/broker/dedupe"
+	"tixie.local/broker/events"
+	"tixie.local/common/money"
+	"tixie.local/common/paymentmethod"
 )
 
-// PaymentMessage represents the structure of incoming payment messages
-type PaymentMessage struct {
-	TicketID int `json:"ticket_id"`
-	Amount   int `json:"amount"`
-}
+// publishConfirmTimeout is how long to wait for RabbitMQ to confirm a
+// published message.
+const publishConfirmTimeout = 5 * time.Second
+
+// producer identifies the payment service in the envelopes it publishes.
+const producer = "payment-service"
+
+// providerTimeout bounds each call to the payment provider.
+const providerTimeout = 30 * time.Second
 
-func startMessageConsumer(rabbitmqURL string) {
+// dedupePurgeInterval is how often expired processed message ids are
+// deleted.
+const dedupePurgeInterval = time.Hour
+
+func startMessageConsumer(rabbitmqURL string, p provider.PaymentProvider, payments *repos.PaymentRepository, processed dedupe.Store) {
 	broker, err := brokerPkg.NewBroker(rabbitmqURL, "tixie", "topic")
 	if err != nil {
 		log.Printf("Failed to create broker: %v", err)
 		return
 	}
-	defer broker.Close()
 
+	if err := broker.EnableConfirms(publishConfirmTimeout); err != nil {
+		log.Printf("Failed to enable publisher confirms: %v", err)
+		broker.Close()
+		return
+	}
+
+	// Nobody listening for confirmations means paid tickets never get
+	// confirmed, so make a misrouted setup visible right away.
+	if err := broker.Probe(events.RoutingKey(events.TypePaymentConfirmed)); err != nil {
+		log.Printf("Warning: payment confirmations are not routable yet: %v", err)
+	}
+
+	// Skip requests that were already paid for when RabbitMQ redelivers them
 	queueName := "payment_requests"
-	err = broker.DeclareAndBindQueue(queueName, "topay")
+
+	err = broker.SubscribeEvents(queueName, events.TypePaymentRequested, brokerPkg.ConsumerOptions{}, dedupe.Wrap(processed, queueName, dedupe.DefaultTTL, func(env events.Envelope, e events.Event) error {
+		log.Printf("Received payment request %s from %s", env.ID, env.Producer)
+
+		paymentMsg, ok := e.(*events.PaymentRequested)
+		if !ok {
+			return brokerPkg.Permanent(fmt.Errorf("unexpected event type %s", env.Type))
+		}
+
+		currency, err := money.NormalizeCurrency(paymentMsg.Currency)
+		if err != nil {
+			return brokerPkg.Permanent(err)
+		}
+		method, err := paymentmethod.Parse(paymentMsg.PaymentMethod)
+		if err != nil {
+			return brokerPkg.Permanent(err)
+		}
+
+		// Create the payment intent. The idempotency key comes from the
+		// reservation, so a retry returns the same payment intent instead
+		// of charging again.
+		ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+		defer cancel()
+
+		items := make([]provider.LineItem, len(paymentMsg.Items))
+		for i, item := range paymentMsg.Items {
+			items[i] = provider.LineItem{TicketID: item.TicketID, Amount: item.Amount}
+		}
+
+		// The metadata lets the webhook map the intent back to its ticket.
+		pi, err := p.CreateIntent(ctx, provider.IntentRequest{
+			Amount:         paymentMsg.Amount,
+			Currency:       currency,
+			PaymentMethod:  method,
+			IdempotencyKey: paymentMsg.IdempotencyKey(),
+			Metadata: map[string]string{
+				provider.MetadataTicketID:       strconv.Itoa(paymentMsg.TicketID),
+				provider.MetadataReservationKey: paymentMsg.ReservationKey,
+			},
+			Items: items,
+		})
+		if errors.Is(err, provider.ErrDeclined) {
+			log.Printf("Payment for ticket %d declined: %v", paymentMsg.TicketID, err)
+			failedMsg := &events.PaymentFailed{
+				TicketID:       paymentMsg.TicketID,
+				ReservationKey: paymentMsg.ReservationKey,
+				Reason:         events.PaymentFailureDeclined,
+				Message:        err.Error(),
+			}
+			if err := broker.PublishEvent(producer, env.CorrelationID, failedMsg); err != nil {
+				log.Printf("Error publishing payment failure: %v", err)
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			log.Printf("Error creating payment intent: %v", err)
+			return err
+		}
+
+		// Tickets paid for at the door can be used right away. They are
+		// confirmed once they have been scanned.
+		if pi.Status == provider.StatusPendingAtDoor {
+			deferredMsg := &events.PaymentDeferred{
+				TicketID:        paymentMsg.TicketID,
+				Amount:          paymentMsg.Amount,
+				Currency:        currency,
+				PaymentMethod:   method,
+				PaymentIntentID: pi.ID,
+			}
+			if err := broker.PublishEvent(producer, env.CorrelationID, deferredMsg); err != nil {
+				log.Printf("Error publishing deferred payment: %v", err)
+				return err
+			}
+			log.Printf("Ticket %d will be paid for at the door, payment intent ID: %s", paymentMsg.TicketID, pi.ID)
+			return nil
+		}
+
+		// Payments the buyer still has to complete are confirmed by the
+		// Stripe webhook once they succeed.
+		if pi.Status != provider.StatusSucceeded {
+			log.Printf("Created payment intent %s for ticket %d, waiting for the buyer to pay", pi.ID, paymentMsg.TicketID)
+			return nil
+		}
+
+		// Publish payment confirmation message
+		confirmationMsg := &events.PaymentConfirmed{
+			TicketID:        paymentMsg.TicketID,
+			Amount:          paymentMsg.Amount,
+			Currency:        currency,
+			PaymentIntentID: pi.ID,
+			ReservationKey:  paymentMsg.ReservationKey,
+		}
+
+		if err := broker.PublishEvent(producer, env.CorrelationID, confirmationMsg); err != nil {
+			log.Printf("Error publishing confirmation message: %v", err)
+			return err
+		}
+
+		log.Printf("Successfully processed payment for ticket %d, payment intent ID: %s", paymentMsg.TicketID, pi.ID)
+		return nil
+	}))
+	if err != nil {
+		log.Printf("Failed to subscribe to payment requests: %v", err)
+		broker.Close()
+		return
+	}
+
+	// Collect payments due at the door when their tickets are scanned
+	doorQueue := "payment_door_collections"
+	err = broker.SubscribeEvents(doorQueue, events.TypeTicketCheckedIn, brokerPkg.ConsumerOptions{}, dedupe.Wrap(processed, doorQueue, dedupe.DefaultTTL, func(env events.Envelope, e events.Event) error {
+		checkedIn, ok := e.(*events.TicketCheckedIn)
+		if !ok {
+			return brokerPkg.Permanent(fmt.Errorf("unexpected event type %s", env.Type))
+		}
+		return collectAtDoor(broker, payments, checkedIn.TicketID)
+	}))
 	if err != nil {
-		log.Printf("Failed to declare and bind queue: %v", err)
+		log.Printf("Failed to subscribe to ticket check-ins: %v", err)
+		broker.Close()
 		return
 	}
 
-	messages, err := broker.Consume(queueName)
+	// Record what sellers are owed for tickets resold to other users
+	payoutsQueue := "payment_resale_payouts"
+	err = broker.SubscribeEvents(payoutsQueue, events.TypeResaleSettled, brokerPkg.ConsumerOptions{}, dedupe.Wrap(processed, payoutsQueue, dedupe.DefaultTTL, func(env events.Envelope, e events.Event) error {
+		settled, ok := e.(*events.ResaleSettled)
+		if !ok {
+			return brokerPkg.Permanent(fmt.Errorf("unexpected event type %s", env.Type))
+		}
+		err := payments.RecordPayout(&models.Payout{
+			ListingID:    settled.ListingID,
+			TicketID:     settled.TicketID,
+			SellerUserID: settled.SellerUserID,
+			IntentID:     settled.PaymentIntentID,
+			GrossAmount:  settled.Price,
+			Fee:          settled.Fee,
+			Amount:       settled.Payout,
+			Currency:     settled.Currency,
+		})
+		if err != nil {
+			log.Printf("Error recording payout of listing %d: %v", settled.ListingID, err)
+			return err
+		}
+		log.Printf("Recorded payout of %d %s to user %d for listing %d", settled.Payout, settled.Currency, settled.SellerUserID, settled.ListingID)
+		return nil
+	}))
 	if err != nil {
-		log.Printf("Failed to start consuming messages: %v", err)
+		log.Printf("Failed to subscribe to resale settlements: %v", err)
+		broker.Close()
 		return
 	}
 
 	log.Println("Payment service consumer started. Waiting for messages...")
+}
 
-	go func() {
-		for msg := range messages {
-			log.Printf("Received payment message: %s", msg.Body)
-
-			var paymentMsg PaymentMessage
-			if err := json.Unmarshal(msg.Body, &paymentMsg); err != nil {
-				log.Printf("Error unmarshaling payment message: %v", err)
-				continue
-			}
-
-			// Create payment intent with Stripe
-			params := &stripe.PaymentIntentParams{
-				Amount:   stripe.Int64(int64(paymentMsg.Amount)),
-				Currency: stripe.String(string(stripe.CurrencyUSD)),
-			}
+// collectAtDoor confirms the payments of a ticket that were due at the door,
+// now that it has been scanned. The confirmation is published before the
+// payment is marked as collected, so a retry never loses it.
+func collectAtDoor(broker *brokerPkg.Broker, payments *repos.PaymentRepository, ticketID int) error {
+	due, err := payments.GetPaymentsByTicketID(ticketID)
+	if err != nil {
+		log.Printf("Error loading payments for ticket %d: %v", ticketID, err)
+		return err
+	}
 
-			pi, err := paymentintent.New(params)
-			if err != nil {
-				log.Printf("Error creating payment intent: %v", err)
-				continue
-			}
+	for _, payment := range due {
+		if payment.Status != string(provider.StatusPendingAtDoor) {
+			continue
+		}
 
-			// Publish payment confirmation message
-			confirmationMsg := struct {
-				TicketID int    `json:"ticket_id"`
-				Amount   int    `json:"amount"`
-				Status   string `json:"status"`
-			}{
-				TicketID: paymentMsg.TicketID,
-				Amount:   paymentMsg.Amount,
-				Status:   "confirmed",
-			}
+		confirmationMsg := &events.PaymentConfirmed{
+			TicketID:        ticketID,
+			Amount:          payment.Amount,
+			Currency:        payment.Currency,
+			PaymentIntentID: payment.IntentID,
+			ReservationKey:  payment.ReservationKey,
+		}
+		if err := broker.PublishEvent(producer, payment.ReservationKey, confirmationMsg); err != nil {
+			log.Printf("Error publishing confirmation message: %v", err)
+			return err
+		}
+		if err := payments.RecordStatus(payment.IntentID, provider.StatusSucceeded, "collected at the door"); err != nil {
+			log.Printf("Error recording collection of payment intent %s: %v", payment.IntentID, err)
+			return err
+		}
+		log.Printf("Collected payment for ticket %d at the door, payment intent ID: %s", ticketID, payment.IntentID)
+	}
+	return nil
+}
 
-			if err := broker.Publish(confirmationMsg, "payment.confirmed"); err != nil {
-				log.Printf("Error publishing confirmation message: %v", err)
-				continue
-			}
+// purgeProcessed deletes the processed message ids whose TTL has run out,
+// every dedupePurgeInterval.
+func purgeProcessed(processed *dedupe.PostgresStore) {
+	ticker := time.NewTicker(dedupePurgeInterval)
+	defer ticker.Stop()
 
-			log.Printf("Successfully processed payment for ticket %d, payment intent ID: %s", paymentMsg.TicketID, pi.ID)
+	for range ticker.C {
+		if _, err := processed.PurgeExpired(); err != nil {
+			log.Printf("Failed to purge processed messages: %v", err)
 		}
-	}()
+	}
+}
+
+// openLogFile opens logs/service.log for appending, creating it if needed.
+func openLogFile() *os.File {
+	if err := os.MkdirAll("logs", os.ModePerm); err != nil {
+		log.Fatalf("failed to create log directory: %v", err)
+	}
+	logFile, err := os.OpenFile("logs/service.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("failed to open log file: %v", err)
+	}
+	return logFile
 }
 
 func main() {
-	// Initialize Stripe
-	stripeKey := os.Getenv("SECRET_KEY")
-	if stripeKey == "" {
-		log.Fatal("SECRET_KEY environment variable is required")
+	// The handlers log to logs/service.log
+	handlers.SetLogOutput(openLogFile())
+
+	// Select the payment provider (Stripe unless PAYMENT_PROVIDER says otherwise)
+	paymentProvider, err := provider.FromEnv()
+	if err != nil {
+		log.Fatalf("Failed to select payment provider: %v", err)
 	}
-	stripe.Key = stripeKey
+
+	// Record every payment in payment_db
+	paymentDB := db.NewDB()
+	payments := repos.NewPaymentRepository(paymentDB)
+	paymentProvider = provider.WithLedger(provider.WithCashOnArrival(paymentProvider), payments)
 
 	// Initialize RabbitMQ URL
 	rabbitmqURL := os.Getenv("RABBITMQ_URL")
@@ -104,10 +300,15 @@ func main() {
 	os.Setenv("RABBITMQ_URL", rabbitmqURL)
 
 	// Start message consumer
-	startMessageConsumer(rabbitmqURL)
+	// Remembers handled messages and Stripe events in payment_db so
+	// redeliveries are skipped, across restarts too
+	processed := dedupe.NewPostgresStore(paymentDB.DB)
+	go purgeProcessed(processed)
+
+	startMessageConsumer(rabbitmqURL, paymentProvider, payments, processed)
 
 	// Setup router
-	r := routes.SetupRouter()
+	r := routes.SetupRouter(paymentProvider, payments, processed)
 
 	// Handle graceful shutdown
 	quit := make(chan os.Signal, 1)
@@ -116,6 +317,9 @@ func main() {
 	go func() {
 		<-quit
 		log.Println("Shutting down server...")
+		if err := paymentDB.Close(); err != nil {
+			log.Printf("Error closing database connection: %v", err)
+		}
 		os.Exit(0)
 	}()
 
@@ -2,25 +2,32 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 
 	"log"
 	"os"
+	"payment/internal/provider"
+	"strconv"
 
 	"github.com/google/uuid"
-	"github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/paymentintent"
+	"tixie.local/broker/events"
 	circuitbreaker "tixie.local/common"
+	"tixie.local/common/money"
+	"tixie.local/common/paymentmethod"
 )
 
 type PaymentHandler struct {
-	breaker *circuitbreaker.Breaker
+	provider provider.PaymentProvider
+	breaker  *circuitbreaker.Breaker
 }
 
-func NewPaymentHandler() *PaymentHandler {
+func NewPaymentHandler(p provider.PaymentProvider) *PaymentHandler {
 	return &PaymentHandler{
-		breaker: circuitbreaker.NewBreaker("payment-service"),
+		provider: p,
+		breaker:  circuitbreaker.NewBreaker("payment-service"),
 	}
 }
 
@@ -29,23 +36,22 @@ type paymentResponse struct {
 	IdempotencyKey string `json:"idempotency_key"`
 }
 
-var logger *log.Logger
+// logger is the log of the payment handlers. It writes to stderr until main
+// points it at the service's log file with SetLogOutput.
+var logger = log.New(os.Stderr, "PAYMENT: ", log.LstdFlags|log.Lshortfile)
 
-func init() {
-	if _, err := os.Stat("logs"); os.IsNotExist(err) {
-		os.MkdirAll("logs", os.ModePerm)
-	}
-	logFile, err := os.OpenFile("logs/service.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("failed to open log file: %v", err)
-	}
-
-	logger = log.New(logFile, "PAYMENT: ", log.LstdFlags|log.Lshortfile)
+// SetLogOutput sets where the payment handlers log to.
+func SetLogOutput(w io.Writer) {
+	logger.SetOutput(w)
 }
 
 func (h *PaymentHandler) CreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Amount int64 `json:"amount"`
+		Amount         int64  `json:"amount"`
+		Currency       string `json:"currency"`
+		PaymentMethod  string `json:"payment_method"`
+		ReservationKey string `json:"reservation_key"`
+		TicketID       int    `json:"ticket_id"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -60,19 +66,48 @@ func (h *PaymentHandler) CreatePaymentIntent(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// Amounts are in the minor units of the currency, USD if none is given.
+	currency, err := money.NormalizeCurrency(req.Currency)
+	if err != nil {
+		logger.Printf("Invalid currency: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	method, err := paymentmethod.Parse(req.PaymentMethod)
+	if err != nil {
+		logger.Printf("Invalid payment method: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Retrying the request for the same reservation must not create a
+	// second payment intent.
 	idempotencyKey := uuid.New().String()
+	if req.ReservationKey != "" {
+		idempotencyKey = events.PaymentIdempotencyKey(req.ReservationKey)
+	}
 
-	result := h.breaker.Execute(func() (interface{}, error) {
-		params := &stripe.PaymentIntentParams{
-			Amount:   stripe.Int64(req.Amount),
-			Currency: stripe.String(string(stripe.CurrencyUSD)),
-		}
-		params.SetIdempotencyKey(idempotencyKey)
+	// The metadata lets the webhook map the intent back to its ticket.
+	metadata := map[string]string{}
+	if req.TicketID > 0 {
+		metadata[provider.MetadataTicketID] = strconv.Itoa(req.TicketID)
+	}
+	if req.ReservationKey != "" {
+		metadata[provider.MetadataReservationKey] = req.ReservationKey
+	}
 
-		pi, err := paymentintent.New(params)
+	result := h.breaker.ExecuteContext(r.Context(), func() (interface{}, error) {
+		pi, err := h.provider.CreateIntent(r.Context(), provider.IntentRequest{
+			Amount:         req.Amount,
+			Currency:       currency,
+			PaymentMethod:  method,
+			IdempotencyKey: idempotencyKey,
+			Metadata:       metadata,
+		})
 		if err != nil {
 			logger.Printf("Failed to create payment intent: %v", err)
-			return nil, fmt.Errorf("failed to create payment intent: %v", err)
+			return nil, fmt.Errorf("failed to create payment intent: %w", err)
 		}
 
 		return &paymentResponse{
@@ -88,6 +123,14 @@ func (h *PaymentHandler) CreatePaymentIntent(w http.ResponseWriter, r *http.Requ
 			http.Error(w, msg, status)
 			return
 		}
+		if errors.Is(result.Error, provider.ErrDeclined) {
+			http.Error(w, "payment declined", http.StatusPaymentRequired)
+			return
+		}
+		if errors.Is(result.Error, provider.ErrTimeout) {
+			http.Error(w, "payment provider timed out", http.StatusGatewayTimeout)
+			return
+		}
 		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -104,3 +147,86 @@ func (h *PaymentHandler) CreatePaymentIntent(w http.ResponseWriter, r *http.Requ
 
 	logger.Printf("Successfully created payment intent: %+v", response)
 }
+
+type refundResponse struct {
+	RefundID        string `json:"refund_id"`
+	PaymentIntentID string `json:"payment_intent_id"`
+	Amount          int64  `json:"amount"`
+	Status          string `json:"status"`
+}
+
+// RefundPayment refunds a payment intent, fully unless an amount is given.
+// Retrying with the same idempotency key returns the first refund.
+func (h *PaymentHandler) RefundPayment(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PaymentIntentID string `json:"payment_intent_id"`
+		Amount          int64  `json:"amount"`
+		IdempotencyKey  string `json:"idempotency_key"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Printf("Invalid request body: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.PaymentIntentID == "" {
+		http.Error(w, "payment_intent_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.Amount < 0 {
+		logger.Printf("Invalid refund amount: %d", req.Amount)
+		http.Error(w, "amount must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	result := h.breaker.ExecuteContext(r.Context(), func() (interface{}, error) {
+		refund, err := h.provider.Refund(r.Context(), provider.RefundRequest{
+			IntentID:       req.PaymentIntentID,
+			Amount:         req.Amount,
+			IdempotencyKey: req.IdempotencyKey,
+		})
+		if err != nil {
+			logger.Printf("Failed to refund payment intent %s: %v", req.PaymentIntentID, err)
+			return nil, fmt.Errorf("failed to refund payment: %w", err)
+		}
+
+		return &refundResponse{
+			RefundID:        refund.ID,
+			PaymentIntentID: refund.IntentID,
+			Amount:          refund.Amount,
+			Status:          refund.Status,
+		}, nil
+	})
+
+	if result.Error != nil {
+		logger.Printf("Error from breaker: %v", result.Error)
+		if circuitbreaker.IsCircuitBreakerError(result.Error) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+			http.Error(w, msg, status)
+			return
+		}
+		if errors.Is(result.Error, provider.ErrNotFound) {
+			http.Error(w, "payment intent not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(result.Error, provider.ErrTimeout) {
+			http.Error(w, "payment provider timed out", http.StatusGatewayTimeout)
+			return
+		}
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, ok := result.Data.(*refundResponse)
+	if !ok {
+		logger.Printf("Unexpected response type from breaker: %+v", result.Data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+
+	logger.Printf("Successfully refunded payment intent: %+v", response)
+}
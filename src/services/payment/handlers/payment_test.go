@@ -5,17 +5,15 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"payment/internal/provider"
 	"testing"
-
-	"github.com/joho/godotenv"
+	"time"
 )
 
 //FAILS
 
 func Test_WrongStripeKey(t *testing.T) {
-	os.Setenv("STRIPE_SECRET_KEY", "sk_test_invalid")
-	paymentHandler := NewPaymentHandler()
+	paymentHandler := NewPaymentHandler(provider.NewStripe("sk_test_invalid"))
 	body := []byte(`{"amount": 1000}`)
 	req := httptest.NewRequest("POST", "/create-payment-intent", bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
@@ -32,7 +30,7 @@ func Test_InvalidJSON(t *testing.T) {
 	req := httptest.NewRequest("POST", "/create-payment-intent", bytes.NewBuffer([]byte(`invalid`)))
 	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
-	paymentHandler := NewPaymentHandler()
+	paymentHandler := NewPaymentHandler(provider.NewFake(provider.FakeSucceed))
 	paymentHandler.CreatePaymentIntent(rr, req)
 
 	if rr.Code != http.StatusBadRequest {
@@ -45,7 +43,7 @@ func Test_MissingAmount(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 
-	paymentHandler := NewPaymentHandler()
+	paymentHandler := NewPaymentHandler(provider.NewFake(provider.FakeSucceed))
 	paymentHandler.CreatePaymentIntent(rr, req)
 
 	if rr.Code != http.StatusBadRequest {
@@ -59,7 +57,7 @@ func Test_InvalidAmount1(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 
-	paymentHandler := NewPaymentHandler()
+	paymentHandler := NewPaymentHandler(provider.NewFake(provider.FakeSucceed))
 	paymentHandler.CreatePaymentIntent(rr, req)
 
 	if rr.Code != http.StatusBadRequest {
@@ -73,7 +71,7 @@ func Test_InvalidAmount2(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 
-	paymentHandler := NewPaymentHandler()
+	paymentHandler := NewPaymentHandler(provider.NewFake(provider.FakeSucceed))
 	paymentHandler.CreatePaymentIntent(rr, req)
 
 	if rr.Code != http.StatusBadRequest {
@@ -81,43 +79,67 @@ func Test_InvalidAmount2(t *testing.T) {
 	}
 }
 
-// SUCCESS
-func TestSimulateWebhook(t *testing.T) {
-	req := httptest.NewRequest("POST", "/simulate-webhook", nil)
+func Test_InvalidCurrency(t *testing.T) {
+	body := []byte(`{"amount": 1000, "currency": "dollars"}`)
+	req := httptest.NewRequest("POST", "/create-payment-intent", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 
-	WebhookHandler := NewWebhookHandler()
-	WebhookHandler.SimulateWebhook(rr, req)
+	paymentHandler := NewPaymentHandler(provider.NewFake(provider.FakeSucceed))
+	paymentHandler.CreatePaymentIntent(rr, req)
 
-	if rr.Code != http.StatusOK {
-		t.Errorf("Expected 200 from simulate-webhook, got %d", rr.Code)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid currency, got %d", rr.Code)
 	}
 }
 
-func TestCreatePaymentIntent_SuccessSimulated(t *testing.T) {
-	err := godotenv.Load("../.env")
-	if err != nil {
-		panic("Error loading .env file from parent directory")
+// SUCCESS
+func Test_Declined(t *testing.T) {
+	body := []byte(`{"amount": 1000}`)
+	req := httptest.NewRequest("POST", "/create-payment-intent", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	paymentHandler := NewPaymentHandler(provider.NewFake(provider.FakeDecline))
+	paymentHandler.CreatePaymentIntent(rr, req)
+
+	if rr.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 for declined payment, got %d", rr.Code)
 	}
-	test_key := os.Getenv("SECRET_KEY")
-	print("the key is: ", test_key)
-	header_input := "Bearer " + test_key
-	print("the test header stuff is: ", header_input)
+}
+
+func Test_ProviderTimeout(t *testing.T) {
+	fake := provider.NewFake(provider.FakeTimeout)
+	fake.Timeout = 10 * time.Millisecond
+
 	body := []byte(`{"amount": 1000}`)
 	req := httptest.NewRequest("POST", "/create-payment-intent", bytes.NewBuffer(body))
-	req.Header.Set("Authorization", header_input)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	paymentHandler := NewPaymentHandler(fake)
+	paymentHandler.CreatePaymentIntent(rr, req)
+
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 for provider timeout, got %d", rr.Code)
+	}
+}
+
+func TestCreatePaymentIntent_SuccessSimulated(t *testing.T) {
+	body := []byte(`{"amount": 1000, "reservation_key": "res-1"}`)
+	req := httptest.NewRequest("POST", "/create-payment-intent", bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
 
-	paymentHandler := NewPaymentHandler()
+	paymentHandler := NewPaymentHandler(provider.NewFake(provider.FakeSucceed))
 	paymentHandler.CreatePaymentIntent(rr, req)
 
 	if rr.Code != http.StatusOK {
 		t.Errorf("Expected 200 for successful payment intent, got %d", rr.Code)
 	}
 	var response map[string]string
-	err = json.NewDecoder(rr.Body).Decode(&response)
+	err := json.NewDecoder(rr.Body).Decode(&response)
 	if err != nil {
 		t.Errorf("Response JSON invalid: %v", err)
 	}
@@ -128,3 +150,17 @@ func TestCreatePaymentIntent_SuccessSimulated(t *testing.T) {
 		t.Errorf("Missing idempotency_key in response")
 	}
 }
+
+func Test_RefundUnknownIntent(t *testing.T) {
+	body := []byte(`{"payment_intent_id": "pi_missing"}`)
+	req := httptest.NewRequest("POST", "/refunds", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	paymentHandler := NewPaymentHandler(provider.NewFake(provider.FakeSucceed))
+	paymentHandler.RefundPayment(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown payment intent, got %d", rr.Code)
+	}
+}
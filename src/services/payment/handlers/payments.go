@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"payment/internal/db/models"
+	"payment/internal/db/repos"
+	"payment/internal/provider"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// PaymentsHandler serves the payments recorded by the payment service, for
+// support and reconciliation.
+type PaymentsHandler struct {
+	repo *repos.PaymentRepository
+}
+
+func NewPaymentsHandler(repo *repos.PaymentRepository) *PaymentsHandler {
+	return &PaymentsHandler{repo: repo}
+}
+
+type paymentWithLedger struct {
+	models.Payment
+	Ledger []models.LedgerEntry `json:"ledger"`
+}
+
+type ticketPayments struct {
+	TicketID int              `json:"ticket_id"`
+	Paid     bool             `json:"paid"`
+	Payments []models.Payment `json:"payments"`
+}
+
+// GetPayment returns a payment, looked up by its payment intent id, with
+// every status change it went through.
+func (h *PaymentsHandler) GetPayment(w http.ResponseWriter, r *http.Request) {
+	intentID := mux.Vars(r)["id"]
+
+	payment, err := h.repo.GetPaymentByIntentID(intentID)
+	if errors.Is(err, repos.ErrPaymentNotFound) {
+		http.Error(w, "payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Printf("Failed to load payment %s: %v", intentID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	ledger, err := h.repo.GetLedger(payment.PaymentID)
+	if err != nil {
+		logger.Printf("Failed to load ledger of payment %s: %v", intentID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(paymentWithLedger{Payment: *payment, Ledger: ledger})
+}
+
+// ListPayments returns the payments for the ticket in the ticket_id query
+// parameter, including those of orders it was bought in, and whether the
+// ticket is currently paid for.
+func (h *PaymentsHandler) ListPayments(w http.ResponseWriter, r *http.Request) {
+	ticketID, err := strconv.Atoi(r.URL.Query().Get("ticket_id"))
+	if err != nil || ticketID <= 0 {
+		http.Error(w, "ticket_id must be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	payments, err := h.repo.GetPaymentsByTicketID(ticketID)
+	if err != nil {
+		logger.Printf("Failed to load payments of ticket %d: %v", ticketID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := ticketPayments{TicketID: ticketID, Payments: payments}
+	for _, p := range payments {
+		if provider.Status(p.Status) == provider.StatusSucceeded {
+			response.Paid = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListPayouts returns what the seller in the seller_user_id query parameter
+// is owed for tickets they sold on the resale market.
+func (h *PaymentsHandler) ListPayouts(w http.ResponseWriter, r *http.Request) {
+	sellerUserID, err := strconv.Atoi(r.URL.Query().Get("seller_user_id"))
+	if err != nil || sellerUserID <= 0 {
+		http.Error(w, "seller_user_id must be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	payouts, err := h.repo.GetPayoutsBySeller(sellerUserID)
+	if err != nil {
+		logger.Printf("Failed to load payouts of user %d: %v", sellerUserID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"seller_user_id": sellerUserID, "payouts": payouts})
+}
@@ -1,38 +1,77 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"payment/internal/provider"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/stripe/stripe-go"
 	"github.com/stripe/stripe-go/webhook"
 	brokerPkg "tixie.local/broker"
+	"tixie.local/broker/dedupe"
+	"tixie.local/broker/events"
 	circuitbreaker "tixie.local/common"
 )
 
-type WebhookHandler struct {
-	broker  *brokerPkg.Broker
-	breaker *circuitbreaker.Breaker
+// publishConfirmTimeout is how long to wait for RabbitMQ to confirm a
+// published message.
+const publishConfirmTimeout = 5 * time.Second
+
+// producer identifies the payment service in the envelopes it publishes.
+const producer = "payment-service"
+
+// webhookConsumer is the name Stripe event ids are remembered under, so a
+// replayed or redelivered webhook is only acted on once.
+const webhookConsumer = "stripe_webhook"
+
+// eventPublisher publishes events to the broker.
+type eventPublisher interface {
+	PublishEvent(producer, correlationID string, e events.Event) error
 }
 
-type EmailMessage struct {
-	RecipientEmail string `json:"recipient_email"`
-	TicketID       string `json:"ticket_id"`
+type WebhookHandler struct {
+	publisher eventPublisher
+	provider  provider.PaymentProvider
+	ledger    provider.Ledger
+	processed dedupe.Store
+	secret    string
+	breaker   *circuitbreaker.Breaker
 }
 
-func NewWebhookHandler() *WebhookHandler {
-	broker, err := brokerPkg.NewBroker(os.Getenv("RABBITMQ_URL"), "notification", "topic")
+// NewWebhookHandler creates a handler for Stripe webhooks signed with
+// secret. Status changes are recorded in ledger, and processed remembers the
+// Stripe events already handled.
+func NewWebhookHandler(p provider.PaymentProvider, ledger provider.Ledger, processed dedupe.Store, secret string) *WebhookHandler {
+	h := &WebhookHandler{
+		provider:  p,
+		ledger:    ledger,
+		processed: processed,
+		secret:    secret,
+		breaker:   circuitbreaker.NewBreaker("payment-webhook-service"),
+	}
+
+	broker, err := brokerPkg.NewBroker(os.Getenv("RABBITMQ_URL"), "tixie", "topic")
 	if err != nil {
 		logger.Printf("Warning: Failed to create broker: %v", err)
+		return h
 	}
-
-	return &WebhookHandler{
-		broker:  broker,
-		breaker: circuitbreaker.NewBreaker("payment-webhook-service"),
+	if err := broker.EnableConfirms(publishConfirmTimeout); err != nil {
+		logger.Printf("Warning: Failed to enable publisher confirms: %v", err)
 	}
+	h.publisher = broker
+	return h
 }
 
+// StripeWebhook verifies a Stripe event and publishes payment.confirmed or
+// payment.failed for the ticket the payment intent belongs to. Any error
+// makes Stripe deliver the event again later.
 func (h *WebhookHandler) StripeWebhook(w http.ResponseWriter, r *http.Request) {
 	const MaxBodyBytes = int64(65536)
 	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
@@ -43,70 +82,187 @@ func (h *WebhookHandler) StripeWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sigHeader := r.Header.Get("Stripe-Signature")
-	secret := os.Getenv("SECRET_KEY")
-
-	result := h.breaker.Execute(func() (interface{}, error) {
-		event, err := webhook.ConstructEvent(payload, sigHeader, secret)
-		if err != nil {
-			return nil, fmt.Errorf("webhook signature verification failed: %v", err)
-		}
+	if h.secret == "" {
+		logger.Println("Webhook error: STRIPE_WEBHOOK_SECRET is not set")
+		http.Error(w, "Webhook not configured", http.StatusServiceUnavailable)
+		return
+	}
 
-		if event.Type == "payment_intent.succeeded" {
-			logger.Printf("PaymentIntent %s succeeded", event.ID)
-		}
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), h.secret)
+	if err != nil {
+		logger.Printf("Webhook signature verification failed: %v", err)
+		http.Error(w, "webhook signature verification failed", http.StatusBadRequest)
+		return
+	}
 
-		return event, nil
-	})
+	processed, err := h.processed.Processed(webhookConsumer, event.ID)
+	if err != nil {
+		logger.Printf("Webhook error: failed to look up event %s: %v", event.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if processed {
+		logger.Printf("Skipping Stripe event %s, already processed", event.ID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
-	if result.Error != nil {
-		logger.Printf("Webhook error: %v", result.Error)
+	msg, correlationID, err := h.paymentEvent(r.Context(), event)
+	if err != nil {
+		logger.Printf("Webhook error: failed to handle %s event %s: %v", event.Type, event.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		if circuitbreaker.IsCircuitBreakerError(result.Error) {
-			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
-			http.Error(w, msg, status)
+	if msg != nil {
+		if h.publisher == nil {
+			http.Error(w, "Message broker not available", http.StatusServiceUnavailable)
 			return
 		}
 
-		http.Error(w, result.Error.Error(), http.StatusBadRequest)
-		return
+		result := h.breaker.Execute(func() (interface{}, error) {
+			if err := h.publisher.PublishEvent(producer, correlationID, msg); err != nil {
+				return nil, fmt.Errorf("failed to publish %s: %v", msg.EventType(), err)
+			}
+			return nil, nil
+		})
+		if result.Error != nil {
+			logger.Printf("Webhook error: %v", result.Error)
+			if circuitbreaker.IsCircuitBreakerError(result.Error) {
+				status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+				http.Error(w, msg, status)
+				return
+			}
+			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Printf("Published %s for Stripe event %s", msg.EventType(), event.ID)
 	}
 
+	// The event was handled, so a failure here must not make Stripe retry.
+	if err := h.processed.MarkProcessed(webhookConsumer, event.ID, dedupe.DefaultTTL); err != nil {
+		logger.Printf("Webhook error: failed to mark event %s processed: %v", event.ID, err)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *WebhookHandler) SimulateWebhook(w http.ResponseWriter, r *http.Request) {
-	logger.Println("Simulated PaymentIntent succeeded")
+// paymentEvent maps a Stripe event onto the event to publish and its
+// correlation id. It returns a nil event for Stripe events that need no
+// action.
+func (h *WebhookHandler) paymentEvent(ctx context.Context, event stripe.Event) (events.Event, string, error) {
+	switch event.Type {
+	case "payment_intent.succeeded", "payment_intent.payment_failed", "payment_intent.canceled":
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return nil, "", fmt.Errorf("failed to parse payment intent: %v", err)
+		}
 
-	if h.broker == nil {
-		http.Error(w, "Message broker not available", http.StatusServiceUnavailable)
-		return
-	}
+		h.recordStatus(pi.ID, provider.Status(pi.Status), event.Type)
 
-	result := h.breaker.Execute(func() (interface{}, error) {
-		msg := EmailMessage{
-			RecipientEmail: "leaguedo@gmail.com",
-			TicketID:       "abc-123-ticket",
+		ticketID, correlationID, ok := purchaseFromMetadata(pi.Metadata)
+		if !ok {
+			logger.Printf("Ignoring %s for payment intent %s without a ticket or reservation", event.Type, pi.ID)
+			return nil, "", nil
 		}
-		if err := h.broker.Publish(msg, "email"); err != nil {
-			return nil, fmt.Errorf("failed to publish email notification: %v", err)
+
+		switch event.Type {
+		case "payment_intent.succeeded":
+			return &events.PaymentConfirmed{
+				TicketID:        ticketID,
+				Amount:          pi.Amount,
+				Currency:        strings.ToUpper(string(pi.Currency)),
+				PaymentIntentID: pi.ID,
+				ReservationKey:  correlationID,
+			}, correlationID, nil
+		case "payment_intent.payment_failed":
+			failed := &events.PaymentFailed{
+				TicketID:        ticketID,
+				PaymentIntentID: pi.ID,
+				ReservationKey:  correlationID,
+				Reason:          events.PaymentFailureDeclined,
+			}
+			if pi.LastPaymentError != nil {
+				failed.Message = pi.LastPaymentError.Msg
+			}
+			return failed, correlationID, nil
+		default:
+			return &events.PaymentFailed{
+				TicketID:        ticketID,
+				PaymentIntentID: pi.ID,
+				ReservationKey:  correlationID,
+				Reason:          events.PaymentFailureCanceled,
+				Message:         string(pi.CancellationReason),
+			}, correlationID, nil
 		}
-		return nil, nil
-	})
 
-	if result.Error != nil {
-		logger.Printf("Failed to publish notification: %v", result.Error)
+	case "charge.refunded":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return nil, "", fmt.Errorf("failed to parse charge: %v", err)
+		}
+		if charge.PaymentIntent == "" {
+			return nil, "", nil
+		}
 
-		if circuitbreaker.IsCircuitBreakerError(result.Error) {
-			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
-			http.Error(w, msg, status)
-			return
+		// Refunds issued from the Stripe dashboard never went through the
+		// refund endpoint, so record them here.
+		if h.ledger != nil && charge.Refunds != nil {
+			for _, refund := range charge.Refunds.Data {
+				err := h.ledger.RecordRefund(&provider.Refund{
+					ID:       refund.ID,
+					IntentID: charge.PaymentIntent,
+					Amount:   refund.Amount,
+					Status:   string(refund.Status),
+				})
+				if err != nil {
+					logger.Printf("Failed to record refund %s of payment intent %s: %v", refund.ID, charge.PaymentIntent, err)
+				}
+			}
+		}
+
+		// Partially refunded tickets stay paid for.
+		if !charge.Refunded {
+			return nil, "", nil
+		}
+
+		// Charges do not carry the intent's metadata, so look it up.
+		pi, err := h.provider.Status(ctx, charge.PaymentIntent)
+		if err != nil {
+			return nil, "", err
+		}
+		ticketID, reservationKey, ok := purchaseFromMetadata(pi.Metadata)
+		if !ok {
+			logger.Printf("Ignoring refund of payment intent %s without a ticket or reservation", pi.ID)
+			return nil, "", nil
 		}
+		return &events.PaymentFailed{
+			TicketID:        ticketID,
+			PaymentIntentID: pi.ID,
+			ReservationKey:  reservationKey,
+			Reason:          events.PaymentFailureRefunded,
+		}, reservationKey, nil
+	}
 
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+	return nil, "", nil
+}
+
+func (h *WebhookHandler) recordStatus(intentID string, status provider.Status, note string) {
+	if h.ledger == nil {
 		return
 	}
+	if err := h.ledger.RecordStatus(intentID, status, note); err != nil {
+		logger.Printf("Failed to record status %s of payment intent %s: %v", status, intentID, err)
+	}
+}
 
-	logger.Println("Published email notification to notification-service successfully.")
-	w.WriteHeader(http.StatusOK)
+// purchaseFromMetadata returns what an intent pays for: a ticket, a
+// reservation or both. Orders pay for several tickets under a single
+// reservation key, so their intents carry no ticket.
+func purchaseFromMetadata(metadata map[string]string) (int, string, bool) {
+	ticketID, err := strconv.Atoi(metadata[provider.MetadataTicketID])
+	if err != nil || ticketID < 0 {
+		ticketID = 0
+	}
+	reservationKey := metadata[provider.MetadataReservationKey]
+	return ticketID, reservationKey, ticketID > 0 || reservationKey != ""
 }
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"payment/internal/provider"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/webhook"
+	"tixie.local/broker/dedupe"
+	"tixie.local/broker/events"
+	circuitbreaker "tixie.local/common"
+)
+
+const testWebhookSecret = "whsec_test"
+
+type recordingPublisher struct {
+	published []events.Event
+}
+
+func (p *recordingPublisher) PublishEvent(producer, correlationID string, e events.Event) error {
+	p.published = append(p.published, e)
+	return nil
+}
+
+func newTestWebhookHandler(publisher eventPublisher) *WebhookHandler {
+	return &WebhookHandler{
+		publisher: publisher,
+		provider:  provider.NewFake(provider.FakeSucceed),
+		processed: dedupe.NewMemoryStore(),
+		secret:    testWebhookSecret,
+		breaker:   circuitbreaker.NewBreaker("payment-webhook-test"),
+	}
+}
+
+func signedWebhookRequest(payload []byte, secret string) *http.Request {
+	now := time.Now()
+	signature := hex.EncodeToString(webhook.ComputeSignature(now, payload, secret))
+
+	req := httptest.NewRequest("POST", "/webhook", bytes.NewBuffer(payload))
+	req.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), signature))
+	return req
+}
+
+func intentEvent(eventID, eventType, status string) []byte {
+	return intentEventWithMetadata(eventID, eventType, status, `{"ticket_id": "42", "reservation_key": "reservation-saga-7"}`)
+}
+
+func intentEventWithMetadata(eventID, eventType, status, metadata string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"id": %q,
+		"object": "event",
+		"type": %q,
+		"data": {"object": {
+			"id": "pi_123",
+			"object": "payment_intent",
+			"amount": 1500,
+			"status": %q,
+			"metadata": %s
+		}}
+	}`, eventID, eventType, status, metadata))
+}
+
+func TestStripeWebhook_InvalidSignature(t *testing.T) {
+	publisher := &recordingPublisher{}
+	h := newTestWebhookHandler(publisher)
+
+	rr := httptest.NewRecorder()
+	h.StripeWebhook(rr, signedWebhookRequest(intentEvent("evt_1", "payment_intent.succeeded", "succeeded"), "whsec_wrong"))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad signature, got %d", rr.Code)
+	}
+	if len(publisher.published) != 0 {
+		t.Errorf("Published %d events for an unverified webhook", len(publisher.published))
+	}
+}
+
+func TestStripeWebhook_SucceededIsPublishedOnce(t *testing.T) {
+	publisher := &recordingPublisher{}
+	h := newTestWebhookHandler(publisher)
+	payload := intentEvent("evt_2", "payment_intent.succeeded", "succeeded")
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		h.StripeWebhook(rr, signedWebhookRequest(payload, testWebhookSecret))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for delivery %d, got %d", i+1, rr.Code)
+		}
+	}
+
+	if len(publisher.published) != 1 {
+		t.Fatalf("Expected the replayed event to be published once, got %d", len(publisher.published))
+	}
+	confirmed, ok := publisher.published[0].(*events.PaymentConfirmed)
+	if !ok {
+		t.Fatalf("Expected *events.PaymentConfirmed, got %T", publisher.published[0])
+	}
+	if confirmed.TicketID != 42 || confirmed.Amount != 1500 || confirmed.PaymentIntentID != "pi_123" {
+		t.Errorf("Unexpected confirmation: %+v", confirmed)
+	}
+}
+
+func TestStripeWebhook_FailedAndCanceled(t *testing.T) {
+	cases := map[string]string{
+		"payment_intent.payment_failed": events.PaymentFailureDeclined,
+		"payment_intent.canceled":       events.PaymentFailureCanceled,
+	}
+	for eventType, reason := range cases {
+		publisher := &recordingPublisher{}
+		h := newTestWebhookHandler(publisher)
+
+		rr := httptest.NewRecorder()
+		h.StripeWebhook(rr, signedWebhookRequest(intentEvent("evt_"+eventType, eventType, "canceled"), testWebhookSecret))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", eventType, rr.Code)
+		}
+		if len(publisher.published) != 1 {
+			t.Fatalf("%s: expected one event, got %d", eventType, len(publisher.published))
+		}
+		failed, ok := publisher.published[0].(*events.PaymentFailed)
+		if !ok || failed.TicketID != 42 || failed.Reason != reason {
+			t.Errorf("%s: unexpected event %+v", eventType, publisher.published[0])
+		}
+	}
+}
+
+func TestStripeWebhook_OrderWithoutTicket(t *testing.T) {
+	publisher := &recordingPublisher{}
+	h := newTestWebhookHandler(publisher)
+
+	rr := httptest.NewRecorder()
+	payload := intentEventWithMetadata("evt_3", "payment_intent.succeeded", "succeeded", `{"ticket_id": "0", "reservation_key": "order-9"}`)
+	h.StripeWebhook(rr, signedWebhookRequest(payload, testWebhookSecret))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rr.Code)
+	}
+
+	if len(publisher.published) != 1 {
+		t.Fatalf("Expected one event, got %d", len(publisher.published))
+	}
+	confirmed, ok := publisher.published[0].(*events.PaymentConfirmed)
+	if !ok || confirmed.TicketID != 0 || confirmed.ReservationKey != "order-9" {
+		t.Errorf("Unexpected event %+v", publisher.published[0])
+	}
+}
+
+func TestStripeWebhook_IgnoresUnknownIntents(t *testing.T) {
+	publisher := &recordingPublisher{}
+	h := newTestWebhookHandler(publisher)
+
+	rr := httptest.NewRecorder()
+	h.StripeWebhook(rr, signedWebhookRequest(intentEventWithMetadata("evt_4", "payment_intent.succeeded", "succeeded", `{}`), testWebhookSecret))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rr.Code)
+	}
+	if len(publisher.published) != 0 {
+		t.Errorf("Published %d events for an intent that pays for nothing", len(publisher.published))
+	}
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq" // postgres driver
+)
+
+// NewDB initializes a new database connection using sqlx.
+func NewDB() *sqlx.DB {
+	connStr := fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		os.Getenv("DB_HOST_PAYMENT"),
+		os.Getenv("DB_PORT_PAYMENT"),
+		os.Getenv("DB_USER_PAYMENT"),
+		os.Getenv("DB_PASSWORD_PAYMENT"),
+		os.Getenv("DB_NAME_PAYMENT"),
+		os.Getenv("DB_SSLMODE_PAYMENT"),
+	)
+	db, err := sqlx.Open("postgres", connStr)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+
+	if err = db.Ping(); err != nil {
+		log.Fatalf("Failed to ping database: %v", err)
+	}
+
+	log.Println("Successfully connected to payment_db")
+	return db
+}
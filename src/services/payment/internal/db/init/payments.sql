@@ -0,0 +1,76 @@
+CREATE TABLE payments (
+    payment_id SERIAL PRIMARY KEY,
+    intent_id TEXT NOT NULL UNIQUE,
+    ticket_id INTEGER NOT NULL DEFAULT 0,
+    reservation_key TEXT NOT NULL DEFAULT '',
+    amount BIGINT NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    status VARCHAR(30) NOT NULL,
+    refunded_amount BIGINT NOT NULL DEFAULT 0,
+    idempotency_key TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT refund_within_amount CHECK (refunded_amount >= 0 AND refunded_amount <= amount)
+);
+
+CREATE INDEX idx_payments_ticket_id ON payments (ticket_id);
+
+-- The tickets an order's payment pays for, and each one's share of it.
+-- Payments for a single ticket have none and use payments.ticket_id.
+CREATE TABLE payment_items (
+    payment_id INTEGER NOT NULL REFERENCES payments (payment_id),
+    ticket_id INTEGER NOT NULL,
+    amount BIGINT NOT NULL,
+    PRIMARY KEY (payment_id, ticket_id)
+);
+
+CREATE INDEX idx_payment_items_ticket_id ON payment_items (ticket_id);
+
+-- Every change to a payment, in order. Entries are only ever inserted.
+CREATE TABLE payment_ledger (
+    entry_id SERIAL PRIMARY KEY,
+    payment_id INTEGER NOT NULL REFERENCES payments (payment_id),
+    from_status VARCHAR(30) NOT NULL DEFAULT '',
+    to_status VARCHAR(30) NOT NULL,
+    amount BIGINT NOT NULL DEFAULT 0,
+    -- Provider id of what caused the entry, e.g. a refund, so that replays
+    -- are only recorded once.
+    reference TEXT NOT NULL DEFAULT '',
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_payment_ledger_payment_id ON payment_ledger (payment_id, entry_id);
+CREATE UNIQUE INDEX idx_payment_ledger_reference ON payment_ledger (reference) WHERE reference <> '';
+
+-- What sellers are owed for tickets sold on the resale market, one row per
+-- listing. Payouts are sent to sellers outside of the payment provider.
+CREATE TABLE payouts (
+    payout_id SERIAL PRIMARY KEY,
+    listing_id INTEGER NOT NULL UNIQUE,
+    ticket_id INTEGER NOT NULL,
+    seller_user_id INTEGER NOT NULL,
+    intent_id TEXT NOT NULL DEFAULT '',
+    gross_amount BIGINT NOT NULL,
+    fee BIGINT NOT NULL,
+    amount BIGINT NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT payout_within_gross CHECK (fee >= 0 AND amount >= 0 AND fee + amount = gross_amount),
+    CONSTRAINT valid_payout_status CHECK (status IN ('pending', 'paid'))
+);
+
+CREATE INDEX idx_payouts_seller ON payouts (seller_user_id, payout_id);
+
+-- Messages and webhook events the service has handled, so redeliveries are
+-- skipped. See dedupe.PostgresStore.
+CREATE TABLE processed_messages (
+    consumer VARCHAR(100) NOT NULL,
+    message_id VARCHAR(100) NOT NULL,
+    processed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (consumer, message_id)
+);
+
+CREATE INDEX idx_processed_messages_expires_at ON processed_messages (expires_at);
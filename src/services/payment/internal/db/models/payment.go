@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+// Payment is a payment intent as recorded by the payment service. Amounts
+// are in the smallest unit of Currency.
+type Payment struct {
+	PaymentID      int       `db:"payment_id" json:"payment_id"`
+	IntentID       string    `db:"intent_id" json:"intent_id"`
+	TicketID       int       `db:"ticket_id" json:"ticket_id"`
+	ReservationKey string    `db:"reservation_key" json:"reservation_key"`
+	Amount         int64     `db:"amount" json:"amount"`
+	Currency       string    `db:"currency" json:"currency"`
+	Status         string    `db:"status" json:"status"`
+	RefundedAmount int64     `db:"refunded_amount" json:"refunded_amount"`
+	IdempotencyKey string    `db:"idempotency_key" json:"idempotency_key"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// LedgerEntry records one change to a payment.
+type LedgerEntry struct {
+	EntryID    int       `db:"entry_id" json:"entry_id"`
+	PaymentID  int       `db:"payment_id" json:"payment_id"`
+	FromStatus string    `db:"from_status" json:"from_status"`
+	ToStatus   string    `db:"to_status" json:"to_status"`
+	Amount     int64     `db:"amount" json:"amount"`
+	Reference  string    `db:"reference" json:"reference,omitempty"`
+	Note       string    `db:"note" json:"note,omitempty"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+// Payout is what a seller is owed for a ticket sold on the resale market:
+// the price the buyer paid, GrossAmount, less the platform's Fee.
+type Payout struct {
+	PayoutID     int       `db:"payout_id" json:"payout_id"`
+	ListingID    int       `db:"listing_id" json:"listing_id"`
+	TicketID     int       `db:"ticket_id" json:"ticket_id"`
+	SellerUserID int       `db:"seller_user_id" json:"seller_user_id"`
+	IntentID     string    `db:"intent_id" json:"intent_id"`
+	GrossAmount  int64     `db:"gross_amount" json:"gross_amount"`
+	Fee          int64     `db:"fee" json:"fee"`
+	Amount       int64     `db:"amount" json:"amount"`
+	Currency     string    `db:"currency" json:"currency"`
+	Status       string    `db:"status" json:"status"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+}
@@ -0,0 +1,237 @@
+package repos
+
+import (
+	"database/sql"
+	"errors"
+	"payment/internal/db/models"
+	"payment/internal/provider"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrPaymentNotFound is returned for payment intents that were never
+// recorded.
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// PaymentRepository stores payments and their ledger. It is the payment
+// service's provider.Ledger.
+type PaymentRepository struct {
+	db *sqlx.DB
+}
+
+// NewPaymentRepository creates a new PaymentRepository.
+func NewPaymentRepository(db *sqlx.DB) *PaymentRepository {
+	return &PaymentRepository{db: db}
+}
+
+// RecordIntent records a newly created payment intent together with its
+// first ledger entry. The ticket and reservation come from the intent's
+// metadata, the tickets of an order from its items.
+func (r *PaymentRepository) RecordIntent(req provider.IntentRequest, intent *provider.Intent) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ticketID, _ := strconv.Atoi(req.Metadata[provider.MetadataTicketID])
+
+	var paymentID int
+	err = tx.QueryRow(`
+		INSERT INTO payments (intent_id, ticket_id, reservation_key, amount, currency, status, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (intent_id) DO NOTHING
+		RETURNING payment_id`,
+		intent.ID, ticketID, req.Metadata[provider.MetadataReservationKey], intent.Amount, intent.Currency, intent.Status, req.IdempotencyKey,
+	).Scan(&paymentID)
+	if err == sql.ErrNoRows {
+		// Already recorded, e.g. a retry with the same idempotency key.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, item := range req.Items {
+		_, err := tx.Exec(
+			"INSERT INTO payment_items (payment_id, ticket_id, amount) VALUES ($1, $2, $3)",
+			paymentID, item.TicketID, item.Amount,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := insertLedgerEntry(tx, models.LedgerEntry{
+		PaymentID: paymentID,
+		ToStatus:  string(intent.Status),
+		Amount:    intent.Amount,
+		Note:      "created",
+	}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordStatus moves a payment to status and adds a ledger entry for the
+// transition. Unchanged statuses are not recorded, and a refunded payment
+// is not moved back to succeeded, which is what the provider keeps
+// reporting for it.
+func (r *PaymentRepository) RecordStatus(intentID string, status provider.Status, note string) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	payment, err := lockPayment(tx, intentID)
+	if err != nil {
+		return err
+	}
+
+	current := provider.Status(payment.Status)
+	if current == status {
+		return nil
+	}
+	if status == provider.StatusSucceeded && (current == provider.StatusRefunded || current == provider.StatusPartiallyRefunded) {
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE payments SET status=$1, updated_at=NOW() WHERE payment_id=$2", status, payment.PaymentID); err != nil {
+		return err
+	}
+	if err := insertLedgerEntry(tx, models.LedgerEntry{
+		PaymentID:  payment.PaymentID,
+		FromStatus: payment.Status,
+		ToStatus:   string(status),
+		Note:       note,
+	}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordRefund adds a refund to its payment. A refund that was already
+// recorded is ignored, so replays do not count it twice.
+func (r *PaymentRepository) RecordRefund(refund *provider.Refund) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	payment, err := lockPayment(tx, refund.IntentID)
+	if err != nil {
+		return err
+	}
+
+	refunded := payment.RefundedAmount + refund.Amount
+	status := provider.StatusPartiallyRefunded
+	if refunded >= payment.Amount {
+		status = provider.StatusRefunded
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO payment_ledger (payment_id, from_status, to_status, amount, reference, note)
+		VALUES ($1, $2, $3, $4, $5, 'refund')
+		ON CONFLICT (reference) WHERE reference <> '' DO NOTHING`,
+		payment.PaymentID, payment.Status, status, -refund.Amount, refund.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE payments SET refunded_amount=$1, status=$2, updated_at=NOW() WHERE payment_id=$3",
+		refunded, status, payment.PaymentID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPaymentByIntentID retrieves a payment by its payment intent id.
+func (r *PaymentRepository) GetPaymentByIntentID(intentID string) (*models.Payment, error) {
+	var payment models.Payment
+	err := r.db.Get(&payment, "SELECT * FROM payments WHERE intent_id = $1", intentID)
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// GetPaymentsByTicketID retrieves every payment for a ticket, oldest first,
+// including the payments of orders the ticket was part of.
+func (r *PaymentRepository) GetPaymentsByTicketID(ticketID int) ([]models.Payment, error) {
+	payments := []models.Payment{}
+	err := r.db.Select(&payments, `
+		SELECT * FROM payments
+		WHERE ticket_id = $1 OR payment_id IN (SELECT payment_id FROM payment_items WHERE ticket_id = $1)
+		ORDER BY payment_id`,
+		ticketID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+// GetLedger retrieves the ledger entries of a payment in the order they
+// were recorded.
+func (r *PaymentRepository) GetLedger(paymentID int) ([]models.LedgerEntry, error) {
+	entries := []models.LedgerEntry{}
+	err := r.db.Select(&entries, "SELECT * FROM payment_ledger WHERE payment_id = $1 ORDER BY entry_id", paymentID)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// RecordPayout records what a seller is owed for a resale. A payout is
+// recorded once per listing, so replaying a settlement is harmless.
+func (r *PaymentRepository) RecordPayout(payout *models.Payout) error {
+	_, err := r.db.Exec(`
+		INSERT INTO payouts (listing_id, ticket_id, seller_user_id, intent_id, gross_amount, fee, amount, currency)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (listing_id) DO NOTHING`,
+		payout.ListingID, payout.TicketID, payout.SellerUserID, payout.IntentID, payout.GrossAmount, payout.Fee, payout.Amount, payout.Currency,
+	)
+	return err
+}
+
+// GetPayoutsBySeller retrieves every payout owed to a seller, oldest first.
+func (r *PaymentRepository) GetPayoutsBySeller(sellerUserID int) ([]models.Payout, error) {
+	payouts := []models.Payout{}
+	err := r.db.Select(&payouts, "SELECT * FROM payouts WHERE seller_user_id = $1 ORDER BY payout_id", sellerUserID)
+	if err != nil {
+		return nil, err
+	}
+	return payouts, nil
+}
+
+func lockPayment(tx *sqlx.Tx, intentID string) (*models.Payment, error) {
+	var payment models.Payment
+	err := tx.Get(&payment, "SELECT * FROM payments WHERE intent_id = $1 FOR UPDATE", intentID)
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func insertLedgerEntry(tx *sqlx.Tx, entry models.LedgerEntry) error {
+	_, err := tx.Exec(
+		"INSERT INTO payment_ledger (payment_id, from_status, to_status, amount, reference, note) VALUES ($1, $2, $3, $4, $5, $6)",
+		entry.PaymentID, entry.FromStatus, entry.ToStatus, entry.Amount, entry.Reference, entry.Note,
+	)
+	return err
+}
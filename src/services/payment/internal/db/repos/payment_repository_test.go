@@ -0,0 +1,178 @@
+package repos
+
+import (
+	"fmt"
+	"os"
+	"payment/internal/db/models"
+	"payment/internal/provider"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// newTestRepository connects to the database in PAYMENT_TEST_DATABASE_URL and
+// loads the schema into a throwaway Postgres schema. The tests are skipped
+// when the variable is not set.
+func newTestRepository(t *testing.T) *PaymentRepository {
+	t.Helper()
+
+	dsn := os.Getenv("PAYMENT_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("PAYMENT_TEST_DATABASE_URL not set, skipping database test")
+	}
+
+	admin, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("payment_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	db, err := sqlx.Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ddl, err := os.ReadFile("../init/payments.sql")
+	if err != nil {
+		t.Fatalf("failed to read schema: %v", err)
+	}
+	if _, err := db.Exec(string(ddl)); err != nil {
+		t.Fatalf("failed to load schema: %v", err)
+	}
+
+	return NewPaymentRepository(db)
+}
+
+func TestPaymentLedger_RecordsTransitionsOnce(t *testing.T) {
+	repo := newTestRepository(t)
+
+	req := provider.IntentRequest{
+		Amount:         2000,
+		Currency:       "USD",
+		IdempotencyKey: "payment-reservation-saga-1",
+		Metadata: map[string]string{
+			provider.MetadataTicketID:       "7",
+			provider.MetadataReservationKey: "reservation-saga-1",
+		},
+	}
+	intent := &provider.Intent{ID: "pi_1", Amount: 2000, Currency: "USD", Status: provider.StatusRequiresPaymentMethod}
+
+	for i := 0; i < 2; i++ {
+		if err := repo.RecordIntent(req, intent); err != nil {
+			t.Fatalf("record intent attempt %d failed: %v", i+1, err)
+		}
+	}
+	if err := repo.RecordStatus("pi_1", provider.StatusSucceeded, "payment_intent.succeeded"); err != nil {
+		t.Fatalf("record status failed: %v", err)
+	}
+
+	refund := &provider.Refund{ID: "re_1", IntentID: "pi_1", Amount: 500}
+	for i := 0; i < 2; i++ {
+		if err := repo.RecordRefund(refund); err != nil {
+			t.Fatalf("record refund attempt %d failed: %v", i+1, err)
+		}
+	}
+
+	// The provider keeps reporting refunded intents as succeeded.
+	if err := repo.RecordStatus("pi_1", provider.StatusSucceeded, "status check"); err != nil {
+		t.Fatalf("record status failed: %v", err)
+	}
+
+	payment, err := repo.GetPaymentByIntentID("pi_1")
+	if err != nil {
+		t.Fatalf("failed to load payment: %v", err)
+	}
+	if payment.TicketID != 7 || payment.RefundedAmount != 500 || payment.Status != string(provider.StatusPartiallyRefunded) {
+		t.Errorf("unexpected payment: %+v", payment)
+	}
+
+	ledger, err := repo.GetLedger(payment.PaymentID)
+	if err != nil {
+		t.Fatalf("failed to load ledger: %v", err)
+	}
+	if len(ledger) != 3 {
+		t.Fatalf("expected 3 ledger entries (created, succeeded, refund), got %d: %+v", len(ledger), ledger)
+	}
+
+	payments, err := repo.GetPaymentsByTicketID(7)
+	if err != nil {
+		t.Fatalf("failed to list payments: %v", err)
+	}
+	if len(payments) != 1 {
+		t.Errorf("expected 1 payment for ticket 7, got %d", len(payments))
+	}
+}
+
+func TestGetPaymentsByTicketID_FindsOrderPayments(t *testing.T) {
+	repo := newTestRepository(t)
+
+	req := provider.IntentRequest{
+		Amount:         2500,
+		Currency:       "USD",
+		IdempotencyKey: "payment-order-saga-1",
+		Metadata: map[string]string{
+			provider.MetadataTicketID:       "0",
+			provider.MetadataReservationKey: "order-saga-1",
+		},
+		Items: []provider.LineItem{{TicketID: 8, Amount: 1000}, {TicketID: 9, Amount: 1500}},
+	}
+	intent := &provider.Intent{ID: "pi_order", Amount: 2500, Currency: "USD", Status: provider.StatusSucceeded}
+	for i := 0; i < 2; i++ {
+		if err := repo.RecordIntent(req, intent); err != nil {
+			t.Fatalf("record intent attempt %d failed: %v", i+1, err)
+		}
+	}
+
+	for _, ticketID := range []int{8, 9} {
+		payments, err := repo.GetPaymentsByTicketID(ticketID)
+		if err != nil {
+			t.Fatalf("failed to list payments of ticket %d: %v", ticketID, err)
+		}
+		if len(payments) != 1 || payments[0].IntentID != "pi_order" {
+			t.Errorf("payments of ticket %d = %+v, want the order's payment", ticketID, payments)
+		}
+	}
+	if payments, err := repo.GetPaymentsByTicketID(0); err != nil || len(payments) != 0 {
+		t.Errorf("payments of ticket 0 = %+v (%v), want none", payments, err)
+	}
+}
+
+func TestRecordPayout_OncePerListing(t *testing.T) {
+	repo := newTestRepository(t)
+
+	payout := &models.Payout{
+		ListingID:    3,
+		TicketID:     7,
+		SellerUserID: 11,
+		IntentID:     "pi_2",
+		GrossAmount:  2200,
+		Fee:          220,
+		Amount:       1980,
+		Currency:     "USD",
+	}
+	for i := 0; i < 2; i++ {
+		if err := repo.RecordPayout(payout); err != nil {
+			t.Fatalf("record payout attempt %d failed: %v", i+1, err)
+		}
+	}
+
+	payouts, err := repo.GetPayoutsBySeller(11)
+	if err != nil {
+		t.Fatalf("failed to list payouts: %v", err)
+	}
+	if len(payouts) != 1 {
+		t.Fatalf("expected 1 payout, got %d: %+v", len(payouts), payouts)
+	}
+	if payouts[0].Amount != 1980 || payouts[0].Status != "pending" {
+		t.Errorf("unexpected payout: %+v", payouts[0])
+	}
+}
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/uuid"
+	"tixie.local/common/paymentmethod"
+)
+
+// cashIntentPrefix marks the ids of cash on arrival intents.
+const cashIntentPrefix = "cash_"
+
+// WithCashOnArrival returns a provider that takes cash on arrival payments
+// itself and passes every other payment on to card. Cash intents are
+// created pending at the door and are confirmed once the money has been
+// collected. Nothing is charged, so the ledger is their only record.
+func WithCashOnArrival(card PaymentProvider) PaymentProvider {
+	return &methodRouter{card: card, cash: cashOnArrival{}}
+}
+
+type methodRouter struct {
+	card PaymentProvider
+	cash PaymentProvider
+}
+
+func (m *methodRouter) route(intentID string) PaymentProvider {
+	if strings.HasPrefix(intentID, cashIntentPrefix) {
+		return m.cash
+	}
+	return m.card
+}
+
+func (m *methodRouter) CreateIntent(ctx context.Context, req IntentRequest) (*Intent, error) {
+	if req.PaymentMethod == paymentmethod.CashOnArrival {
+		return m.cash.CreateIntent(ctx, req)
+	}
+	return m.card.CreateIntent(ctx, req)
+}
+
+func (m *methodRouter) Confirm(ctx context.Context, intentID string) (*Intent, error) {
+	return m.route(intentID).Confirm(ctx, intentID)
+}
+
+func (m *methodRouter) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	return m.route(req.IntentID).Refund(ctx, req)
+}
+
+func (m *methodRouter) Status(ctx context.Context, intentID string) (*Intent, error) {
+	return m.route(intentID).Status(ctx, intentID)
+}
+
+// cashOnArrival is paid at the door. Its intent ids derive from the
+// idempotency key, so creating an intent again with the same key returns the
+// same id.
+type cashOnArrival struct{}
+
+func (cashOnArrival) CreateIntent(ctx context.Context, req IntentRequest) (*Intent, error) {
+	key := req.IdempotencyKey
+	if key == "" {
+		key = uuid.New().String()
+	}
+	return &Intent{
+		ID:       cashIntentPrefix + key,
+		Amount:   req.Amount,
+		Currency: req.Currency,
+		Status:   StatusPendingAtDoor,
+		Metadata: req.Metadata,
+	}, nil
+}
+
+func (cashOnArrival) Confirm(ctx context.Context, intentID string) (*Intent, error) {
+	return &Intent{ID: intentID, Status: StatusSucceeded}, nil
+}
+
+// Refund is not supported, cash is handed back at the venue.
+func (cashOnArrival) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	return nil, ErrUnsupported
+}
+
+// Status is not supported, the ledger knows whether the cash was collected.
+func (cashOnArrival) Status(ctx context.Context, intentID string) (*Intent, error) {
+	return nil, ErrUnsupported
+}
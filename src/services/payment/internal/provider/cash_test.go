@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"tixie.local/common/paymentmethod"
+)
+
+func TestCashOnArrivalBypassesTheCardProvider(t *testing.T) {
+	ctx := context.Background()
+	card := NewFake(FakeDecline)
+	p := WithCashOnArrival(card)
+
+	req := IntentRequest{
+		Amount:         1500,
+		Currency:       "USD",
+		PaymentMethod:  paymentmethod.CashOnArrival,
+		IdempotencyKey: "payment-res-1",
+	}
+	intent, err := p.CreateIntent(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateIntent: %v", err)
+	}
+	if intent.Status != StatusPendingAtDoor {
+		t.Fatalf("status = %s, want %s", intent.Status, StatusPendingAtDoor)
+	}
+	again, err := p.CreateIntent(ctx, req)
+	if err != nil || again.ID != intent.ID {
+		t.Fatalf("same idempotency key created two cash intents: %s and %v (%v)", intent.ID, again, err)
+	}
+
+	collected, err := p.Confirm(ctx, intent.ID)
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if collected.Status != StatusSucceeded {
+		t.Errorf("status after collection = %s, want %s", collected.Status, StatusSucceeded)
+	}
+	if _, err := p.Refund(ctx, RefundRequest{IntentID: intent.ID}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected cash refunds to be unsupported, got %v", err)
+	}
+
+	req.PaymentMethod = paymentmethod.Card
+	if _, err := p.CreateIntent(ctx, req); !errors.Is(err, ErrDeclined) {
+		t.Errorf("expected card payments to reach the card provider, got %v", err)
+	}
+}
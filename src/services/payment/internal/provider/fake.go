@@ -0,0 +1,220 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FakeMode selects how a Fake provider behaves.
+type FakeMode string
+
+// Fake provider behaviours.
+const (
+	// FakeSucceed accepts every payment.
+	FakeSucceed FakeMode = "succeed"
+	// FakeDecline refuses every payment with ErrDeclined.
+	FakeDecline FakeMode = "decline"
+	// FakeDelay accepts every payment after waiting Delay.
+	FakeDelay FakeMode = "delay"
+	// FakeTimeout never answers; calls fail with ErrTimeout once the
+	// context is done or Timeout has passed.
+	FakeTimeout FakeMode = "timeout"
+)
+
+// DefaultFakeDelay is how long a Fake in FakeDelay mode waits by default.
+const DefaultFakeDelay = 2 * time.Second
+
+// DefaultFakeTimeout is how long a Fake in FakeTimeout mode blocks when the
+// context has no deadline.
+const DefaultFakeTimeout = 30 * time.Second
+
+// Fake is an in-process payment provider that keeps intents in memory. It
+// lets the purchase flow run without a payment processor.
+type Fake struct {
+	Mode    FakeMode
+	Delay   time.Duration
+	Timeout time.Duration
+	// AutoConfirm makes new intents succeed straight away, standing in for
+	// the buyer completing the payment.
+	AutoConfirm bool
+
+	mu       sync.Mutex
+	intents  map[string]*Intent
+	byKey    map[string]string
+	refunds  map[string]*Refund
+	refunded map[string]int64
+}
+
+// NewFake returns a Fake provider in the given mode.
+func NewFake(mode FakeMode) *Fake {
+	return &Fake{
+		Mode:     mode,
+		Delay:    DefaultFakeDelay,
+		Timeout:  DefaultFakeTimeout,
+		intents:  make(map[string]*Intent),
+		byKey:    make(map[string]string),
+		refunds:  make(map[string]*Refund),
+		refunded: make(map[string]int64),
+	}
+}
+
+// SetMode changes how the provider answers subsequent calls.
+func (f *Fake) SetMode(mode FakeMode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Mode = mode
+}
+
+func (f *Fake) CreateIntent(ctx context.Context, req IntentRequest) (*Intent, error) {
+	if err := f.simulate(ctx); err != nil {
+		return nil, err
+	}
+	if req.Amount <= 0 {
+		return nil, fmt.Errorf("amount must be greater than 0")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if req.IdempotencyKey != "" {
+		if id, ok := f.byKey[req.IdempotencyKey]; ok {
+			return copyIntent(f.intents[id]), nil
+		}
+	}
+
+	id := "pi_fake_" + uuid.New().String()
+	intent := &Intent{
+		ID:           id,
+		ClientSecret: id + "_secret_" + uuid.New().String(),
+		Amount:       req.Amount,
+		Currency:     req.Currency,
+		Status:       StatusRequiresConfirmation,
+		Metadata:     make(map[string]string, len(req.Metadata)),
+	}
+	for k, v := range req.Metadata {
+		intent.Metadata[k] = v
+	}
+	if f.AutoConfirm {
+		intent.Status = StatusSucceeded
+	}
+	f.intents[id] = intent
+	if req.IdempotencyKey != "" {
+		f.byKey[req.IdempotencyKey] = id
+	}
+	return copyIntent(intent), nil
+}
+
+func (f *Fake) Confirm(ctx context.Context, intentID string) (*Intent, error) {
+	if err := f.simulate(ctx); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.intents[intentID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if intent.Status == StatusCanceled {
+		return nil, fmt.Errorf("payment intent %s is canceled", intentID)
+	}
+	intent.Status = StatusSucceeded
+	return copyIntent(intent), nil
+}
+
+func (f *Fake) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	if err := f.simulate(ctx); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if req.IdempotencyKey != "" {
+		if r, ok := f.refunds[req.IdempotencyKey]; ok {
+			refund := *r
+			return &refund, nil
+		}
+	}
+
+	intent, ok := f.intents[req.IntentID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if intent.Status != StatusSucceeded {
+		return nil, fmt.Errorf("payment intent %s has not succeeded", req.IntentID)
+	}
+
+	amount := req.Amount
+	if amount == 0 {
+		amount = intent.Amount - f.refunded[intent.ID]
+	}
+	if amount <= 0 || f.refunded[intent.ID]+amount > intent.Amount {
+		return nil, fmt.Errorf("refund of %d exceeds the refundable amount of payment intent %s", amount, intent.ID)
+	}
+	f.refunded[intent.ID] += amount
+
+	refund := &Refund{
+		ID:       "re_fake_" + uuid.New().String(),
+		IntentID: intent.ID,
+		Amount:   amount,
+		Status:   "succeeded",
+	}
+	if req.IdempotencyKey != "" {
+		f.refunds[req.IdempotencyKey] = refund
+	}
+	result := *refund
+	return &result, nil
+}
+
+func (f *Fake) Status(ctx context.Context, intentID string) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.intents[intentID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyIntent(intent), nil
+}
+
+// simulate applies the configured mode before an operation runs.
+func (f *Fake) simulate(ctx context.Context) error {
+	f.mu.Lock()
+	mode, delay, timeout := f.Mode, f.Delay, f.Timeout
+	f.mu.Unlock()
+
+	switch mode {
+	case FakeDecline:
+		return ErrDeclined
+	case FakeDelay:
+		select {
+		case <-time.After(delay):
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ErrTimeout, ctx.Err())
+		}
+	case FakeTimeout:
+		select {
+		case <-time.After(timeout):
+			return ErrTimeout
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ErrTimeout, ctx.Err())
+		}
+	}
+	return nil
+}
+
+func copyIntent(intent *Intent) *Intent {
+	c := *intent
+	c.Metadata = make(map[string]string, len(intent.Metadata))
+	for k, v := range intent.Metadata {
+		c.Metadata[k] = v
+	}
+	return &c
+}
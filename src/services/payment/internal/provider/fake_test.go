@@ -0,0 +1,80 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFakeIdempotentCreateAndRefund(t *testing.T) {
+	ctx := context.Background()
+	f := NewFake(FakeSucceed)
+
+	req := IntentRequest{Amount: 1500, Currency: "USD", IdempotencyKey: "payment-res-1"}
+	first, err := f.CreateIntent(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateIntent: %v", err)
+	}
+	second, err := f.CreateIntent(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateIntent again: %v", err)
+	}
+	if first.ID != second.ID {
+		t.Fatalf("same idempotency key created two intents: %s and %s", first.ID, second.ID)
+	}
+
+	if _, err := f.Refund(ctx, RefundRequest{IntentID: first.ID}); err == nil {
+		t.Fatal("refunded an intent that was never confirmed")
+	}
+
+	confirmed, err := f.Confirm(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if confirmed.Status != StatusSucceeded {
+		t.Fatalf("status after confirm = %s, want %s", confirmed.Status, StatusSucceeded)
+	}
+
+	refund, err := f.Refund(ctx, RefundRequest{IntentID: first.ID, Amount: 500})
+	if err != nil {
+		t.Fatalf("partial Refund: %v", err)
+	}
+	if refund.Amount != 500 {
+		t.Fatalf("refund amount = %d, want 500", refund.Amount)
+	}
+	rest, err := f.Refund(ctx, RefundRequest{IntentID: first.ID})
+	if err != nil {
+		t.Fatalf("full Refund: %v", err)
+	}
+	if rest.Amount != 1000 {
+		t.Fatalf("remaining refund amount = %d, want 1000", rest.Amount)
+	}
+	if _, err := f.Refund(ctx, RefundRequest{IntentID: first.ID, Amount: 1}); err == nil {
+		t.Fatal("refunded more than was charged")
+	}
+}
+
+func TestFakeModes(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := NewFake(FakeDecline).CreateIntent(ctx, IntentRequest{Amount: 100}); !errors.Is(err, ErrDeclined) {
+		t.Fatalf("decline mode: got %v, want ErrDeclined", err)
+	}
+
+	delayed := NewFake(FakeDelay)
+	delayed.Delay = 20 * time.Millisecond
+	start := time.Now()
+	if _, err := delayed.CreateIntent(ctx, IntentRequest{Amount: 100}); err != nil {
+		t.Fatalf("delay mode: %v", err)
+	}
+	if time.Since(start) < delayed.Delay {
+		t.Fatal("delay mode answered before the delay passed")
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := NewFake(FakeTimeout).CreateIntent(timeoutCtx, IntentRequest{Amount: 100}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("timeout mode: got %v, want ErrTimeout", err)
+	}
+}
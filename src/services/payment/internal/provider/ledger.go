@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"context"
+	"log"
+)
+
+// Statuses recorded by the ledger on top of the provider's own.
+const (
+	StatusPartiallyRefunded Status = "partially_refunded"
+	StatusRefunded          Status = "refunded"
+)
+
+// Ledger records what happens to payments, so that the payment service has
+// its own record of every intent instead of only the provider's.
+type Ledger interface {
+	// RecordIntent records a newly created intent. Recording the same
+	// intent again is a no-op.
+	RecordIntent(req IntentRequest, intent *Intent) error
+	// RecordStatus records that an intent moved to status.
+	RecordStatus(intentID string, status Status, note string) error
+	// RecordRefund records a refund. Recording the same refund again is a
+	// no-op.
+	RecordRefund(refund *Refund) error
+}
+
+// WithLedger returns a provider that records the outcome of every call to p
+// in ledger. The provider call counts, not the record: a failure to record
+// is logged and the result of p is returned regardless.
+func WithLedger(p PaymentProvider, ledger Ledger) PaymentProvider {
+	return &recordingProvider{next: p, ledger: ledger}
+}
+
+type recordingProvider struct {
+	next   PaymentProvider
+	ledger Ledger
+}
+
+func (r *recordingProvider) CreateIntent(ctx context.Context, req IntentRequest) (*Intent, error) {
+	intent, err := r.next.CreateIntent(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.ledger.RecordIntent(req, intent); err != nil {
+		log.Printf("Ledger: failed to record payment intent %s: %v", intent.ID, err)
+	}
+	return intent, nil
+}
+
+func (r *recordingProvider) Confirm(ctx context.Context, intentID string) (*Intent, error) {
+	intent, err := r.next.Confirm(ctx, intentID)
+	if err != nil {
+		return nil, err
+	}
+	r.recordStatus(intent, "confirmed")
+	return intent, nil
+}
+
+func (r *recordingProvider) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	refund, err := r.next.Refund(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.ledger.RecordRefund(refund); err != nil {
+		log.Printf("Ledger: failed to record refund %s of payment intent %s: %v", refund.ID, refund.IntentID, err)
+	}
+	return refund, nil
+}
+
+func (r *recordingProvider) Status(ctx context.Context, intentID string) (*Intent, error) {
+	intent, err := r.next.Status(ctx, intentID)
+	if err != nil {
+		return nil, err
+	}
+	r.recordStatus(intent, "status check")
+	return intent, nil
+}
+
+func (r *recordingProvider) recordStatus(intent *Intent, note string) {
+	if err := r.ledger.RecordStatus(intent.ID, intent.Status, note); err != nil {
+		log.Printf("Ledger: failed to record status of payment intent %s: %v", intent.ID, err)
+	}
+}
@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// FromEnv returns the provider selected by PAYMENT_PROVIDER, which is
+// either "stripe" (the default) or "fake". The Stripe provider needs
+// SECRET_KEY. The fake provider behaves as set by FAKE_PAYMENT_MODE and,
+// in delay mode, FAKE_PAYMENT_DELAY. Its payments succeed as soon as they
+// are created, since no buyer is around to complete them.
+func FromEnv() (PaymentProvider, error) {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "", "stripe":
+		key := os.Getenv("SECRET_KEY")
+		if key == "" {
+			return nil, fmt.Errorf("SECRET_KEY environment variable is required for the stripe payment provider")
+		}
+		return NewStripe(key), nil
+
+	case "fake":
+		mode := FakeMode(os.Getenv("FAKE_PAYMENT_MODE"))
+		switch mode {
+		case "":
+			mode = FakeSucceed
+		case FakeSucceed, FakeDecline, FakeDelay, FakeTimeout:
+		default:
+			return nil, fmt.Errorf("unknown FAKE_PAYMENT_MODE %q", mode)
+		}
+
+		fake := NewFake(mode)
+		fake.AutoConfirm = true
+		if s := os.Getenv("FAKE_PAYMENT_DELAY"); s != "" {
+			delay, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FAKE_PAYMENT_DELAY: %v", err)
+			}
+			fake.Delay = delay
+		}
+		log.Printf("Using fake payment provider in %s mode", mode)
+		return fake, nil
+
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", name)
+	}
+}
@@ -0,0 +1,104 @@
+// Package provider abstracts the payment processor the payment service
+// charges through, so that the purchase flow can run against Stripe in
+// production and against an in-process fake in tests.
+package provider
+
+import (
+	"context"
+	"errors"
+)
+
+// Status is the state of a payment intent.
+type Status string
+
+// Payment intent states. They follow the Stripe names.
+const (
+	StatusRequiresPaymentMethod Status = "requires_payment_method"
+	StatusRequiresConfirmation  Status = "requires_confirmation"
+	StatusRequiresAction        Status = "requires_action"
+	StatusProcessing            Status = "processing"
+	StatusSucceeded             Status = "succeeded"
+	StatusCanceled              Status = "canceled"
+	// StatusPendingAtDoor is an intent paid for in cash when the ticket is
+	// scanned at the door.
+	StatusPendingAtDoor Status = "pending_at_door"
+)
+
+var (
+	// ErrDeclined is returned when the processor refuses the charge.
+	ErrDeclined = errors.New("payment declined")
+	// ErrTimeout is returned when the processor does not answer in time.
+	ErrTimeout = errors.New("payment provider timed out")
+	// ErrNotFound is returned for unknown payment intents.
+	ErrNotFound = errors.New("payment intent not found")
+	// ErrUnsupported is returned for operations the intent's payment method
+	// does not support.
+	ErrUnsupported = errors.New("not supported for this payment method")
+)
+
+// Metadata keys that tie a payment intent back to what it pays for.
+const (
+	MetadataTicketID       = "ticket_id"
+	MetadataReservationKey = "reservation_key"
+)
+
+// IntentRequest describes a payment intent to create. Amount is in the
+// smallest unit of Currency, an upper case ISO 4217 code such as "USD".
+// PaymentMethod is one of the paymentmethod constants, card when empty.
+// Items are the tickets an order's intent pays for. They are recorded in the
+// ledger, not sent to the processor.
+type IntentRequest struct {
+	Amount         int64
+	Currency       string
+	PaymentMethod  string
+	IdempotencyKey string
+	Metadata       map[string]string
+	Items          []LineItem
+}
+
+// LineItem is a ticket paid for as part of an order, and its share of the
+// intent's amount.
+type LineItem struct {
+	TicketID int
+	Amount   int64
+}
+
+// Intent is a payment intent as reported by the provider.
+type Intent struct {
+	ID           string
+	ClientSecret string
+	Amount       int64
+	Currency     string
+	Status       Status
+	Metadata     map[string]string
+}
+
+// RefundRequest describes a refund of a payment intent. An Amount of zero
+// refunds the whole intent.
+type RefundRequest struct {
+	IntentID       string
+	Amount         int64
+	IdempotencyKey string
+}
+
+// Refund is a refund as reported by the provider.
+type Refund struct {
+	ID       string
+	IntentID string
+	Amount   int64
+	Status   string
+}
+
+// PaymentProvider creates and manages payments with a payment processor.
+// Implementations must be safe for concurrent use.
+type PaymentProvider interface {
+	// CreateIntent creates a payment intent. Creating an intent twice with
+	// the same idempotency key returns the first one.
+	CreateIntent(ctx context.Context, req IntentRequest) (*Intent, error)
+	// Confirm attempts to collect payment for an intent.
+	Confirm(ctx context.Context, intentID string) (*Intent, error)
+	// Refund returns money collected for an intent.
+	Refund(ctx context.Context, req RefundRequest) (*Refund, error)
+	// Status looks up the current state of an intent.
+	Status(ctx context.Context, intentID string) (*Intent, error)
+}
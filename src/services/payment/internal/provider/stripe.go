@@ -0,0 +1,118 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/client"
+)
+
+// Stripe charges through the Stripe API.
+type Stripe struct {
+	api *client.API
+}
+
+// NewStripe returns a provider that authenticates to Stripe with secretKey.
+func NewStripe(secretKey string) *Stripe {
+	return &Stripe{api: client.New(secretKey, nil)}
+}
+
+func (s *Stripe) CreateIntent(ctx context.Context, req IntentRequest) (*Intent, error) {
+	params := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(req.Amount),
+		Currency: stripe.String(strings.ToLower(req.Currency)),
+	}
+	params.Context = ctx
+	if req.IdempotencyKey != "" {
+		params.SetIdempotencyKey(req.IdempotencyKey)
+	}
+	for k, v := range req.Metadata {
+		params.AddMetadata(k, v)
+	}
+
+	pi, err := s.api.PaymentIntents.New(params)
+	if err != nil {
+		return nil, stripeError("create payment intent", err)
+	}
+	return intentFromStripe(pi), nil
+}
+
+func (s *Stripe) Confirm(ctx context.Context, intentID string) (*Intent, error) {
+	params := &stripe.PaymentIntentConfirmParams{}
+	params.Context = ctx
+
+	pi, err := s.api.PaymentIntents.Confirm(intentID, params)
+	if err != nil {
+		return nil, stripeError("confirm payment intent", err)
+	}
+	return intentFromStripe(pi), nil
+}
+
+func (s *Stripe) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(req.IntentID),
+	}
+	params.Context = ctx
+	if req.Amount > 0 {
+		params.Amount = stripe.Int64(req.Amount)
+	}
+	if req.IdempotencyKey != "" {
+		params.SetIdempotencyKey(req.IdempotencyKey)
+	}
+
+	r, err := s.api.Refunds.New(params)
+	if err != nil {
+		return nil, stripeError("refund payment intent", err)
+	}
+	return &Refund{
+		ID:       r.ID,
+		IntentID: req.IntentID,
+		Amount:   r.Amount,
+		Status:   string(r.Status),
+	}, nil
+}
+
+func (s *Stripe) Status(ctx context.Context, intentID string) (*Intent, error) {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+
+	pi, err := s.api.PaymentIntents.Get(intentID, params)
+	if err != nil {
+		return nil, stripeError("get payment intent", err)
+	}
+	return intentFromStripe(pi), nil
+}
+
+func intentFromStripe(pi *stripe.PaymentIntent) *Intent {
+	return &Intent{
+		ID:           pi.ID,
+		ClientSecret: pi.ClientSecret,
+		Amount:       pi.Amount,
+		Currency:     strings.ToUpper(pi.Currency),
+		Status:       Status(pi.Status),
+		Metadata:     pi.Metadata,
+	}
+}
+
+// stripeError maps Stripe errors onto the provider errors callers can act
+// on, keeping the original error for logging.
+func stripeError(op string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("failed to %s: %w: %v", op, ErrTimeout, err)
+	}
+
+	var serr *stripe.Error
+	if errors.As(err, &serr) {
+		switch {
+		case serr.Type == stripe.ErrorTypeCard:
+			return fmt.Errorf("failed to %s: %w: %v", op, ErrDeclined, err)
+		case serr.HTTPStatusCode == http.StatusNotFound:
+			return fmt.Errorf("failed to %s: %w: %v", op, ErrNotFound, err)
+		}
+	}
+	return fmt.Errorf("failed to %s: %v", op, err)
+}
@@ -1,20 +1,28 @@
 package routes
 
 import (
+	"os"
 	"payment/handlers"
+	"payment/internal/db/repos"
+	"payment/internal/provider"
 
 	"github.com/gorilla/mux"
+	"tixie.local/broker/dedupe"
 )
 
-func SetupRouter() *mux.Router {
+func SetupRouter(p provider.PaymentProvider, payments *repos.PaymentRepository, processed dedupe.Store) *mux.Router {
 	r := mux.NewRouter()
 
-	paymentHandler := handlers.NewPaymentHandler()
-	webhookHandler := handlers.NewWebhookHandler()
+	paymentHandler := handlers.NewPaymentHandler(p)
+	paymentsHandler := handlers.NewPaymentsHandler(payments)
+	webhookHandler := handlers.NewWebhookHandler(p, payments, processed, os.Getenv("STRIPE_WEBHOOK_SECRET"))
 
 	r.HandleFunc("/create-payment-intent", paymentHandler.CreatePaymentIntent).Methods("POST")
-	// r.HandleFunc("/webhook", webhookHandler.StripeWebhook).Methods("POST")
-	r.HandleFunc("/simulate-webhook", webhookHandler.SimulateWebhook).Methods("POST")
+	r.HandleFunc("/refunds", paymentHandler.RefundPayment).Methods("POST")
+	r.HandleFunc("/payments", paymentsHandler.ListPayments).Methods("GET")
+	r.HandleFunc("/payments/{id}", paymentsHandler.GetPayment).Methods("GET")
+	r.HandleFunc("/payouts", paymentsHandler.ListPayouts).Methods("GET")
+	r.HandleFunc("/webhook", webhookHandler.StripeWebhook).Methods("POST")
 
 	return r
 }
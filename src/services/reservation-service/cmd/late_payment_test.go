@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/dbtest"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"tixie.local/broker/events"
+	circuitbreaker "tixie.local/common"
+)
+
+type refundCall struct {
+	PaymentIntentID string `json:"payment_intent_id"`
+	Amount          int64  `json:"amount"`
+	IdempotencyKey  string `json:"idempotency_key"`
+}
+
+// fakePayments stands in for the payment service's POST /refunds. Refunds
+// fail with a 500 while failing is set.
+type fakePayments struct {
+	mu      sync.Mutex
+	refunds []refundCall
+	failing bool
+}
+
+func (f *fakePayments) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/refunds" || f.failing {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	var call refundCall
+	json.NewDecoder(r.Body).Decode(&call)
+	f.refunds = append(f.refunds, call)
+	json.NewEncoder(w).Encode(clients.Refund{RefundID: "re_late", Status: "succeeded"})
+}
+
+func (f *fakePayments) calls() []refundCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]refundCall(nil), f.refunds...)
+}
+
+func newLatePaymentService(t *testing.T) (*ReservationService, *sqlx.DB, *fakePayments) {
+	t.Helper()
+	db := dbtest.Open(t)
+
+	payments := &fakePayments{}
+	srv := httptest.NewServer(payments)
+	t.Cleanup(srv.Close)
+	t.Setenv("PAYMENT_SERVICE_URL", srv.URL)
+
+	return &ReservationService{
+		purchaseRepo: repos.NewPurchaseRepository(db),
+		orderRepo:    repos.NewOrderRepository(db),
+		resaleRepo:   repos.NewResaleRepository(db),
+		services:     clients.NewServiceClients(circuitbreaker.NewBreaker("late-payment-test")),
+	}, db, payments
+}
+
+func createTestPurchase(t *testing.T, db *sqlx.DB, ticketID int, status, paymentIntentID string) string {
+	t.Helper()
+	key := "reservation-saga-" + time.Now().Format("150405.000000000")
+	_, err := db.Exec(
+		`INSERT INTO purchases (ticket_id, user_id, event_id, purchase_date, status, reservation_key, amount, currency, payment_intent_id)
+		 VALUES ($1, 1, 1, NOW(), $2, $3, 2500, 'USD', $4)`,
+		ticketID, status, key, paymentIntentID,
+	)
+	if err != nil {
+		t.Fatalf("failed to create purchase: %v", err)
+	}
+	return key
+}
+
+func TestHandlePaymentConfirmed_RefundsPaymentAfterHoldReleased(t *testing.T) {
+	s, db, payments := newLatePaymentService(t)
+	key := createTestPurchase(t, db, 101, "expired", "")
+
+	msg := &events.PaymentConfirmed{TicketID: 101, Amount: 2500, PaymentIntentID: "pi_late", ReservationKey: key}
+	if err := s.handlePaymentConfirmed(events.Envelope{ID: "m1"}, msg); err != nil {
+		t.Fatalf("handlePaymentConfirmed: %v", err)
+	}
+
+	calls := payments.calls()
+	if len(calls) != 1 {
+		t.Fatalf("refunds = %d, want 1", len(calls))
+	}
+	want := refundCall{PaymentIntentID: "pi_late", Amount: 0, IdempotencyKey: events.RefundIdempotencyKey(key)}
+	if calls[0] != want {
+		t.Errorf("refund = %+v, want %+v", calls[0], want)
+	}
+
+	purchase, err := s.purchaseRepo.GetPurchaseByTicketID(101)
+	if err != nil {
+		t.Fatalf("GetPurchaseByTicketID: %v", err)
+	}
+	if purchase.Status != "expired" {
+		t.Errorf("purchase status = %s, want expired", purchase.Status)
+	}
+}
+
+func TestHandlePaymentConfirmed_LatePaymentIsRetriedUntilRefunded(t *testing.T) {
+	s, db, payments := newLatePaymentService(t)
+	key := createTestPurchase(t, db, 102, "expired", "")
+	msg := &events.PaymentConfirmed{TicketID: 102, PaymentIntentID: "pi_late", ReservationKey: key}
+
+	payments.failing = true
+	if err := s.handlePaymentConfirmed(events.Envelope{ID: "m1"}, msg); err == nil {
+		t.Fatal("handlePaymentConfirmed acknowledged the payment although its refund failed")
+	}
+
+	payments.failing = false
+	if err := s.handlePaymentConfirmed(events.Envelope{ID: "m1"}, msg); err != nil {
+		t.Fatalf("handlePaymentConfirmed: %v", err)
+	}
+	if calls := payments.calls(); len(calls) != 1 {
+		t.Errorf("refunds = %d, want 1", len(calls))
+	}
+}
+
+func TestHandlePaymentConfirmed_CancelledPurchaseIsNotRefundedAgain(t *testing.T) {
+	s, db, payments := newLatePaymentService(t)
+	key := createTestPurchase(t, db, 103, "cancelled", "pi_paid")
+
+	msg := &events.PaymentConfirmed{TicketID: 103, PaymentIntentID: "pi_paid", ReservationKey: key}
+	if err := s.handlePaymentConfirmed(events.Envelope{ID: "m1"}, msg); err != nil {
+		t.Fatalf("handlePaymentConfirmed: %v", err)
+	}
+	if calls := payments.calls(); len(calls) != 0 {
+		t.Errorf("refunds = %+v, want none", calls)
+	}
+}
+
+func TestSettleOrder_RefundsPaymentAfterHoldReleased(t *testing.T) {
+	s, db, payments := newLatePaymentService(t)
+
+	key := repos.OrderReservationKey(1)
+	now := time.Now().UTC()
+	items := []models.Purchase{
+		{TicketID: 201, UserID: 1, EventID: 1, PurchaseDate: now, Status: "pending", ReservationKey: repos.OrderTicketReservationKey(key, 1), Amount: 1000, Currency: "USD", PaymentMethod: "card"},
+		{TicketID: 202, UserID: 1, EventID: 2, PurchaseDate: now, Status: "pending", ReservationKey: repos.OrderTicketReservationKey(key, 2), Amount: 1500, Currency: "USD", PaymentMethod: "card"},
+	}
+	order, err := s.orderRepo.CreateOrder(&models.Order{UserID: 1, ReservationKey: key, Amount: 2500, Currency: "USD", PaymentMethod: "card"}, items, nil)
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	if _, err := db.Exec("UPDATE purchases SET status='expired' WHERE order_id=$1", order.OrderID); err != nil {
+		t.Fatalf("failed to expire order: %v", err)
+	}
+
+	msg := &events.PaymentConfirmed{Amount: 2500, PaymentIntentID: "pi_order", ReservationKey: key}
+	if err := s.handlePaymentConfirmed(events.Envelope{ID: "m1"}, msg); err != nil {
+		t.Fatalf("handlePaymentConfirmed: %v", err)
+	}
+
+	calls := payments.calls()
+	want := refundCall{PaymentIntentID: "pi_order", Amount: 0, IdempotencyKey: events.RefundIdempotencyKey(key)}
+	if len(calls) != 1 || calls[0] != want {
+		t.Errorf("refunds = %+v, want [%+v]", calls, want)
+	}
+}
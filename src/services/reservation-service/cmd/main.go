@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -8,7 +9,14 @@ import (
 	"os"
 	"os/signal"
 	"reservation-service/internal/api"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/models"
 	"reservation-service/internal/db/repos"
+	"reservation-service/internal/holds"
+	"reservation-service/internal/outbox"
+	"reservation-service/internal/saga"
+	"reservation-service/internal/waitlist"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -16,19 +24,57 @@ import (
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	brokerPkg "tixie.local/broker"
+	"tixie.local/broker/dedupe"
+	"tixie.local/broker/events"
+	brokerOutbox "tixie.local/broker/outbox"
+	circuitbreaker "tixie.local/common"
+	"tixie.local/common/admission"
+	"tixie.local/common/paymentmethod"
+	"tixie.local/common/ticketsig"
+)
+
+const (
+	// sagaRecoveryInterval is how often unfinished sagas are looked for.
+	sagaRecoveryInterval = 30 * time.Second
+	// sagaStaleAfter is how long a saga may go without progress before it is
+	// considered abandoned by the replica that started it.
+	sagaStaleAfter = 2 * time.Minute
+	// defaultHoldTTL is how long a seat stays held waiting for payment when
+	// HOLD_TTL is not set.
+	defaultHoldTTL = 15 * time.Minute
+	// holdReaperInterval is how often expired holds are released.
+	holdReaperInterval = 30 * time.Second
+	// outboxRelayInterval is how often pending outbox messages are published.
+	outboxRelayInterval = 2 * time.Second
+	// dedupePurgeInterval is how often expired processed message ids are
+	// deleted.
+	dedupePurgeInterval = time.Hour
+	// defaultResaleFeePercent is the share of a resale price the platform
+	// keeps when RESALE_FEE_PERCENT is not set.
+	defaultResaleFeePercent = 10
+	// defaultWaitlistOfferTTL is how long a user on a waitlist has to accept
+	// an offer when WAITLIST_OFFER_TTL is not set.
+	defaultWaitlistOfferTTL = 30 * time.Minute
+	// waitlistOfferInterval is how often freed tickets are offered to
+	// waiting users.
+	waitlistOfferInterval = 30 * time.Second
 )
 
 type ReservationService struct {
 	reservationDB *sqlx.DB
 	purchaseRepo  *repos.PurchaseRepository
+	resaleRepo    *repos.ResaleRepository
+	waitlistRepo  *repos.WaitlistRepository
+	orderRepo     *repos.OrderRepository
+	outbox        *brokerOutbox.Store
+	processed     *dedupe.PostgresStore
+	sagas         *saga.Orchestrator
+	services      *clients.ServiceClients
 	ticketClient  *http.Client
 	broker        *brokerPkg.Broker
-}
-
-// PaymentMessage represents the structure of payment confirmation messages
-type PaymentMessage struct {
-	TicketID int     `json:"ticket_id"`
-	Amount   float64 `json:"amount"`
+	ticketKeys    *ticketsig.Keyring
+	admissions    *admission.Verifier
+	holdTTL       time.Duration
 }
 
 func NewReservationService() *ReservationService {
@@ -40,7 +86,10 @@ func NewReservationService() *ReservationService {
 	}
 
 	purchaseRepo := repos.NewPurchaseRepository(reservationDB)
+	orderRepo := repos.NewOrderRepository(reservationDB)
+	outboxStore := brokerOutbox.NewStore(reservationDB.DB)
 	ticketClient := &http.Client{Timeout: 10 * time.Second}
+	services := clients.NewServiceClients(circuitbreaker.NewBreaker("reservation-service-clients"))
 
 	// Initialize broker
 	broker, err := brokerPkg.NewBroker(os.Getenv("RABBITMQ_URL"), "tixie", "topic")
@@ -48,11 +97,52 @@ func NewReservationService() *ReservationService {
 		log.Printf("Warning: Failed to create broker: %v", err)
 	}
 
+	holdTTL := defaultHoldTTL
+	if v := os.Getenv("HOLD_TTL"); v != "" {
+		if holdTTL, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("Invalid HOLD_TTL %q: %v", v, err)
+		}
+	}
+
+	// Every key ticket-service signs, or has signed, QR codes with
+	ticketKeys, err := ticketsig.ParseKeyring(os.Getenv("TICKET_VERIFY_KEYS"))
+	if err != nil {
+		log.Fatalf("Invalid TICKET_VERIFY_KEYS: %v", err)
+	}
+	if ticketKeys.Len() == 0 {
+		log.Printf("Warning: TICKET_VERIFY_KEYS is not set, no ticket will pass verification")
+	}
+
+	// Every key the waiting room signs, or has signed, admission tokens with
+	admissionKeys, err := ticketsig.ParseKeyring(os.Getenv("WAITING_ROOM_VERIFY_KEYS"))
+	if err != nil {
+		log.Fatalf("Invalid WAITING_ROOM_VERIFY_KEYS: %v", err)
+	}
+	if admissionKeys.Len() == 0 {
+		log.Printf("Warning: WAITING_ROOM_VERIFY_KEYS is not set, no ticket can be bought during a protected on-sale")
+	}
+
+	sagas := saga.NewOrchestrator(repos.NewSagaRepository(reservationDB))
+	sagas.Register(saga.NewReserveTicketDefinition(services, purchaseRepo, holdTTL))
+	sagas.Register(saga.NewReserveOrderDefinition(services, orderRepo, purchaseRepo, holdTTL))
+	sagas.Register(saga.NewExpireHoldDefinition(services, purchaseRepo))
+	sagas.Register(saga.NewCancelPurchaseDefinition(services, outboxStore))
+
 	return &ReservationService{
 		reservationDB: reservationDB,
 		purchaseRepo:  purchaseRepo,
+		resaleRepo:    repos.NewResaleRepository(reservationDB),
+		waitlistRepo:  repos.NewWaitlistRepository(reservationDB),
+		orderRepo:     orderRepo,
+		outbox:        outboxStore,
+		processed:     dedupe.NewPostgresStore(reservationDB.DB),
+		sagas:         sagas,
+		services:      services,
 		ticketClient:  ticketClient,
 		broker:        broker,
+		ticketKeys:    ticketKeys,
+		admissions:    admission.NewVerifier(admissionKeys),
+		holdTTL:       holdTTL,
 	}
 }
 
@@ -62,89 +152,311 @@ func (s *ReservationService) startMessageConsumer() {
 		return
 	}
 
-	// Declare and bind queue for payment confirmations
+	// Consume payment confirmations, retrying failures and dead-lettering
+	// messages that keep failing. Redelivered confirmations are skipped so
+	// that the email is only sent once.
 	queueName := "reservation_payments"
-	err := s.broker.DeclareAndBindQueue(queueName, "payment.confirmed")
+	handler := dedupe.Wrap(s.processed, queueName, dedupe.DefaultTTL, s.handlePaymentConfirmed)
+	err := s.broker.SubscribeEvents(queueName, events.TypePaymentConfirmed, brokerPkg.ConsumerOptions{}, handler)
 	if err != nil {
-		log.Printf("Failed to declare and bind queue: %v", err)
+		log.Printf("Failed to subscribe to payment confirmations: %v", err)
 		return
 	}
 
-	// Start consuming messages
-	messages, err := s.broker.Consume(queueName)
+	// Activate tickets that will be paid for at the door
+	deferralsQueue := "reservation_payment_deferrals"
+	deferralsHandler := dedupe.Wrap(s.processed, deferralsQueue, dedupe.DefaultTTL, s.handlePaymentDeferred)
+	err = s.broker.SubscribeEvents(deferralsQueue, events.TypePaymentDeferred, brokerPkg.ConsumerOptions{}, deferralsHandler)
 	if err != nil {
-		log.Printf("Failed to start consuming messages: %v", err)
+		log.Printf("Failed to subscribe to deferred payments: %v", err)
+		return
+	}
+
+	// Give back seats whose payment failed or was refunded
+	failuresQueue := "reservation_payment_failures"
+	failuresHandler := dedupe.Wrap(s.processed, failuresQueue, dedupe.DefaultTTL, s.handlePaymentFailed)
+	err = s.broker.SubscribeEvents(failuresQueue, events.TypePaymentFailed, brokerPkg.ConsumerOptions{}, failuresHandler)
+	if err != nil {
+		log.Printf("Failed to subscribe to payment failures: %v", err)
 		return
 	}
 
 	go func() {
-		for msg := range messages {
-			log.Printf("Received payment confirmation message: %s", msg.Body)
+		ticker := time.NewTicker(dedupePurgeInterval)
+		defer ticker.Stop()
 
-			var paymentMsg PaymentMessage
-			if err := json.Unmarshal(msg.Body, &paymentMsg); err != nil {
-				log.Printf("Error unmarshaling payment message: %v", err)
-				continue
+		for range ticker.C {
+			if _, err := s.processed.PurgeExpired(); err != nil {
+				log.Printf("Failed to purge processed messages: %v", err)
 			}
+		}
+	}()
 
-			// Get user email and ticket details from the database
-			purchase, err := s.purchaseRepo.GetPurchaseByTicketID(paymentMsg.TicketID)
-			if err != nil {
-				log.Printf("Error fetching purchase details: %v", err)
-				continue
-			}
+	log.Println("Message consumer started successfully")
+}
 
-			// Get user details to get email
-			userResp, err := s.ticketClient.Get(fmt.Sprintf("%s/v1/%d", os.Getenv("USER_SERVICE_URL"), purchase.UserID))
-			if err != nil {
-				log.Printf("Error fetching user details: %v", err)
-				continue
-			}
-			defer userResp.Body.Close()
+// handlePaymentConfirmed confirms the purchase of a paid ticket, activates
+// the ticket and queues the confirmation email. It is safe to run again for
+// the same message, as a retry after a partial failure does.
+func (s *ReservationService) handlePaymentConfirmed(env events.Envelope, e events.Event) error {
+	log.Printf("Received payment confirmation %s", env.ID)
+	paymentMsg, ok := e.(*events.PaymentConfirmed)
+	if !ok {
+		return brokerPkg.Permanent(fmt.Errorf("unexpected event type %s", env.Type))
+	}
 
-			var userDetails struct {
-				Email string `json:"email"`
+	// A resale pays for a listing, not for the purchase of the ticket
+	if repos.IsResaleReservationKey(paymentMsg.ReservationKey) {
+		return s.settleResale(env, paymentMsg)
+	}
+	// An order pays for all of its tickets at once
+	if repos.IsOrderReservationKey(paymentMsg.ReservationKey) {
+		return s.settleOrder(env, paymentMsg)
+	}
+
+	// Confirm the hold. If it already expired the seat may have been
+	// sold to someone else, so the ticket is not activated and the payment
+	// is refunded instead.
+	purchase, err := s.purchaseRepo.ConfirmPurchaseByTicketID(paymentMsg.TicketID, paymentMsg.PaymentIntentID)
+	if err == sql.ErrNoRows {
+		purchase, err = s.purchaseRepo.GetPurchaseByTicketID(paymentMsg.TicketID)
+		if err != nil {
+			log.Printf("Error loading purchase for ticket %d: %v", paymentMsg.TicketID, err)
+			return err
+		}
+		if purchase.Status != "confirmed" {
+			// A purchase that recorded a payment was paid for and
+			// cancelled since, with its own refund.
+			if purchase.PaymentIntentID != "" {
+				log.Printf("Purchase of ticket %d is %s, ignoring payment confirmation", paymentMsg.TicketID, purchase.Status)
+				return nil
 			}
-			if err := json.NewDecoder(userResp.Body).Decode(&userDetails); err != nil {
-				log.Printf("Error parsing user response: %v", err)
-				continue
+			// Nothing was charged for cash, whatever is collected at the
+			// door is handed back there.
+			if purchase.PaymentMethod == paymentmethod.CashOnArrival {
+				log.Printf("Cash payment for ticket %d arrived after its hold was released, not confirming", paymentMsg.TicketID)
+				return nil
 			}
+			log.Printf("Payment for ticket %d arrived after its hold was released, refunding it", paymentMsg.TicketID)
+			return s.refundLatePayment(paymentMsg, purchase.ReservationKey)
+		}
+	} else if err != nil {
+		log.Printf("Error confirming purchase: %v", err)
+		return err
+	}
 
-			// Get ticket details
-			ticketResp, err := s.ticketClient.Get(fmt.Sprintf("%s/v1/%d", os.Getenv("TICKET_SERVICE_URL"), paymentMsg.TicketID))
-			if err != nil {
-				log.Printf("Error fetching ticket details: %v", err)
-				continue
-			}
-			defer ticketResp.Body.Close()
+	// Tickets paid for at the door were activated and sent when the
+	// payment was deferred, and have just been scanned.
+	if purchase.PaymentMethod == paymentmethod.CashOnArrival {
+		log.Printf("Ticket %d was paid for at the door", paymentMsg.TicketID)
+		return nil
+	}
 
-			var ticketDetails struct {
-				TicketCode string `json:"ticket_code"`
-			}
-			if err := json.NewDecoder(ticketResp.Body).Decode(&ticketDetails); err != nil {
-				log.Printf("Error parsing ticket response: %v", err)
-				continue
-			}
+	if err := s.activateTicket(env.CorrelationID, purchase); err != nil {
+		return err
+	}
 
-			// Publish notification message
-			notificationMsg := struct {
-				RecipientEmail string `json:"recipient_email"`
-				TicketID       string `json:"ticket_id"`
-			}{
-				RecipientEmail: userDetails.Email,
-				TicketID:       ticketDetails.TicketCode,
-			}
+	log.Printf("Successfully processed payment confirmation for ticket %d", paymentMsg.TicketID)
+	return nil
+}
 
-			if err := s.broker.Publish(notificationMsg, "email"); err != nil {
-				log.Printf("Error publishing notification message: %v", err)
-				continue
-			}
+// refundLatePayment refunds all of a payment that arrived after the hold it
+// paid for was released, as the buyer gets nothing for it. The message is
+// only acknowledged once the refund went through, so a failed refund is
+// retried. The refund's idempotency key is derived from reservationKey, so a
+// redelivered payment is never refunded twice.
+func (s *ReservationService) refundLatePayment(paymentMsg *events.PaymentConfirmed, reservationKey string) error {
+	refund, err := s.services.RefundPayment(paymentMsg.PaymentIntentID, 0, events.RefundIdempotencyKey(reservationKey))
+	if err != nil {
+		log.Printf("Error refunding late payment %s: %v", paymentMsg.PaymentIntentID, err)
+		return err
+	}
+	log.Printf("Refunded late payment %s of %s (refund %s)", paymentMsg.PaymentIntentID, reservationKey, refund.RefundID)
+	return nil
+}
+
+// activateTicket makes a purchased ticket usable and queues the email with
+// its code.
+func (s *ReservationService) activateTicket(correlationID string, purchase *models.Purchase) error {
+	if err := s.services.UpdateTicketStatus(purchase.TicketID, "active"); err != nil {
+		log.Printf("Error activating ticket %d: %v", purchase.TicketID, err)
+		return err
+	}
+
+	// Get user details to get email
+	userResp, err := s.ticketClient.Get(fmt.Sprintf("%s/v1/%d", os.Getenv("USER_SERVICE_URL"), purchase.UserID))
+	if err != nil {
+		log.Printf("Error fetching user details: %v", err)
+		return err
+	}
+	defer userResp.Body.Close()
+
+	var userDetails struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(userResp.Body).Decode(&userDetails); err != nil {
+		log.Printf("Error parsing user response: %v", err)
+		return err
+	}
+
+	// Get ticket details
+	ticketResp, err := s.ticketClient.Get(fmt.Sprintf("%s/v1/%d", os.Getenv("TICKET_SERVICE_URL"), purchase.TicketID))
+	if err != nil {
+		log.Printf("Error fetching ticket details: %v", err)
+		return err
+	}
+	defer ticketResp.Body.Close()
+
+	var ticketDetails struct {
+		TicketCode string `json:"ticket_code"`
+	}
+	if err := json.NewDecoder(ticketResp.Body).Decode(&ticketDetails); err != nil {
+		log.Printf("Error parsing ticket response: %v", err)
+		return err
+	}
+
+	// Queue notification message
+	notificationMsg, err := outbox.NewEvent(correlationID, &events.NotificationEmail{
+		RecipientEmail: userDetails.Email,
+		TicketCode:     ticketDetails.TicketCode,
+		TicketID:       purchase.TicketID,
+	})
+	if err != nil {
+		log.Printf("Error building notification message: %v", err)
+		return brokerPkg.Permanent(err)
+	}
 
-			log.Printf("Successfully processed payment confirmation for ticket %d", paymentMsg.TicketID)
+	if err := s.outbox.Enqueue(notificationMsg); err != nil {
+		log.Printf("Error queueing notification message: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// handlePaymentDeferred handles a ticket that will be paid for at the door.
+// The purchase stops expiring and the ticket is activated and sent right
+// away, so it can be scanned. The purchase is confirmed by the
+// payment.confirmed published once the ticket has been scanned.
+func (s *ReservationService) handlePaymentDeferred(env events.Envelope, e events.Event) error {
+	log.Printf("Received deferred payment %s", env.ID)
+	deferredMsg, ok := e.(*events.PaymentDeferred)
+	if !ok {
+		return brokerPkg.Permanent(fmt.Errorf("unexpected event type %s", env.Type))
+	}
+
+	purchase, err := s.purchaseRepo.DeferPurchaseByTicketID(deferredMsg.TicketID, deferredMsg.PaymentIntentID)
+	if err == sql.ErrNoRows {
+		purchase, err = s.purchaseRepo.GetPurchaseByTicketID(deferredMsg.TicketID)
+		if err != nil {
+			log.Printf("Error loading purchase for ticket %d: %v", deferredMsg.TicketID, err)
+			return err
 		}
-	}()
+		// Anything but a retry after a partial failure is left alone.
+		if purchase.Status != "pending_at_door" {
+			log.Printf("Purchase of ticket %d is %s, not deferring its payment", deferredMsg.TicketID, purchase.Status)
+			return nil
+		}
+	} else if err != nil {
+		log.Printf("Error deferring purchase: %v", err)
+		return err
+	}
 
-	log.Println("Message consumer started successfully")
+	if err := s.activateTicket(env.CorrelationID, purchase); err != nil {
+		return err
+	}
+
+	log.Printf("Ticket %d will be paid for at the door", deferredMsg.TicketID)
+	return nil
+}
+
+// handlePaymentFailed releases the hold of a ticket whose payment failed, so
+// the seat is sold again without waiting for the hold to expire. A confirmed
+// purchase whose payment was refunded outside of a cancellation, e.g. from
+// the Stripe dashboard, is cancelled without refunding again.
+func (s *ReservationService) handlePaymentFailed(env events.Envelope, e events.Event) error {
+	log.Printf("Received payment failure %s", env.ID)
+	failedMsg, ok := e.(*events.PaymentFailed)
+	if !ok {
+		return brokerPkg.Permanent(fmt.Errorf("unexpected event type %s", env.Type))
+	}
+
+	if repos.IsResaleReservationKey(failedMsg.ReservationKey) {
+		return s.releaseResale(failedMsg)
+	}
+	if repos.IsOrderReservationKey(failedMsg.ReservationKey) {
+		return s.failOrder(failedMsg)
+	}
+
+	purchase, err := s.purchaseRepo.GetPurchaseByTicketID(failedMsg.TicketID)
+	if err == sql.ErrNoRows {
+		log.Printf("No purchase for ticket %d, ignoring payment failure", failedMsg.TicketID)
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error loading purchase for ticket %d: %v", failedMsg.TicketID, err)
+		return err
+	}
+
+	switch {
+	case purchase.Status == "pending":
+		failed, err := s.purchaseRepo.FailPendingPurchaseByTicketID(failedMsg.TicketID)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Error cancelling purchase for ticket %d: %v", failedMsg.TicketID, err)
+			return err
+		}
+
+		log.Printf("Payment for ticket %d %s, releasing its hold", failedMsg.TicketID, failedMsg.Reason)
+		data := &models.SagaData{
+			EventID:        failed.EventID,
+			UserID:         failed.UserID,
+			TicketID:       failed.TicketID,
+			PurchaseID:     failed.PurchaseID,
+			ReservationKey: failed.ReservationKey,
+		}
+		// Failed steps are retried by the saga recovery loop.
+		if err := s.sagas.Run(saga.ExpireHold, data); err != nil {
+			log.Printf("Failed to release hold for purchase %d: %v", failed.PurchaseID, err)
+		}
+
+	case purchase.Status == "confirmed" && failedMsg.Reason == events.PaymentFailureRefunded:
+		userDetails, err := s.services.GetUser(purchase.UserID)
+		if err != nil {
+			log.Printf("Error fetching user %d: %v", purchase.UserID, err)
+			return err
+		}
+
+		cancelled, err := s.purchaseRepo.CancelConfirmedPurchase(purchase.PurchaseID)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Error cancelling purchase %d: %v", purchase.PurchaseID, err)
+			return err
+		}
+
+		log.Printf("Payment for ticket %d was refunded, cancelling purchase %d", failedMsg.TicketID, cancelled.PurchaseID)
+		data := &models.SagaData{
+			EventID:        cancelled.EventID,
+			UserID:         cancelled.UserID,
+			Amount:         cancelled.Amount,
+			Currency:       cancelled.Currency,
+			Email:          userDetails.Email,
+			TicketID:       cancelled.TicketID,
+			PurchaseID:     cancelled.PurchaseID,
+			ReservationKey: cancelled.ReservationKey,
+		}
+		if err := s.sagas.Run(saga.CancelPurchase, data); err != nil {
+			log.Printf("Failed to run cancellation saga for purchase %d: %v", cancelled.PurchaseID, err)
+		}
+
+	default:
+		log.Printf("Purchase for ticket %d is %s, ignoring payment failure (%s)", failedMsg.TicketID, purchase.Status, failedMsg.Reason)
+	}
+	return nil
 }
 
 func main() {
@@ -156,7 +468,42 @@ func main() {
 	router := gin.Default()
 
 	// Setup routes using the routes package
-	api.SetupRoutes(router, service.purchaseRepo)
+	// At the door, verifying a ticket checks it in
+	doorMode := os.Getenv("DOOR_MODE") == "true"
+
+	// Share of every resale price the platform keeps
+	resaleFeePercent := defaultResaleFeePercent
+	if v := os.Getenv("RESALE_FEE_PERCENT"); v != "" {
+		var err error
+		if resaleFeePercent, err = strconv.Atoi(v); err != nil || resaleFeePercent < 0 || resaleFeePercent > 100 {
+			log.Fatalf("Invalid RESALE_FEE_PERCENT %q: must be between 0 and 100", v)
+		}
+	}
+	api.SetupRoutes(router, api.Handlers{
+		Purchases: api.NewHandler(service.purchaseRepo, service.sagas, service.services, service.waitlistRepo, service.ticketKeys, service.admissions, doorMode),
+		Resale:    api.NewResaleHandler(service.resaleRepo, service.services, resaleFeePercent, service.holdTTL),
+		Waitlist:  api.NewWaitlistHandler(service.waitlistRepo, service.purchaseRepo, service.sagas, service.services),
+		Orders:    api.NewOrderHandler(service.orderRepo, service.purchaseRepo, service.waitlistRepo, service.sagas, service.services, service.admissions),
+	})
+
+	// Resume sagas left unfinished by a previous run
+	service.sagas.StartRecovery(sagaRecoveryInterval, sagaStaleAfter)
+
+	// Give back holds that were never paid for
+	holds.NewReaper(service.purchaseRepo, service.resaleRepo, service.sagas, holdReaperInterval).Start()
+
+	// Offer freed tickets to the users waiting for them
+	offerTTL := defaultWaitlistOfferTTL
+	if v := os.Getenv("WAITLIST_OFFER_TTL"); v != "" {
+		var err error
+		if offerTTL, err = time.ParseDuration(v); err != nil || offerTTL <= 0 {
+			log.Fatalf("Invalid WAITLIST_OFFER_TTL %q: must be a positive duration", v)
+		}
+	}
+	waitlist.NewOfferer(service.waitlistRepo, service.services, offerTTL, waitlistOfferInterval).Start()
+
+	// Publish messages written to the outbox
+	brokerOutbox.NewRelay(service.outbox, os.Getenv("RABBITMQ_URL"), "tixie", "topic", outboxRelayInterval, outbox.RoutingKeys...).Start()
 
 	// Handle graceful shutdown
 	quit := make(chan os.Signal, 1)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/saga"
+
+	"tixie.local/broker/events"
+)
+
+// settleOrder confirms every ticket of the order paid for by paymentMsg,
+// activates them and queues an email per ticket. It is safe to run again for
+// the same message.
+func (s *ReservationService) settleOrder(env events.Envelope, paymentMsg *events.PaymentConfirmed) error {
+	// Like a single ticket, an order whose hold started to expire is not
+	// confirmed, as its seats may have been sold to someone else, and its
+	// payment is refunded.
+	items, err := s.orderRepo.ConfirmOrder(paymentMsg.ReservationKey, paymentMsg.PaymentIntentID)
+	if err == sql.ErrNoRows {
+		items, err = s.orderRepo.GetItemsByReservationKey(paymentMsg.ReservationKey)
+		if err == sql.ErrNoRows {
+			log.Printf("No order for payment %s, ignoring it", paymentMsg.ReservationKey)
+			return nil
+		}
+		if err != nil {
+			log.Printf("Error loading order for payment %s: %v", paymentMsg.ReservationKey, err)
+			return err
+		}
+		if status := models.OrderStatus(items); status != models.OrderConfirmed {
+			// An order that recorded a payment was paid for and had
+			// tickets cancelled since, each with its own refund.
+			for _, item := range items {
+				if item.PaymentIntentID != "" {
+					log.Printf("Order %s is %s, ignoring payment confirmation", paymentMsg.ReservationKey, status)
+					return nil
+				}
+			}
+			log.Printf("Payment for order %s arrived after its hold was released (%s), refunding it", paymentMsg.ReservationKey, status)
+			return s.refundLatePayment(paymentMsg, paymentMsg.ReservationKey)
+		}
+	} else if err != nil {
+		log.Printf("Error confirming order for payment %s: %v", paymentMsg.ReservationKey, err)
+		return err
+	}
+
+	for i := range items {
+		if err := s.activateTicket(env.CorrelationID, &items[i]); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Successfully processed payment confirmation for order %s (%d tickets)", paymentMsg.ReservationKey, len(items))
+	return nil
+}
+
+// failOrder releases the holds of an order whose payment failed. The
+// tickets of an order whose payment was refunded outside of a cancellation
+// are cancelled without refunding again.
+func (s *ReservationService) failOrder(failedMsg *events.PaymentFailed) error {
+	items, err := s.orderRepo.GetItemsByReservationKey(failedMsg.ReservationKey)
+	if err == sql.ErrNoRows {
+		log.Printf("No order for payment %s, ignoring payment failure", failedMsg.ReservationKey)
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error loading order for payment %s: %v", failedMsg.ReservationKey, err)
+		return err
+	}
+
+	switch status := models.OrderStatus(items); {
+	case status == models.OrderPending:
+		failed, err := s.orderRepo.FailPendingOrder(failedMsg.ReservationKey)
+		if err != nil {
+			log.Printf("Error cancelling order for payment %s: %v", failedMsg.ReservationKey, err)
+			return err
+		}
+
+		log.Printf("Payment for order %s %s, releasing its holds", failedMsg.ReservationKey, failedMsg.Reason)
+		for _, item := range failed {
+			data := &models.SagaData{
+				EventID:        item.EventID,
+				UserID:         item.UserID,
+				TicketID:       item.TicketID,
+				PurchaseID:     item.PurchaseID,
+				ReservationKey: item.ReservationKey,
+			}
+			// Failed steps are retried by the saga recovery loop.
+			if err := s.sagas.Run(saga.ExpireHold, data); err != nil {
+				log.Printf("Failed to release hold for purchase %d: %v", item.PurchaseID, err)
+			}
+		}
+
+	case status != models.OrderCancelled && failedMsg.Reason == events.PaymentFailureRefunded:
+		userID := items[0].UserID
+		userDetails, err := s.services.GetUser(userID)
+		if err != nil {
+			log.Printf("Error fetching user %d: %v", userID, err)
+			return err
+		}
+
+		for _, item := range items {
+			if item.Status != "confirmed" {
+				continue
+			}
+			cancelled, err := s.purchaseRepo.CancelConfirmedPurchase(item.PurchaseID)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				log.Printf("Error cancelling purchase %d: %v", item.PurchaseID, err)
+				return err
+			}
+
+			log.Printf("Payment for order %s was refunded, cancelling purchase %d", failedMsg.ReservationKey, cancelled.PurchaseID)
+			data := &models.SagaData{
+				EventID:        cancelled.EventID,
+				UserID:         cancelled.UserID,
+				Amount:         cancelled.Amount,
+				Currency:       cancelled.Currency,
+				Email:          userDetails.Email,
+				TicketID:       cancelled.TicketID,
+				PurchaseID:     cancelled.PurchaseID,
+				ReservationKey: cancelled.ReservationKey,
+			}
+			if cancelled.OrderID != nil {
+				data.OrderID = *cancelled.OrderID
+			}
+			if err := s.sagas.Run(saga.CancelPurchase, data); err != nil {
+				log.Printf("Failed to run cancellation saga for purchase %d: %v", cancelled.PurchaseID, err)
+			}
+		}
+
+	default:
+		log.Printf("Order %s is %s, ignoring payment failure (%s)", failedMsg.ReservationKey, status, failedMsg.Reason)
+	}
+	return nil
+}
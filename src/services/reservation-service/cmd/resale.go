@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"reservation-service/internal/outbox"
+
+	brokerPkg "tixie.local/broker"
+	"tixie.local/broker/events"
+	brokerOutbox "tixie.local/broker/outbox"
+)
+
+// settleResale completes the resale paid for by paymentMsg: the listing is
+// marked sold, the ticket is re-issued to the buyer under a new code, the
+// buyer gets the ticket, the seller is told it was sold and the payout is
+// published. It is safe to run again for the same message.
+func (s *ReservationService) settleResale(env events.Envelope, paymentMsg *events.PaymentConfirmed) error {
+	// Selling the listing first keeps the hold from expiring under the
+	// buyer once the payment went through.
+	// A payment that arrives after its hold was released is refunded, as
+	// the listing may have been sold to someone else meanwhile.
+	listing, err := s.resaleRepo.SellListing(paymentMsg.ReservationKey, paymentMsg.PaymentIntentID)
+	if err == sql.ErrNoRows {
+		listing, err = s.resaleRepo.GetListingByReservationKey(paymentMsg.ReservationKey)
+		if err == sql.ErrNoRows {
+			// A later purchase attempt reserved the listing under a key
+			// of its own.
+			log.Printf("Resale payment %s arrived after its hold was released, refunding it", paymentMsg.ReservationKey)
+			return s.refundLatePayment(paymentMsg, paymentMsg.ReservationKey)
+		}
+		if err != nil {
+			log.Printf("Error loading listing for resale payment %s: %v", paymentMsg.ReservationKey, err)
+			return err
+		}
+		if listing.Status != "sold" {
+			log.Printf("Payment for listing %d arrived after its hold was released, refunding it", listing.ListingID)
+			return s.refundLatePayment(paymentMsg, paymentMsg.ReservationKey)
+		}
+	} else if err != nil {
+		log.Printf("Error selling listing for resale payment %s: %v", paymentMsg.ReservationKey, err)
+		return err
+	}
+
+	ticket, err := s.services.ResellTicket(listing.TicketID, listing.SellerUserID, *listing.BuyerUserID)
+	if err != nil {
+		log.Printf("Error re-issuing ticket %d of listing %d: %v", listing.TicketID, listing.ListingID, err)
+		return err
+	}
+
+	buyer, err := s.services.GetUser(*listing.BuyerUserID)
+	if err != nil {
+		log.Printf("Error fetching user %d: %v", *listing.BuyerUserID, err)
+		return err
+	}
+	seller, err := s.services.GetUser(listing.SellerUserID)
+	if err != nil {
+		log.Printf("Error fetching user %d: %v", listing.SellerUserID, err)
+		return err
+	}
+
+	var messages []brokerOutbox.Message
+	for _, e := range []events.Event{
+		&events.NotificationEmail{
+			RecipientEmail: buyer.Email,
+			TicketCode:     ticket.TicketCode,
+			TicketID:       ticket.TicketID,
+		},
+		&events.NotificationEmail{
+			RecipientEmail: seller.Email,
+			TicketID:       ticket.TicketID,
+			Kind:           events.EmailTicketTransferred,
+		},
+		&events.ResaleSettled{
+			ListingID:       listing.ListingID,
+			TicketID:        listing.TicketID,
+			EventID:         listing.EventID,
+			SellerUserID:    listing.SellerUserID,
+			BuyerUserID:     *listing.BuyerUserID,
+			Price:           listing.Price,
+			Fee:             listing.Fee,
+			Payout:          listing.Payout(),
+			Currency:        listing.Currency,
+			PaymentIntentID: listing.PaymentIntentID,
+		},
+	} {
+		msg, err := outbox.NewEvent(env.CorrelationID, e)
+		if err != nil {
+			log.Printf("Error building resale message: %v", err)
+			return brokerPkg.Permanent(err)
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := s.outbox.Enqueue(messages...); err != nil {
+		log.Printf("Error queueing resale messages: %v", err)
+		return err
+	}
+
+	log.Printf("Sold listing %d: ticket %d now belongs to user %d", listing.ListingID, listing.TicketID, *listing.BuyerUserID)
+	return nil
+}
+
+// releaseResale puts a listing whose payment failed back on the market. A
+// sold listing whose payment was refunded keeps its new holder; reversing a
+// resale is left to support.
+func (s *ReservationService) releaseResale(failedMsg *events.PaymentFailed) error {
+	listing, err := s.resaleRepo.ReleaseListing(failedMsg.ReservationKey)
+	if err == sql.ErrNoRows {
+		log.Printf("Listing of resale payment %s is not pending, ignoring payment failure (%s)", failedMsg.ReservationKey, failedMsg.Reason)
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error releasing listing of resale payment %s: %v", failedMsg.ReservationKey, err)
+		return err
+	}
+
+	log.Printf("Payment for listing %d %s, putting it back on the market", listing.ListingID, failedMsg.Reason)
+	return nil
+}
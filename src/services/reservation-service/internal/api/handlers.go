@@ -2,49 +2,35 @@ package api
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
+	"reservation-service/internal/clients"
 	"reservation-service/internal/db/models"
 	"reservation-service/internal/db/repos"
+	"reservation-service/internal/qr"
+	"reservation-service/internal/saga"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	brokerPkg "tixie.local/broker"
 	circuitbreaker "tixie.local/common"
+	"tixie.local/common/admission"
+	"tixie.local/common/paymentmethod"
+	"tixie.local/common/ticketsig"
 )
 
-type eventDetails struct {
-	Price float64 `json:"price"`
-}
-
-type userDetails struct {
-	Email string `json:"email"`
-}
-
-type ticketResponse struct {
-	TicketID   int    `json:"ticket_id"`
-	UserID     int    `json:"user_id"`
-	TicketCode string `json:"ticket_code"`
-}
-
 type paymentResponse struct {
 	ClientSecret   string `json:"client_secret"`
 	IdempotencyKey string `json:"idempotency_key"`
 }
 
-type qrResponse struct {
-	Symbol []struct {
-		Data  string `json:"data"`
-		Error string `json:"error"`
-	} `json:"symbol"`
-}
-
 type ticketVerificationResponse struct {
 	TicketID int    `json:"ticket_id"`
 	EventID  int    `json:"event_id"`
@@ -52,26 +38,40 @@ type ticketVerificationResponse struct {
 	Status   string `json:"status"`
 }
 
+// admissionTokenHeader carries the waiting room's admission token of a
+// ticket purchase.
+const admissionTokenHeader = "X-Admission-Token"
+
 type Handler struct {
 	repo       *repos.PurchaseRepository
 	httpClient *http.Client
-	broker     *brokerPkg.Broker
 	breaker    *circuitbreaker.Breaker
+	services   *clients.ServiceClients
+	sagas      *saga.Orchestrator
+	waitlist   *repos.WaitlistRepository
+	ticketKeys *ticketsig.Keyring
+	admissions *admission.Verifier
+	doorMode   bool
 }
 
-func NewHandler(repo *repos.PurchaseRepository) *Handler {
-	broker, err := brokerPkg.NewBroker(os.Getenv("RABBITMQ_URL"), "payment", "topic")
-	if err != nil {
-		log.Printf("Warning: Failed to create broker: %v", err)
-	}
-
+// NewHandler creates a new Handler with dependencies. Tickets are not sold
+// while users are on the event's waitlist, nor during a protected on-sale to
+// users without an admission token checked by admissions. Ticket QR codes are
+// only accepted when they are signed with one of ticketKeys. In door mode,
+// verifying a ticket also checks it in, so it cannot be used twice.
+func NewHandler(repo *repos.PurchaseRepository, sagas *saga.Orchestrator, services *clients.ServiceClients, waitlist *repos.WaitlistRepository, ticketKeys *ticketsig.Keyring, admissions *admission.Verifier, doorMode bool) *Handler {
 	return &Handler{
 		repo: repo,
 		httpClient: &http.Client{
 			Timeout: 5 * time.Second,
 		},
-		broker:  broker,
-		breaker: circuitbreaker.NewBreaker("reservation-service"),
+		breaker:    circuitbreaker.NewBreaker("reservation-service"),
+		services:   services,
+		sagas:      sagas,
+		waitlist:   waitlist,
+		ticketKeys: ticketKeys,
+		admissions: admissions,
+		doorMode:   doorMode,
 	}
 }
 
@@ -79,187 +79,269 @@ func (h *Handler) ReserveTicket(c *gin.Context) {
 	log.Println("ReserveTicket called")
 	var input struct {
 		EventID int `json:"event_id" binding:"required,gt=0"`
-		UserID  int `json:"user_id" binding:"required,gt=0"`
+		// TicketTypeID is required for events that sell ticket types.
+		TicketTypeID  int    `json:"ticket_type_id" binding:"omitempty,gt=0"`
+		UserID        int    `json:"user_id" binding:"required,gt=0"`
+		PaymentMethod string `json:"payment_method"`
 	}
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
 		return
 	}
+	method, err := paymentmethod.Parse(input.PaymentMethod)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
 
-	// Fetch event details with circuit breaker
-	result := h.breaker.Execute(func() (interface{}, error) {
-		resp, err := h.httpClient.Get(fmt.Sprintf("%s/v1/%d", os.Getenv("EVENT_SERVICE_URL"), input.EventID))
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("event service returned status %d", resp.StatusCode)
+	eventDetails, err := h.services.GetEvent(input.EventID)
+	if err != nil {
+		if circuitbreaker.IsCircuitBreakerError(err) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(err)
+			c.JSON(status, gin.H{"error": msg})
+			return
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch event details: %v", err)})
+		return
+	}
 
-		var details eventDetails
-		if err := json.NewDecoder(resp.Body).Decode(&details); err != nil {
-			return nil, err
-		}
-		return details, nil
-	})
+	if !admitted(h.admissions, c, eventDetails, input.EventID, input.UserID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This on-sale is protected by the waiting room, join the queue to be admitted"})
+		return
+	}
 
-	if result.Error != nil {
-		if circuitbreaker.IsCircuitBreakerError(result.Error) {
-			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+	userDetails, err := h.services.GetUser(input.UserID)
+	if err != nil {
+		if circuitbreaker.IsCircuitBreakerError(err) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(err)
 			c.JSON(status, gin.H{"error": msg})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch event details: %v", result.Error)})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch user details: %v", err)})
 		return
 	}
 
-	eventDetails, ok := result.Data.(eventDetails)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse event response"})
+	if !paymentmethod.Allowed(eventDetails.PaymentMethods, method) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Event does not accept payment method %s", method)})
 		return
 	}
 
-	// Fetch user details with circuit breaker
-	result = h.breaker.Execute(func() (interface{}, error) {
-		resp, err := h.httpClient.Get(fmt.Sprintf("%s/v1/%d", os.Getenv("USER_SERVICE_URL"), input.UserID))
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
+	ticketType, err := eventDetails.TicketTypeOnSale(input.TicketTypeID, time.Now())
+	if err != nil {
+		c.JSON(ticketTypeErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if ok, err := withinPerUserLimit(h.repo, ticketType, input.UserID, 1); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	} else if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("At most %d %s tickets can be bought per user", *ticketType.PerUserLimit, ticketType.Name)})
+		return
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("user service returned status %d", resp.StatusCode)
-		}
+	price, err := eventDetails.FaceValue(input.TicketTypeID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Invalid event price: %v", err)})
+		return
+	}
 
-		var details userDetails
-		if err := json.NewDecoder(resp.Body).Decode(&details); err != nil {
-			return nil, err
-		}
-		return details, nil
-	})
+	// Freed tickets belong to the users waiting for them, so nobody jumps
+	// the queue by buying one before it is offered.
+	waiting, err := h.waitlist.HasWaiting(input.EventID, input.TicketTypeID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	if waiting {
+		c.JSON(http.StatusConflict, gin.H{"error": "Tickets are being offered to the event's waitlist, join it to get one"})
+		return
+	}
 
-	if result.Error != nil {
-		if circuitbreaker.IsCircuitBreakerError(result.Error) {
-			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+	// The hold (inventory, held ticket, pending purchase) is placed by a
+	// saga so a failure half way through undoes whatever was already done.
+	// The purchase is confirmed once payment.confirmed arrives.
+	data := &models.SagaData{
+		EventID:       input.EventID,
+		TicketTypeID:  input.TicketTypeID,
+		PerUserLimit:  perUserLimit(ticketType),
+		UserID:        input.UserID,
+		Amount:        price.Amount,
+		Currency:      price.Currency,
+		PaymentMethod: method,
+		Email:         userDetails.Email,
+	}
+	if err := h.sagas.Run(saga.ReserveTicket, data); err != nil {
+		if errors.Is(err, clients.ErrNotEnoughTickets) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Not enough tickets available, join the waitlist to be offered one when it frees up"})
+			return
+		}
+		if errors.Is(err, repos.ErrPerUserLimit) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("At most %d %s tickets can be bought per user", *ticketType.PerUserLimit, ticketType.Name)})
+			return
+		}
+		if circuitbreaker.IsCircuitBreakerError(err) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(err)
 			c.JSON(status, gin.H{"error": msg})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch user details: %v", result.Error)})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to reserve ticket: %v", err)})
 		return
 	}
 
-	userDetails, ok := result.Data.(userDetails)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse user response"})
+	createdPurchase, err := h.repo.GetPurchaseByID(data.PurchaseID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
 		return
 	}
 
-	// Create ticket with circuit breaker
-	result = h.breaker.Execute(func() (interface{}, error) {
-		ticketReq := struct {
-			EventID int `json:"event_id"`
-			UserID  int `json:"user_id"`
-		}{EventID: input.EventID, UserID: input.UserID}
+	c.JSON(http.StatusCreated, createdPurchase)
+}
 
-		ticketReqBody, err := json.Marshal(ticketReq)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal ticket request: %v", err)
-		}
+// CancelPurchase cancels a confirmed purchase while the event's cancellation
+// window is open. The refund, ticket cancellation, inventory release and
+// notification run as a saga, so they are recorded step by step and finish
+// even if a downstream service is briefly unavailable. Cancelling an already
+// cancelled purchase returns it unchanged.
+func (h *Handler) CancelPurchase(c *gin.Context) {
+	log.Println("CancelPurchase called")
+	purchaseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid purchase ID"})
+		return
+	}
 
-		resp, err := h.httpClient.Post(os.Getenv("TICKET_SERVICE_URL")+"/v1", "application/json", bytes.NewBuffer(ticketReqBody))
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
+	purchase, err := h.repo.GetPurchaseByID(purchaseID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Purchase not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	if purchase.Status == "cancelled" {
+		c.JSON(http.StatusOK, purchase)
+		return
+	}
+	if purchase.Status != "confirmed" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Purchase is %s and cannot be cancelled", purchase.Status)})
+		return
+	}
 
-		if resp.StatusCode != http.StatusCreated {
-			return nil, fmt.Errorf("ticket service returned status %d", resp.StatusCode)
+	eventDetails, err := h.services.GetEvent(purchase.EventID)
+	if err != nil {
+		if circuitbreaker.IsCircuitBreakerError(err) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(err)
+			c.JSON(status, gin.H{"error": msg})
+			return
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch event details: %v", err)})
+		return
+	}
 
-		var ticket ticketResponse
-		if err := json.NewDecoder(resp.Body).Decode(&ticket); err != nil {
-			return nil, err
-		}
-		return ticket, nil
-	})
+	deadline, err := eventDetails.CancellationDeadline()
+	if errors.Is(err, clients.ErrCancellationClosed) {
+		c.JSON(http.StatusConflict, gin.H{"error": "This event does not allow cancellations"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if time.Now().After(deadline) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cancellation window closed", "deadline": deadline})
+		return
+	}
 
-	if result.Error != nil {
-		if circuitbreaker.IsCircuitBreakerError(result.Error) {
-			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+	// A transferred or resold ticket belongs to someone else now, so its
+	// buyer can no longer cancel it and take the refund. A listed ticket may
+	// be about to be.
+	ticket, err := h.services.GetTicket(purchase.TicketID)
+	if err != nil {
+		if circuitbreaker.IsCircuitBreakerError(err) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(err)
 			c.JSON(status, gin.H{"error": msg})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create ticket: %v", result.Error)})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch ticket: %v", err)})
 		return
 	}
-
-	ticketResp, ok := result.Data.(ticketResponse)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse ticket response"})
+	if ticket.UserID != purchase.UserID {
+		c.JSON(http.StatusConflict, gin.H{"error": "Ticket was transferred to another user and can no longer be cancelled"})
 		return
 	}
-
-	// Create purchase with circuit breaker
-	purchase := &models.Purchase{
-		TicketID:     ticketResp.TicketID,
-		UserID:       input.UserID,
-		EventID:      input.EventID,
-		PurchaseDate: time.Now().UTC(),
-		Status:       "confirmed",
+	if ticket.Status == "listed" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Ticket is listed for resale, cancel the listing first"})
+		return
 	}
 
-	result = h.breaker.Execute(func() (interface{}, error) {
-		return h.repo.CreatePurchase(purchase)
-	})
-
-	if result.Error != nil {
-		if circuitbreaker.IsCircuitBreakerError(result.Error) {
-			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+	userDetails, err := h.services.GetUser(purchase.UserID)
+	if err != nil {
+		if circuitbreaker.IsCircuitBreakerError(err) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(err)
 			c.JSON(status, gin.H{"error": msg})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + result.Error.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch user details: %v", err)})
 		return
 	}
 
-	createdPurchase, ok := result.Data.(*models.Purchase)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create purchase"})
+	// Only the request that moves the purchase out of "confirmed" starts
+	// the saga, so concurrent or repeated cancels refund at most once.
+	cancelled, err := h.repo.CancelConfirmedPurchase(purchaseID)
+	if err == sql.ErrNoRows {
+		current, getErr := h.repo.GetPurchaseByID(purchaseID)
+		if getErr == nil && current.Status == "cancelled" {
+			c.JSON(http.StatusOK, current)
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Purchase can no longer be cancelled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
 		return
 	}
 
-	// Publish messages with circuit breaker
-	if h.broker != nil {
-		result = h.breaker.Execute(func() (interface{}, error) {
-			paymentMsg := struct {
-				TicketID int `json:"ticket_id"`
-				Amount   int `json:"amount"`
-			}{
-				TicketID: ticketResp.TicketID,
-				Amount:   int(eventDetails.Price * 100), // Convert to cents
-			}
-			if err := h.broker.Publish(paymentMsg, "topay"); err != nil {
-				return nil, err
-			}
+	data := &models.SagaData{
+		EventID:         cancelled.EventID,
+		UserID:          cancelled.UserID,
+		Amount:          cancelled.Amount,
+		Currency:        cancelled.Currency,
+		PaymentMethod:   cancelled.PaymentMethod,
+		Email:           userDetails.Email,
+		TicketID:        cancelled.TicketID,
+		PurchaseID:      cancelled.PurchaseID,
+		ReservationKey:  cancelled.ReservationKey,
+		PaymentIntentID: cancelled.PaymentIntentID,
+	}
+	if cancelled.OrderID != nil {
+		data.OrderID = *cancelled.OrderID
+	}
+	// Failed steps stay in the saga table and are retried by the saga
+	// recovery loop, so the cancellation stands either way.
+	if err := h.sagas.Run(saga.CancelPurchase, data); err != nil {
+		log.Printf("Failed to run cancellation saga for purchase %d: %v", purchaseID, err)
+	}
 
-			notificationMsg := struct {
-				RecipientEmail string `json:"recipient_email"`
-				TicketID       string `json:"ticket_id"`
-			}{
-				RecipientEmail: userDetails.Email,
-				TicketID:       ticketResp.TicketCode,
-			}
-			return nil, h.broker.Publish(notificationMsg, "email")
-		})
+	c.JSON(http.StatusOK, cancelled)
+}
 
-		if result.Error != nil {
-			log.Printf("Warning: Failed to publish messages: %v", result.Error)
+// admitted reports whether the user may buy tickets to the event. During a
+// protected on-sale only users the waiting room admitted may, so nobody skips
+// the queue by calling reservation-service directly. A request for tickets to
+// several protected events carries an admission token for each.
+func admitted(admissions *admission.Verifier, c *gin.Context, event *clients.EventDetails, eventID, userID int) bool {
+	now := time.Now()
+	if !event.QueueProtected(now) {
+		return true
+	}
+	for _, token := range c.Request.Header.Values(admissionTokenHeader) {
+		if _, err := admissions.VerifyFor(token, admission.KindAdmission, eventID, userID, now); err == nil {
+			return true
 		}
 	}
-
-	c.JSON(http.StatusCreated, createdPurchase)
+	return false
 }
 
 func (h *Handler) handlePayment(amount int) (bool, error) {
@@ -339,132 +421,44 @@ func (h *Handler) VerifyTicket(c *gin.Context) {
 		return
 	}
 
-	var qrData string
-	// Check for file or URL
+	// Only uploaded images are read. Fetching user-supplied URLs would let
+	// anyone make this service send requests on their behalf.
+	if c.Request.FormValue("url") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "QR code URLs are not supported, upload the image as file"})
+		return
+	}
 	file, _, err := c.Request.FormFile("file")
-	if err == nil {
-		defer file.Close()
-
-		result := h.breaker.Execute(func() (interface{}, error) {
-			// Send QR code image to goqr.me
-			body := &bytes.Buffer{}
-			writer := multipart.NewWriter(body)
-			part, err := writer.CreateFormFile("file", "qr.png")
-			if err != nil {
-				return nil, fmt.Errorf("failed to create form file: %v", err)
-			}
-			if _, err := io.Copy(part, file); err != nil {
-				return nil, fmt.Errorf("failed to copy file: %v", err)
-			}
-			writer.Close()
-
-			req, err := http.NewRequest("POST", "https://api.qrserver.com/v1/read-qr-code/", body)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create QR request: %v", err)
-			}
-			req.Header.Set("Content-Type", writer.FormDataContentType())
-
-			resp, err := h.httpClient.Do(req)
-			if err != nil {
-				return nil, fmt.Errorf("QR service error: %v", err)
-			}
-			defer resp.Body.Close()
-
-			var qrResp []qrResponse
-			if err := json.NewDecoder(resp.Body).Decode(&qrResp); err != nil {
-				return nil, fmt.Errorf("failed to parse QR response: %v", err)
-			}
-			if len(qrResp) == 0 || len(qrResp[0].Symbol) == 0 {
-				return nil, fmt.Errorf("invalid QR code")
-			}
-			if qrResp[0].Symbol[0].Error != "" {
-				return nil, fmt.Errorf("QR code error: %v", qrResp[0].Symbol[0].Error)
-			}
-			return qrResp[0].Symbol[0].Data, nil
-		})
-
-		if result.Error != nil {
-			if circuitbreaker.IsCircuitBreakerError(result.Error) {
-				status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
-				c.JSON(status, gin.H{"error": msg})
-				return
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
-			return
-		}
-
-		var ok bool
-		qrData, ok = result.Data.(string)
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid QR response type"})
-			return
-		}
-	} else if url := c.Request.FormValue("url"); url != "" {
-		result := h.breaker.Execute(func() (interface{}, error) {
-			// Send QR code URL to goqr.me
-			body := &bytes.Buffer{}
-			writer := multipart.NewWriter(body)
-			if err := writer.WriteField("file", "@url:"+url); err != nil {
-				return nil, fmt.Errorf("failed to write URL field: %v", err)
-			}
-			writer.Close()
-
-			req, err := http.NewRequest("POST", "https://api.qrserver.com/v1/read-qr-code/", body)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create QR request: %v", err)
-			}
-			req.Header.Set("Content-Type", writer.FormDataContentType())
-
-			resp, err := h.httpClient.Do(req)
-			if err != nil {
-				return nil, fmt.Errorf("QR service error: %v", err)
-			}
-			defer resp.Body.Close()
-
-			var qrResp []qrResponse
-			if err := json.NewDecoder(resp.Body).Decode(&qrResp); err != nil {
-				return nil, fmt.Errorf("failed to parse QR response: %v", err)
-			}
-			if len(qrResp) == 0 || len(qrResp[0].Symbol) == 0 {
-				return nil, fmt.Errorf("invalid QR code")
-			}
-			if qrResp[0].Symbol[0].Error != "" {
-				return nil, fmt.Errorf("QR code error: %v", qrResp[0].Symbol[0].Error)
-			}
-			return qrResp[0].Symbol[0].Data, nil
-		})
-
-		if result.Error != nil {
-			if circuitbreaker.IsCircuitBreakerError(result.Error) {
-				status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
-				c.JSON(status, gin.H{"error": msg})
-				return
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
-			return
-		}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+		return
+	}
+	defer file.Close()
 
-		var ok bool
-		qrData, ok = result.Data.(string)
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid QR response type"})
-			return
-		}
-	} else {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No file or URL provided"})
+	qrData, err := qr.Decode(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"valid": false, "error": err.Error()})
 		return
 	}
 
-	// Extract ticket_code (assume format "ticket_code:<UUID>")
-	ticketCode := qrData
-	if strings.HasPrefix(qrData, "ticket_code:") {
-		ticketCode = strings.TrimPrefix(qrData, "ticket_code:")
+	// The signature is checked first, so forged or guessed codes are turned
+	// away without asking ticket-service about them.
+	claims, err := h.ticketKeys.Verify(qrData)
+	if err != nil {
+		log.Printf("Rejected ticket QR code: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"valid": false, "error": "Ticket is not genuine"})
+		return
 	}
+	ticketCode := claims.TicketCode
 	if !isValidUUID(ticketCode) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket code format"})
 		return
 	}
 
+	if h.doorMode {
+		h.checkInTicket(c, ticketCode, claims)
+		return
+	}
+
 	// Query ticket service to verify ticket with circuit breaker
 	var result circuitbreaker.Result
 	result = h.breaker.Execute(func() (interface{}, error) {
@@ -509,19 +503,104 @@ func (h *Handler) VerifyTicket(c *gin.Context) {
 		return
 	}
 
+	if ticket.TicketID != claims.TicketID || ticket.EventID != claims.EventID {
+		c.JSON(http.StatusBadRequest, gin.H{"valid": false, "error": "Ticket is not genuine"})
+		return
+	}
 	if ticket.Status != "active" {
 		c.JSON(http.StatusNotFound, gin.H{"valid": false, "error": "Ticket is not active"})
 		return
 	}
 
+	// The ticket type comes from the signed payload, so staff can tell a
+	// VIP ticket at the gate without another lookup.
 	c.JSON(http.StatusOK, gin.H{
-		"valid":     true,
-		"ticket_id": ticket.TicketID,
-		"event_id":  ticket.EventID,
-		"user_id":   ticket.UserID,
+		"valid":          true,
+		"ticket_id":      ticket.TicketID,
+		"event_id":       ticket.EventID,
+		"ticket_type_id": claims.TicketTypeID,
+		"user_id":        ticket.UserID,
 	})
 }
 
+// checkInTicket lets a ticket in at the gate named by the gate_id form field.
+// Ticket-service admits each ticket once, so a ticket scanned at two gates at
+// the same time is only let in at one of them, and only if it matches the
+// signed claims.
+func (h *Handler) checkInTicket(c *gin.Context, ticketCode string, claims ticketsig.Claims) {
+	gateID := c.Request.FormValue("gate_id")
+	if gateID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "gate_id is required at the door"})
+		return
+	}
+
+	checkIn, err := h.services.CheckInTicket(ticketCode, gateID, c.Request.FormValue("scanner_id"), claims.TicketID, claims.EventID)
+	if err != nil {
+		if circuitbreaker.IsCircuitBreakerError(err) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(err)
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch checkIn.Result {
+	case clients.CheckInCheckedIn:
+		c.JSON(http.StatusOK, gin.H{
+			"valid":          true,
+			"checked_in":     true,
+			"ticket_id":      checkIn.Ticket.TicketID,
+			"event_id":       checkIn.Ticket.EventID,
+			"ticket_type_id": claims.TicketTypeID,
+			"user_id":        checkIn.Ticket.UserID,
+		})
+	case clients.CheckInAlreadyUsed:
+		c.JSON(http.StatusConflict, gin.H{"valid": false, "result": checkIn.Result, "error": checkIn.Message})
+	case clients.CheckInNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"valid": false, "result": checkIn.Result, "error": "ticket not found or inactive"})
+	case clients.CheckInNotGenuine:
+		c.JSON(http.StatusBadRequest, gin.H{"valid": false, "result": checkIn.Result, "error": "Ticket is not genuine"})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"valid": false, "result": checkIn.Result, "error": "Ticket is not active"})
+	}
+}
+
+// ticketTypeErrorStatus returns the status of a request for a ticket type
+// that cannot be sold: a conflict while it is off sale, otherwise a bad
+// request.
+func ticketTypeErrorStatus(err error) int {
+	if errors.Is(err, clients.ErrTicketTypeNotOnSale) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// withinPerUserLimit reports whether the user may buy quantity more tickets
+// of ticketType. Tickets without a type, or of a type without a limit, are
+// not limited. It turns requests over the limit away before any tickets are
+// held; the limit is enforced when the purchase is written, see
+// repos.ErrPerUserLimit.
+func withinPerUserLimit(purchases *repos.PurchaseRepository, ticketType *clients.TicketType, userID, quantity int) (bool, error) {
+	if ticketType == nil || ticketType.PerUserLimit == nil {
+		return true, nil
+	}
+	held, err := purchases.CountActiveTickets(userID, ticketType.ID)
+	if err != nil {
+		return false, err
+	}
+	return held+quantity <= *ticketType.PerUserLimit, nil
+}
+
+// perUserLimit returns the per-user limit of ticketType for the saga, zero
+// if it has none.
+func perUserLimit(ticketType *clients.TicketType) int {
+	if ticketType == nil || ticketType.PerUserLimit == nil {
+		return 0
+	}
+	return *ticketType.PerUserLimit
+}
+
 // isValidUUID checks if the string is a valid UUID
 func isValidUUID(s string) bool {
 	if len(s) != 36 {
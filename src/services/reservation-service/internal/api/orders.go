@@ -0,0 +1,210 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"reservation-service/internal/saga"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"tixie.local/common/admission"
+	"tixie.local/common/paymentmethod"
+)
+
+// maxOrderTickets is the most tickets a single order may hold.
+const maxOrderTickets = 10
+
+// OrderHandler serves orders: checkouts of several tickets, possibly to
+// several events, paid for with a single payment.
+type OrderHandler struct {
+	repo       *repos.OrderRepository
+	purchases  *repos.PurchaseRepository
+	waitlist   *repos.WaitlistRepository
+	sagas      *saga.Orchestrator
+	services   *clients.ServiceClients
+	admissions *admission.Verifier
+}
+
+// NewOrderHandler creates a new OrderHandler. Like single tickets, orders
+// are refused for events with a waitlist, and during a protected on-sale to
+// users without an admission token checked by admissions. The tickets a
+// user already bought, found in purchases, count towards the per-user limits
+// of ticket types.
+func NewOrderHandler(repo *repos.OrderRepository, purchases *repos.PurchaseRepository, waitlist *repos.WaitlistRepository, sagas *saga.Orchestrator, services *clients.ServiceClients, admissions *admission.Verifier) *OrderHandler {
+	return &OrderHandler{
+		repo:       repo,
+		purchases:  purchases,
+		waitlist:   waitlist,
+		sagas:      sagas,
+		services:   services,
+		admissions: admissions,
+	}
+}
+
+// PlaceOrder holds every ticket of an order and requests a single payment
+// for its total. The tickets are held all together or not at all, and are
+// confirmed together once the payment arrives.
+func (h *OrderHandler) PlaceOrder(c *gin.Context) {
+	log.Println("PlaceOrder called")
+	var input struct {
+		UserID        int    `json:"user_id" binding:"required,gt=0"`
+		PaymentMethod string `json:"payment_method"`
+		Items         []struct {
+			EventID int `json:"event_id" binding:"required,gt=0"`
+			// TicketTypeID is required for events that sell ticket types.
+			TicketTypeID int `json:"ticket_type_id" binding:"omitempty,gt=0"`
+			Quantity     int `json:"quantity" binding:"required,gt=0"`
+		} `json:"items" binding:"required,min=1,dive"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+	method, err := paymentmethod.Parse(input.PaymentMethod)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+	// Payments at the door are collected ticket by ticket as they are
+	// scanned, which a single payment for the whole order cannot be.
+	if method != paymentmethod.Card {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Orders cannot be paid by %s, reserve those tickets one at a time", method)})
+		return
+	}
+
+	type itemKey struct{ eventID, ticketTypeID int }
+	quantity := 0
+	seen := make(map[itemKey]bool)
+	for _, item := range input.Items {
+		key := itemKey{item.EventID, item.TicketTypeID}
+		if seen[key] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Tickets of event %d appear more than once in the order", item.EventID)})
+			return
+		}
+		seen[key] = true
+		quantity += item.Quantity
+	}
+	if quantity > maxOrderTickets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("An order holds at most %d tickets", maxOrderTickets)})
+		return
+	}
+
+	userDetails, err := h.services.GetUser(input.UserID)
+	if err != nil {
+		respondServiceError(c, "Failed to fetch user details", err)
+		return
+	}
+
+	data := &models.SagaData{
+		UserID:        input.UserID,
+		PaymentMethod: method,
+		Email:         userDetails.Email,
+	}
+	for _, item := range input.Items {
+		eventDetails, err := h.services.GetEvent(item.EventID)
+		if err != nil {
+			respondServiceError(c, "Failed to fetch event details", err)
+			return
+		}
+		if !admitted(h.admissions, c, eventDetails, item.EventID, input.UserID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("The on-sale of event %d is protected by the waiting room, join the queue to be admitted", item.EventID)})
+			return
+		}
+		if !paymentmethod.Allowed(eventDetails.PaymentMethods, method) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Event %d does not accept payment method %s", item.EventID, method)})
+			return
+		}
+
+		ticketType, err := eventDetails.TicketTypeOnSale(item.TicketTypeID, time.Now())
+		if err != nil {
+			c.JSON(ticketTypeErrorStatus(err), gin.H{"error": fmt.Sprintf("Event %d: %v", item.EventID, err)})
+			return
+		}
+		if ok, err := withinPerUserLimit(h.purchases, ticketType, input.UserID, item.Quantity); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		} else if !ok {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("At most %d %s tickets to event %d can be bought per user", *ticketType.PerUserLimit, ticketType.Name, item.EventID)})
+			return
+		}
+
+		price, err := eventDetails.FaceValue(item.TicketTypeID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Invalid price of event %d: %v", item.EventID, err)})
+			return
+		}
+		if data.Currency == "" {
+			data.Currency = price.Currency
+		}
+		if price.Currency != data.Currency {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Every ticket of an order must be priced in the same currency"})
+			return
+		}
+
+		waiting, err := h.waitlist.HasWaiting(item.EventID, item.TicketTypeID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		}
+		if waiting {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Tickets to event %d are being offered to its waitlist, join it to get one", item.EventID)})
+			return
+		}
+
+		for i := 0; i < item.Quantity; i++ {
+			data.OrderTickets = append(data.OrderTickets, models.OrderTicket{EventID: item.EventID, TicketTypeID: item.TicketTypeID, PerUserLimit: perUserLimit(ticketType), Amount: price.Amount})
+			data.Amount += price.Amount
+		}
+	}
+
+	if err := h.sagas.Run(saga.ReserveOrder, data); err != nil {
+		if errors.Is(err, clients.ErrNotEnoughTickets) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Not enough tickets available for the whole order"})
+			return
+		}
+		if errors.Is(err, repos.ErrPerUserLimit) {
+			c.JSON(http.StatusConflict, gin.H{"error": "The order would take you over a ticket type's per-user limit"})
+			return
+		}
+		respondServiceError(c, "Failed to place order", err)
+		return
+	}
+
+	order, err := h.repo.GetOrder(data.OrderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, order)
+}
+
+// GetOrder returns an order with its line items. Its status rolls up from
+// theirs.
+func (h *OrderHandler) GetOrder(c *gin.Context) {
+	log.Println("GetOrder called")
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	order, err := h.repo.GetOrder(orderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"reservation-service/internal/outbox"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"tixie.local/broker/events"
+	circuitbreaker "tixie.local/common"
+	"tixie.local/common/money"
+	"tixie.local/common/paymentmethod"
+)
+
+// errEventStarted is returned for resales of events that already started.
+var errEventStarted = errors.New("event has already started")
+
+// ResaleHandler serves the resale market, where holders sell their tickets
+// to other users at no more than the event's price cap.
+type ResaleHandler struct {
+	repo       *repos.ResaleRepository
+	services   *clients.ServiceClients
+	feePercent int
+	holdTTL    time.Duration
+}
+
+// NewResaleHandler creates a new ResaleHandler. The platform keeps
+// feePercent of every sale, and buyers have holdTTL to pay for a listing.
+func NewResaleHandler(repo *repos.ResaleRepository, services *clients.ServiceClients, feePercent int, holdTTL time.Duration) *ResaleHandler {
+	return &ResaleHandler{
+		repo:       repo,
+		services:   services,
+		feePercent: feePercent,
+		holdTTL:    holdTTL,
+	}
+}
+
+// CreateListing puts a ticket on the resale market at a price no higher
+// than the event's cap. The ticket cannot be used or transferred while it is
+// listed.
+func (h *ResaleHandler) CreateListing(c *gin.Context) {
+	log.Println("CreateListing called")
+	var input struct {
+		TicketID     int         `json:"ticket_id" binding:"required,gt=0"`
+		SellerUserID int         `json:"seller_user_id" binding:"required,gt=0"`
+		Price        json.Number `json:"price" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	ticket, err := h.services.GetTicket(input.TicketID)
+	if err != nil {
+		respondServiceError(c, "Failed to fetch ticket", err)
+		return
+	}
+	if ticket.UserID != input.SellerUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Ticket does not belong to seller_user_id"})
+		return
+	}
+
+	eventDetails, err := h.openEvent(ticket.EventID)
+	if err != nil {
+		respondResaleClosed(c, err)
+		return
+	}
+	priceCap, err := eventDetails.ResalePriceCap(ticket.TicketTypeID)
+	if err != nil {
+		respondResaleClosed(c, err)
+		return
+	}
+	price, err := money.Parse(input.Price.String(), priceCap.Currency)
+	if err != nil || price.Amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid price %q", input.Price)})
+		return
+	}
+	if price.Amount > priceCap.Amount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Price exceeds the resale cap of %s", priceCap)})
+		return
+	}
+
+	// Ticket-service checks the holder and status again as it lists the
+	// ticket, so a ticket used or transferred meanwhile is not listed.
+	if _, err := h.services.ListTicket(input.TicketID, input.SellerUserID); err != nil {
+		respondServiceError(c, "Failed to list ticket", err)
+		return
+	}
+
+	listing, err := h.repo.CreateListing(&models.ResaleListing{
+		TicketID:     input.TicketID,
+		EventID:      ticket.EventID,
+		SellerUserID: input.SellerUserID,
+		Price:        price.Amount,
+		Fee:          price.Amount * int64(h.feePercent) / 100,
+		Currency:     price.Currency,
+	})
+	if errors.Is(err, repos.ErrAlreadyListed) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Ticket is already listed for resale"})
+		return
+	}
+	if err != nil {
+		// Without a listing nobody can buy the ticket, so give it back
+		if _, unlistErr := h.services.UnlistTicket(input.TicketID, input.SellerUserID); unlistErr != nil {
+			log.Printf("Failed to unlist ticket %d after its listing failed: %v", input.TicketID, unlistErr)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, listing)
+}
+
+// GetListings lists the tickets of the event in the event_id query parameter
+// that are for sale, cheapest first.
+func (h *ResaleHandler) GetListings(c *gin.Context) {
+	log.Println("GetListings called")
+	eventID, err := strconv.Atoi(c.Query("event_id"))
+	if err != nil || eventID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "event_id must be a positive integer"})
+		return
+	}
+
+	listings, err := h.repo.GetOpenListings(eventID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"event_id": eventID, "listings": listings})
+}
+
+// GetListing returns a listing.
+func (h *ResaleHandler) GetListing(c *gin.Context) {
+	log.Println("GetListing called")
+	listingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid listing ID"})
+		return
+	}
+
+	listing, err := h.repo.GetListing(listingID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Listing not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, listing)
+}
+
+// CancelListing takes a listing off the market and makes the ticket usable
+// again. A listing a buyer is paying for cannot be cancelled. Cancelling a
+// cancelled listing is safe, and retries giving the ticket back.
+func (h *ResaleHandler) CancelListing(c *gin.Context) {
+	log.Println("CancelListing called")
+	listingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid listing ID"})
+		return
+	}
+	var input struct {
+		SellerUserID int `json:"seller_user_id" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	// The listing is closed first, so nobody starts buying the ticket
+	// while it is given back.
+	listing, err := h.repo.CancelListing(listingID, input.SellerUserID)
+	if err == sql.ErrNoRows {
+		listing, err = h.repo.GetListing(listingID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Listing not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		}
+		if listing.SellerUserID != input.SellerUserID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Listing does not belong to seller_user_id"})
+			return
+		}
+		if listing.Status != "cancelled" {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Listing is %s and cannot be cancelled", listing.Status)})
+			return
+		}
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	if _, err := h.services.UnlistTicket(listing.TicketID, listing.SellerUserID); err != nil && !errors.Is(err, clients.ErrTicketRefused) {
+		respondServiceError(c, "Listing cancelled, but the ticket could not be given back. Please retry", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, listing)
+}
+
+// BuyListing holds a listing for a buyer and requests the payment, which
+// goes through the same payment flow as a first-hand purchase. Once it is
+// confirmed the ticket is re-issued to the buyer under a new code. If it
+// does not arrive in time, the listing goes back on the market.
+func (h *ResaleHandler) BuyListing(c *gin.Context) {
+	log.Println("BuyListing called")
+	listingID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid listing ID"})
+		return
+	}
+	var input struct {
+		UserID int `json:"user_id" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	listing, err := h.repo.GetListing(listingID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Listing not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	if listing.Status != "listed" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Listing is %s and cannot be bought", listing.Status)})
+		return
+	}
+	if listing.SellerUserID == input.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sellers cannot buy their own listing"})
+		return
+	}
+
+	if _, err := h.openEvent(listing.EventID); err != nil {
+		respondResaleClosed(c, err)
+		return
+	}
+	if _, err := h.services.GetUser(input.UserID); err != nil {
+		respondServiceError(c, "Failed to fetch user details", err)
+		return
+	}
+
+	reservationKey := repos.ResaleReservationKey(listing.ListingID, listing.Attempts+1)
+	paymentMsg, err := outbox.NewEvent(reservationKey, &events.PaymentRequested{
+		TicketID:       listing.TicketID,
+		Amount:         listing.Price,
+		Currency:       listing.Currency,
+		PaymentMethod:  paymentmethod.Card,
+		ReservationKey: reservationKey,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request payment: " + err.Error()})
+		return
+	}
+
+	reserved, err := h.repo.ReserveListing(listing.ListingID, input.UserID, listing.Attempts, reservationKey, time.Now().UTC().Add(h.holdTTL), paymentMsg)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Listing was just taken by another buyer"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, reserved)
+}
+
+// openEvent fetches an event whose tickets can still change hands, which
+// ends when the event starts.
+func (h *ResaleHandler) openEvent(eventID int) (*clients.EventDetails, error) {
+	eventDetails, err := h.services.GetEvent(eventID)
+	if err != nil {
+		return nil, err
+	}
+	start, err := eventDetails.Start()
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(start) {
+		return nil, errEventStarted
+	}
+	return eventDetails, nil
+}
+
+func respondResaleClosed(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, clients.ErrResaleNotAllowed):
+		c.JSON(http.StatusConflict, gin.H{"error": "This event does not allow resale"})
+	case errors.Is(err, errEventStarted):
+		c.JSON(http.StatusConflict, gin.H{"error": "Event has already started"})
+	default:
+		respondServiceError(c, "Failed to fetch event details", err)
+	}
+}
+
+// respondServiceError reports a failed call to another service.
+func respondServiceError(c *gin.Context, msg string, err error) {
+	if circuitbreaker.IsCircuitBreakerError(err) {
+		status, breakerMsg := circuitbreaker.HandleCircuitBreakerError(err)
+		c.JSON(status, gin.H{"error": breakerMsg})
+		return
+	}
+	if errors.Is(err, clients.ErrTicketRefused) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s: %v", msg, err)})
+}
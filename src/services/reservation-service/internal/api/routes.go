@@ -1,17 +1,37 @@
 package api
 
 import (
-	"reservation-service/internal/db/repos"
-
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRoutes(r *gin.Engine, purchaseRepo *repos.PurchaseRepository) {
-	handler := NewHandler(purchaseRepo)
+// Handlers are the handlers served by SetupRoutes. They are built in main.
+type Handlers struct {
+	Purchases *Handler
+	Resale    *ResaleHandler
+	Waitlist  *WaitlistHandler
+	Orders    *OrderHandler
+}
+
+func SetupRoutes(r *gin.Engine, h Handlers) {
 	res := r.Group("/v1")
 	{
-		res.POST("", handler.ReserveTicket)
-		//res.GET("/:id", handler.GetTicket)
-		res.POST("/verify", handler.VerifyTicket)
+		res.POST("/resale", h.Resale.CreateListing)
+		res.GET("/resale", h.Resale.GetListings)
+		res.GET("/resale/:id", h.Resale.GetListing)
+		res.POST("/resale/:id/cancel", h.Resale.CancelListing)
+		res.POST("/resale/:id/buy", h.Resale.BuyListing)
+
+		res.POST("/waitlist", h.Waitlist.JoinWaitlist)
+		res.GET("/waitlist/:id", h.Waitlist.GetWaitlistEntry)
+		res.POST("/waitlist/:id/leave", h.Waitlist.LeaveWaitlist)
+		res.POST("/waitlist/:id/accept", h.Waitlist.AcceptOffer)
+
+		res.POST("/orders", h.Orders.PlaceOrder)
+		res.GET("/orders/:id", h.Orders.GetOrder)
+
+		res.POST("", h.Purchases.ReserveTicket)
+		//res.GET("/:id", h.Purchases.GetTicket)
+		res.POST("/verify", h.Purchases.VerifyTicket)
+		res.POST("/:id/cancel", h.Purchases.CancelPurchase)
 	}
 }
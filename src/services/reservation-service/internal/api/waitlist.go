@@ -0,0 +1,308 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"reservation-service/internal/saga"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"tixie.local/common/paymentmethod"
+)
+
+// WaitlistHandler serves the waitlists of sold-out events. Tickets that free
+// up are offered to waiting users in the order they joined, and an offer
+// that is not accepted in time goes to the next user.
+type WaitlistHandler struct {
+	repo      *repos.WaitlistRepository
+	purchases *repos.PurchaseRepository
+	sagas     *saga.Orchestrator
+	services  *clients.ServiceClients
+}
+
+// NewWaitlistHandler creates a new WaitlistHandler.
+func NewWaitlistHandler(repo *repos.WaitlistRepository, purchases *repos.PurchaseRepository, sagas *saga.Orchestrator, services *clients.ServiceClients) *WaitlistHandler {
+	return &WaitlistHandler{
+		repo:      repo,
+		purchases: purchases,
+		sagas:     sagas,
+		services:  services,
+	}
+}
+
+// waitlistEntryResponse is a waitlist entry together with its place in the
+// queue while it is waiting.
+type waitlistEntryResponse struct {
+	*models.WaitlistEntry
+	Position int `json:"position,omitempty"`
+}
+
+// JoinWaitlist puts a user at the end of a sold-out event's waitlist. For
+// events that sell ticket types, users wait for a ticket of the type they
+// name, which must be on sale and sold out.
+func (h *WaitlistHandler) JoinWaitlist(c *gin.Context) {
+	log.Println("JoinWaitlist called")
+	var input struct {
+		EventID      int `json:"event_id" binding:"required,gt=0"`
+		TicketTypeID int `json:"ticket_type_id" binding:"omitempty,gt=0"`
+		UserID       int `json:"user_id" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	eventDetails, err := h.services.GetEvent(input.EventID)
+	if err != nil {
+		respondServiceError(c, "Failed to fetch event details", err)
+		return
+	}
+	start, err := eventDetails.Start()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !time.Now().Before(start) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Event has already started"})
+		return
+	}
+	ticketType, err := eventDetails.TicketTypeOnSale(input.TicketTypeID, time.Now())
+	if err != nil {
+		c.JSON(ticketTypeErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	ticketsLeft := eventDetails.TicketsLeft
+	if ticketType != nil && ticketType.TicketsLeft < ticketsLeft {
+		ticketsLeft = ticketType.TicketsLeft
+	}
+	if ticketsLeft > 0 {
+		waiting, err := h.repo.HasWaiting(input.EventID, input.TicketTypeID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		}
+		if !waiting {
+			c.JSON(http.StatusConflict, gin.H{"error": "Tickets are still available, reserve one instead"})
+			return
+		}
+	}
+
+	if _, err := h.services.GetUser(input.UserID); err != nil {
+		respondServiceError(c, "Failed to fetch user details", err)
+		return
+	}
+
+	entry, err := h.repo.Join(input.EventID, input.TicketTypeID, input.UserID)
+	if errors.Is(err, repos.ErrAlreadyWaiting) {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already on the waitlist of this event"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	h.respondEntry(c, http.StatusCreated, entry)
+}
+
+// GetWaitlistEntry returns a waitlist entry and, while it is waiting, its
+// place in the queue.
+func (h *WaitlistHandler) GetWaitlistEntry(c *gin.Context) {
+	log.Println("GetWaitlistEntry called")
+	entryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid waitlist entry ID"})
+		return
+	}
+
+	entry, err := h.repo.GetEntry(entryID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waitlist entry not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	h.respondEntry(c, http.StatusOK, entry)
+}
+
+// LeaveWaitlist takes a user off a waitlist. Leaving with an offer declines
+// it, and its ticket goes to the next user. Leaving twice is safe.
+func (h *WaitlistHandler) LeaveWaitlist(c *gin.Context) {
+	log.Println("LeaveWaitlist called")
+	entryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid waitlist entry ID"})
+		return
+	}
+	var input struct {
+		UserID int `json:"user_id" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	entry, err := h.repo.Leave(entryID, input.UserID)
+	if err == sql.ErrNoRows {
+		entry, err = h.repo.GetEntry(entryID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Waitlist entry not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		}
+		if entry.UserID != input.UserID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Waitlist entry does not belong to user_id"})
+			return
+		}
+		if entry.Status != "left" {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Waitlist entry is %s and cannot be left", entry.Status)})
+			return
+		}
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// AcceptOffer buys the ticket offered to a user. It is held for them like
+// any other purchase, under the reservation the offer set aside, and the
+// payment goes through the usual payment flow.
+func (h *WaitlistHandler) AcceptOffer(c *gin.Context) {
+	log.Println("AcceptOffer called")
+	entryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid waitlist entry ID"})
+		return
+	}
+	var input struct {
+		UserID        int    `json:"user_id" binding:"required,gt=0"`
+		PaymentMethod string `json:"payment_method"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+	method, err := paymentmethod.Parse(input.PaymentMethod)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	entry, err := h.repo.GetEntry(entryID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waitlist entry not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	if entry.UserID != input.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Waitlist entry does not belong to user_id"})
+		return
+	}
+	if entry.Status == "accepted" && entry.PurchaseID != nil {
+		purchase, err := h.purchases.GetPurchaseByID(*entry.PurchaseID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, purchase)
+		return
+	}
+	if entry.Status != "offered" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Waitlist entry is %s and has no offer", entry.Status)})
+		return
+	}
+
+	eventDetails, err := h.services.GetEvent(entry.EventID)
+	if err != nil {
+		respondServiceError(c, "Failed to fetch event details", err)
+		return
+	}
+	userDetails, err := h.services.GetUser(entry.UserID)
+	if err != nil {
+		respondServiceError(c, "Failed to fetch user details", err)
+		return
+	}
+	if !paymentmethod.Allowed(eventDetails.PaymentMethods, method) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Event does not accept payment method %s", method)})
+		return
+	}
+	// The offer is for a ticket of the type waited for, at its price even if
+	// its sale window has closed since.
+	price, err := eventDetails.FaceValue(entry.TicketType())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Invalid event price: %v", err)})
+		return
+	}
+
+	accepted, err := h.repo.AcceptOffer(entry.EntryID, entry.UserID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Offer has lapsed"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	// The inventory step finds the ticket already taken under the offer's
+	// reservation key, so it is not taken a second time.
+	data := &models.SagaData{
+		EventID:        accepted.EventID,
+		TicketTypeID:   accepted.TicketType(),
+		UserID:         accepted.UserID,
+		Amount:         price.Amount,
+		Currency:       price.Currency,
+		PaymentMethod:  method,
+		Email:          userDetails.Email,
+		ReservationKey: *accepted.ReservationKey,
+	}
+	if err := h.sagas.Run(saga.ReserveTicket, data); err != nil {
+		if dropErr := h.repo.DropAcceptedOffer(accepted.EntryID); dropErr != nil {
+			log.Printf("Failed to lapse waitlist entry %d after its purchase failed: %v", accepted.EntryID, dropErr)
+		}
+		respondServiceError(c, "Failed to reserve ticket", err)
+		return
+	}
+
+	if err := h.repo.SetPurchase(accepted.EntryID, data.PurchaseID); err != nil {
+		log.Printf("Failed to record purchase %d of waitlist entry %d: %v", data.PurchaseID, accepted.EntryID, err)
+	}
+	purchase, err := h.purchases.GetPurchaseByID(data.PurchaseID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, purchase)
+}
+
+func (h *WaitlistHandler) respondEntry(c *gin.Context, status int, entry *models.WaitlistEntry) {
+	resp := waitlistEntryResponse{WaitlistEntry: entry}
+	if entry.Status == "waiting" {
+		position, err := h.repo.Position(entry)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		}
+		resp.Position = position
+	}
+	c.JSON(status, resp)
+}
@@ -0,0 +1,667 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	circuitbreaker "tixie.local/common"
+	"tixie.local/common/money"
+)
+
+// ErrNotEnoughTickets is returned when event-service has no capacity left
+// for a reservation.
+var ErrNotEnoughTickets = errors.New("not enough tickets available")
+
+// ErrCancellationClosed is returned when a purchase can no longer be
+// cancelled because the event's cancellation window has passed or the event
+// does not allow cancellations.
+var ErrCancellationClosed = errors.New("cancellation window closed")
+
+// ErrTicketRefused is returned when ticket-service refuses a change to a
+// ticket, e.g. because it does not belong to the user.
+var ErrTicketRefused = errors.New("ticket service refused the change")
+
+// ErrResaleNotAllowed is returned for events whose tickets cannot be resold.
+var ErrResaleNotAllowed = errors.New("this event does not allow resale")
+
+// ErrTicketTypeRequired is returned when a ticket to an event with ticket
+// types is bought without naming one.
+var ErrTicketTypeRequired = errors.New("this event sells its tickets by ticket type, ticket_type_id is required")
+
+// ErrUnknownTicketType is returned for a ticket type the event does not have.
+var ErrUnknownTicketType = errors.New("the event has no such ticket type")
+
+// ErrTicketTypeNotOnSale is returned for a ticket type outside its sale
+// window.
+var ErrTicketTypeNotOnSale = errors.New("this ticket type is not on sale")
+
+// EventDetails is the subset of an event-service event that reservation needs.
+type EventDetails struct {
+	Price                   json.Number  `json:"price"`
+	Currency                string       `json:"currency"`
+	Date                    string       `json:"date"`
+	TicketsLeft             int          `json:"tickets_left"`
+	CancellationWindowHours *int         `json:"cancellation_window_hours"`
+	ResalePriceCapPercent   *int         `json:"resale_price_cap_percent"`
+	PaymentMethods          []string     `json:"payment_methods"`
+	QueueRatePerMinute      *int         `json:"queue_rate_per_minute"`
+	QueueUntil              *time.Time   `json:"queue_until"`
+	TicketTypes             []TicketType `json:"ticket_types"`
+}
+
+// TicketType is a type an event's tickets are sold as, e.g. early bird or
+// VIP, with its own price, capacity, sale window and per-user limit.
+type TicketType struct {
+	ID           int         `json:"id"`
+	Name         string      `json:"name"`
+	Price        json.Number `json:"price"`
+	TicketsLeft  int         `json:"tickets_left"`
+	SaleStartsAt *time.Time  `json:"sale_starts_at"`
+	SaleEndsAt   *time.Time  `json:"sale_ends_at"`
+	PerUserLimit *int        `json:"per_user_limit"`
+}
+
+// OnSale reports whether the ticket type is sold at now.
+func (t *TicketType) OnSale(now time.Time) bool {
+	if t.SaleStartsAt != nil && now.Before(*t.SaleStartsAt) {
+		return false
+	}
+	return t.SaleEndsAt == nil || now.Before(*t.SaleEndsAt)
+}
+
+// PriceMoney returns the event's price in minor units of its currency.
+func (e *EventDetails) PriceMoney() (money.Money, error) {
+	return money.Parse(e.Price.String(), e.Currency)
+}
+
+// TicketType returns the event's ticket type with the given id, or
+// ErrUnknownTicketType.
+func (e *EventDetails) TicketType(ticketTypeID int) (*TicketType, error) {
+	for i := range e.TicketTypes {
+		if e.TicketTypes[i].ID == ticketTypeID {
+			return &e.TicketTypes[i], nil
+		}
+	}
+	return nil, ErrUnknownTicketType
+}
+
+// TicketTypeOnSale returns the ticket type a buyer asked for by
+// ticketTypeID, which is zero if they named none. Events with ticket types
+// only sell tickets of a type that is on sale at now; events without any
+// sell plain tickets, for which it returns nil.
+func (e *EventDetails) TicketTypeOnSale(ticketTypeID int, now time.Time) (*TicketType, error) {
+	if ticketTypeID == 0 {
+		if len(e.TicketTypes) > 0 {
+			return nil, ErrTicketTypeRequired
+		}
+		return nil, nil
+	}
+	ticketType, err := e.TicketType(ticketTypeID)
+	if err != nil {
+		return nil, err
+	}
+	if !ticketType.OnSale(now) {
+		return nil, ErrTicketTypeNotOnSale
+	}
+	return ticketType, nil
+}
+
+// FaceValue returns the price of a ticket of the given type, or of a plain
+// ticket when ticketTypeID is zero, in minor units of the event's currency.
+func (e *EventDetails) FaceValue(ticketTypeID int) (money.Money, error) {
+	if ticketTypeID == 0 {
+		return e.PriceMoney()
+	}
+	ticketType, err := e.TicketType(ticketTypeID)
+	if err != nil {
+		return money.Money{}, err
+	}
+	return money.Parse(ticketType.Price.String(), e.Currency)
+}
+
+// eventDateLayouts are the formats event dates are stored in.
+var eventDateLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// Start returns when the event starts.
+func (e *EventDetails) Start() (time.Time, error) {
+	for _, layout := range eventDateLayouts {
+		if start, err := time.Parse(layout, e.Date); err == nil {
+			return start, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid event date %q", e.Date)
+}
+
+// CancellationDeadline returns the moment after which purchases for the
+// event can no longer be cancelled, or ErrCancellationClosed if they cannot
+// be cancelled at all.
+func (e *EventDetails) CancellationDeadline() (time.Time, error) {
+	if e.CancellationWindowHours == nil {
+		return time.Time{}, ErrCancellationClosed
+	}
+	start, err := e.Start()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return start.Add(-time.Duration(*e.CancellationWindowHours) * time.Hour), nil
+}
+
+// ResalePriceCap returns the highest price the event's tickets of the given
+// type, or its plain tickets when ticketTypeID is zero, may be resold at, or
+// ErrResaleNotAllowed if they cannot be resold. Fractions of a minor unit
+// are rounded down.
+func (e *EventDetails) ResalePriceCap(ticketTypeID int) (money.Money, error) {
+	if e.ResalePriceCapPercent == nil {
+		return money.Money{}, ErrResaleNotAllowed
+	}
+	price, err := e.FaceValue(ticketTypeID)
+	if err != nil {
+		return money.Money{}, err
+	}
+	return money.New(price.Amount*int64(*e.ResalePriceCapPercent)/100, price.Currency)
+}
+
+// QueueProtected reports whether the event's on-sale is protected by the
+// waiting room at now, so tickets are only sold to users it admitted.
+func (e *EventDetails) QueueProtected(now time.Time) bool {
+	return e.QueueRatePerMinute != nil && e.QueueUntil != nil && now.Before(*e.QueueUntil)
+}
+
+// Refund is a refund issued by the payment service.
+type Refund struct {
+	RefundID string `json:"refund_id"`
+	Amount   int64  `json:"amount"`
+	Status   string `json:"status"`
+}
+
+// UserDetails is the subset of a user-service user that reservation needs.
+type UserDetails struct {
+	Email string `json:"email"`
+}
+
+// Ticket is the ticket returned by ticket-service.
+type Ticket struct {
+	TicketID   int    `json:"ticket_id"`
+	EventID    int    `json:"event_id"`
+	UserID     int    `json:"user_id"`
+	TicketCode string `json:"ticket_code"`
+	Status     string `json:"status"`
+	// TicketTypeID is zero for events without ticket types.
+	TicketTypeID int `json:"ticket_type_id"`
+}
+
+// Results of a check-in at ticket-service.
+const (
+	CheckInCheckedIn   = "checked_in"
+	CheckInAlreadyUsed = "already_used"
+	CheckInNotActive   = "not_active"
+	CheckInNotFound    = "not_found"
+	CheckInNotGenuine  = "not_genuine"
+)
+
+// CheckIn is the outcome of checking a ticket in at a gate. Message explains
+// why a ticket was not let in, e.g. where it was already used.
+type CheckIn struct {
+	Result  string `json:"result"`
+	Message string `json:"message"`
+	Ticket  struct {
+		TicketID int    `json:"ticket_id"`
+		EventID  int    `json:"event_id"`
+		UserID   int    `json:"user_id"`
+		Status   string `json:"status"`
+	} `json:"ticket"`
+}
+
+// ServiceClients wraps the HTTP calls reservation-service makes to the other
+// services. Every call goes through the shared circuit breaker.
+type ServiceClients struct {
+	httpClient *http.Client
+	breaker    *circuitbreaker.Breaker
+}
+
+// NewServiceClients creates a new ServiceClients using the given breaker.
+func NewServiceClients(breaker *circuitbreaker.Breaker) *ServiceClients {
+	return &ServiceClients{
+		httpClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		breaker: breaker,
+	}
+}
+
+// GetEvent fetches an event from event-service.
+func (c *ServiceClients) GetEvent(eventID int) (*EventDetails, error) {
+	result := c.breaker.Execute(func() (interface{}, error) {
+		resp, err := c.httpClient.Get(fmt.Sprintf("%s/v1/%d", os.Getenv("EVENT_SERVICE_URL"), eventID))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("event service returned status %d", resp.StatusCode)
+		}
+
+		var details EventDetails
+		if err := json.NewDecoder(resp.Body).Decode(&details); err != nil {
+			return nil, err
+		}
+		return &details, nil
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	details, ok := result.Data.(*EventDetails)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse event response")
+	}
+	return details, nil
+}
+
+// GetUser fetches a user from user-service.
+func (c *ServiceClients) GetUser(userID int) (*UserDetails, error) {
+	result := c.breaker.Execute(func() (interface{}, error) {
+		resp, err := c.httpClient.Get(fmt.Sprintf("%s/v1/%d", os.Getenv("USER_SERVICE_URL"), userID))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("user service returned status %d", resp.StatusCode)
+		}
+
+		var details UserDetails
+		if err := json.NewDecoder(resp.Body).Decode(&details); err != nil {
+			return nil, err
+		}
+		return &details, nil
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	details, ok := result.Data.(*UserDetails)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse user response")
+	}
+	return details, nil
+}
+
+// CreateTicket creates a ticket of the given type, zero for none, with the
+// given status ("active" or "held") in ticket-service. Creating a ticket
+// again under the same reservation key returns the ticket created first.
+func (c *ServiceClients) CreateTicket(eventID, ticketTypeID, userID int, status, reservationKey string) (*Ticket, error) {
+	result := c.breaker.Execute(func() (interface{}, error) {
+		ticketReq := struct {
+			EventID        int    `json:"event_id"`
+			TicketTypeID   int    `json:"ticket_type_id,omitempty"`
+			UserID         int    `json:"user_id"`
+			Status         string `json:"status"`
+			ReservationKey string `json:"reservation_key,omitempty"`
+		}{EventID: eventID, TicketTypeID: ticketTypeID, UserID: userID, Status: status, ReservationKey: reservationKey}
+
+		ticketReqBody, err := json.Marshal(ticketReq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal ticket request: %v", err)
+		}
+
+		resp, err := c.httpClient.Post(os.Getenv("TICKET_SERVICE_URL")+"/v1", "application/json", bytes.NewBuffer(ticketReqBody))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			return nil, fmt.Errorf("ticket service returned status %d", resp.StatusCode)
+		}
+
+		var ticket Ticket
+		if err := json.NewDecoder(resp.Body).Decode(&ticket); err != nil {
+			return nil, err
+		}
+		return &ticket, nil
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	ticket, ok := result.Data.(*Ticket)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse ticket response")
+	}
+	return ticket, nil
+}
+
+// GetTicket fetches a ticket from ticket-service.
+func (c *ServiceClients) GetTicket(ticketID int) (*Ticket, error) {
+	result := c.breaker.Execute(func() (interface{}, error) {
+		resp, err := c.httpClient.Get(fmt.Sprintf("%s/v1/%d", os.Getenv("TICKET_SERVICE_URL"), ticketID))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("ticket service returned status %d", resp.StatusCode)
+		}
+
+		var ticket Ticket
+		if err := json.NewDecoder(resp.Body).Decode(&ticket); err != nil {
+			return nil, err
+		}
+		return &ticket, nil
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	ticket, ok := result.Data.(*Ticket)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse ticket response")
+	}
+	return ticket, nil
+}
+
+// GetTicketByReservationKey fetches the ticket created under a reservation
+// key, or nil if ticket-service has none.
+func (c *ServiceClients) GetTicketByReservationKey(key string) (*Ticket, error) {
+	result := c.breaker.Execute(func() (interface{}, error) {
+		resp, err := c.httpClient.Get(fmt.Sprintf("%s/v1/reservations/%s", os.Getenv("TICKET_SERVICE_URL"), url.PathEscape(key)))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return (*Ticket)(nil), nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("ticket service returned status %d", resp.StatusCode)
+		}
+
+		var ticket Ticket
+		if err := json.NewDecoder(resp.Body).Decode(&ticket); err != nil {
+			return nil, err
+		}
+		return &ticket, nil
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	ticket, ok := result.Data.(*Ticket)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse ticket response")
+	}
+	return ticket, nil
+}
+
+// UpdateTicketStatus sets the status of a ticket through PUT /v1/:id/status.
+func (c *ServiceClients) UpdateTicketStatus(ticketID int, status string) error {
+	result := c.breaker.Execute(func() (interface{}, error) {
+		body, err := json.Marshal(map[string]string{"status": status})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal status request: %v", err)
+		}
+
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/v1/%d/status", os.Getenv("TICKET_SERVICE_URL"), ticketID), bytes.NewBuffer(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create status request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("ticket service returned status %d", resp.StatusCode)
+		}
+		return nil, nil
+	})
+	return result.Error
+}
+
+// ListTicket puts a user's ticket on the resale market through
+// POST /v1/:id/list. Ticket-service refuses tickets that are not the user's
+// or not active.
+func (c *ServiceClients) ListTicket(ticketID, userID int) (*Ticket, error) {
+	return c.postTicket(fmt.Sprintf("/v1/%d/list", ticketID), map[string]int{"user_id": userID})
+}
+
+// UnlistTicket takes a user's ticket off the resale market through
+// POST /v1/:id/unlist.
+func (c *ServiceClients) UnlistTicket(ticketID, userID int) (*Ticket, error) {
+	return c.postTicket(fmt.Sprintf("/v1/%d/unlist", ticketID), map[string]int{"user_id": userID})
+}
+
+// ResellTicket re-issues a listed ticket to its buyer under a new code
+// through POST /v1/:id/resell. It is safe to retry.
+func (c *ServiceClients) ResellTicket(ticketID, sellerUserID, buyerUserID int) (*Ticket, error) {
+	return c.postTicket(fmt.Sprintf("/v1/%d/resell", ticketID), map[string]int{
+		"seller_user_id": sellerUserID,
+		"buyer_user_id":  buyerUserID,
+	})
+}
+
+func (c *ServiceClients) postTicket(path string, body map[string]int) (*Ticket, error) {
+	// A ticket that is not the user's or not in the right state is an
+	// answer, not a failure of ticket-service, so it is kept out of the
+	// breaker's failure count.
+	var refusal error
+	result := c.breaker.Execute(func() (interface{}, error) {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal ticket request: %v", err)
+		}
+
+		resp, err := c.httpClient.Post(os.Getenv("TICKET_SERVICE_URL")+path, "application/json", bytes.NewBuffer(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusForbidden, http.StatusNotFound, http.StatusConflict:
+			var apiErr struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+				return nil, err
+			}
+			refusal = fmt.Errorf("%w: %s", ErrTicketRefused, apiErr.Error)
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("ticket service returned status %d", resp.StatusCode)
+		}
+
+		var ticket Ticket
+		if err := json.NewDecoder(resp.Body).Decode(&ticket); err != nil {
+			return nil, err
+		}
+		return &ticket, nil
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if refusal != nil {
+		return nil, refusal
+	}
+
+	ticket, ok := result.Data.(*Ticket)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse ticket response")
+	}
+	return ticket, nil
+}
+
+// CheckInTicket checks a ticket in at a gate through POST /v1/checkin. The
+// ticket is only let in if it is the ticket and event its signed payload was
+// issued for. A ticket that is not let in is not an error; the result says
+// why.
+func (c *ServiceClients) CheckInTicket(ticketCode, gateID, scannerID string, ticketID, eventID int) (*CheckIn, error) {
+	result := c.breaker.Execute(func() (interface{}, error) {
+		body, err := json.Marshal(map[string]interface{}{
+			"ticket_code": ticketCode,
+			"gate_id":     gateID,
+			"scanner_id":  scannerID,
+			"ticket_id":   ticketID,
+			"event_id":    eventID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal check-in request: %v", err)
+		}
+
+		resp, err := c.httpClient.Post(os.Getenv("TICKET_SERVICE_URL")+"/v1/checkin", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusConflict, http.StatusNotFound:
+		default:
+			return nil, fmt.Errorf("ticket service returned status %d", resp.StatusCode)
+		}
+
+		var checkIn CheckIn
+		if err := json.NewDecoder(resp.Body).Decode(&checkIn); err != nil {
+			return nil, err
+		}
+		return &checkIn, nil
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	checkIn, ok := result.Data.(*CheckIn)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse check-in response")
+	}
+	return checkIn, nil
+}
+
+// ReserveInventory takes quantity tickets of the given type, zero for none,
+// out of the event's inventory through PATCH /v1/:id/tickets and returns how
+// many are left. The reservation key makes retries safe.
+func (c *ServiceClients) ReserveInventory(eventID, ticketTypeID, quantity int, reservationKey string) (int, error) {
+	body := map[string]interface{}{
+		"tickets_to_buy":  quantity,
+		"ticket_type_id":  ticketTypeID,
+		"reservation_key": reservationKey,
+	}
+	return c.patchInventory(fmt.Sprintf("%s/v1/%d/tickets", os.Getenv("EVENT_SERVICE_URL"), eventID), body)
+}
+
+// ReleaseInventory returns the tickets reserved under reservationKey to the
+// event's inventory through PATCH /v1/:id/tickets/release.
+func (c *ServiceClients) ReleaseInventory(eventID int, reservationKey string) (int, error) {
+	body := map[string]interface{}{
+		"reservation_key": reservationKey,
+	}
+	return c.patchInventory(fmt.Sprintf("%s/v1/%d/tickets/release", os.Getenv("EVENT_SERVICE_URL"), eventID), body)
+}
+
+func (c *ServiceClients) patchInventory(url string, body map[string]interface{}) (int, error) {
+	// Running out of tickets is an answer, not a failure of event-service, so
+	// it is kept out of the breaker's failure count.
+	var soldOut bool
+	result := c.breaker.Execute(func() (interface{}, error) {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal inventory request: %v", err)
+		}
+
+		req, err := http.NewRequest(http.MethodPatch, url, bytes.NewBuffer(reqBody))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create inventory request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusConflict {
+			soldOut = true
+			return nil, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("event service returned status %d", resp.StatusCode)
+		}
+
+		var inventory struct {
+			TicketsLeft int `json:"tickets_left"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&inventory); err != nil {
+			return nil, err
+		}
+		return inventory.TicketsLeft, nil
+	})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if soldOut {
+		return 0, ErrNotEnoughTickets
+	}
+
+	ticketsLeft, ok := result.Data.(int)
+	if !ok {
+		return 0, fmt.Errorf("failed to parse inventory response")
+	}
+	return ticketsLeft, nil
+}
+
+// RefundPayment refunds amount of a payment intent through the payment
+// service's POST /refunds, or all of it when amount is zero. The idempotency
+// key makes retries safe.
+func (c *ServiceClients) RefundPayment(paymentIntentID string, amount int64, idempotencyKey string) (*Refund, error) {
+	result := c.breaker.Execute(func() (interface{}, error) {
+		body, err := json.Marshal(map[string]interface{}{
+			"payment_intent_id": paymentIntentID,
+			"amount":            amount,
+			"idempotency_key":   idempotencyKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal refund request: %v", err)
+		}
+
+		resp, err := c.httpClient.Post(os.Getenv("PAYMENT_SERVICE_URL")+"/refunds", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("payment service returned status %d", resp.StatusCode)
+		}
+
+		var refund Refund
+		if err := json.NewDecoder(resp.Body).Decode(&refund); err != nil {
+			return nil, err
+		}
+		return &refund, nil
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	refund, ok := result.Data.(*Refund)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse refund response")
+	}
+	return refund, nil
+}
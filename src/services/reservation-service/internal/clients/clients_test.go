@@ -0,0 +1,131 @@
+package clients
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResalePriceCap(t *testing.T) {
+	percent := func(p int) *int { return &p }
+
+	for name, tc := range map[string]struct {
+		price, currency string
+		percent         *int
+		want            int64
+		wantErr         error
+	}{
+		"110 percent":        {"50.00", "USD", percent(110), 5500, nil},
+		"face value":         {"19.99", "EUR", percent(100), 1999, nil},
+		"rounded down":       {"0.99", "USD", percent(110), 108, nil},
+		"zero-decimal":       {"1000", "JPY", percent(120), 1200, nil},
+		"resale not allowed": {"50.00", "USD", nil, 0, ErrResaleNotAllowed},
+	} {
+		event := EventDetails{Price: json.Number(tc.price), Currency: tc.currency, ResalePriceCapPercent: tc.percent}
+		got, err := event.ResalePriceCap(0)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: error = %v, want %v", name, err, tc.wantErr)
+			continue
+		}
+		if err == nil && (got.Amount != tc.want || got.Currency != tc.currency) {
+			t.Errorf("%s: cap = %v, want %d %s", name, got, tc.want, tc.currency)
+		}
+	}
+}
+
+func TestQueueProtected(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	rate := 100
+	until := now.Add(time.Hour)
+	ended := now.Add(-time.Minute)
+
+	for name, tc := range map[string]struct {
+		event EventDetails
+		want  bool
+	}{
+		"protected":     {EventDetails{QueueRatePerMinute: &rate, QueueUntil: &until}, true},
+		"on-sale ended": {EventDetails{QueueRatePerMinute: &rate, QueueUntil: &ended}, false},
+		"no queue":      {EventDetails{}, false},
+	} {
+		if got := tc.event.QueueProtected(now); got != tc.want {
+			t.Errorf("%s: QueueProtected = %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+func TestTicketTypeOnSale(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	ended := now.Add(-time.Minute)
+	tiered := EventDetails{TicketTypes: []TicketType{
+		{ID: 1, Name: "Early bird", SaleEndsAt: &ended},
+		{ID: 2, Name: "General admission"},
+		{ID: 3, Name: "VIP", SaleStartsAt: &later},
+	}}
+
+	for name, tc := range map[string]struct {
+		event        EventDetails
+		ticketTypeID int
+		wantID       int
+		wantErr      error
+	}{
+		"on sale":       {tiered, 2, 2, nil},
+		"sale ended":    {tiered, 1, 0, ErrTicketTypeNotOnSale},
+		"sale not open": {tiered, 3, 0, ErrTicketTypeNotOnSale},
+		"unknown":       {tiered, 9, 0, ErrUnknownTicketType},
+		"required":      {tiered, 0, 0, ErrTicketTypeRequired},
+		"untyped event": {EventDetails{}, 0, 0, nil},
+		"untyped named": {EventDetails{}, 2, 0, ErrUnknownTicketType},
+	} {
+		got, err := tc.event.TicketTypeOnSale(tc.ticketTypeID, now)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: error = %v, want %v", name, err, tc.wantErr)
+			continue
+		}
+		gotID := 0
+		if got != nil {
+			gotID = got.ID
+		}
+		if gotID != tc.wantID {
+			t.Errorf("%s: ticket type = %d, want %d", name, gotID, tc.wantID)
+		}
+	}
+}
+
+func TestFaceValue(t *testing.T) {
+	percent := 110
+	event := EventDetails{
+		Price:                 json.Number("50.00"),
+		Currency:              "USD",
+		ResalePriceCapPercent: &percent,
+		TicketTypes:           []TicketType{{ID: 4, Name: "VIP", Price: json.Number("120.00")}},
+	}
+
+	for name, tc := range map[string]struct {
+		ticketTypeID  int
+		want, wantCap int64
+		wantErr       error
+	}{
+		"plain ticket": {0, 5000, 5500, nil},
+		"ticket type":  {4, 12000, 13200, nil},
+		"unknown type": {5, 0, 0, ErrUnknownTicketType},
+	} {
+		got, err := event.FaceValue(tc.ticketTypeID)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: error = %v, want %v", name, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		capped, err := event.ResalePriceCap(tc.ticketTypeID)
+		if err != nil {
+			t.Errorf("%s: cap error = %v", name, err)
+			continue
+		}
+		if got.Amount != tc.want || capped.Amount != tc.wantCap {
+			t.Errorf("%s: face value = %v, cap = %v, want %d and %d", name, got, capped, tc.want, tc.wantCap)
+		}
+	}
+}
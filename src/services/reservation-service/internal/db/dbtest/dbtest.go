@@ -0,0 +1,64 @@
+// Package dbtest gives database tests a throwaway copy of reservation_db.
+package dbtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// Open connects to the database in RESERVATION_TEST_DATABASE_URL and loads
+// the schema into a throwaway Postgres schema, dropped when the test ends.
+// The test is skipped when the variable is not set.
+func Open(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	dsn := os.Getenv("RESERVATION_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("RESERVATION_TEST_DATABASE_URL not set, skipping database test")
+	}
+
+	admin, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("reservation_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	db, err := sqlx.Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// The files are loaded in the order Postgres' entrypoint runs them.
+	_, file, _, _ := runtime.Caller(0)
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(file), "..", "init", "*.sql"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("failed to find schema: %v", err)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		ddl, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("failed to read schema: %v", err)
+		}
+		if _, err := db.Exec(string(ddl)); err != nil {
+			t.Fatalf("failed to load %s: %v", filepath.Base(f), err)
+		}
+	}
+
+	return db
+}
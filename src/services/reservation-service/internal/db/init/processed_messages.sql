@@ -0,0 +1,9 @@
+CREATE TABLE processed_messages (
+    consumer VARCHAR(100) NOT NULL,
+    message_id VARCHAR(100) NOT NULL,
+    processed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (consumer, message_id)
+);
+
+CREATE INDEX idx_processed_messages_expires_at ON processed_messages (expires_at);
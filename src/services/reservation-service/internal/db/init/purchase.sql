@@ -1,3 +1,18 @@
+-- An order buys several tickets in one checkout, paid for with a single
+-- payment. Its line items are purchases, one per ticket, and its status rolls
+-- up from theirs.
+CREATE TABLE orders (
+    order_id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    -- The order's payment is requested under this key
+    reservation_key TEXT NOT NULL UNIQUE,
+    -- The total of the line items, in minor units of currency
+    amount BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    payment_method TEXT NOT NULL DEFAULT 'card',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
 CREATE TABLE purchases (
     purchase_id SERIAL PRIMARY KEY,
     ticket_id INTEGER NOT NULL,
@@ -5,6 +20,19 @@ CREATE TABLE purchases (
     event_id INTEGER NOT NULL,
     purchase_date TIMESTAMP NOT NULL,
     status VARCHAR(20) NOT NULL DEFAULT 'pending',
-    CONSTRAINT valid_status CHECK (status IN ('pending', 'confirmed', 'cancelled'))
+    expires_at TIMESTAMP,
+    reservation_key TEXT NOT NULL DEFAULT '',
+    amount BIGINT NOT NULL DEFAULT 0,
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    payment_method TEXT NOT NULL DEFAULT 'card',
+    payment_intent_id TEXT NOT NULL DEFAULT '',
+    cancelled_at TIMESTAMP,
+    order_id INTEGER REFERENCES orders (order_id),
+    -- The event's ticket type bought, NULL for events without types
+    ticket_type_id INTEGER,
+    CONSTRAINT valid_status CHECK (status IN ('pending', 'pending_at_door', 'confirmed', 'expired', 'cancelled'))
 );
 
+CREATE INDEX idx_purchases_pending_expiry ON purchases (expires_at) WHERE status = 'pending';
+CREATE INDEX idx_purchases_order ON purchases (order_id) WHERE order_id IS NOT NULL;
+
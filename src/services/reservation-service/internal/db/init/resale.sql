@@ -0,0 +1,29 @@
+-- Tickets their holders offer for resale. A listing is pending while a buyer
+-- pays for it and sold once the ticket has been re-issued to the buyer.
+CREATE TABLE resale_listings (
+    listing_id SERIAL PRIMARY KEY,
+    ticket_id INTEGER NOT NULL,
+    event_id INTEGER NOT NULL,
+    seller_user_id INTEGER NOT NULL,
+    -- Amounts are in the minor units of currency. The seller is paid the
+    -- price less the fee.
+    price BIGINT NOT NULL,
+    fee BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'listed',
+    buyer_user_id INTEGER,
+    -- Every purchase attempt pays under a new reservation key
+    attempts INTEGER NOT NULL DEFAULT 0,
+    reservation_key TEXT UNIQUE,
+    expires_at TIMESTAMP,
+    payment_intent_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sold_at TIMESTAMP,
+    CONSTRAINT valid_status CHECK (status IN ('listed', 'pending', 'sold', 'cancelled')),
+    CONSTRAINT fee_within_price CHECK (price > 0 AND fee >= 0 AND fee <= price)
+);
+
+-- A ticket is on the market at most once
+CREATE UNIQUE INDEX idx_resale_listings_open_ticket ON resale_listings (ticket_id) WHERE status IN ('listed', 'pending');
+CREATE INDEX idx_resale_listings_event ON resale_listings (event_id, price) WHERE status = 'listed';
+CREATE INDEX idx_resale_listings_pending_expiry ON resale_listings (expires_at) WHERE status = 'pending';
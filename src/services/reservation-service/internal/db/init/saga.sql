@@ -0,0 +1,23 @@
+CREATE TABLE sagas (
+    saga_id SERIAL PRIMARY KEY,
+    saga_type VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'running',
+    current_step INTEGER NOT NULL DEFAULT 0,
+    payload JSONB NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT valid_saga_status CHECK (status IN ('running', 'completed', 'compensating', 'compensated'))
+);
+
+CREATE INDEX idx_sagas_status_updated_at ON sagas (status, updated_at);
+
+CREATE TABLE saga_steps (
+    saga_step_id SERIAL PRIMARY KEY,
+    saga_id INTEGER NOT NULL REFERENCES sagas (saga_id),
+    step_name VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT valid_step_status CHECK (status IN ('completed', 'failed', 'compensated', 'compensation_failed'))
+);
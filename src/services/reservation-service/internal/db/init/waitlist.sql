@@ -0,0 +1,27 @@
+-- Users waiting for a ticket to a sold-out event, served first come first
+-- served. A freed ticket is set aside for the next waiting user, whose entry
+-- is offered until offer_expires_at. An offer that is not accepted in time
+-- lapses and the ticket goes to the next user.
+CREATE TABLE waitlist_entries (
+    entry_id SERIAL PRIMARY KEY,
+    event_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    -- The ticket type waited for, NULL for events without types
+    ticket_type_id INTEGER,
+    status VARCHAR(20) NOT NULL DEFAULT 'waiting',
+    -- The ticket set aside for an offer is taken from the event's inventory
+    -- under this key, and the purchase made when it is accepted reuses it
+    reservation_key TEXT UNIQUE,
+    offered_at TIMESTAMP,
+    offer_expires_at TIMESTAMP,
+    purchase_id INTEGER,
+    -- Whether the ticket of a lapsed or left entry went back to the event
+    inventory_released BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT valid_status CHECK (status IN ('waiting', 'offered', 'accepted', 'lapsed', 'left'))
+);
+
+-- A user waits for an event at most once at a time
+CREATE UNIQUE INDEX idx_waitlist_entries_open_user ON waitlist_entries (event_id, user_id) WHERE status IN ('waiting', 'offered');
+CREATE INDEX idx_waitlist_entries_queue ON waitlist_entries (event_id, ticket_type_id, entry_id) WHERE status = 'waiting';
+CREATE INDEX idx_waitlist_entries_offer_expiry ON waitlist_entries (offer_expires_at) WHERE status = 'offered';
@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// Order statuses. They are not stored but rolled up from the statuses of an
+// order's line items.
+const (
+	// OrderPending orders are held while their payment is outstanding.
+	OrderPending = "pending"
+	// OrderConfirmed orders are paid for and none of their tickets were
+	// cancelled.
+	OrderConfirmed = "confirmed"
+	// OrderPartiallyCancelled orders are paid for but some of their tickets
+	// were cancelled since.
+	OrderPartiallyCancelled = "partially_cancelled"
+	// OrderCancelled orders have no ticket left, because their payment
+	// failed, their hold expired or every ticket was cancelled.
+	OrderCancelled = "cancelled"
+)
+
+// Order is a checkout of several tickets paid for with a single payment.
+type Order struct {
+	OrderID        int    `db:"order_id" json:"order_id"`
+	UserID         int    `db:"user_id" json:"user_id"`
+	ReservationKey string `db:"reservation_key" json:"-"`
+	// Amount is the total of the line items in the minor units of Currency.
+	Amount        int64     `db:"amount" json:"amount"`
+	Currency      string    `db:"currency" json:"currency"`
+	PaymentMethod string    `db:"payment_method" json:"payment_method"`
+	CreatedAt     time.Time `db:"created_at" json:"created_at"`
+	// Status and Items are loaded from the order's purchases.
+	Status string     `db:"-" json:"status"`
+	Items  []Purchase `db:"-" json:"items"`
+}
+
+// OrderStatus rolls the statuses of an order's line items up into the
+// status of the order.
+func OrderStatus(items []Purchase) string {
+	confirmed, cancelled := 0, 0
+	for _, item := range items {
+		switch item.Status {
+		case "pending", "pending_at_door":
+			return OrderPending
+		case "confirmed":
+			confirmed++
+		default:
+			cancelled++
+		}
+	}
+
+	switch {
+	case confirmed == 0:
+		return OrderCancelled
+	case cancelled == 0:
+		return OrderConfirmed
+	default:
+		return OrderPartiallyCancelled
+	}
+}
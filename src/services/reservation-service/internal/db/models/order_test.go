@@ -0,0 +1,29 @@
+package models
+
+import "testing"
+
+func TestOrderStatus(t *testing.T) {
+	items := func(statuses ...string) []Purchase {
+		purchases := make([]Purchase, len(statuses))
+		for i, status := range statuses {
+			purchases[i].Status = status
+		}
+		return purchases
+	}
+
+	for name, tc := range map[string]struct {
+		items []Purchase
+		want  string
+	}{
+		"held":                 {items("pending", "pending"), OrderPending},
+		"paid":                 {items("confirmed", "confirmed"), OrderConfirmed},
+		"one ticket cancelled": {items("confirmed", "cancelled"), OrderPartiallyCancelled},
+		"all cancelled":        {items("cancelled", "cancelled"), OrderCancelled},
+		"expiring":             {items("expired", "cancelled"), OrderCancelled},
+		"being expired":        {items("pending", "expired"), OrderPending},
+	} {
+		if got := OrderStatus(tc.items); got != tc.want {
+			t.Errorf("%s: OrderStatus = %q, want %q", name, got, tc.want)
+		}
+	}
+}
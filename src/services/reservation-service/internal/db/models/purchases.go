@@ -9,4 +9,18 @@ type Purchase struct {
 	EventID      int       `db:"event_id"`
 	PurchaseDate time.Time `db:"purchase_date"`
 	Status       string    `db:"status"`
+	// ExpiresAt is when a pending purchase's hold lapses. It is cleared once
+	// the purchase is confirmed.
+	ExpiresAt      *time.Time `db:"expires_at"`
+	ReservationKey string     `db:"reservation_key"`
+	// Amount is the price paid in the minor units of Currency.
+	Amount          int64      `db:"amount"`
+	Currency        string     `db:"currency"`
+	PaymentMethod   string     `db:"payment_method"`
+	PaymentIntentID string     `db:"payment_intent_id"`
+	CancelledAt     *time.Time `db:"cancelled_at"`
+	// OrderID is the order the purchase is a line item of, if any.
+	OrderID *int `db:"order_id"`
+	// TicketTypeID is the ticket type bought, if the event has types.
+	TicketTypeID *int `db:"ticket_type_id"`
 }
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// ResaleListing is a ticket offered for resale by its holder. Price and Fee
+// are in the minor units of Currency.
+type ResaleListing struct {
+	ListingID    int    `db:"listing_id" json:"listing_id"`
+	TicketID     int    `db:"ticket_id" json:"ticket_id"`
+	EventID      int    `db:"event_id" json:"event_id"`
+	SellerUserID int    `db:"seller_user_id" json:"seller_user_id"`
+	Price        int64  `db:"price" json:"price"`
+	Fee          int64  `db:"fee" json:"fee"`
+	Currency     string `db:"currency" json:"currency"`
+	Status       string `db:"status" json:"status"`
+	// BuyerUserID, ReservationKey and ExpiresAt describe the purchase in
+	// progress while the listing is pending, and the one that went through
+	// once it is sold.
+	BuyerUserID     *int       `db:"buyer_user_id" json:"buyer_user_id,omitempty"`
+	Attempts        int        `db:"attempts" json:"-"`
+	ReservationKey  *string    `db:"reservation_key" json:"reservation_key,omitempty"`
+	ExpiresAt       *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+	PaymentIntentID string     `db:"payment_intent_id" json:"payment_intent_id,omitempty"`
+	CreatedAt       time.Time  `db:"created_at" json:"created_at"`
+	SoldAt          *time.Time `db:"sold_at" json:"sold_at,omitempty"`
+}
+
+// Payout is what the seller is paid once the listing is sold.
+func (l *ResaleListing) Payout() int64 {
+	return l.Price - l.Fee
+}
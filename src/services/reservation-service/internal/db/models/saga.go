@@ -0,0 +1,72 @@
+package models
+
+import "time"
+
+// Saga is the persisted state of a multi-step workflow.
+type Saga struct {
+	SagaID      int       `db:"saga_id"`
+	SagaType    string    `db:"saga_type"`
+	Status      string    `db:"status"`
+	CurrentStep int       `db:"current_step"`
+	Payload     []byte    `db:"payload"`
+	LastError   string    `db:"last_error"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+// SagaStep records the outcome of a single step or compensation.
+type SagaStep struct {
+	SagaStepID int       `db:"saga_step_id"`
+	SagaID     int       `db:"saga_id"`
+	StepName   string    `db:"step_name"`
+	Status     string    `db:"status"`
+	Error      string    `db:"error"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// SagaData is the state carried between saga steps. It is stored as the saga
+// payload so compensations can run after a restart.
+type SagaData struct {
+	SagaID  int `json:"saga_id"`
+	EventID int `json:"event_id"`
+	// TicketTypeID is the ticket type bought, zero for events without types.
+	TicketTypeID int `json:"ticket_type_id,omitempty"`
+	// PerUserLimit is the most tickets of TicketTypeID a user may hold,
+	// zero for no limit.
+	PerUserLimit int `json:"per_user_limit,omitempty"`
+	UserID       int `json:"user_id"`
+	// Amount is the price in the minor units of Currency.
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency,omitempty"`
+	// PaymentMethod is how the buyer pays, card when empty.
+	PaymentMethod string `json:"payment_method,omitempty"`
+	Email         string `json:"email"`
+	TicketID      int    `json:"ticket_id,omitempty"`
+	TicketCode    string `json:"ticket_code,omitempty"`
+	PurchaseID    int    `json:"purchase_id,omitempty"`
+	// ReservationKey identifies the inventory taken in event-service.
+	ReservationKey string `json:"reservation_key,omitempty"`
+	// PaymentIntentID is the payment refunded when a purchase is cancelled.
+	PaymentIntentID string `json:"payment_intent_id,omitempty"`
+	RefundID        string `json:"refund_id,omitempty"`
+	RefundAmount    int64  `json:"refund_amount,omitempty"`
+	// OrderID is the order a purchase is a line item of. Cancelling the
+	// purchase refunds only its share of the order's payment.
+	OrderID int `json:"order_id,omitempty"`
+	// OrderTickets are the tickets of an order being placed.
+	OrderTickets []OrderTicket `json:"order_tickets,omitempty"`
+}
+
+// OrderTicket is one ticket of an order being placed, held under its own
+// reservation key so it can be released or cancelled on its own later.
+type OrderTicket struct {
+	EventID      int `json:"event_id"`
+	TicketTypeID int `json:"ticket_type_id,omitempty"`
+	// PerUserLimit is the most tickets of TicketTypeID a user may hold,
+	// zero for no limit.
+	PerUserLimit int `json:"per_user_limit,omitempty"`
+	// Amount is the ticket's price in the minor units of the order's currency.
+	Amount         int64  `json:"amount"`
+	ReservationKey string `json:"reservation_key,omitempty"`
+	TicketID       int    `json:"ticket_id,omitempty"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// WaitlistEntry is a user waiting for a ticket to a sold-out event.
+type WaitlistEntry struct {
+	EntryID int    `db:"entry_id" json:"entry_id"`
+	EventID int    `db:"event_id" json:"event_id"`
+	UserID  int    `db:"user_id" json:"user_id"`
+	Status  string `db:"status" json:"status"`
+	// TicketTypeID is the ticket type waited for, if the event has types.
+	TicketTypeID *int `db:"ticket_type_id" json:"ticket_type_id,omitempty"`
+	// ReservationKey, OfferedAt and OfferExpiresAt describe the ticket set
+	// aside for the user once the entry is offered.
+	ReservationKey    *string    `db:"reservation_key" json:"-"`
+	OfferedAt         *time.Time `db:"offered_at" json:"offered_at,omitempty"`
+	OfferExpiresAt    *time.Time `db:"offer_expires_at" json:"offer_expires_at,omitempty"`
+	PurchaseID        *int       `db:"purchase_id" json:"purchase_id,omitempty"`
+	InventoryReleased bool       `db:"inventory_released" json:"-"`
+	CreatedAt         time.Time  `db:"created_at" json:"created_at"`
+}
+
+// TicketType returns the ticket type waited for, zero for events without
+// types.
+func (e *WaitlistEntry) TicketType() int {
+	if e.TicketTypeID == nil {
+		return 0
+	}
+	return *e.TicketTypeID
+}
@@ -0,0 +1,202 @@
+package repos
+
+import (
+	"database/sql"
+	"fmt"
+	"reservation-service/internal/db/models"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"tixie.local/broker/outbox"
+)
+
+const orderKeyPrefix = "order-"
+
+// OrderReservationKey returns the reservation key an order is paid for
+// under.
+func OrderReservationKey(sagaID int) string {
+	return fmt.Sprintf("%s%d", orderKeyPrefix, sagaID)
+}
+
+// OrderTicketReservationKey returns the reservation key the n-th ticket of
+// an order is held under.
+func OrderTicketReservationKey(orderKey string, n int) string {
+	return fmt.Sprintf("%s-%d", orderKey, n)
+}
+
+// IsOrderReservationKey reports whether key belongs to an order.
+func IsOrderReservationKey(key string) bool {
+	return strings.HasPrefix(key, orderKeyPrefix)
+}
+
+// OrderRepository handles database operations for orders and their line
+// items.
+type OrderRepository struct {
+	db *sqlx.DB
+}
+
+// NewOrderRepository creates a new OrderRepository.
+func NewOrderRepository(db *sqlx.DB) *OrderRepository {
+	return &OrderRepository{db: db}
+}
+
+// CreateOrder creates an order together with its line items. Any outbox
+// messages are written in the same transaction, so they are published if and
+// only if the order exists. perUserLimits maps ticket types to the most
+// tickets of the type the user may hold, and ErrPerUserLimit is returned if
+// the order would exceed one.
+func (r *OrderRepository) CreateOrder(order *models.Order, items []models.Purchase, perUserLimits map[int]int, messages ...outbox.Message) (*models.Order, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	quantities := make(map[int]int)
+	for _, item := range items {
+		if item.TicketTypeID != nil {
+			quantities[*item.TicketTypeID]++
+		}
+	}
+	if err := checkPerUserLimits(tx, order.UserID, perUserLimits, quantities); err != nil {
+		return nil, err
+	}
+
+	var created models.Order
+	err = tx.QueryRowx(
+		"INSERT INTO orders (user_id, reservation_key, amount, currency, payment_method) VALUES ($1, $2, $3, $4, $5) RETURNING *",
+		order.UserID, order.ReservationKey, order.Amount, order.Currency, order.PaymentMethod,
+	).StructScan(&created)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		var purchase models.Purchase
+		err := tx.QueryRowx(
+			"INSERT INTO purchases (ticket_id, user_id, event_id, purchase_date, status, expires_at, reservation_key, amount, currency, payment_method, order_id, ticket_type_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING *",
+			item.TicketID, item.UserID, item.EventID, item.PurchaseDate, item.Status, item.ExpiresAt, item.ReservationKey, item.Amount, item.Currency, item.PaymentMethod, created.OrderID, item.TicketTypeID,
+		).StructScan(&purchase)
+		if err != nil {
+			return nil, err
+		}
+		created.Items = append(created.Items, purchase)
+	}
+	created.Status = models.OrderStatus(created.Items)
+
+	if err := outbox.Insert(tx.Tx, messages...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// GetOrder retrieves an order by its ID together with its line items.
+func (r *OrderRepository) GetOrder(orderID int) (*models.Order, error) {
+	var order models.Order
+	if err := r.db.Get(&order, "SELECT * FROM orders WHERE order_id = $1", orderID); err != nil {
+		return nil, err
+	}
+	if err := r.db.Select(&order.Items, "SELECT * FROM purchases WHERE order_id = $1 ORDER BY purchase_id", orderID); err != nil {
+		return nil, err
+	}
+	order.Status = models.OrderStatus(order.Items)
+	return &order, nil
+}
+
+// GetItemsByReservationKey returns the line items of the order paid for
+// under key.
+func (r *OrderRepository) GetItemsByReservationKey(key string) ([]models.Purchase, error) {
+	var items []models.Purchase
+	err := r.db.Select(&items, `
+		SELECT p.* FROM purchases p
+		JOIN orders o ON o.order_id = p.order_id
+		WHERE o.reservation_key = $1
+		ORDER BY p.purchase_id`,
+		key,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return items, nil
+}
+
+// ConfirmOrder confirms every line item of the order paid for under key and
+// records the payment intent that paid for them. An order is confirmed as a
+// whole or not at all: it returns sql.ErrNoRows if any line item is no longer
+// pending, e.g. because the order's hold started to expire.
+func (r *OrderRepository) ConfirmOrder(key, paymentIntentID string) ([]models.Purchase, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the line items keeps the hold reaper, which skips locked
+	// rows, from expiring part of the order meanwhile.
+	var statuses []string
+	err = tx.Select(&statuses, `
+		SELECT p.status FROM purchases p
+		JOIN orders o ON o.order_id = p.order_id
+		WHERE o.reservation_key = $1
+		FOR UPDATE OF p`,
+		key,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(statuses) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	for _, status := range statuses {
+		if status != "pending" {
+			return nil, sql.ErrNoRows
+		}
+	}
+
+	var items []models.Purchase
+	err = tx.Select(&items, `
+		UPDATE purchases SET status='confirmed', expires_at=NULL, payment_intent_id=$2
+		WHERE order_id = (SELECT order_id FROM orders WHERE reservation_key = $1)
+		RETURNING *`,
+		key, paymentIntentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// FailPendingOrder cancels the pending line items of the order paid for
+// under key, whose payment failed, and returns them.
+func (r *OrderRepository) FailPendingOrder(key string) ([]models.Purchase, error) {
+	var items []models.Purchase
+	err := r.db.Select(&items, `
+		UPDATE purchases SET status='cancelled', expires_at=NULL, cancelled_at=$2
+		WHERE order_id = (SELECT order_id FROM orders WHERE reservation_key = $1) AND status='pending'
+		RETURNING *`,
+		key, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// CancelPendingOrder cancels the pending line items of an order, if there
+// are any, so that a late payment can no longer confirm them.
+func (r *OrderRepository) CancelPendingOrder(orderID int) error {
+	_, err := r.db.Exec("UPDATE purchases SET status='cancelled' WHERE order_id=$1 AND status='pending'", orderID)
+	return err
+}
@@ -1,11 +1,23 @@
 package repos
 
 import (
+	"errors"
 	"reservation-service/internal/db/models"
+	"sort"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"tixie.local/broker/outbox"
 )
 
+// ErrPerUserLimit is returned when a hold would take a user over the
+// per-user limit of a ticket type.
+var ErrPerUserLimit = errors.New("per-user ticket limit reached")
+
+// countActiveTicketsQuery counts the tickets of a ticket type a user holds or
+// has bought and not cancelled.
+const countActiveTicketsQuery = "SELECT COUNT(*) FROM purchases WHERE user_id = $1 AND ticket_type_id = $2 AND status IN ('pending', 'pending_at_door', 'confirmed')"
+
 // PurchaseRepository handles database operations for purchases.
 type PurchaseRepository struct {
 	db *sqlx.DB
@@ -16,16 +28,42 @@ func NewPurchaseRepository(db *sqlx.DB) *PurchaseRepository {
 	return &PurchaseRepository{db: db}
 }
 
-// CreatePurchase creates a new purchase record.
-func (r *PurchaseRepository) CreatePurchase(purchase *models.Purchase) (*models.Purchase, error) {
+// CreatePurchase creates a new purchase record. Any outbox messages are
+// written in the same transaction, so they are published if and only if the
+// purchase exists. A perUserLimit above zero caps the tickets of the
+// purchase's type the user may hold, and ErrPerUserLimit is returned if the
+// purchase would exceed it.
+func (r *PurchaseRepository) CreatePurchase(purchase *models.Purchase, perUserLimit int, messages ...outbox.Message) (*models.Purchase, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if purchase.TicketTypeID != nil {
+		limits := map[int]int{*purchase.TicketTypeID: perUserLimit}
+		quantities := map[int]int{*purchase.TicketTypeID: 1}
+		if err := checkPerUserLimits(tx, purchase.UserID, limits, quantities); err != nil {
+			return nil, err
+		}
+	}
+
 	var createdPurchase models.Purchase
-	err := r.db.QueryRowx(
-		"INSERT INTO purchases (ticket_id, user_id, event_id, purchase_date, status) VALUES ($1, $2, $3, $4, $5) RETURNING *",
-		purchase.TicketID, purchase.UserID, purchase.EventID, purchase.PurchaseDate, purchase.Status,
+	err = tx.QueryRowx(
+		"INSERT INTO purchases (ticket_id, user_id, event_id, purchase_date, status, expires_at, reservation_key, amount, currency, payment_method, ticket_type_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING *",
+		purchase.TicketID, purchase.UserID, purchase.EventID, purchase.PurchaseDate, purchase.Status, purchase.ExpiresAt, purchase.ReservationKey, purchase.Amount, purchase.Currency, purchase.PaymentMethod, purchase.TicketTypeID,
 	).StructScan(&createdPurchase)
 	if err != nil {
 		return nil, err
 	}
+
+	if err := outbox.Insert(tx.Tx, messages...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	return &createdPurchase, nil
 }
 
@@ -33,7 +71,7 @@ func (r *PurchaseRepository) CreatePurchase(purchase *models.Purchase) (*models.
 func (r *PurchaseRepository) UpdatePurchaseStatus(purchaseID int, status string) (*models.Purchase, error) {
 	var updatedPurchase models.Purchase
 	err := r.db.QueryRowx(
-		"UPDATE purchases SET status=$1 WHERE id=$2 RETURNING *",
+		"UPDATE purchases SET status=$1 WHERE purchase_id=$2 RETURNING *",
 		status, purchaseID,
 	).StructScan(&updatedPurchase)
 	if err != nil {
@@ -42,6 +80,146 @@ func (r *PurchaseRepository) UpdatePurchaseStatus(purchaseID int, status string)
 	return &updatedPurchase, nil
 }
 
+// ConfirmPurchaseByTicketID confirms the pending purchase of a ticket and
+// records the payment intent that paid for it, so it can be refunded later.
+// Purchases paid for at the door are confirmed the same way once the cash
+// has been collected. It returns sql.ErrNoRows if the purchase is no longer
+// pending, e.g. because its hold already expired.
+func (r *PurchaseRepository) ConfirmPurchaseByTicketID(ticketID int, paymentIntentID string) (*models.Purchase, error) {
+	var confirmedPurchase models.Purchase
+	err := r.db.QueryRowx(
+		"UPDATE purchases SET status='confirmed', expires_at=NULL, payment_intent_id=$2 WHERE ticket_id=$1 AND status IN ('pending', 'pending_at_door') RETURNING *",
+		ticketID, paymentIntentID,
+	).StructScan(&confirmedPurchase)
+	if err != nil {
+		return nil, err
+	}
+	return &confirmedPurchase, nil
+}
+
+// DeferPurchaseByTicketID moves the pending purchase of a ticket paid for at
+// the door to "pending_at_door". Its hold no longer expires, and it is
+// confirmed when the ticket is scanned. It returns sql.ErrNoRows if the
+// purchase is no longer pending.
+func (r *PurchaseRepository) DeferPurchaseByTicketID(ticketID int, paymentIntentID string) (*models.Purchase, error) {
+	var deferredPurchase models.Purchase
+	err := r.db.QueryRowx(
+		"UPDATE purchases SET status='pending_at_door', expires_at=NULL, payment_intent_id=$2 WHERE ticket_id=$1 AND status='pending' RETURNING *",
+		ticketID, paymentIntentID,
+	).StructScan(&deferredPurchase)
+	if err != nil {
+		return nil, err
+	}
+	return &deferredPurchase, nil
+}
+
+// CancelPendingPurchaseByTicketID cancels the pending purchase for a ticket,
+// if there is one, so that a late payment can no longer confirm it.
+func (r *PurchaseRepository) CancelPendingPurchaseByTicketID(ticketID int) error {
+	_, err := r.db.Exec("UPDATE purchases SET status='cancelled' WHERE ticket_id=$1 AND status='pending'", ticketID)
+	return err
+}
+
+// CancelConfirmedPurchase moves a confirmed purchase to "cancelled". It
+// returns sql.ErrNoRows if the purchase is not confirmed, so only one caller
+// gets to run the cancellation.
+func (r *PurchaseRepository) CancelConfirmedPurchase(purchaseID int) (*models.Purchase, error) {
+	var cancelledPurchase models.Purchase
+	err := r.db.QueryRowx(
+		"UPDATE purchases SET status='cancelled', cancelled_at=$1 WHERE purchase_id=$2 AND status='confirmed' RETURNING *",
+		time.Now().UTC(), purchaseID,
+	).StructScan(&cancelledPurchase)
+	if err != nil {
+		return nil, err
+	}
+	return &cancelledPurchase, nil
+}
+
+// FailPendingPurchaseByTicketID cancels the pending purchase of a ticket
+// whose payment failed and returns it. It returns sql.ErrNoRows if the
+// purchase is no longer pending.
+func (r *PurchaseRepository) FailPendingPurchaseByTicketID(ticketID int) (*models.Purchase, error) {
+	var failedPurchase models.Purchase
+	err := r.db.QueryRowx(
+		"UPDATE purchases SET status='cancelled', expires_at=NULL, cancelled_at=$1 WHERE ticket_id=$2 AND status='pending' RETURNING *",
+		time.Now().UTC(), ticketID,
+	).StructScan(&failedPurchase)
+	if err != nil {
+		return nil, err
+	}
+	return &failedPurchase, nil
+}
+
+// ClaimExpiredHolds moves pending purchases whose hold has lapsed to
+// "expired" and returns them. Once expired, a purchase can no longer be
+// confirmed by a late payment.
+func (r *PurchaseRepository) ClaimExpiredHolds(limit int) ([]models.Purchase, error) {
+	var purchases []models.Purchase
+	err := r.db.Select(&purchases, `
+		UPDATE purchases SET status = 'expired'
+		WHERE purchase_id IN (
+			SELECT purchase_id FROM purchases
+			WHERE status = 'pending' AND expires_at < $1
+			ORDER BY expires_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		time.Now().UTC(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return purchases, nil
+}
+
+// CountActiveTickets returns how many tickets of a ticket type the user holds
+// or has bought and not cancelled, for the type's per-user limit.
+func (r *PurchaseRepository) CountActiveTickets(userID, ticketTypeID int) (int, error) {
+	var count int
+	err := r.db.Get(&count, countActiveTicketsQuery, userID, ticketTypeID)
+	return count, err
+}
+
+// checkPerUserLimits returns ErrPerUserLimit if the user holding quantities
+// more tickets of each ticket type would exceed the type's limit. Types
+// without a limit above zero are not checked. The user's tickets of each
+// checked type are locked for the rest of tx, so two holds placed at once
+// cannot both pass. Types are locked in order so orders cannot deadlock.
+func checkPerUserLimits(tx *sqlx.Tx, userID int, limits, quantities map[int]int) error {
+	ticketTypeIDs := make([]int, 0, len(quantities))
+	for ticketTypeID := range quantities {
+		if limits[ticketTypeID] > 0 {
+			ticketTypeIDs = append(ticketTypeIDs, ticketTypeID)
+		}
+	}
+	sort.Ints(ticketTypeIDs)
+
+	for _, ticketTypeID := range ticketTypeIDs {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1, $2)", userID, ticketTypeID); err != nil {
+			return err
+		}
+		var held int
+		if err := tx.Get(&held, countActiveTicketsQuery, userID, ticketTypeID); err != nil {
+			return err
+		}
+		if held+quantities[ticketTypeID] > limits[ticketTypeID] {
+			return ErrPerUserLimit
+		}
+	}
+	return nil
+}
+
+// GetPurchaseByID retrieves a purchase record by its ID.
+func (r *PurchaseRepository) GetPurchaseByID(purchaseID int) (*models.Purchase, error) {
+	var purchase models.Purchase
+	err := r.db.Get(&purchase, "SELECT * FROM purchases WHERE purchase_id = $1", purchaseID)
+	if err != nil {
+		return nil, err
+	}
+	return &purchase, nil
+}
+
 // GetPurchaseByTicketID retrieves a purchase record by ticket ID
 func (r *PurchaseRepository) GetPurchaseByTicketID(ticketID int) (*models.Purchase, error) {
 	var purchase models.Purchase
@@ -0,0 +1,85 @@
+package repos
+
+import (
+	"errors"
+	"fmt"
+	"reservation-service/internal/db/dbtest"
+	"reservation-service/internal/db/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newHold(ticketID, ticketTypeID int) *models.Purchase {
+	return &models.Purchase{
+		TicketID:       ticketID,
+		UserID:         1,
+		EventID:        7,
+		PurchaseDate:   time.Now().UTC(),
+		Status:         "pending",
+		ReservationKey: fmt.Sprintf("reservation-saga-%d", ticketID),
+		Amount:         2500,
+		Currency:       "USD",
+		PaymentMethod:  "card",
+		TicketTypeID:   &ticketTypeID,
+	}
+}
+
+func TestCreatePurchase_EnforcesPerUserLimitUnderConcurrency(t *testing.T) {
+	repo := NewPurchaseRepository(dbtest.Open(t))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created, limited := 0, 0
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(ticketID int) {
+			defer wg.Done()
+			_, err := repo.CreatePurchase(newHold(ticketID, 3), 2)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				created++
+			case errors.Is(err, ErrPerUserLimit):
+				limited++
+			default:
+				t.Errorf("CreatePurchase: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if created != 2 || limited != 8 {
+		t.Errorf("created %d and limited %d holds, want 2 and 8", created, limited)
+	}
+
+	// Other ticket types have limits of their own
+	if _, err := repo.CreatePurchase(newHold(11, 4), 2); err != nil {
+		t.Errorf("CreatePurchase of another type: %v", err)
+	}
+}
+
+func TestCreateOrder_CountsEveryTicketOfATypeAgainstItsLimit(t *testing.T) {
+	db := dbtest.Open(t)
+	purchases := NewPurchaseRepository(db)
+	orders := NewOrderRepository(db)
+
+	if _, err := purchases.CreatePurchase(newHold(1, 3), 3); err != nil {
+		t.Fatalf("CreatePurchase: %v", err)
+	}
+
+	key := OrderReservationKey(1)
+	items := []models.Purchase{*newHold(2, 3), *newHold(3, 3)}
+	order := &models.Order{UserID: 1, ReservationKey: key, Amount: 5000, Currency: "USD", PaymentMethod: "card"}
+	if _, err := orders.CreateOrder(order, items, map[int]int{3: 3}); !errors.Is(err, ErrPerUserLimit) {
+		t.Fatalf("CreateOrder error = %v, want ErrPerUserLimit", err)
+	}
+	if held, err := purchases.CountActiveTickets(1, 3); err != nil || held != 1 {
+		t.Errorf("user holds %d tickets (%v), want 1 after the order was refused", held, err)
+	}
+
+	if _, err := orders.CreateOrder(order, items[:1], map[int]int{3: 3}); err != nil {
+		t.Errorf("CreateOrder within the limit: %v", err)
+	}
+}
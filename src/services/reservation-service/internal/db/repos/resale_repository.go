@@ -0,0 +1,183 @@
+package repos
+
+import (
+	"errors"
+	"fmt"
+	"reservation-service/internal/db/models"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"tixie.local/broker/outbox"
+)
+
+// ErrAlreadyListed is returned when a ticket that is already on the resale
+// market is listed again.
+var ErrAlreadyListed = errors.New("ticket is already listed for resale")
+
+// resaleKeyPrefix marks the reservation keys of resale purchases, so their
+// payments are told apart from those of first-hand purchases.
+const resaleKeyPrefix = "resale-"
+
+// ResaleReservationKey returns the reservation key of a purchase attempt of
+// a listing.
+func ResaleReservationKey(listingID, attempt int) string {
+	return fmt.Sprintf("%s%d-%d", resaleKeyPrefix, listingID, attempt)
+}
+
+// IsResaleReservationKey reports whether key belongs to a resale purchase.
+func IsResaleReservationKey(key string) bool {
+	return strings.HasPrefix(key, resaleKeyPrefix)
+}
+
+// ResaleRepository handles database operations for resale listings.
+type ResaleRepository struct {
+	db *sqlx.DB
+}
+
+// NewResaleRepository creates a new ResaleRepository.
+func NewResaleRepository(db *sqlx.DB) *ResaleRepository {
+	return &ResaleRepository{db: db}
+}
+
+// CreateListing puts a ticket on the resale market. It returns
+// ErrAlreadyListed if the ticket has an open listing.
+func (r *ResaleRepository) CreateListing(listing *models.ResaleListing) (*models.ResaleListing, error) {
+	var created models.ResaleListing
+	err := r.db.QueryRowx(
+		"INSERT INTO resale_listings (ticket_id, event_id, seller_user_id, price, fee, currency) VALUES ($1, $2, $3, $4, $5, $6) RETURNING *",
+		listing.TicketID, listing.EventID, listing.SellerUserID, listing.Price, listing.Fee, listing.Currency,
+	).StructScan(&created)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return nil, ErrAlreadyListed
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// GetListing retrieves a listing by its ID.
+func (r *ResaleRepository) GetListing(listingID int) (*models.ResaleListing, error) {
+	var listing models.ResaleListing
+	err := r.db.Get(&listing, "SELECT * FROM resale_listings WHERE listing_id = $1", listingID)
+	if err != nil {
+		return nil, err
+	}
+	return &listing, nil
+}
+
+// GetListingByReservationKey retrieves the listing whose current or last
+// purchase attempt paid under key.
+func (r *ResaleRepository) GetListingByReservationKey(key string) (*models.ResaleListing, error) {
+	var listing models.ResaleListing
+	err := r.db.Get(&listing, "SELECT * FROM resale_listings WHERE reservation_key = $1", key)
+	if err != nil {
+		return nil, err
+	}
+	return &listing, nil
+}
+
+// GetOpenListings retrieves the listings of an event that can be bought,
+// cheapest first.
+func (r *ResaleRepository) GetOpenListings(eventID int) ([]models.ResaleListing, error) {
+	listings := []models.ResaleListing{}
+	err := r.db.Select(&listings, "SELECT * FROM resale_listings WHERE event_id = $1 AND status = 'listed' ORDER BY price, listing_id", eventID)
+	if err != nil {
+		return nil, err
+	}
+	return listings, nil
+}
+
+// CancelListing takes a listing off the market. It returns sql.ErrNoRows if
+// the listing is not the seller's or is no longer listed, e.g. because a
+// buyer is paying for it.
+func (r *ResaleRepository) CancelListing(listingID, sellerUserID int) (*models.ResaleListing, error) {
+	var cancelled models.ResaleListing
+	err := r.db.QueryRowx(
+		"UPDATE resale_listings SET status='cancelled' WHERE listing_id=$1 AND seller_user_id=$2 AND status='listed' RETURNING *",
+		listingID, sellerUserID,
+	).StructScan(&cancelled)
+	if err != nil {
+		return nil, err
+	}
+	return &cancelled, nil
+}
+
+// ReserveListing holds a listing for a buyer until expiresAt, under the
+// reservation key of its next purchase attempt. attempts is the number of
+// attempts the caller saw, so two buyers never hold the listing at once.
+// Any outbox messages, the payment request, are written in the same
+// transaction. It returns sql.ErrNoRows if the listing was taken meanwhile.
+func (r *ResaleRepository) ReserveListing(listingID, buyerUserID, attempts int, reservationKey string, expiresAt time.Time, messages ...outbox.Message) (*models.ResaleListing, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var reserved models.ResaleListing
+	err = tx.QueryRowx(
+		`UPDATE resale_listings SET status='pending', buyer_user_id=$2, attempts=attempts+1, reservation_key=$4, expires_at=$5
+		WHERE listing_id=$1 AND status='listed' AND attempts=$3 RETURNING *`,
+		listingID, buyerUserID, attempts, reservationKey, expiresAt,
+	).StructScan(&reserved)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := outbox.Insert(tx.Tx, messages...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &reserved, nil
+}
+
+// SellListing marks the pending listing paid for under reservationKey as
+// sold and records the payment intent. It returns sql.ErrNoRows if the
+// listing is no longer pending, e.g. because its hold already expired.
+func (r *ResaleRepository) SellListing(reservationKey, paymentIntentID string) (*models.ResaleListing, error) {
+	var sold models.ResaleListing
+	err := r.db.QueryRowx(
+		"UPDATE resale_listings SET status='sold', expires_at=NULL, payment_intent_id=$2, sold_at=$3 WHERE reservation_key=$1 AND status='pending' RETURNING *",
+		reservationKey, paymentIntentID, time.Now().UTC(),
+	).StructScan(&sold)
+	if err != nil {
+		return nil, err
+	}
+	return &sold, nil
+}
+
+// ReleaseListing puts the pending listing whose payment under
+// reservationKey failed back on the market. It returns sql.ErrNoRows if the
+// listing is no longer pending.
+func (r *ResaleRepository) ReleaseListing(reservationKey string) (*models.ResaleListing, error) {
+	var released models.ResaleListing
+	err := r.db.QueryRowx(
+		"UPDATE resale_listings SET status='listed', buyer_user_id=NULL, expires_at=NULL WHERE reservation_key=$1 AND status='pending' RETURNING *",
+		reservationKey,
+	).StructScan(&released)
+	if err != nil {
+		return nil, err
+	}
+	return &released, nil
+}
+
+// ReleaseExpiredHolds puts pending listings whose hold has lapsed back on
+// the market and returns how many there were. Their reservation key is kept,
+// so a late payment finds the listing but can no longer buy it.
+func (r *ResaleRepository) ReleaseExpiredHolds() (int64, error) {
+	result, err := r.db.Exec(
+		"UPDATE resale_listings SET status='listed', buyer_user_id=NULL, expires_at=NULL WHERE status='pending' AND expires_at < $1",
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,100 @@
+package repos
+
+import (
+	"reservation-service/internal/db/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SagaRepository handles database operations for sagas.
+type SagaRepository struct {
+	db *sqlx.DB
+}
+
+// NewSagaRepository creates a new SagaRepository.
+func NewSagaRepository(db *sqlx.DB) *SagaRepository {
+	return &SagaRepository{db: db}
+}
+
+// CreateSaga inserts a new running saga.
+func (r *SagaRepository) CreateSaga(sagaType string, payload []byte) (*models.Saga, error) {
+	var saga models.Saga
+	err := r.db.QueryRowx(
+		"INSERT INTO sagas (saga_type, status, payload) VALUES ($1, 'running', $2) RETURNING *",
+		sagaType, payload,
+	).StructScan(&saga)
+	if err != nil {
+		return nil, err
+	}
+	return &saga, nil
+}
+
+// RecordStep stores the outcome of a step and the saga's new position and
+// payload in a single transaction.
+func (r *SagaRepository) RecordStep(sagaID int, stepName, stepStatus, stepErr string, currentStep int, payload []byte) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO saga_steps (saga_id, step_name, status, error) VALUES ($1, $2, $3, $4)",
+		sagaID, stepName, stepStatus, stepErr,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE sagas SET current_step=$1, payload=$2, updated_at=NOW() WHERE saga_id=$3",
+		currentStep, payload, sagaID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateSagaStatus sets the status and last error of a saga.
+func (r *SagaRepository) UpdateSagaStatus(sagaID int, status, lastError string) error {
+	_, err := r.db.Exec(
+		"UPDATE sagas SET status=$1, last_error=$2, updated_at=NOW() WHERE saga_id=$3",
+		status, lastError, sagaID,
+	)
+	return err
+}
+
+// UpdateSagaStatusAndStep sets the status, last error and current step of a
+// saga.
+func (r *SagaRepository) UpdateSagaStatusAndStep(sagaID int, status, lastError string, currentStep int) error {
+	_, err := r.db.Exec(
+		"UPDATE sagas SET status=$1, last_error=$2, current_step=$3, updated_at=NOW() WHERE saga_id=$4",
+		status, lastError, currentStep, sagaID,
+	)
+	return err
+}
+
+// ClaimStaleSagas returns unfinished sagas that have not been touched for
+// staleAfter. Claimed sagas get a fresh updated_at so other replicas skip them.
+func (r *SagaRepository) ClaimStaleSagas(staleAfter time.Duration, limit int) ([]models.Saga, error) {
+	var sagas []models.Saga
+	err := r.db.Select(&sagas, `
+		UPDATE sagas SET updated_at = NOW()
+		WHERE saga_id IN (
+			SELECT saga_id FROM sagas
+			WHERE status IN ('running', 'compensating') AND updated_at < NOW() - $1 * INTERVAL '1 second'
+			ORDER BY saga_id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		staleAfter.Seconds(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sagas, nil
+}
@@ -0,0 +1,219 @@
+package repos
+
+import (
+	"errors"
+	"fmt"
+	"reservation-service/internal/db/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"tixie.local/broker/outbox"
+)
+
+// ErrAlreadyWaiting is returned when a user joins the waitlist of an event
+// they are already waiting for.
+var ErrAlreadyWaiting = errors.New("user is already on the waitlist")
+
+// WaitlistReservationKey returns the reservation key the ticket offered to a
+// waitlist entry is set aside under. The purchase made when the offer is
+// accepted reuses it, so the ticket is not taken twice.
+func WaitlistReservationKey(entryID int) string {
+	return fmt.Sprintf("waitlist-%d", entryID)
+}
+
+// WaitlistRepository handles database operations for event waitlists.
+type WaitlistRepository struct {
+	db *sqlx.DB
+}
+
+// NewWaitlistRepository creates a new WaitlistRepository.
+func NewWaitlistRepository(db *sqlx.DB) *WaitlistRepository {
+	return &WaitlistRepository{db: db}
+}
+
+// Join puts a user at the end of the waitlist for a ticket type of an event,
+// zero for events without types. It returns ErrAlreadyWaiting if the user is
+// waiting or has an offer for the event.
+func (r *WaitlistRepository) Join(eventID, ticketTypeID, userID int) (*models.WaitlistEntry, error) {
+	var entry models.WaitlistEntry
+	err := r.db.QueryRowx(
+		"INSERT INTO waitlist_entries (event_id, ticket_type_id, user_id) VALUES ($1, NULLIF($2, 0), $3) RETURNING *",
+		eventID, ticketTypeID, userID,
+	).StructScan(&entry)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return nil, ErrAlreadyWaiting
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// GetEntry retrieves a waitlist entry by its ID.
+func (r *WaitlistRepository) GetEntry(entryID int) (*models.WaitlistEntry, error) {
+	var entry models.WaitlistEntry
+	err := r.db.Get(&entry, "SELECT * FROM waitlist_entries WHERE entry_id = $1", entryID)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Position returns the place of a waiting entry in the queue for its
+// event's ticket type, starting at 1.
+func (r *WaitlistRepository) Position(entry *models.WaitlistEntry) (int, error) {
+	var position int
+	err := r.db.Get(&position,
+		"SELECT COUNT(*) FROM waitlist_entries WHERE event_id = $1 AND ticket_type_id IS NOT DISTINCT FROM $2 AND status = 'waiting' AND entry_id <= $3",
+		entry.EventID, entry.TicketTypeID, entry.EntryID,
+	)
+	return position, err
+}
+
+// HasWaiting reports whether anyone is waiting for a ticket of the given
+// type, zero for events without types, to the event.
+func (r *WaitlistRepository) HasWaiting(eventID, ticketTypeID int) (bool, error) {
+	var waiting bool
+	err := r.db.Get(&waiting,
+		"SELECT EXISTS (SELECT 1 FROM waitlist_entries WHERE event_id = $1 AND ticket_type_id IS NOT DISTINCT FROM NULLIF($2, 0) AND status = 'waiting')",
+		eventID, ticketTypeID,
+	)
+	return waiting, err
+}
+
+// GetWaitingEvents returns the events anyone is waiting for.
+func (r *WaitlistRepository) GetWaitingEvents() ([]int, error) {
+	eventIDs := []int{}
+	err := r.db.Select(&eventIDs, "SELECT DISTINCT event_id FROM waitlist_entries WHERE status = 'waiting' ORDER BY event_id")
+	if err != nil {
+		return nil, err
+	}
+	return eventIDs, nil
+}
+
+// GetNextWaiting returns up to limit entries at the front of the queue for
+// a ticket type of an event, zero for events without types, first come
+// first.
+func (r *WaitlistRepository) GetNextWaiting(eventID, ticketTypeID, limit int) ([]models.WaitlistEntry, error) {
+	entries := []models.WaitlistEntry{}
+	err := r.db.Select(&entries,
+		"SELECT * FROM waitlist_entries WHERE event_id = $1 AND ticket_type_id IS NOT DISTINCT FROM NULLIF($2, 0) AND status = 'waiting' ORDER BY entry_id LIMIT $3",
+		eventID, ticketTypeID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Offer sets a ticket aside for a waiting entry until expiresAt. Any outbox
+// messages, the offer email, are written in the same transaction. It returns
+// sql.ErrNoRows if the entry is no longer waiting.
+func (r *WaitlistRepository) Offer(entryID int, reservationKey string, expiresAt time.Time, messages ...outbox.Message) (*models.WaitlistEntry, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var offered models.WaitlistEntry
+	err = tx.QueryRowx(
+		`UPDATE waitlist_entries SET status='offered', reservation_key=$2, offered_at=$3, offer_expires_at=$4
+		WHERE entry_id=$1 AND status='waiting' RETURNING *`,
+		entryID, reservationKey, time.Now().UTC(), expiresAt,
+	).StructScan(&offered)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := outbox.Insert(tx.Tx, messages...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &offered, nil
+}
+
+// AcceptOffer claims the ticket offered to a user. It returns sql.ErrNoRows
+// if the entry is not the user's, has no offer or its offer has lapsed, so
+// an offer is either accepted or lapses, never both.
+func (r *WaitlistRepository) AcceptOffer(entryID, userID int) (*models.WaitlistEntry, error) {
+	var accepted models.WaitlistEntry
+	err := r.db.QueryRowx(
+		"UPDATE waitlist_entries SET status='accepted' WHERE entry_id=$1 AND user_id=$2 AND status='offered' AND offer_expires_at > $3 RETURNING *",
+		entryID, userID, time.Now().UTC(),
+	).StructScan(&accepted)
+	if err != nil {
+		return nil, err
+	}
+	return &accepted, nil
+}
+
+// SetPurchase records the purchase an accepted offer was turned into.
+func (r *WaitlistRepository) SetPurchase(entryID, purchaseID int) error {
+	_, err := r.db.Exec("UPDATE waitlist_entries SET purchase_id=$2 WHERE entry_id=$1", entryID, purchaseID)
+	return err
+}
+
+// DropAcceptedOffer lapses an accepted offer whose purchase could not be
+// made, so its ticket is given back like that of any lapsed offer.
+func (r *WaitlistRepository) DropAcceptedOffer(entryID int) error {
+	_, err := r.db.Exec("UPDATE waitlist_entries SET status='lapsed' WHERE entry_id=$1 AND status='accepted'", entryID)
+	return err
+}
+
+// Leave takes a user off an event's waitlist, declining their offer if they
+// have one. It returns sql.ErrNoRows if the entry is not the user's or is
+// neither waiting nor offered.
+func (r *WaitlistRepository) Leave(entryID, userID int) (*models.WaitlistEntry, error) {
+	var left models.WaitlistEntry
+	// Only an offered entry has a ticket set aside to give back
+	err := r.db.QueryRowx(
+		`UPDATE waitlist_entries SET status='left', inventory_released=(status='waiting')
+		WHERE entry_id=$1 AND user_id=$2 AND status IN ('waiting', 'offered') RETURNING *`,
+		entryID, userID,
+	).StructScan(&left)
+	if err != nil {
+		return nil, err
+	}
+	return &left, nil
+}
+
+// LapseExpiredOffers lapses offers that were not accepted in time and
+// returns how many there were. Their tickets are given back through
+// GetUnreleasedEntries.
+func (r *WaitlistRepository) LapseExpiredOffers() (int64, error) {
+	result, err := r.db.Exec(
+		"UPDATE waitlist_entries SET status='lapsed' WHERE status='offered' AND offer_expires_at < $1",
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetUnreleasedEntries returns up to limit lapsed or left entries whose
+// ticket has not been given back to the event yet.
+func (r *WaitlistRepository) GetUnreleasedEntries(limit int) ([]models.WaitlistEntry, error) {
+	entries := []models.WaitlistEntry{}
+	err := r.db.Select(&entries,
+		"SELECT * FROM waitlist_entries WHERE status IN ('lapsed', 'left') AND NOT inventory_released ORDER BY entry_id LIMIT $1",
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// MarkInventoryReleased records that the ticket set aside for an entry went
+// back to the event.
+func (r *WaitlistRepository) MarkInventoryReleased(entryID int) error {
+	_, err := r.db.Exec("UPDATE waitlist_entries SET inventory_released=TRUE WHERE entry_id=$1", entryID)
+	return err
+}
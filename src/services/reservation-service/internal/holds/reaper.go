@@ -0,0 +1,79 @@
+package holds
+
+import (
+	"log"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"reservation-service/internal/saga"
+	"time"
+)
+
+// Reaper periodically releases holds whose payment never arrived, both on
+// tickets and on resale listings.
+type Reaper struct {
+	purchases *repos.PurchaseRepository
+	resale    *repos.ResaleRepository
+	sagas     *saga.Orchestrator
+	interval  time.Duration
+}
+
+// NewReaper creates a new Reaper that checks for expired holds every interval.
+func NewReaper(purchases *repos.PurchaseRepository, resale *repos.ResaleRepository, sagas *saga.Orchestrator, interval time.Duration) *Reaper {
+	return &Reaper{
+		purchases: purchases,
+		resale:    resale,
+		sagas:     sagas,
+		interval:  interval,
+	}
+}
+
+// Start runs the reaper in a background goroutine.
+func (r *Reaper) Start() {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			r.reap()
+		}
+	}()
+	log.Printf("Hold reaper started, checking every %s", r.interval)
+}
+
+func (r *Reaper) reap() {
+	// A listing goes straight back on the market, as its ticket never left
+	// the seller.
+	released, err := r.resale.ReleaseExpiredHolds()
+	if err != nil {
+		log.Printf("Hold reaper: failed to release expired resale holds: %v", err)
+	} else if released > 0 {
+		log.Printf("Hold reaper: put %d resale listing(s) back on the market", released)
+	}
+
+	for {
+		expired, err := r.purchases.ClaimExpiredHolds(50)
+		if err != nil {
+			log.Printf("Hold reaper: failed to claim expired holds: %v", err)
+			return
+		}
+		if len(expired) == 0 {
+			return
+		}
+
+		for _, purchase := range expired {
+			log.Printf("Hold reaper: releasing expired hold for purchase %d (ticket %d)", purchase.PurchaseID, purchase.TicketID)
+			data := &models.SagaData{
+				EventID:        purchase.EventID,
+				UserID:         purchase.UserID,
+				TicketID:       purchase.TicketID,
+				PurchaseID:     purchase.PurchaseID,
+				ReservationKey: purchase.ReservationKey,
+			}
+			// Failed steps stay in the saga table and are retried by the
+			// saga recovery loop.
+			if err := r.sagas.Run(saga.ExpireHold, data); err != nil {
+				log.Printf("Hold reaper: failed to release hold for purchase %d: %v", purchase.PurchaseID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package holds
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/dbtest"
+	"reservation-service/internal/db/repos"
+	"reservation-service/internal/saga"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	circuitbreaker "tixie.local/common"
+)
+
+// fakeServices stands in for event-service and ticket-service, recording
+// the seats released and the tickets whose status changed. Every call fails
+// while down is set.
+type fakeServices struct {
+	mu       sync.Mutex
+	released []string
+	statuses map[string]string
+	down     bool
+}
+
+func (f *fakeServices) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case r.Method == http.MethodPatch && strings.HasSuffix(r.URL.Path, "/tickets/release"):
+		f.released = append(f.released, fmt.Sprint(body["reservation_key"]))
+		json.NewEncoder(w).Encode(map[string]int{"tickets_left": 1})
+	case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/status"):
+		f.statuses[r.URL.Path] = fmt.Sprint(body["status"])
+		json.NewEncoder(w).Encode(map[string]string{"status": fmt.Sprint(body["status"])})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestReaper(t *testing.T) (*Reaper, *sqlx.DB, *fakeServices) {
+	t.Helper()
+	db := dbtest.Open(t)
+
+	fake := &fakeServices{statuses: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	t.Setenv("EVENT_SERVICE_URL", srv.URL)
+	t.Setenv("TICKET_SERVICE_URL", srv.URL)
+
+	purchases := repos.NewPurchaseRepository(db)
+	services := clients.NewServiceClients(circuitbreaker.NewBreaker("reaper-test"))
+	sagas := saga.NewOrchestrator(repos.NewSagaRepository(db))
+	sagas.Register(saga.NewExpireHoldDefinition(services, purchases))
+
+	return NewReaper(purchases, repos.NewResaleRepository(db), sagas, time.Minute), db, fake
+}
+
+func createHold(t *testing.T, db *sqlx.DB, ticketID int, expiresIn time.Duration) string {
+	t.Helper()
+	key := fmt.Sprintf("reservation-saga-%d", ticketID)
+	_, err := db.Exec(
+		`INSERT INTO purchases (ticket_id, user_id, event_id, purchase_date, status, expires_at, reservation_key, amount, currency)
+		 VALUES ($1, 1, 7, NOW(), 'pending', $2, $3, 2500, 'USD')`,
+		ticketID, time.Now().UTC().Add(expiresIn), key,
+	)
+	if err != nil {
+		t.Fatalf("failed to create hold: %v", err)
+	}
+	return key
+}
+
+func purchaseStatus(t *testing.T, db *sqlx.DB, ticketID int) string {
+	t.Helper()
+	var status string
+	if err := db.QueryRow("SELECT status FROM purchases WHERE ticket_id = $1", ticketID).Scan(&status); err != nil {
+		t.Fatalf("failed to load purchase of ticket %d: %v", ticketID, err)
+	}
+	return status
+}
+
+func TestReap_ReleasesExpiredHolds(t *testing.T) {
+	reaper, db, fake := newTestReaper(t)
+	expiredKey := createHold(t, db, 1, -time.Minute)
+	createHold(t, db, 2, time.Hour)
+
+	reaper.reap()
+
+	if len(fake.released) != 1 || fake.released[0] != expiredKey {
+		t.Errorf("released seats %v, want [%s]", fake.released, expiredKey)
+	}
+	if got := fake.statuses["/v1/1/status"]; got != "cancelled" {
+		t.Errorf("ticket 1 status = %q, want cancelled", got)
+	}
+	if _, ok := fake.statuses["/v1/2/status"]; ok {
+		t.Errorf("ticket 2 was changed although its hold has not expired")
+	}
+	if got := purchaseStatus(t, db, 1); got != "cancelled" {
+		t.Errorf("expired purchase is %s, want cancelled", got)
+	}
+	if got := purchaseStatus(t, db, 2); got != "pending" {
+		t.Errorf("held purchase is %s, want pending", got)
+	}
+
+	// A payment arriving now can no longer confirm the released hold.
+	if _, err := reaper.purchases.ConfirmPurchaseByTicketID(1, "pi_late"); err != sql.ErrNoRows {
+		t.Errorf("confirming a released hold: error = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestReap_ExpiredHoldStaysClaimedWhileServicesAreDown(t *testing.T) {
+	reaper, db, fake := newTestReaper(t)
+	createHold(t, db, 1, -time.Minute)
+
+	fake.down = true
+	reaper.reap()
+
+	// The purchase is expired at once, and the release is left to the saga
+	// recovery loop.
+	if got := purchaseStatus(t, db, 1); got != "expired" {
+		t.Errorf("purchase is %s, want expired", got)
+	}
+	var status string
+	var step int
+	if err := db.QueryRow("SELECT status, current_step FROM sagas WHERE saga_type = $1", saga.ExpireHold).Scan(&status, &step); err != nil {
+		t.Fatalf("failed to load saga: %v", err)
+	}
+	if status != saga.StatusRunning || step != 0 {
+		t.Errorf("saga is %s at step %d, want %s at step 0", status, step, saga.StatusRunning)
+	}
+
+	// Reaping again does not claim the hold a second time.
+	fake.down = false
+	reaper.reap()
+	if len(fake.released) != 0 {
+		t.Errorf("released seats %v, want none until recovery", fake.released)
+	}
+}
+
+func TestReap_PutsExpiredResaleListingsBackOnTheMarket(t *testing.T) {
+	reaper, db, _ := newTestReaper(t)
+	var listingID int
+	err := db.QueryRow(
+		`INSERT INTO resale_listings (ticket_id, event_id, seller_user_id, price, fee, currency, status, buyer_user_id, attempts, reservation_key, expires_at)
+		 VALUES (1, 7, 1, 5000, 500, 'USD', 'pending', 2, 1, 'resale-1-1', $1) RETURNING listing_id`,
+		time.Now().UTC().Add(-time.Minute),
+	).Scan(&listingID)
+	if err != nil {
+		t.Fatalf("failed to create listing: %v", err)
+	}
+
+	reaper.reap()
+
+	listing, err := reaper.resale.GetListing(listingID)
+	if err != nil {
+		t.Fatalf("GetListing: %v", err)
+	}
+	if listing.Status != "listed" || listing.BuyerUserID != nil {
+		t.Errorf("listing is %s with buyer %v, want listed without a buyer", listing.Status, listing.BuyerUserID)
+	}
+}
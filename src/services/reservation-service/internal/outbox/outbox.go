@@ -0,0 +1,27 @@
+// Package outbox describes the messages reservation-service publishes through
+// the broker outbox.
+package outbox
+
+import (
+	"tixie.local/broker/events"
+	brokerOutbox "tixie.local/broker/outbox"
+)
+
+// Producer identifies reservation-service in the envelopes it publishes.
+const Producer = "reservation-service"
+
+// RoutingKeys are the keys reservation-service publishes to. The relay probes
+// them when it connects so that a missing consumer shows up in the logs at
+// startup.
+var RoutingKeys = []string{
+	events.RoutingKey(events.TypePaymentRequested),
+	events.RoutingKey(events.TypeNotificationEmail),
+	events.RoutingKey(events.TypePurchaseCancelled),
+	events.RoutingKey(events.TypeResaleSettled),
+	events.RoutingKey(events.TypeWaitlistOffered),
+}
+
+// NewEvent builds an outbox message that publishes e in a new envelope.
+func NewEvent(correlationID string, e events.Event) (brokerOutbox.Message, error) {
+	return brokerOutbox.NewMessage(Producer, correlationID, e)
+}
@@ -0,0 +1,42 @@
+// Package qr reads ticket QR codes from uploaded images. Decoding happens
+// in-process, so ticket codes are never sent to a third party.
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// ErrNoQRCode is returned for images without a readable QR code.
+var ErrNoQRCode = errors.New("no QR code found")
+
+// Decode reads the QR code in a PNG, JPEG or GIF image and returns its
+// content.
+func Decode(r io.Reader) (string, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+
+	bitmap, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+
+	hints := map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bitmap, hints)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNoQRCode, err)
+	}
+	return result.GetText(), nil
+}
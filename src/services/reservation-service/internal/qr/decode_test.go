@@ -0,0 +1,51 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+func encodePNG(t *testing.T, img image.Image) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode PNG: %v", err)
+	}
+	return &buf
+}
+
+func TestDecode(t *testing.T) {
+	const content = "ticket_code:123e4567-e89b-12d3-a456-426614174000"
+	matrix, err := qrcode.NewQRCodeWriter().Encode(content, gozxing.BarcodeFormat_QR_CODE, 256, 256, nil)
+	if err != nil {
+		t.Fatalf("failed to encode QR code: %v", err)
+	}
+
+	got, err := Decode(encodePNG(t, matrix))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if got != content {
+		t.Errorf("Decode = %q, want %q", got, content)
+	}
+}
+
+func TestDecode_NoQRCode(t *testing.T) {
+	blank := image.NewGray(image.Rect(0, 0, 64, 64))
+	for i := range blank.Pix {
+		blank.Pix[i] = 0xff
+	}
+
+	if _, err := Decode(encodePNG(t, blank)); !errors.Is(err, ErrNoQRCode) {
+		t.Errorf("expected ErrNoQRCode, got %v", err)
+	}
+	if _, err := Decode(bytes.NewBufferString("not an image")); err == nil {
+		t.Error("expected an error for a file that is not an image")
+	}
+}
@@ -0,0 +1,106 @@
+package saga
+
+import (
+	"log"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/outbox"
+
+	"tixie.local/broker/events"
+	brokerOutbox "tixie.local/broker/outbox"
+	"tixie.local/common/paymentmethod"
+)
+
+// CancelPurchase is the saga type that undoes a paid purchase: the payment
+// is refunded, the ticket cancelled, the seat given back to the event's
+// inventory and the buyer notified.
+const CancelPurchase = "cancel_purchase"
+
+// NewCancelPurchaseDefinition builds the steps of the CancelPurchase saga.
+// The purchase is already marked cancelled when the saga starts, so every
+// step is retried until it succeeds. The saga's steps are the audit trail of
+// the cancellation.
+func NewCancelPurchaseDefinition(services *clients.ServiceClients, outboxStore *brokerOutbox.Store) Definition {
+	return Definition{
+		Type: CancelPurchase,
+		Steps: []Step{
+			{
+				Name:  "refund_payment",
+				Retry: true,
+				Action: func(data *models.SagaData) error {
+					if data.PaymentIntentID == "" {
+						log.Printf("Saga %d: purchase %d has no payment to refund", data.SagaID, data.PurchaseID)
+						return nil
+					}
+					// Cash collected at the door is handed back at the
+					// venue, the payment provider cannot refund it.
+					if data.PaymentMethod == paymentmethod.CashOnArrival {
+						log.Printf("Saga %d: purchase %d was paid in cash, its refund is handed back at the venue", data.SagaID, data.PurchaseID)
+						return nil
+					}
+					// A ticket of an order was paid for together with the
+					// order's other tickets, so only its share is refunded.
+					var amount int64
+					if data.OrderID != 0 {
+						if data.Amount == 0 {
+							log.Printf("Saga %d: ticket %d of order %d was free, nothing to refund", data.SagaID, data.TicketID, data.OrderID)
+							return nil
+						}
+						amount = data.Amount
+					}
+					refund, err := services.RefundPayment(data.PaymentIntentID, amount, events.RefundIdempotencyKey(data.ReservationKey))
+					if err != nil {
+						return err
+					}
+					data.RefundID = refund.RefundID
+					data.RefundAmount = refund.Amount
+					return nil
+				},
+			},
+			{
+				Name:  "cancel_ticket",
+				Retry: true,
+				Action: func(data *models.SagaData) error {
+					return services.UpdateTicketStatus(data.TicketID, "cancelled")
+				},
+			},
+			{
+				Name:  "release_inventory",
+				Retry: true,
+				Action: func(data *models.SagaData) error {
+					_, err := services.ReleaseInventory(data.EventID, data.ReservationKey)
+					return err
+				},
+			},
+			{
+				Name:  "notify_buyer",
+				Retry: true,
+				Action: func(data *models.SagaData) error {
+					if data.TicketCode == "" {
+						ticket, err := services.GetTicket(data.TicketID)
+						if err != nil {
+							return err
+						}
+						data.TicketCode = ticket.TicketCode
+					}
+
+					msg, err := outbox.NewEvent(data.ReservationKey, &events.PurchaseCancelled{
+						PurchaseID:     data.PurchaseID,
+						TicketID:       data.TicketID,
+						EventID:        data.EventID,
+						UserID:         data.UserID,
+						RecipientEmail: data.Email,
+						TicketCode:     data.TicketCode,
+						RefundAmount:   data.RefundAmount,
+						Currency:       data.Currency,
+						RefundID:       data.RefundID,
+					})
+					if err != nil {
+						return err
+					}
+					return outboxStore.Enqueue(msg)
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,26 @@
+package saga
+
+import (
+	"reservation-service/internal/db/models"
+	"testing"
+
+	"tixie.local/common/paymentmethod"
+)
+
+func TestCancelPurchase_CashIsNotRefunded(t *testing.T) {
+	// The provider cannot refund cash, so the step must not call it: nil
+	// clients would panic if it did.
+	def := NewCancelPurchaseDefinition(nil, nil)
+	data := &models.SagaData{
+		PurchaseID:      7,
+		PaymentMethod:   paymentmethod.CashOnArrival,
+		PaymentIntentID: "cash_reservation-saga-7",
+		Amount:          2500,
+	}
+	if err := def.Steps[0].Action(data); err != nil {
+		t.Fatalf("refund_payment: %v", err)
+	}
+	if data.RefundID != "" || data.RefundAmount != 0 {
+		t.Errorf("refund = %q (%d), want none", data.RefundID, data.RefundAmount)
+	}
+}
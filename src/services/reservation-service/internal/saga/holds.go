@@ -0,0 +1,45 @@
+package saga
+
+import (
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+)
+
+// ExpireHold is the saga type that gives an expired hold back: the seat goes
+// back to the event's inventory, and the ticket and purchase are cancelled.
+const ExpireHold = "expire_hold"
+
+// NewExpireHoldDefinition builds the steps of the ExpireHold saga. The
+// purchase is already marked expired when the saga starts, so there is
+// nothing to roll back to and every step is retried until it succeeds.
+func NewExpireHoldDefinition(services *clients.ServiceClients, purchases *repos.PurchaseRepository) Definition {
+	return Definition{
+		Type: ExpireHold,
+		Steps: []Step{
+			{
+				Name:  "release_inventory",
+				Retry: true,
+				Action: func(data *models.SagaData) error {
+					_, err := services.ReleaseInventory(data.EventID, data.ReservationKey)
+					return err
+				},
+			},
+			{
+				Name:  "cancel_ticket",
+				Retry: true,
+				Action: func(data *models.SagaData) error {
+					return services.UpdateTicketStatus(data.TicketID, "cancelled")
+				},
+			},
+			{
+				Name:  "cancel_purchase",
+				Retry: true,
+				Action: func(data *models.SagaData) error {
+					_, err := purchases.UpdatePurchaseStatus(data.PurchaseID, "cancelled")
+					return err
+				},
+			},
+		},
+	}
+}
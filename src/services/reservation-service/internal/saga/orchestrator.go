@@ -0,0 +1,237 @@
+package saga
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"time"
+)
+
+// Saga statuses as stored in the sagas table.
+const (
+	StatusRunning      = "running"
+	StatusCompleted    = "completed"
+	StatusCompensating = "compensating"
+	StatusCompensated  = "compensated"
+)
+
+// Step is a single unit of work in a saga together with the action that undoes it.
+type Step struct {
+	Name   string
+	Action func(data *models.SagaData) error
+	// Compensate may run for an action that did not complete, or never ran,
+	// when recovery rolls back a saga that crashed in this step.
+	Compensate func(data *models.SagaData) error
+	// Retry marks steps that must eventually succeed instead of triggering
+	// compensation. A failed retry step leaves the saga running so the
+	// recovery loop picks it up again.
+	Retry bool
+}
+
+// Definition describes the ordered steps of a saga type.
+type Definition struct {
+	Type  string
+	Steps []Step
+}
+
+// StepError is returned when a saga step fails and the saga was rolled back.
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Orchestrator runs sagas, persisting every step so that they can be
+// compensated or resumed after a restart.
+type Orchestrator struct {
+	repo        *repos.SagaRepository
+	definitions map[string]Definition
+}
+
+// NewOrchestrator creates a new Orchestrator.
+func NewOrchestrator(repo *repos.SagaRepository) *Orchestrator {
+	return &Orchestrator{
+		repo:        repo,
+		definitions: make(map[string]Definition),
+	}
+}
+
+// Register adds a saga definition to the orchestrator.
+func (o *Orchestrator) Register(def Definition) {
+	o.definitions[def.Type] = def
+}
+
+// Run starts a new saga of the given type. If a step fails, the steps that
+// already completed are compensated in reverse order and a *StepError is
+// returned. data is updated in place with whatever the steps produced.
+func (o *Orchestrator) Run(sagaType string, data *models.SagaData) error {
+	def, ok := o.definitions[sagaType]
+	if !ok {
+		return fmt.Errorf("unknown saga type %q", sagaType)
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal saga payload: %v", err)
+	}
+
+	saga, err := o.repo.CreateSaga(def.Type, payload)
+	if err != nil {
+		return fmt.Errorf("failed to create saga: %v", err)
+	}
+	data.SagaID = saga.SagaID
+
+	return o.execute(def, saga, data)
+}
+
+// execute runs the remaining steps of a saga starting at saga.CurrentStep.
+func (o *Orchestrator) execute(def Definition, saga *models.Saga, data *models.SagaData) error {
+	for i := saga.CurrentStep; i < len(def.Steps); i++ {
+		step := def.Steps[i]
+
+		if err := step.Action(data); err != nil {
+			log.Printf("Saga %d (%s): step %s failed: %v", saga.SagaID, def.Type, step.Name, err)
+			if recordErr := o.record(saga, step.Name, "failed", err, saga.CurrentStep, data); recordErr != nil {
+				log.Printf("Saga %d: failed to record step %s: %v", saga.SagaID, step.Name, recordErr)
+			}
+
+			if step.Retry {
+				// Left running on purpose, the recovery loop retries it.
+				return nil
+			}
+
+			if statusErr := o.repo.UpdateSagaStatus(saga.SagaID, StatusCompensating, err.Error()); statusErr != nil {
+				log.Printf("Saga %d: failed to mark as compensating: %v", saga.SagaID, statusErr)
+			}
+			saga.Status = StatusCompensating
+			o.compensate(def, saga, data)
+			return &StepError{Step: step.Name, Err: err}
+		}
+
+		saga.CurrentStep = i + 1
+		if err := o.record(saga, step.Name, "completed", nil, saga.CurrentStep, data); err != nil {
+			// The step itself succeeded, so keep going. Worst case recovery
+			// re-runs this step after a restart.
+			log.Printf("Saga %d: failed to record step %s: %v", saga.SagaID, step.Name, err)
+		}
+	}
+
+	if err := o.repo.UpdateSagaStatus(saga.SagaID, StatusCompleted, ""); err != nil {
+		log.Printf("Saga %d: failed to mark as completed: %v", saga.SagaID, err)
+	}
+	saga.Status = StatusCompleted
+	return nil
+}
+
+// compensate undoes completed steps in reverse order. CurrentStep is the
+// number of steps still to be undone, so a partially compensated saga can be
+// picked up again by the recovery loop.
+func (o *Orchestrator) compensate(def Definition, saga *models.Saga, data *models.SagaData) {
+	for saga.CurrentStep > 0 {
+		step := def.Steps[saga.CurrentStep-1]
+		if step.Compensate != nil {
+			if err := step.Compensate(data); err != nil {
+				log.Printf("Saga %d (%s): compensation of %s failed: %v", saga.SagaID, def.Type, step.Name, err)
+				if recordErr := o.record(saga, step.Name, "compensation_failed", err, saga.CurrentStep, data); recordErr != nil {
+					log.Printf("Saga %d: failed to record compensation of %s: %v", saga.SagaID, step.Name, recordErr)
+				}
+				return
+			}
+		}
+
+		saga.CurrentStep--
+		if err := o.record(saga, step.Name, "compensated", nil, saga.CurrentStep, data); err != nil {
+			log.Printf("Saga %d: failed to record compensation of %s: %v", saga.SagaID, step.Name, err)
+		}
+	}
+
+	if err := o.repo.UpdateSagaStatus(saga.SagaID, StatusCompensated, saga.LastError); err != nil {
+		log.Printf("Saga %d: failed to mark as compensated: %v", saga.SagaID, err)
+	}
+	saga.Status = StatusCompensated
+}
+
+func (o *Orchestrator) record(saga *models.Saga, stepName, status string, stepErr error, currentStep int, data *models.SagaData) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal saga payload: %v", err)
+	}
+	errMsg := ""
+	if stepErr != nil {
+		errMsg = stepErr.Error()
+		saga.LastError = errMsg
+	}
+	return o.repo.RecordStep(saga.SagaID, stepName, status, errMsg, currentStep, payload)
+}
+
+// Recover resumes sagas that were left unfinished, e.g. because the process
+// restarted half way through. Compensating sagas continue compensating. A
+// running saga whose next step is a retry step is past its point of no return
+// and is rolled forward; any other running saga is compensated, since the
+// client that started it never got an answer. The step it was running is
+// compensated too, as it may have taken effect without being recorded.
+func (o *Orchestrator) Recover(staleAfter time.Duration) {
+	sagas, err := o.repo.ClaimStaleSagas(staleAfter, 20)
+	if err != nil {
+		log.Printf("Saga recovery: failed to load stale sagas: %v", err)
+		return
+	}
+
+	for i := range sagas {
+		saga := &sagas[i]
+		def, ok := o.definitions[saga.SagaType]
+		if !ok {
+			log.Printf("Saga recovery: unknown saga type %q for saga %d", saga.SagaType, saga.SagaID)
+			continue
+		}
+
+		var data models.SagaData
+		if err := json.Unmarshal(saga.Payload, &data); err != nil {
+			log.Printf("Saga recovery: failed to unmarshal payload of saga %d: %v", saga.SagaID, err)
+			continue
+		}
+		// The payload is stored before the saga has an id, so a saga that
+		// crashed in its first step does not have it yet.
+		data.SagaID = saga.SagaID
+
+		log.Printf("Saga recovery: resuming saga %d (%s) in status %s at step %d", saga.SagaID, saga.SagaType, saga.Status, saga.CurrentStep)
+
+		if saga.Status == StatusRunning && (saga.CurrentStep >= len(def.Steps) || def.Steps[saga.CurrentStep].Retry) {
+			o.execute(def, saga, &data)
+			continue
+		}
+
+		if saga.Status == StatusRunning {
+			saga.CurrentStep++
+			if err := o.repo.UpdateSagaStatusAndStep(saga.SagaID, StatusCompensating, "interrupted", saga.CurrentStep); err != nil {
+				log.Printf("Saga %d: failed to mark as compensating: %v", saga.SagaID, err)
+			}
+			saga.Status = StatusCompensating
+			saga.LastError = "interrupted"
+		}
+		o.compensate(def, saga, &data)
+	}
+}
+
+// StartRecovery runs Recover every interval in a background goroutine.
+func (o *Orchestrator) StartRecovery(interval, staleAfter time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		o.Recover(staleAfter)
+		for range ticker.C {
+			o.Recover(staleAfter)
+		}
+	}()
+	log.Println("Saga recovery loop started")
+}
@@ -0,0 +1,237 @@
+package saga
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"reservation-service/internal/db/dbtest"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// stepLog records the actions and compensations a test saga ran, in order.
+type stepLog struct {
+	calls []string
+}
+
+// step returns a step that logs its action and compensation, failing its
+// action with fail if it is set.
+func (l *stepLog) step(name string, retry bool, fail *error) Step {
+	return Step{
+		Name:  name,
+		Retry: retry,
+		Action: func(data *models.SagaData) error {
+			l.calls = append(l.calls, "do "+name)
+			if fail != nil && *fail != nil {
+				return *fail
+			}
+			return nil
+		},
+		Compensate: func(data *models.SagaData) error {
+			l.calls = append(l.calls, "undo "+name)
+			return nil
+		},
+	}
+}
+
+func newTestOrchestrator(t *testing.T) (*Orchestrator, *sqlx.DB) {
+	t.Helper()
+	db := dbtest.Open(t)
+	return NewOrchestrator(repos.NewSagaRepository(db)), db
+}
+
+func sagaState(t *testing.T, db *sqlx.DB, sagaID int) (string, int) {
+	t.Helper()
+	var status string
+	var currentStep int
+	if err := db.QueryRow("SELECT status, current_step FROM sagas WHERE saga_id = $1", sagaID).Scan(&status, &currentStep); err != nil {
+		t.Fatalf("failed to load saga %d: %v", sagaID, err)
+	}
+	return status, currentStep
+}
+
+// crash leaves a saga the way a process that died after completing its
+// first steps would: still running at that step, and stale.
+func crash(t *testing.T, db *sqlx.DB, sagaType string, steps int) int {
+	t.Helper()
+	payload, _ := json.Marshal(&models.SagaData{EventID: 1})
+	var sagaID int
+	err := db.QueryRow(
+		"INSERT INTO sagas (saga_type, current_step, payload, updated_at) VALUES ($1, $2, $3, NOW() - INTERVAL '1 hour') RETURNING saga_id",
+		sagaType, steps, payload,
+	).Scan(&sagaID)
+	if err != nil {
+		t.Fatalf("failed to create saga: %v", err)
+	}
+	return sagaID
+}
+
+func TestRun_CompletesEveryStep(t *testing.T) {
+	o, db := newTestOrchestrator(t)
+	var log stepLog
+	o.Register(Definition{Type: "test", Steps: []Step{log.step("a", false, nil), log.step("b", false, nil)}})
+
+	data := &models.SagaData{}
+	if err := o.Run("test", data); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if want := []string{"do a", "do b"}; !reflect.DeepEqual(log.calls, want) {
+		t.Errorf("calls = %v, want %v", log.calls, want)
+	}
+	if status, step := sagaState(t, db, data.SagaID); status != StatusCompleted || step != 2 {
+		t.Errorf("saga is %s at step %d, want %s at step 2", status, step, StatusCompleted)
+	}
+}
+
+func TestRun_FailingStepCompensatesEarlierStepsInReverse(t *testing.T) {
+	o, db := newTestOrchestrator(t)
+	var log stepLog
+	failure := errors.New("out of tickets")
+	o.Register(Definition{Type: "test", Steps: []Step{
+		log.step("a", false, nil),
+		log.step("b", false, nil),
+		log.step("c", false, &failure),
+		log.step("d", false, nil),
+	}})
+
+	data := &models.SagaData{}
+	err := o.Run("test", data)
+
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "c" || !errors.Is(err, failure) {
+		t.Fatalf("Run error = %v, want a StepError for step c wrapping %v", err, failure)
+	}
+	// The failed step is not compensated itself, and later steps never run.
+	if want := []string{"do a", "do b", "do c", "undo b", "undo a"}; !reflect.DeepEqual(log.calls, want) {
+		t.Errorf("calls = %v, want %v", log.calls, want)
+	}
+	if status, step := sagaState(t, db, data.SagaID); status != StatusCompensated || step != 0 {
+		t.Errorf("saga is %s at step %d, want %s at step 0", status, step, StatusCompensated)
+	}
+}
+
+func TestRun_FailingRetryStepLeavesSagaRunning(t *testing.T) {
+	o, db := newTestOrchestrator(t)
+	var log stepLog
+	failure := errors.New("ticket service unavailable")
+	o.Register(Definition{Type: "test", Steps: []Step{log.step("a", false, nil), log.step("b", true, &failure)}})
+
+	data := &models.SagaData{}
+	if err := o.Run("test", data); err != nil {
+		t.Fatalf("Run error = %v, want nil for a retry step", err)
+	}
+
+	if want := []string{"do a", "do b"}; !reflect.DeepEqual(log.calls, want) {
+		t.Errorf("calls = %v, want %v", log.calls, want)
+	}
+	if status, step := sagaState(t, db, data.SagaID); status != StatusRunning || step != 1 {
+		t.Errorf("saga is %s at step %d, want %s at step 1", status, step, StatusRunning)
+	}
+
+	// Once the service is back, recovery finishes the saga.
+	failure = nil
+	if _, err := db.Exec("UPDATE sagas SET updated_at = NOW() - INTERVAL '1 hour'"); err != nil {
+		t.Fatalf("failed to age saga: %v", err)
+	}
+	o.Recover(time.Minute)
+	if status, step := sagaState(t, db, data.SagaID); status != StatusCompleted || step != 2 {
+		t.Errorf("after recovery saga is %s at step %d, want %s at step 2", status, step, StatusCompleted)
+	}
+}
+
+func TestRecover_RollsCrashedSagaForwardPastPointOfNoReturn(t *testing.T) {
+	o, db := newTestOrchestrator(t)
+	var log stepLog
+	o.Register(Definition{Type: "test", Steps: []Step{log.step("a", false, nil), log.step("b", true, nil), log.step("c", true, nil)}})
+	sagaID := crash(t, db, "test", 1)
+
+	o.Recover(time.Minute)
+
+	if want := []string{"do b", "do c"}; !reflect.DeepEqual(log.calls, want) {
+		t.Errorf("calls = %v, want %v", log.calls, want)
+	}
+	if status, step := sagaState(t, db, sagaID); status != StatusCompleted || step != 3 {
+		t.Errorf("saga is %s at step %d, want %s at step 3", status, step, StatusCompleted)
+	}
+}
+
+func TestRecover_CompensatesInterruptedSaga(t *testing.T) {
+	o, db := newTestOrchestrator(t)
+	var log stepLog
+	o.Register(Definition{Type: "test", Steps: []Step{log.step("a", false, nil), log.step("b", false, nil), log.step("c", false, nil)}})
+	sagaID := crash(t, db, "test", 2)
+
+	o.Recover(time.Minute)
+
+	// Its client never got an answer, so the saga is rolled back, including
+	// the step it was running.
+	if want := []string{"undo c", "undo b", "undo a"}; !reflect.DeepEqual(log.calls, want) {
+		t.Errorf("calls = %v, want %v", log.calls, want)
+	}
+	if status, step := sagaState(t, db, sagaID); status != StatusCompensated || step != 0 {
+		t.Errorf("saga is %s at step %d, want %s at step 0", status, step, StatusCompensated)
+	}
+}
+
+func TestRecover_CompensatesStepThatCrashedBeforeBeingRecorded(t *testing.T) {
+	o, db := newTestOrchestrator(t)
+	var log stepLog
+	b := log.step("b", false, nil)
+	action := b.Action
+	b.Action = func(data *models.SagaData) error {
+		action(data)
+		// The process dies after the step took effect, before the
+		// orchestrator records it.
+		runtime.Goexit()
+		return nil
+	}
+	o.Register(Definition{Type: "test", Steps: []Step{log.step("a", false, nil), b, log.step("c", false, nil)}})
+
+	data := &models.SagaData{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.Run("test", data)
+	}()
+	<-done
+	if status, step := sagaState(t, db, data.SagaID); status != StatusRunning || step != 1 {
+		t.Fatalf("crashed saga is %s at step %d, want %s at step 1", status, step, StatusRunning)
+	}
+
+	if _, err := db.Exec("UPDATE sagas SET updated_at = NOW() - INTERVAL '1 hour'"); err != nil {
+		t.Fatalf("failed to age saga: %v", err)
+	}
+	o.Recover(time.Minute)
+
+	if want := []string{"do a", "do b", "undo b", "undo a"}; !reflect.DeepEqual(log.calls, want) {
+		t.Errorf("calls = %v, want %v", log.calls, want)
+	}
+	if status, step := sagaState(t, db, data.SagaID); status != StatusCompensated || step != 0 {
+		t.Errorf("saga is %s at step %d, want %s at step 0", status, step, StatusCompensated)
+	}
+}
+
+func TestRecover_SkipsSagasStillInProgress(t *testing.T) {
+	o, db := newTestOrchestrator(t)
+	var log stepLog
+	o.Register(Definition{Type: "test", Steps: []Step{log.step("a", false, nil), log.step("b", false, nil)}})
+	sagaID := crash(t, db, "test", 1)
+	if _, err := db.Exec("UPDATE sagas SET updated_at = NOW() WHERE saga_id = $1", sagaID); err != nil {
+		t.Fatalf("failed to touch saga: %v", err)
+	}
+
+	o.Recover(time.Minute)
+
+	if len(log.calls) != 0 {
+		t.Errorf("calls = %v, want none for a saga updated within staleAfter", log.calls)
+	}
+	if status, step := sagaState(t, db, sagaID); status != StatusRunning || step != 1 {
+		t.Errorf("saga is %s at step %d, want %s at step 1", status, step, StatusRunning)
+	}
+}
@@ -0,0 +1,204 @@
+package saga
+
+import (
+	"log"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"reservation-service/internal/outbox"
+	"time"
+
+	"tixie.local/broker/events"
+)
+
+// ReserveOrder is the saga type that places a hold on every ticket of an
+// order.
+const ReserveOrder = "reserve_order"
+
+// NewReserveOrderDefinition builds the steps of the ReserveOrder saga: take
+// a seat for every ticket from its event's inventory, create the held
+// tickets, then record the order with a pending purchase per ticket that
+// expires after holdTTL. A single payment request for the order's total is
+// written to the outbox together with the order.
+//
+// The order gets all of its tickets or none. A step that fails half way
+// through undoes its own work before the saga compensates the steps before
+// it.
+func NewReserveOrderDefinition(services *clients.ServiceClients, orders *repos.OrderRepository, purchases *repos.PurchaseRepository, holdTTL time.Duration) Definition {
+	return Definition{
+		Type: ReserveOrder,
+		Steps: []Step{
+			{
+				Name: "reserve_inventory",
+				Action: func(data *models.SagaData) error {
+					assignOrderReservationKeys(data)
+					for i := range data.OrderTickets {
+						ticket := &data.OrderTickets[i]
+						if _, err := services.ReserveInventory(ticket.EventID, ticket.TicketTypeID, 1, ticket.ReservationKey); err != nil {
+							releaseOrderInventory(services, data)
+							return err
+						}
+					}
+					return nil
+				},
+				Compensate: func(data *models.SagaData) error {
+					assignOrderReservationKeys(data)
+					return releaseOrderInventory(services, data)
+				},
+			},
+			{
+				Name: "create_tickets",
+				Action: func(data *models.SagaData) error {
+					for i := range data.OrderTickets {
+						ticket := &data.OrderTickets[i]
+						if ticket.TicketID != 0 {
+							continue
+						}
+						created, err := services.CreateTicket(ticket.EventID, ticket.TicketTypeID, data.UserID, "held", ticket.ReservationKey)
+						if err != nil {
+							cancelOrderTickets(services, purchases, data)
+							return err
+						}
+						ticket.TicketID = created.TicketID
+					}
+					return nil
+				},
+				Compensate: func(data *models.SagaData) error {
+					return cancelOrderTickets(services, purchases, data)
+				},
+			},
+			{
+				Name: "create_order",
+				Action: func(data *models.SagaData) error {
+					// The items let the payment service find the order's
+					// payment by any of its tickets.
+					paymentItems := make([]events.PaymentItem, len(data.OrderTickets))
+					for i, ticket := range data.OrderTickets {
+						paymentItems[i] = events.PaymentItem{TicketID: ticket.TicketID, Amount: ticket.Amount}
+					}
+					paymentMsg, err := outbox.NewEvent(data.ReservationKey, &events.PaymentRequested{
+						Amount:         data.Amount,
+						Currency:       data.Currency,
+						PaymentMethod:  data.PaymentMethod,
+						ReservationKey: data.ReservationKey,
+						Items:          paymentItems,
+					})
+					if err != nil {
+						return err
+					}
+
+					now := time.Now().UTC()
+					expiresAt := now.Add(holdTTL)
+					items := make([]models.Purchase, len(data.OrderTickets))
+					for i, ticket := range data.OrderTickets {
+						items[i] = models.Purchase{
+							TicketID:       ticket.TicketID,
+							UserID:         data.UserID,
+							EventID:        ticket.EventID,
+							PurchaseDate:   now,
+							Status:         "pending",
+							ExpiresAt:      &expiresAt,
+							ReservationKey: ticket.ReservationKey,
+							Amount:         ticket.Amount,
+							Currency:       data.Currency,
+							PaymentMethod:  data.PaymentMethod,
+							TicketTypeID:   ticketTypeIDPtr(ticket.TicketTypeID),
+						}
+					}
+
+					perUserLimits := make(map[int]int)
+					for _, ticket := range data.OrderTickets {
+						perUserLimits[ticket.TicketTypeID] = ticket.PerUserLimit
+					}
+					order, err := orders.CreateOrder(&models.Order{
+						UserID:         data.UserID,
+						ReservationKey: data.ReservationKey,
+						Amount:         data.Amount,
+						Currency:       data.Currency,
+						PaymentMethod:  data.PaymentMethod,
+					}, items, perUserLimits, paymentMsg)
+					if err != nil {
+						return err
+					}
+					data.OrderID = order.OrderID
+					return nil
+				},
+				Compensate: func(data *models.SagaData) error {
+					return orders.CancelPendingOrder(data.OrderID)
+				},
+			},
+		},
+	}
+}
+
+// assignOrderReservationKeys derives the keys the order and each of its
+// tickets reserve their seats under from the saga, so a compensation finds
+// the seats even if the saga crashed before recording the keys.
+func assignOrderReservationKeys(data *models.SagaData) {
+	if data.ReservationKey == "" {
+		data.ReservationKey = repos.OrderReservationKey(data.SagaID)
+	}
+	for i := range data.OrderTickets {
+		data.OrderTickets[i].ReservationKey = repos.OrderTicketReservationKey(data.ReservationKey, i+1)
+	}
+}
+
+// releaseOrderInventory gives the seats of an order's tickets back to their
+// events. Releasing under a key that holds nothing does nothing, so it is
+// safe to repeat.
+func releaseOrderInventory(services *clients.ServiceClients, data *models.SagaData) error {
+	var firstErr error
+	for _, ticket := range data.OrderTickets {
+		if ticket.ReservationKey == "" {
+			continue
+		}
+		if _, err := services.ReleaseInventory(ticket.EventID, ticket.ReservationKey); err != nil {
+			log.Printf("Saga %d: failed to release seat %s: %v", data.SagaID, ticket.ReservationKey, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// cancelOrderTickets cancels the tickets created for an order, and their
+// purchases in case the order was committed just before a crash kept
+// create_order from being recorded. Tickets whose ids were not recorded are
+// looked up by their reservation keys.
+func cancelOrderTickets(services *clients.ServiceClients, purchases *repos.PurchaseRepository, data *models.SagaData) error {
+	var firstErr error
+	for i := range data.OrderTickets {
+		ticket := &data.OrderTickets[i]
+		if ticket.TicketID == 0 {
+			ticketID, err := unrecordedTicketID(services, ticket.ReservationKey)
+			if err != nil {
+				log.Printf("Saga %d: failed to look up ticket %s: %v", data.SagaID, ticket.ReservationKey, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if ticketID == 0 {
+				continue
+			}
+			ticket.TicketID = ticketID
+		}
+		if err := purchases.CancelPendingPurchaseByTicketID(ticket.TicketID); err != nil {
+			log.Printf("Saga %d: failed to cancel the purchase of ticket %d: %v", data.SagaID, ticket.TicketID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err := services.UpdateTicketStatus(ticket.TicketID, "cancelled"); err != nil {
+			log.Printf("Saga %d: failed to cancel ticket %d: %v", data.SagaID, ticket.TicketID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		ticket.TicketID = 0
+	}
+	return firstErr
+}
@@ -0,0 +1,144 @@
+package saga
+
+import (
+	"fmt"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"reservation-service/internal/outbox"
+	"time"
+
+	"tixie.local/broker/events"
+)
+
+// ReserveTicket is the saga type that places a hold on a ticket.
+const ReserveTicket = "reserve_ticket"
+
+// NewReserveTicketDefinition builds the steps of the ReserveTicket saga: take
+// a seat from the event's inventory, create a held ticket, then record a
+// pending purchase that expires after holdTTL. The payment request is written
+// to the outbox together with the purchase.
+func NewReserveTicketDefinition(services *clients.ServiceClients, purchases *repos.PurchaseRepository, holdTTL time.Duration) Definition {
+	return Definition{
+		Type: ReserveTicket,
+		Steps: []Step{
+			{
+				Name: "reserve_inventory",
+				Action: func(data *models.SagaData) error {
+					_, err := services.ReserveInventory(data.EventID, data.TicketTypeID, 1, reservationKey(data))
+					return err
+				},
+				Compensate: func(data *models.SagaData) error {
+					_, err := services.ReleaseInventory(data.EventID, reservationKey(data))
+					return err
+				},
+			},
+			{
+				Name: "create_ticket",
+				Action: func(data *models.SagaData) error {
+					ticket, err := services.CreateTicket(data.EventID, data.TicketTypeID, data.UserID, "held", data.ReservationKey)
+					if err != nil {
+						return err
+					}
+					data.TicketID = ticket.TicketID
+					data.TicketCode = ticket.TicketCode
+					return nil
+				},
+				Compensate: func(data *models.SagaData) error {
+					if data.TicketID == 0 {
+						ticketID, err := unrecordedTicketID(services, data.ReservationKey)
+						if err != nil || ticketID == 0 {
+							return err
+						}
+						data.TicketID = ticketID
+					}
+					// The purchase may have been committed, with its payment
+					// request, just before a crash kept create_purchase from
+					// being recorded.
+					if err := purchases.CancelPendingPurchaseByTicketID(data.TicketID); err != nil {
+						return err
+					}
+					return services.UpdateTicketStatus(data.TicketID, "cancelled")
+				},
+			},
+			{
+				Name: "create_purchase",
+				Action: func(data *models.SagaData) error {
+					paymentMsg, err := outbox.NewEvent(data.ReservationKey, &events.PaymentRequested{
+						TicketID:       data.TicketID,
+						Amount:         data.Amount,
+						Currency:       data.Currency,
+						PaymentMethod:  data.PaymentMethod,
+						ReservationKey: data.ReservationKey,
+					})
+					if err != nil {
+						return err
+					}
+
+					now := time.Now().UTC()
+					expiresAt := now.Add(holdTTL)
+					purchase, err := purchases.CreatePurchase(&models.Purchase{
+						TicketID:       data.TicketID,
+						UserID:         data.UserID,
+						EventID:        data.EventID,
+						PurchaseDate:   now,
+						Status:         "pending",
+						ExpiresAt:      &expiresAt,
+						ReservationKey: data.ReservationKey,
+						Amount:         data.Amount,
+						Currency:       data.Currency,
+						PaymentMethod:  data.PaymentMethod,
+						TicketTypeID:   ticketTypeIDPtr(data.TicketTypeID),
+					}, data.PerUserLimit, paymentMsg)
+					if err != nil {
+						return err
+					}
+					data.PurchaseID = purchase.PurchaseID
+					return nil
+				},
+				Compensate: func(data *models.SagaData) error {
+					// A purchase committed without being recorded is
+					// cancelled by create_ticket's compensation.
+					if data.PurchaseID == 0 {
+						return nil
+					}
+					_, err := purchases.UpdatePurchaseStatus(data.PurchaseID, "cancelled")
+					return err
+				},
+			},
+		},
+	}
+}
+
+// reservationKey returns the key the saga reserves its seat under. It is
+// derived from the saga, so a compensation finds the seat even if the saga
+// crashed before recording the key.
+func reservationKey(data *models.SagaData) string {
+	if data.ReservationKey == "" {
+		data.ReservationKey = fmt.Sprintf("reservation-saga-%d", data.SagaID)
+	}
+	return data.ReservationKey
+}
+
+// unrecordedTicketID returns the id of the ticket ticket-service created
+// under a reservation key, for a saga that crashed before recording it, or
+// zero if there is no such ticket.
+func unrecordedTicketID(services *clients.ServiceClients, key string) (int, error) {
+	if key == "" {
+		return 0, nil
+	}
+	ticket, err := services.GetTicketByReservationKey(key)
+	if err != nil || ticket == nil {
+		return 0, err
+	}
+	return ticket.TicketID, nil
+}
+
+// ticketTypeIDPtr returns the ticket type a purchase records, nil for the
+// zero id of events without types.
+func ticketTypeIDPtr(ticketTypeID int) *int {
+	if ticketTypeID == 0 {
+		return nil
+	}
+	return &ticketTypeID
+}
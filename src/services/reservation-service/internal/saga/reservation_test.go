@@ -0,0 +1,113 @@
+package saga
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	circuitbreaker "tixie.local/common"
+)
+
+// fakeTicketServices stands in for event-service and ticket-service. It
+// holds the tickets created under reservation keys and records the seats
+// released and the tickets whose status changed.
+type fakeTicketServices struct {
+	mu       sync.Mutex
+	tickets  map[string]int
+	released []string
+	statuses map[string]string
+}
+
+func (f *fakeTicketServices) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/reservations/"):
+		ticketID, ok := f.tickets[strings.TrimPrefix(r.URL.Path, "/v1/reservations/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ticket_id": ticketID, "status": "held"})
+	case r.Method == http.MethodPatch && strings.HasSuffix(r.URL.Path, "/tickets/release"):
+		f.released = append(f.released, fmt.Sprint(body["reservation_key"]))
+		json.NewEncoder(w).Encode(map[string]int{"tickets_left": 1})
+	case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/status"):
+		f.statuses[r.URL.Path] = fmt.Sprint(body["status"])
+		json.NewEncoder(w).Encode(map[string]string{"status": fmt.Sprint(body["status"])})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRecover_CancelsTicketCreatedBeforeACrash(t *testing.T) {
+	o, db := newTestOrchestrator(t)
+	fake := &fakeTicketServices{tickets: make(map[string]int), statuses: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	t.Setenv("EVENT_SERVICE_URL", srv.URL)
+	t.Setenv("TICKET_SERVICE_URL", srv.URL)
+
+	services := clients.NewServiceClients(circuitbreaker.NewBreaker("saga-test"))
+	o.Register(NewReserveTicketDefinition(services, repos.NewPurchaseRepository(db), time.Minute))
+
+	// The seat was reserved and recorded, then ticket-service created the
+	// ticket but the process died before create_ticket was recorded.
+	payload, _ := json.Marshal(&models.SagaData{EventID: 1, UserID: 7, ReservationKey: "reservation-key-1"})
+	var sagaID int
+	err := db.QueryRow(
+		"INSERT INTO sagas (saga_type, current_step, payload, updated_at) VALUES ($1, 1, $2, NOW() - INTERVAL '1 hour') RETURNING saga_id",
+		ReserveTicket, payload,
+	).Scan(&sagaID)
+	if err != nil {
+		t.Fatalf("failed to create saga: %v", err)
+	}
+	fake.tickets["reservation-key-1"] = 9
+
+	o.Recover(time.Minute)
+
+	if got := fake.statuses["/v1/9/status"]; got != "cancelled" {
+		t.Errorf("ticket 9 status = %q, want cancelled", got)
+	}
+	if len(fake.released) != 1 || fake.released[0] != "reservation-key-1" {
+		t.Errorf("released seats %v, want [reservation-key-1]", fake.released)
+	}
+	if status, step := sagaState(t, db, sagaID); status != StatusCompensated || step != 0 {
+		t.Errorf("saga is %s at step %d, want %s at step 0", status, step, StatusCompensated)
+	}
+}
+
+func TestRecover_ReleasesSeatReservedBeforeACrash(t *testing.T) {
+	o, db := newTestOrchestrator(t)
+	fake := &fakeTicketServices{tickets: make(map[string]int), statuses: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	t.Setenv("EVENT_SERVICE_URL", srv.URL)
+	t.Setenv("TICKET_SERVICE_URL", srv.URL)
+
+	services := clients.NewServiceClients(circuitbreaker.NewBreaker("saga-test"))
+	o.Register(NewReserveTicketDefinition(services, repos.NewPurchaseRepository(db), time.Minute))
+
+	// The process died in reserve_inventory, before its key was recorded.
+	sagaID := crash(t, db, ReserveTicket, 0)
+
+	o.Recover(time.Minute)
+
+	if want := fmt.Sprintf("reservation-saga-%d", sagaID); len(fake.released) != 1 || fake.released[0] != want {
+		t.Errorf("released seats %v, want [%s]", fake.released, want)
+	}
+	if status, step := sagaState(t, db, sagaID); status != StatusCompensated || step != 0 {
+		t.Errorf("saga is %s at step %d, want %s at step 0", status, step, StatusCompensated)
+	}
+}
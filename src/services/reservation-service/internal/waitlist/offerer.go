@@ -0,0 +1,200 @@
+package waitlist
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"reservation-service/internal/clients"
+	"reservation-service/internal/db/models"
+	"reservation-service/internal/db/repos"
+	"reservation-service/internal/outbox"
+	"time"
+
+	"tixie.local/broker/events"
+)
+
+// Offerer periodically offers the tickets that freed up for sold-out events
+// to the users waiting for them. Tickets free up when a purchase is
+// cancelled, a hold expires or the vendor adds more, so rather than reacting
+// to each it looks at how many tickets every event with a waitlist has left.
+type Offerer struct {
+	entries  *repos.WaitlistRepository
+	services *clients.ServiceClients
+	offerTTL time.Duration
+	interval time.Duration
+}
+
+// NewOfferer creates a new Offerer that checks for freed tickets every
+// interval. Users have offerTTL to accept an offer.
+func NewOfferer(entries *repos.WaitlistRepository, services *clients.ServiceClients, offerTTL, interval time.Duration) *Offerer {
+	return &Offerer{
+		entries:  entries,
+		services: services,
+		offerTTL: offerTTL,
+		interval: interval,
+	}
+}
+
+// Start runs the offerer in a background goroutine.
+func (o *Offerer) Start() {
+	go func() {
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			o.offer()
+		}
+	}()
+	log.Printf("Waitlist offerer started, checking every %s", o.interval)
+}
+
+func (o *Offerer) offer() {
+	// Lapsed offers are given back first, so their tickets roll over to
+	// the next user in the same pass.
+	lapsed, err := o.entries.LapseExpiredOffers()
+	if err != nil {
+		log.Printf("Waitlist offerer: failed to lapse expired offers: %v", err)
+	} else if lapsed > 0 {
+		log.Printf("Waitlist offerer: %d offer(s) lapsed", lapsed)
+	}
+	o.releaseTickets()
+
+	eventIDs, err := o.entries.GetWaitingEvents()
+	if err != nil {
+		log.Printf("Waitlist offerer: failed to load waitlists: %v", err)
+		return
+	}
+	for _, eventID := range eventIDs {
+		o.offerEvent(eventID)
+	}
+}
+
+// releaseTickets gives the tickets set aside for lapsed and declined offers
+// back to their events.
+func (o *Offerer) releaseTickets() {
+	for {
+		entries, err := o.entries.GetUnreleasedEntries(50)
+		if err != nil {
+			log.Printf("Waitlist offerer: failed to load lapsed offers: %v", err)
+			return
+		}
+		if len(entries) == 0 {
+			return
+		}
+
+		for _, entry := range entries {
+			if entry.ReservationKey != nil {
+				if _, err := o.services.ReleaseInventory(entry.EventID, *entry.ReservationKey); err != nil {
+					// Retried on the next pass
+					log.Printf("Waitlist offerer: failed to give back ticket of entry %d: %v", entry.EntryID, err)
+					return
+				}
+			}
+			if err := o.entries.MarkInventoryReleased(entry.EntryID); err != nil {
+				log.Printf("Waitlist offerer: failed to record ticket of entry %d as given back: %v", entry.EntryID, err)
+				return
+			}
+		}
+	}
+}
+
+// offerEvent offers each of the event's free tickets to the next user in
+// line. Events with ticket types keep a line per type, served out of the
+// type's free tickets while it is on sale. Nothing is offered once the event
+// has started.
+func (o *Offerer) offerEvent(eventID int) {
+	eventDetails, err := o.services.GetEvent(eventID)
+	if err != nil {
+		log.Printf("Waitlist offerer: failed to fetch event %d: %v", eventID, err)
+		return
+	}
+	if start, err := eventDetails.Start(); err != nil || !time.Now().Before(start) {
+		return
+	}
+	if len(eventDetails.TicketTypes) == 0 {
+		o.offerLine(eventID, 0, eventDetails.TicketsLeft)
+		return
+	}
+
+	now := time.Now()
+	ticketsLeft := eventDetails.TicketsLeft
+	for _, ticketType := range eventDetails.TicketTypes {
+		if !ticketType.OnSale(now) {
+			continue
+		}
+		ticketsLeft -= o.offerLine(eventID, ticketType.ID, min(ticketType.TicketsLeft, ticketsLeft))
+	}
+}
+
+// offerLine offers up to free tickets of a ticket type, zero for events
+// without types, to the users first in its line and returns how many it
+// offered.
+func (o *Offerer) offerLine(eventID, ticketTypeID, free int) int {
+	if free <= 0 {
+		return 0
+	}
+
+	entries, err := o.entries.GetNextWaiting(eventID, ticketTypeID, free)
+	if err != nil {
+		log.Printf("Waitlist offerer: failed to load waitlist of event %d: %v", eventID, err)
+		return 0
+	}
+	for i := range entries {
+		if err := o.offerEntry(&entries[i]); err != nil {
+			if !errors.Is(err, clients.ErrNotEnoughTickets) {
+				log.Printf("Waitlist offerer: failed to make an offer to entry %d: %v", entries[i].EntryID, err)
+			}
+			return i
+		}
+	}
+	return len(entries)
+}
+
+// offerEntry sets a ticket aside for a waiting entry and emails the user
+// the offer.
+func (o *Offerer) offerEntry(entry *models.WaitlistEntry) error {
+	user, err := o.services.GetUser(entry.UserID)
+	if err != nil {
+		return err
+	}
+
+	// The ticket is taken out of the inventory first, so nobody else can
+	// buy it while the user decides.
+	reservationKey := repos.WaitlistReservationKey(entry.EntryID)
+	if _, err := o.services.ReserveInventory(entry.EventID, entry.TicketType(), 1, reservationKey); err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().UTC().Add(o.offerTTL)
+	offerMsg, err := outbox.NewEvent(reservationKey, &events.WaitlistOffered{
+		EntryID:        entry.EntryID,
+		EventID:        entry.EventID,
+		UserID:         entry.UserID,
+		RecipientEmail: user.Email,
+		ExpiresAt:      expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = o.entries.Offer(entry.EntryID, reservationKey, expiresAt, offerMsg)
+	if err == sql.ErrNoRows {
+		// The user left while the ticket was set aside. If another
+		// replica made the offer first, the ticket is theirs to keep.
+		current, getErr := o.entries.GetEntry(entry.EntryID)
+		if getErr != nil {
+			return getErr
+		}
+		if current.Status == "left" && current.ReservationKey == nil {
+			_, err := o.services.ReleaseInventory(entry.EventID, reservationKey)
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Waitlist offerer: offered a ticket to event %d to user %d until %s", entry.EventID, entry.UserID, expiresAt.Format(time.RFC3339))
+	return nil
+}
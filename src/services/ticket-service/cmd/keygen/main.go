@@ -0,0 +1,33 @@
+// Command keygen creates a key for signing ticket QR codes.
+//
+//	go run ./cmd/keygen -id 2026-10
+//
+// It prints the signing key, for TICKET_SIGNING_KEY of ticket-service, and
+// its public key, to add to TICKET_VERIFY_KEYS of the services that check
+// tickets. To rotate keys, add the new public key everywhere first, then
+// switch TICKET_SIGNING_KEY and keep the previous public key in
+// TICKET_VERIFY_KEYS until its tickets are no longer in use.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"tixie.local/common/ticketsig"
+)
+
+func main() {
+	id := flag.String("id", "", "id of the new key, e.g. the month it is introduced")
+	flag.Parse()
+	if *id == "" {
+		log.Fatal("-id is required")
+	}
+
+	signingKey, publicKey, err := ticketsig.GenerateKey(*id)
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	fmt.Printf("TICKET_SIGNING_KEY=%s\n", signingKey)
+	fmt.Printf("TICKET_VERIFY_KEYS=%s\n", publicKey)
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"log"
+	"os"
 	"ticket-service/internal/api"
 	"ticket-service/internal/db"
 	"ticket-service/internal/db/repos"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"tixie.local/broker/outbox"
+	"tixie.local/common/ticketsig"
 )
 
+// outboxRelayInterval is how often pending outbox messages are published.
+const outboxRelayInterval = 2 * time.Second
+
 func main() {
 	// Create database connection
 	dbConn := db.NewDB()
@@ -15,12 +23,45 @@ func main() {
 	// Create a ticket repository instance using the connection
 	repo := repos.NewTicketRepository(dbConn)
 
+	// Check-ins and transfer emails are written to the outbox with the
+	// ticket, and the relay publishes them so payments due at the door get
+	// collected
+	outbox.NewRelay(outbox.NewStore(dbConn.DB), os.Getenv("RABBITMQ_URL"), "tixie", "topic", outboxRelayInterval, repos.RoutingKeys...).Start()
+
+	// QR codes are signed with the current key. Keys retired by a rotation
+	// stay trusted until the tickets signed with them are no longer in use.
+	signer, keyring := loadSigningKeys()
+
 	// Initialize Gin
 	r := gin.Default()
 
 	// Set up your API routes
-	api.SetupRoutes(r, repo)
+	api.SetupRoutes(r, repo, signer, keyring)
 
 	// Run the server on port 8082
 	r.Run(":8082")
 }
+
+// loadSigningKeys reads the ticket signing key from TICKET_SIGNING_KEY and the
+// retired keys that are still trusted from TICKET_VERIFY_KEYS. Without a
+// signing key the signer is nil and no QR codes are issued.
+func loadSigningKeys() (*ticketsig.Signer, *ticketsig.Keyring) {
+	keyring, err := ticketsig.ParseKeyring(os.Getenv("TICKET_VERIFY_KEYS"))
+	if err != nil {
+		log.Fatalf("Invalid TICKET_VERIFY_KEYS: %v", err)
+	}
+
+	spec := os.Getenv("TICKET_SIGNING_KEY")
+	if spec == "" {
+		log.Printf("Warning: TICKET_SIGNING_KEY is not set, ticket QR codes cannot be issued")
+		return nil, keyring
+	}
+	signer, err := ticketsig.ParseSigner(spec)
+	if err != nil {
+		log.Fatalf("Invalid TICKET_SIGNING_KEY: %v", err)
+	}
+	if err := keyring.Add(signer.KeyID(), signer.PublicKey()); err != nil {
+		log.Fatalf("Invalid TICKET_SIGNING_KEY: %v", err)
+	}
+	return signer, keyring
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"ticket-service/internal/db/models"
+	"ticket-service/internal/db/repos"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	circuitbreaker "tixie.local/common"
+)
+
+// maxOfflineCheckIns bounds the number of check-ins uploaded in one batch.
+const maxOfflineCheckIns = 1000
+
+// maxClockSkew is how far in the future a gate's clock may run.
+const maxClockSkew = 5 * time.Minute
+
+// manifest lists the tickets of an event for gate scanners. A full manifest
+// holds the tickets that can be or were let in. A delta, with Since set,
+// holds every ticket that changed since that version, so scanners also
+// learn about cancellations. Version is passed as since on the next sync.
+// A delta may repeat tickets sent before.
+type manifest struct {
+	EventID     int              `json:"event_id"`
+	Version     int64            `json:"version"`
+	Since       int64            `json:"since,omitempty"`
+	GeneratedAt time.Time        `json:"generated_at"`
+	Tickets     []manifestTicket `json:"tickets"`
+}
+
+// manifestTicket is a ticket in a manifest, kept short as scanners download
+// every ticket of an event.
+type manifestTicket struct {
+	Code   string `json:"c"`
+	Status string `json:"s"`
+}
+
+// GetGateManifest exports the tickets of an event as a signed manifest for
+// gates that scan offline. With ?since=<version> only the tickets that
+// changed since the manifest of that version are returned. The signature covers the
+// manifest exactly as sent and verifies with the key listed under key_id
+// at /v1/signing-keys.
+func (h *Handler) GetGateManifest(c *gin.Context) {
+	log.Println("GetGateManifest called")
+	if h.signer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ticket signing is not configured"})
+		return
+	}
+
+	eventID, err := strconv.Atoi(c.Param("event_id"))
+	if err != nil || eventID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil || since < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a manifest version"})
+		return
+	}
+
+	var version int64
+	result := h.breaker.Execute(func() (interface{}, error) {
+		tickets, next, err := h.repo.GetTicketsChangedSince(eventID, since)
+		version = next
+		return tickets, err
+	})
+	if result.Error != nil {
+		if circuitbreaker.IsCircuitBreakerError(result.Error) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + result.Error.Error()})
+		return
+	}
+	tickets, ok := result.Data.([]models.Ticket)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	m := manifest{
+		EventID:     eventID,
+		Version:     version,
+		Since:       since,
+		GeneratedAt: time.Now().UTC(),
+		Tickets:     []manifestTicket{},
+	}
+	for _, ticket := range tickets {
+		if since == 0 && ticket.Status != "active" && ticket.Status != "used" {
+			continue
+		}
+		m.Tickets = append(m.Tickets, manifestTicket{Code: ticket.TicketCode, Status: ticket.Status})
+	}
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode manifest: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"key_id":    h.signer.KeyID(),
+		"signature": h.signer.SignDocument(body),
+		"manifest":  json.RawMessage(body),
+	})
+}
+
+// UploadOfflineCheckIns records the check-ins a gate made while offline. If
+// another gate scanned the same ticket, the earlier scan is the check-in and
+// the later one is reported as a duplicate. Each check-in gets its own
+// result, and uploading a batch again is safe.
+func (h *Handler) UploadOfflineCheckIns(c *gin.Context) {
+	log.Println("UploadOfflineCheckIns called")
+	var input struct {
+		GateID    string `json:"gate_id" binding:"required"`
+		ScannerID string `json:"scanner_id"`
+		CheckIns  []struct {
+			TicketCode string    `json:"ticket_code"`
+			ScannedAt  time.Time `json:"scanned_at"`
+		} `json:"checkins" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+	if len(input.CheckIns) > maxOfflineCheckIns {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d check-ins can be uploaded at once", maxOfflineCheckIns)})
+		return
+	}
+
+	type checkInResult struct {
+		TicketCode string     `json:"ticket_code"`
+		Result     string     `json:"result"`
+		TicketID   int        `json:"ticket_id,omitempty"`
+		GateID     string     `json:"gate_id,omitempty"`
+		CheckedIn  *time.Time `json:"checked_in_at,omitempty"`
+		Error      string     `json:"error,omitempty"`
+	}
+	results := make([]checkInResult, 0, len(input.CheckIns))
+	for _, checkIn := range input.CheckIns {
+		code := strings.TrimSpace(strings.ToLower(checkIn.TicketCode))
+		if _, err := uuid.Parse(code); err != nil {
+			results = append(results, checkInResult{TicketCode: checkIn.TicketCode, Result: "invalid", Error: "Invalid ticket code"})
+			continue
+		}
+		if checkIn.ScannedAt.IsZero() || checkIn.ScannedAt.After(time.Now().Add(maxClockSkew)) {
+			results = append(results, checkInResult{TicketCode: checkIn.TicketCode, Result: "invalid", Error: "Invalid scanned_at"})
+			continue
+		}
+
+		result := h.breaker.Execute(func() (interface{}, error) {
+			return h.repo.RecordOfflineCheckIn(models.OfflineCheckIn{
+				TicketCode: code,
+				GateID:     input.GateID,
+				ScannerID:  input.ScannerID,
+				ScannedAt:  checkIn.ScannedAt,
+			})
+		})
+		if result.Error != nil {
+			if circuitbreaker.IsCircuitBreakerError(result.Error) {
+				status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+				c.JSON(status, gin.H{"error": msg, "results": results})
+				return
+			}
+			results = append(results, checkInResult{TicketCode: checkIn.TicketCode, Result: "error", Error: result.Error.Error()})
+			continue
+		}
+		recorded, ok := result.Data.(*repos.OfflineCheckInResult)
+		if !ok {
+			results = append(results, checkInResult{TicketCode: checkIn.TicketCode, Result: "error", Error: "Internal server error"})
+			continue
+		}
+
+		res := checkInResult{TicketCode: checkIn.TicketCode, Result: recorded.Result}
+		if ticket := recorded.Ticket; ticket != nil {
+			res.TicketID = ticket.TicketID
+			res.CheckedIn = ticket.CheckedInAt
+			if ticket.GateID != nil {
+				res.GateID = *ticket.GateID
+			}
+		}
+		results = append(results, res)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
@@ -10,12 +10,14 @@ import (
 	"sync"
 	"ticket-service/internal/db/models"
 	"ticket-service/internal/db/repos"
+	"ticket-service/internal/qr"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	circuitbreaker "tixie.local/common"
+	"tixie.local/common/ticketsig"
 )
 
 var upgrader = websocket.Upgrader{
@@ -35,16 +37,22 @@ type Handler struct {
 	repo       *repos.TicketRepository
 	httpClient *http.Client
 	breaker    *circuitbreaker.Breaker
+	signer     *ticketsig.Signer
+	keyring    *ticketsig.Keyring
 }
 
-// NewHandler creates a new Handler with dependencies.
-func NewHandler(repo *repos.TicketRepository) *Handler {
+// NewHandler creates a new Handler with dependencies. QR codes are signed
+// with signer, which may be nil when no signing key is configured, and
+// keyring lists the keys gates should trust.
+func NewHandler(repo *repos.TicketRepository, signer *ticketsig.Signer, keyring *ticketsig.Keyring) *Handler {
 	return &Handler{
 		repo: repo,
 		httpClient: &http.Client{
 			Timeout: 5 * time.Second,
 		},
 		breaker: circuitbreaker.NewBreaker("ticket-service"),
+		signer:  signer,
+		keyring: keyring,
 	}
 }
 
@@ -79,6 +87,110 @@ func (h *Handler) GetTicketByID(c *gin.Context) {
 	c.JSON(http.StatusOK, ticket)
 }
 
+// Sizes, in pixels, of PNG QR codes.
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 1024
+)
+
+// GetTicketQR renders the QR code of a ticket as a PNG, or as an SVG with
+// ?format=svg. ?size sets the PNG's width and height in pixels. The code
+// holds a signed payload, so gates can reject forged tickets offline.
+func (h *Handler) GetTicketQR(c *gin.Context) {
+	if h.signer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ticket signing is not configured"})
+		return
+	}
+
+	ticketID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket ID"})
+		return
+	}
+
+	size := defaultQRSize
+	if s := c.Query("size"); s != "" {
+		size, err = strconv.Atoi(s)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be between %d and %d", minQRSize, maxQRSize)})
+			return
+		}
+	}
+	format := c.DefaultQuery("format", "png")
+	if format != "png" && format != "svg" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be png or svg"})
+		return
+	}
+
+	result := h.breaker.Execute(func() (interface{}, error) {
+		return h.repo.GetTicketByID(ticketID)
+	})
+	if result.Error != nil {
+		if circuitbreaker.IsCircuitBreakerError(result.Error) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + result.Error.Error()})
+		return
+	}
+	ticket, ok := result.Data.(*models.Ticket)
+	if !ok || ticket == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+		return
+	}
+	if ticket.Status == "cancelled" {
+		c.JSON(http.StatusGone, gin.H{"error": "Ticket is cancelled"})
+		return
+	}
+
+	claims := ticketsig.Claims{
+		TicketID:   ticket.TicketID,
+		EventID:    ticket.EventID,
+		TicketCode: ticket.TicketCode,
+		IssuedAt:   time.Now().UTC(),
+	}
+	if ticket.TicketTypeID != nil {
+		claims.TicketTypeID = *ticket.TicketTypeID
+	}
+	content, err := h.signer.Sign(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign ticket: " + err.Error()})
+		return
+	}
+	if format == "svg" {
+		svg, err := qr.SVG(content)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render QR code: " + err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "image/svg+xml", svg)
+		return
+	}
+
+	image, err := qr.PNG(content, size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render QR code: " + err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "image/png", image)
+}
+
+// GetSigningKeys lists the public keys that verify ticket QR codes, by key
+// id, so gates can check tickets without calling this service.
+func (h *Handler) GetSigningKeys(c *gin.Context) {
+	keys := map[string]string{}
+	if h.keyring != nil {
+		keys = h.keyring.PublicKeys()
+	}
+	current := ""
+	if h.signer != nil {
+		current = h.signer.KeyID()
+	}
+	c.JSON(http.StatusOK, gin.H{"current_key_id": current, "keys": keys})
+}
+
 func (h *Handler) GetTicketsByEventID(c *gin.Context) {
 	log.Println("GetTicketsByEventID called")
 	eventID, err := strconv.Atoi(c.Query("event_id"))
@@ -118,14 +230,29 @@ func (h *Handler) GetTicketsByEventID(c *gin.Context) {
 func (h *Handler) CreateTicket(c *gin.Context) {
 	log.Println("CreateTicket called")
 	var input struct {
-		EventID int `json:"event_id" binding:"required,gt=0"`
-		UserID  int `json:"user_id" binding:"required,gt=0"`
+		EventID      int    `json:"event_id" binding:"required,gt=0"`
+		TicketTypeID *int   `json:"ticket_type_id" binding:"omitempty,gt=0"`
+		UserID       int    `json:"user_id" binding:"required,gt=0"`
+		Status       string `json:"status"`
+		// Makes the request idempotent: a retry with the same key gets the
+		// ticket the first request created
+		ReservationKey string `json:"reservation_key"`
 	}
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
 		return
 	}
 
+	// Tickets are active unless the caller asks for a hold that is only
+	// activated once payment goes through.
+	if input.Status == "" {
+		input.Status = "active"
+	}
+	if input.Status != "active" && input.Status != "held" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status: must be active or held"})
+		return
+	}
+
 	if err := h.validateEvent(input.EventID); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid event_id: %v", err)})
 		return
@@ -139,10 +266,14 @@ func (h *Handler) CreateTicket(c *gin.Context) {
 	ticketCode := uuid.New().String()
 
 	ticket := &models.Ticket{
-		EventID:    input.EventID,
-		UserID:     input.UserID,
-		TicketCode: ticketCode,
-		Status:     "active",
+		EventID:      input.EventID,
+		TicketTypeID: input.TicketTypeID,
+		UserID:       input.UserID,
+		TicketCode:   ticketCode,
+		Status:       input.Status,
+	}
+	if input.ReservationKey != "" {
+		ticket.ReservationKey = &input.ReservationKey
 	}
 
 	result := h.breaker.Execute(func() (interface{}, error) {
@@ -172,6 +303,36 @@ func (h *Handler) CreateTicket(c *gin.Context) {
 	c.JSON(http.StatusCreated, createdTicket)
 }
 
+// GetTicketByReservationKey returns the ticket created for a reservation.
+// The reservation saga uses it to undo a ticket it created but did not get
+// to record.
+func (h *Handler) GetTicketByReservationKey(c *gin.Context) {
+	log.Println("GetTicketByReservationKey called")
+	key := c.Param("key")
+
+	result := h.breaker.Execute(func() (interface{}, error) {
+		return h.repo.GetTicketByReservationKey(key)
+	})
+
+	if result.Error != nil {
+		if circuitbreaker.IsCircuitBreakerError(result.Error) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + result.Error.Error()})
+		return
+	}
+
+	ticket, ok := result.Data.(*models.Ticket)
+	if !ok || ticket == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ticket)
+}
+
 func (h *Handler) UpdateTicketStatus(c *gin.Context) {
 	log.Println("UpdateTicketStatus called")
 	ticketID, err := strconv.Atoi(c.Param("id"))
@@ -188,8 +349,8 @@ func (h *Handler) UpdateTicketStatus(c *gin.Context) {
 		return
 	}
 
-	if input.Status != "active" && input.Status != "used" && input.Status != "cancelled" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status: must be active, used, or cancelled"})
+	if input.Status != "held" && input.Status != "active" && input.Status != "used" && input.Status != "cancelled" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status: must be held, active, used, or cancelled"})
 		return
 	}
 
@@ -238,6 +399,90 @@ func (h *Handler) UpdateTicketStatus(c *gin.Context) {
 	c.JSON(http.StatusOK, updatedTicket)
 }
 
+// Results of a check-in.
+const (
+	checkInCheckedIn   = "checked_in"
+	checkInAlreadyUsed = "already_used"
+	checkInNotActive   = "not_active"
+	checkInNotFound    = "not_found"
+	checkInNotGenuine  = "not_genuine"
+)
+
+// CheckInTicket admits a ticket at a gate. The ticket goes from active to
+// used in a single conditional update, so of two gates scanning the same
+// ticket only one lets it in. The other is told where and when it was used.
+// A gate that verified a signed payload sends the ticket and event it was
+// signed for, and a ticket that does not match them is not let in.
+func (h *Handler) CheckInTicket(c *gin.Context) {
+	log.Println("CheckInTicket called")
+	var input struct {
+		TicketCode string `json:"ticket_code" binding:"required"`
+		GateID     string `json:"gate_id" binding:"required"`
+		ScannerID  string `json:"scanner_id"`
+		TicketID   int    `json:"ticket_id" binding:"omitempty,gt=0"`
+		EventID    int    `json:"event_id" binding:"omitempty,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+	ticketCode := strings.TrimSpace(strings.ToLower(input.TicketCode))
+	if _, err := uuid.Parse(ticketCode); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket code"})
+		return
+	}
+
+	var checkedIn bool
+	result := h.breaker.Execute(func() (interface{}, error) {
+		ticket, ok, err := h.repo.CheckIn(ticketCode, input.GateID, input.ScannerID, input.TicketID, input.EventID)
+		checkedIn = ok
+		return ticket, err
+	})
+	if result.Error != nil {
+		if circuitbreaker.IsCircuitBreakerError(result.Error) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + result.Error.Error()})
+		return
+	}
+
+	ticket, ok := result.Data.(*models.Ticket)
+	if !ok || ticket == nil {
+		c.JSON(http.StatusNotFound, gin.H{"result": checkInNotFound, "error": "Ticket not found"})
+		return
+	}
+
+	if !checkedIn {
+		if (input.TicketID != 0 && ticket.TicketID != input.TicketID) || (input.EventID != 0 && ticket.EventID != input.EventID) {
+			c.JSON(http.StatusConflict, gin.H{"result": checkInNotGenuine, "message": "Ticket is not genuine"})
+			return
+		}
+		if ticket.Status == "used" {
+			c.JSON(http.StatusConflict, gin.H{"result": checkInAlreadyUsed, "message": alreadyUsedMessage(ticket), "ticket": ticket})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"result": checkInNotActive, "message": "Ticket is " + ticket.Status, "ticket": ticket})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": checkInCheckedIn, "ticket": ticket})
+}
+
+// alreadyUsedMessage tells a gate where and when a ticket was checked in.
+// Tickets marked used without a gate scan have neither.
+func alreadyUsedMessage(ticket *models.Ticket) string {
+	msg := "Already used"
+	if ticket.CheckedInAt != nil {
+		msg += " at " + ticket.CheckedInAt.UTC().Format("15:04")
+	}
+	if ticket.GateID != nil {
+		msg += " at gate " + *ticket.GateID
+	}
+	return msg
+}
+
 // func (h *Handler) GetTicketByCode(c *gin.Context) {
 // 	log.Println("GetTicketByCode called")
 // 	ticketCode := c.Param("ticket_code")
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"ticket-service/internal/db/models"
+	"ticket-service/internal/db/repos"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	circuitbreaker "tixie.local/common"
+)
+
+// ListTicket puts a ticket on the resale market. A listed ticket cannot be
+// used or transferred until it is sold or unlisted. Listing a ticket that is
+// already listed by the same user returns it unchanged.
+func (h *Handler) ListTicket(c *gin.Context) {
+	log.Println("ListTicket called")
+	h.changeListing(c, "listed", h.repo.ListTicket)
+}
+
+// UnlistTicket takes a ticket off the resale market, so its holder can use
+// it again. Unlisting a ticket that is not listed any more returns it
+// unchanged.
+func (h *Handler) UnlistTicket(c *gin.Context) {
+	log.Println("UnlistTicket called")
+	h.changeListing(c, "active", h.repo.UnlistTicket)
+}
+
+func (h *Handler) changeListing(c *gin.Context, want string, change func(ticketID, userID int) (*models.Ticket, error)) {
+	ticketID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket ID"})
+		return
+	}
+
+	var input struct {
+		UserID int `json:"user_id" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+	userID := input.UserID
+
+	result := h.breaker.Execute(func() (interface{}, error) {
+		return change(ticketID, userID)
+	})
+	if result.Error == nil {
+		c.JSON(http.StatusOK, result.Data)
+		return
+	}
+	if circuitbreaker.IsCircuitBreakerError(result.Error) {
+		status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+	if !errors.Is(result.Error, repos.ErrNotListable) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + result.Error.Error()})
+		return
+	}
+
+	// Work out why, so retries of a change that went through succeed
+	ticket, err := h.repo.GetTicketByID(ticketID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	switch {
+	case ticket == nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+	case ticket.UserID != userID:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Ticket does not belong to user_id"})
+	case ticket.Status == want:
+		c.JSON(http.StatusOK, ticket)
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Ticket is %s", ticket.Status)})
+	}
+}
+
+// ResellTicket re-issues a listed ticket to the user who bought it on the
+// resale market, under a new code. Re-issuing a ticket the buyer already
+// holds returns it unchanged, so a settlement can be retried. Emails are
+// left to the caller, which knows what was paid.
+func (h *Handler) ResellTicket(c *gin.Context) {
+	log.Println("ResellTicket called")
+	ticketID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket ID"})
+		return
+	}
+
+	var input struct {
+		SellerUserID int `json:"seller_user_id" binding:"required,gt=0"`
+		BuyerUserID  int `json:"buyer_user_id" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+	if input.SellerUserID == input.BuyerUserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A ticket cannot be resold to its holder"})
+		return
+	}
+
+	result := h.breaker.Execute(func() (interface{}, error) {
+		return h.repo.ResellTicket(ticketID, input.SellerUserID, input.BuyerUserID, uuid.New().String())
+	})
+	if result.Error == nil {
+		c.JSON(http.StatusOK, result.Data)
+		return
+	}
+	if circuitbreaker.IsCircuitBreakerError(result.Error) {
+		status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+	if !errors.Is(result.Error, repos.ErrNotTransferable) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + result.Error.Error()})
+		return
+	}
+
+	ticket, err := h.repo.GetTicketByID(ticketID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	switch {
+	case ticket == nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+	case ticket.UserID == input.BuyerUserID && ticket.Status == "active":
+		c.JSON(http.StatusOK, ticket)
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Ticket is %s and is not listed by seller_user_id", ticket.Status)})
+	}
+}
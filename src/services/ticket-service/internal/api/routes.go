@@ -4,11 +4,12 @@ import (
 	"ticket-service/internal/db/repos"
 
 	"github.com/gin-gonic/gin"
+	"tixie.local/common/ticketsig"
 )
 
-func SetupRoutes(r *gin.Engine, repo *repos.TicketRepository) {
+func SetupRoutes(r *gin.Engine, repo *repos.TicketRepository, signer *ticketsig.Signer, keyring *ticketsig.Keyring) {
 
-	handler := NewHandler(repo)
+	handler := NewHandler(repo, signer, keyring)
 
 	// API routes for tickets
 	tickets := r.Group("/v1")
@@ -19,14 +20,36 @@ func SetupRoutes(r *gin.Engine, repo *repos.TicketRepository) {
 
 		tickets.GET("/events-with-tickets", handler.GetEventsWithTickets)
 
+		tickets.GET("/signing-keys", handler.GetSigningKeys)
+
+		tickets.POST("/checkin", handler.CheckInTicket)
+
+		tickets.POST("/checkin/batch", handler.UploadOfflineCheckIns)
+
+		tickets.GET("/manifest/:event_id", handler.GetGateManifest)
+
+		tickets.GET("/reservations/:key", handler.GetTicketByReservationKey)
+
 		tickets.GET("/:id", handler.GetTicketByID)
 
+		tickets.GET("/:id/qr", handler.GetTicketQR)
+
 		tickets.GET("", handler.GetTicketsByEventID)
 
 		tickets.POST("", handler.CreateTicket)
 
 		tickets.PUT("/:id/status", handler.UpdateTicketStatus)
 
+		tickets.POST("/:id/transfer", handler.TransferTicket)
+
+		tickets.GET("/:id/transfers", handler.GetTicketTransfers)
+
+		tickets.POST("/:id/list", handler.ListTicket)
+
+		tickets.POST("/:id/unlist", handler.UnlistTicket)
+
+		tickets.POST("/:id/resell", handler.ResellTicket)
+
 		tickets.GET("/verify/:ticket_code", handler.GetTicketByCode)
 	}
 }
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"ticket-service/internal/db/models"
+	"ticket-service/internal/db/repos"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	circuitbreaker "tixie.local/common"
+)
+
+// errTransfersNotAllowed is returned for events whose tickets cannot be
+// transferred.
+var errTransfersNotAllowed = errors.New("this event does not allow transfers")
+
+// eventDateLayouts are the formats event dates are stored in.
+var eventDateLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// transferRules is the part of an event-service event that decides whether
+// its tickets can be transferred.
+type transferRules struct {
+	Date                string `json:"date"`
+	TransferCutoffHours *int   `json:"transfer_cutoff_hours"`
+}
+
+// deadline returns the moment after which the event's tickets can no longer
+// be transferred, or errTransfersNotAllowed if they cannot be at all.
+func (r *transferRules) deadline() (time.Time, error) {
+	if r.TransferCutoffHours == nil {
+		return time.Time{}, errTransfersNotAllowed
+	}
+	for _, layout := range eventDateLayouts {
+		if start, err := time.Parse(layout, r.Date); err == nil {
+			return start.Add(-time.Duration(*r.TransferCutoffHours) * time.Hour), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid event date %q", r.Date)
+}
+
+// TransferTicket gives a ticket to another user. The ticket gets a new code,
+// so QR codes the previous holder kept stop working, and both users are
+// emailed: the new holder gets the ticket.
+func (h *Handler) TransferTicket(c *gin.Context) {
+	log.Println("TransferTicket called")
+	ticketID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket ID"})
+		return
+	}
+
+	var input struct {
+		FromUserID int `json:"from_user_id" binding:"required,gt=0"`
+		ToUserID   int `json:"to_user_id" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+	if input.FromUserID == input.ToUserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A ticket cannot be transferred to its holder"})
+		return
+	}
+
+	result := h.breaker.Execute(func() (interface{}, error) {
+		return h.repo.GetTicketByID(ticketID)
+	})
+	if result.Error != nil {
+		if circuitbreaker.IsCircuitBreakerError(result.Error) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + result.Error.Error()})
+		return
+	}
+	ticket, ok := result.Data.(*models.Ticket)
+	if !ok || ticket == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+		return
+	}
+	if ticket.UserID != input.FromUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Ticket does not belong to from_user_id"})
+		return
+	}
+	if ticket.Status != "active" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Ticket is %s and cannot be transferred", ticket.Status)})
+		return
+	}
+
+	rules, err := h.getTransferRules(ticket.EventID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch event details: %v", err)})
+		return
+	}
+	deadline, err := rules.deadline()
+	if errors.Is(err, errTransfersNotAllowed) {
+		c.JSON(http.StatusConflict, gin.H{"error": "This event does not allow transfers"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if time.Now().After(deadline) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Transfer window closed", "deadline": deadline})
+		return
+	}
+
+	fromEmail, err := h.getUserEmail(input.FromUserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid from_user_id: %v", err)})
+		return
+	}
+	toEmail, err := h.getUserEmail(input.ToUserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid to_user_id: %v", err)})
+		return
+	}
+
+	result = h.breaker.Execute(func() (interface{}, error) {
+		return h.repo.TransferTicket(ticketID, input.FromUserID, input.ToUserID, uuid.New().String(), fromEmail, toEmail)
+	})
+	if result.Error != nil {
+		if circuitbreaker.IsCircuitBreakerError(result.Error) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		if errors.Is(result.Error, repos.ErrNotTransferable) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Ticket changed while it was being transferred, please retry"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + result.Error.Error()})
+		return
+	}
+	transferred, ok := result.Data.(*models.Ticket)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, transferred)
+}
+
+// GetTicketTransfers lists the transfers of a ticket, oldest first.
+func (h *Handler) GetTicketTransfers(c *gin.Context) {
+	log.Println("GetTicketTransfers called")
+	ticketID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket ID"})
+		return
+	}
+
+	result := h.breaker.Execute(func() (interface{}, error) {
+		return h.repo.GetTransfers(ticketID)
+	})
+	if result.Error != nil {
+		if circuitbreaker.IsCircuitBreakerError(result.Error) {
+			status, msg := circuitbreaker.HandleCircuitBreakerError(result.Error)
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + result.Error.Error()})
+		return
+	}
+	transfers, ok := result.Data.([]models.TicketTransfer)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ticket_id": ticketID, "transfers": transfers})
+}
+
+func (h *Handler) getTransferRules(eventID int) (*transferRules, error) {
+	url := fmt.Sprintf("http://event-service-1:8080/v1/%d", eventID)
+	resp, err := h.httpClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to contact event service: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("event not found or service error (status: %d)", resp.StatusCode)
+	}
+
+	var rules transferRules
+	if err := json.NewDecoder(resp.Body).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("failed to parse event: %v", err)
+	}
+	return &rules, nil
+}
+
+func (h *Handler) getUserEmail(userID int) (string, error) {
+	url := fmt.Sprintf("http://user-service-1:8081/v1/%d", userID)
+	resp, err := h.httpClient.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("failed to contact user service: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("user not found or service error (status: %d)", resp.StatusCode)
+	}
+
+	var user struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", fmt.Errorf("failed to parse user: %v", err)
+	}
+	if user.Email == "" {
+		return "", fmt.Errorf("user has no email address")
+	}
+	return user.Email, nil
+}
@@ -1,12 +1,84 @@
+-- Every change to a ticket gets a new version and records the transaction
+-- that made it, so gate scanners can fetch only what changed since they
+-- last synced.
+CREATE SEQUENCE ticket_version_seq;
+
 CREATE TABLE ticket (
     ticket_id SERIAL PRIMARY KEY,
     event_id INTEGER NOT NULL,
+    -- The event-service ticket type the ticket was sold as, if the event
+    -- has ticket types
+    ticket_type_id INTEGER,
     user_id INTEGER NOT NULL,
     ticket_code UUID NOT NULL UNIQUE,
+    -- A listed ticket is offered on the resale market and cannot be used
+    -- or transferred until it is sold or taken off the market.
     status VARCHAR(20) NOT NULL DEFAULT 'active',
-    CONSTRAINT valid_status CHECK (status IN ('active', 'used', 'cancelled'))
+    -- Set when the ticket is checked in at a gate
+    checked_in_at TIMESTAMPTZ,
+    gate_id TEXT,
+    scanner_id TEXT,
+    version BIGINT NOT NULL DEFAULT nextval('ticket_version_seq'),
+    changed_xid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+    -- Set by the reservation saga that created the ticket, so a retried or
+    -- recovered saga finds the ticket instead of creating another one
+    reservation_key TEXT UNIQUE,
+    CONSTRAINT valid_status CHECK (status IN ('held', 'active', 'listed', 'used', 'cancelled'))
+);
+
+CREATE INDEX ticket_event_changed_xid ON ticket (event_id, changed_xid);
+
+CREATE FUNCTION bump_ticket_version() RETURNS trigger AS $$
+BEGIN
+    NEW.version := nextval('ticket_version_seq');
+    NEW.changed_xid := pg_current_xact_id();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER ticket_version BEFORE UPDATE ON ticket
+    FOR EACH ROW EXECUTE FUNCTION bump_ticket_version();
+
+-- Every change of a ticket's holder
+CREATE TABLE ticket_transfers (
+    transfer_id SERIAL PRIMARY KEY,
+    ticket_id INTEGER NOT NULL REFERENCES ticket (ticket_id),
+    from_user_id INTEGER NOT NULL,
+    to_user_id INTEGER NOT NULL,
+    transferred_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 
+CREATE INDEX ticket_transfers_ticket ON ticket_transfers (ticket_id);
+
+-- Offline check-ins that lost to an earlier scan of the same ticket at
+-- another gate, kept so staff can look into shared tickets.
+CREATE TABLE checkin_conflicts (
+    conflict_id SERIAL PRIMARY KEY,
+    ticket_id INTEGER NOT NULL REFERENCES ticket (ticket_id),
+    gate_id TEXT NOT NULL,
+    scanner_id TEXT,
+    scanned_at TIMESTAMPTZ NOT NULL,
+    recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (ticket_id, gate_id, scanned_at)
+);
+
+-- Broker messages written in the same transaction as the ticket change they
+-- announce, until the relay has published them.
+CREATE TABLE outbox (
+    outbox_id SERIAL PRIMARY KEY,
+    routing_key VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP,
+    CONSTRAINT valid_outbox_status CHECK (status IN ('pending', 'sent'))
+);
+
+CREATE INDEX idx_outbox_pending ON outbox (next_attempt_at) WHERE status = 'pending';
+
 INSERT INTO ticket (event_id, user_id, ticket_code, status)
 VALUES (1, 1, '123e4567-e89b-12d3-a456-426614174000', 'active');
 INSERT INTO ticket (event_id, user_id, ticket_code, status)
@@ -1,9 +1,43 @@
 package models
 
+import "time"
+
 type Ticket struct {
 	TicketID   int    `json:"ticket_id" db:"ticket_id"`
 	EventID    int    `json:"event_id" db:"event_id"`
 	UserID     int    `json:"user_id" db:"user_id"`
 	TicketCode string `json:"ticket_code" db:"ticket_code"`
 	Status     string `json:"status" db:"status"`
+	// The ticket type the ticket was sold as, e.g. VIP. Nil for events
+	// without ticket types.
+	TicketTypeID *int `json:"ticket_type_id,omitempty" db:"ticket_type_id"`
+	// Where and when the ticket was checked in, if it was
+	CheckedInAt *time.Time `json:"checked_in_at,omitempty" db:"checked_in_at"`
+	GateID      *string    `json:"gate_id,omitempty" db:"gate_id"`
+	ScannerID   *string    `json:"scanner_id,omitempty" db:"scanner_id"`
+	// Version increases with every change, ordering the changes in a gate
+	// manifest
+	Version int64 `json:"version" db:"version"`
+	// ChangedXID is the transaction that made the last change. Gate
+	// scanners sync by it, see GetTicketsChangedSince.
+	ChangedXID int64 `json:"-" db:"changed_xid"`
+	// The key of the reservation the ticket was created for, if any
+	ReservationKey *string `json:"reservation_key,omitempty" db:"reservation_key"`
+}
+
+// OfflineCheckIn is a scan a gate recorded while it was offline.
+type OfflineCheckIn struct {
+	TicketCode string    `json:"ticket_code"`
+	GateID     string    `json:"gate_id"`
+	ScannerID  string    `json:"scanner_id"`
+	ScannedAt  time.Time `json:"scanned_at"`
+}
+
+// TicketTransfer records a ticket moving from one user to another.
+type TicketTransfer struct {
+	TransferID    int       `json:"transfer_id" db:"transfer_id"`
+	TicketID      int       `json:"ticket_id" db:"ticket_id"`
+	FromUserID    int       `json:"from_user_id" db:"from_user_id"`
+	ToUserID      int       `json:"to_user_id" db:"to_user_id"`
+	TransferredAt time.Time `json:"transferred_at" db:"transferred_at"`
 }
@@ -0,0 +1,69 @@
+package repos
+
+import (
+	"ticket-service/internal/db/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"tixie.local/broker/events"
+	"tixie.local/broker/outbox"
+)
+
+// Producer identifies the ticket service in the envelopes it publishes.
+const Producer = "ticket-service"
+
+// RoutingKeys are the keys the ticket service publishes to. The relay probes
+// them when it connects so that a missing consumer shows up in the logs at
+// startup.
+var RoutingKeys = []string{
+	events.RoutingKey(events.TypeTicketCheckedIn),
+	events.RoutingKey(events.TypeNotificationEmail),
+}
+
+// insertEvent writes e to the outbox in tx, so it is published if and only
+// if tx commits.
+func insertEvent(tx *sqlx.Tx, e events.Event) error {
+	msg, err := outbox.NewMessage(Producer, "", e)
+	if err != nil {
+		return err
+	}
+	return outbox.Insert(tx.Tx, msg)
+}
+
+// transferEmails returns the emails of a transfer: the new holder gets the
+// ticket under its new code, and the previous holder is told it is gone.
+func transferEmails(ticketID int, newCode, fromEmail, toEmail string) []events.Event {
+	return []events.Event{
+		&events.NotificationEmail{
+			RecipientEmail: toEmail,
+			TicketCode:     newCode,
+			TicketID:       ticketID,
+		},
+		&events.NotificationEmail{
+			RecipientEmail: fromEmail,
+			TicketID:       ticketID,
+			Kind:           events.EmailTicketTransferred,
+		},
+	}
+}
+
+// insertCheckIn writes the TicketCheckedIn event of a ticket that was just
+// marked used to the outbox. Payments due at the door are collected on it.
+func insertCheckIn(tx *sqlx.Tx, ticket *models.Ticket) error {
+	checkIn := &events.TicketCheckedIn{
+		TicketID:    ticket.TicketID,
+		EventID:     ticket.EventID,
+		UserID:      ticket.UserID,
+		CheckedInAt: time.Now().UTC(),
+	}
+	if ticket.CheckedInAt != nil {
+		checkIn.CheckedInAt = ticket.CheckedInAt.UTC()
+	}
+	if ticket.GateID != nil {
+		checkIn.GateID = *ticket.GateID
+	}
+	if ticket.ScannerID != nil {
+		checkIn.ScannerID = *ticket.ScannerID
+	}
+	return insertEvent(tx, checkIn)
+}
@@ -1,13 +1,17 @@
 package repos
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"ticket-service/internal/db/models"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"tixie.local/broker/events"
 )
 
 // TicketRepository handles database operations for tickets.
@@ -53,9 +57,16 @@ func (r *TicketRepository) GetTicketsByEventID(eventID int) ([]models.Ticket, er
 func (r *TicketRepository) CreateTicket(ticket *models.Ticket) (*models.Ticket, error) {
 	var createdTicket models.Ticket
 	err := r.db.QueryRowx(
-		"INSERT INTO ticket (event_id, user_id, ticket_code, status) VALUES ($1, $2, $3, $4) RETURNING *",
-		ticket.EventID, ticket.UserID, ticket.TicketCode, ticket.Status,
+		`INSERT INTO ticket (event_id, ticket_type_id, user_id, ticket_code, status, reservation_key)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT (reservation_key) DO NOTHING
+		 RETURNING *`,
+		ticket.EventID, ticket.TicketTypeID, ticket.UserID, ticket.TicketCode, ticket.Status, ticket.ReservationKey,
 	).StructScan(&createdTicket)
+	if err == sql.ErrNoRows && ticket.ReservationKey != nil {
+		// The reservation already has its ticket, from an earlier attempt
+		return r.GetTicketByReservationKey(*ticket.ReservationKey)
+	}
 	if err != nil {
 		if strings.Contains(err.Error(), "unique constraint") {
 			return nil, fmt.Errorf("ticket_code already exists")
@@ -65,27 +76,104 @@ func (r *TicketRepository) CreateTicket(ticket *models.Ticket) (*models.Ticket,
 	return &createdTicket, nil
 }
 
-// UpdateTicketStatus updates the status of a ticket.
+// GetTicketByReservationKey returns the ticket created for a reservation, or
+// nil if there is none.
+func (r *TicketRepository) GetTicketByReservationKey(key string) (*models.Ticket, error) {
+	var ticket models.Ticket
+	err := r.db.Get(&ticket, "SELECT * FROM ticket WHERE reservation_key=$1", key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ticket, nil
+}
+
+// UpdateTicketStatus updates the status of a ticket. Marking an unused
+// ticket used records its check-in in the outbox, as a gate scan does.
 func (r *TicketRepository) UpdateTicketStatus(ticketID int, status string) (*models.Ticket, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.Get(&previous, "SELECT status FROM ticket WHERE ticket_id=$1 FOR UPDATE", ticketID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
 	var updatedTicket models.Ticket
-	err := r.db.QueryRowx(
+	err = tx.QueryRowx(
 		"UPDATE ticket SET status=$1 WHERE ticket_id=$2 RETURNING *",
 		status, ticketID,
 	).StructScan(&updatedTicket)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
 		return nil, err
 	}
-	return &updatedTicket, nil
+	if updatedTicket.Status == "used" && previous != "used" {
+		if err := insertCheckIn(tx, &updatedTicket); err != nil {
+			return nil, err
+		}
+	}
+	return &updatedTicket, tx.Commit()
+}
+
+// CheckIn marks an active ticket as used at a gate. The update only applies
+// to active tickets, so two gates scanning the same ticket at once cannot
+// both let it in. A non-zero ticketID or eventID must match the ticket too,
+// so a code presented with a payload signed for another ticket is never
+// marked used. It returns the ticket as it is after the call and whether
+// this call checked it in. The ticket is nil when no ticket has the code.
+// The check-in is written to the outbox together with the ticket, so it is
+// published even if the broker is down.
+func (r *TicketRepository) CheckIn(ticketCode, gateID, scannerID string, ticketID, eventID int) (*models.Ticket, bool, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	var ticket models.Ticket
+	err = tx.QueryRowx(
+		`UPDATE ticket SET status='used', checked_in_at=NOW(), gate_id=$2, scanner_id=NULLIF($3, '')
+		WHERE ticket_code=CAST($1 AS UUID) AND status='active'
+		AND ($4 = 0 OR ticket_id=$4) AND ($5 = 0 OR event_id=$5) RETURNING *`,
+		ticketCode, gateID, scannerID, ticketID, eventID,
+	).StructScan(&ticket)
+	if err == nil {
+		if err := insertCheckIn(tx, &ticket); err != nil {
+			return nil, false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, false, err
+		}
+		return &ticket, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, false, err
+	}
+
+	err = tx.Get(&ticket, "SELECT * FROM ticket WHERE ticket_code=CAST($1 AS UUID)", ticketCode)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &ticket, false, nil
 }
 
 func (r *TicketRepository) GetTicketByCode(ticketCode string) (*models.Ticket, error) {
 	ticket := &models.Ticket{}
-	query := `SELECT ticket_id, event_id, user_id, ticket_code, status FROM ticket WHERE ticket_code = CAST($1 AS UUID)`
+	query := `SELECT ticket_id, event_id, ticket_type_id, user_id, ticket_code, status FROM ticket WHERE ticket_code = CAST($1 AS UUID)`
 	err := r.db.QueryRow(query, ticketCode).Scan(
-		&ticket.TicketID, &ticket.EventID, &ticket.UserID, &ticket.TicketCode, &ticket.Status,
+		&ticket.TicketID, &ticket.EventID, &ticket.TicketTypeID, &ticket.UserID, &ticket.TicketCode, &ticket.Status,
 	)
 	if err == sql.ErrNoRows {
 		log.Printf("No ticket found for ticket_code: %s", ticketCode)
@@ -98,6 +186,99 @@ func (r *TicketRepository) GetTicketByCode(ticketCode string) (*models.Ticket, e
 	return ticket, nil
 }
 
+// ErrNotTransferable is returned when a ticket changed hands or stopped
+// being active, or listed for a resale, before it could be transferred.
+var ErrNotTransferable = errors.New("ticket can no longer be transferred")
+
+// TransferTicket moves an active ticket from one user to another under a new
+// ticket code, so the code the previous holder has stops working, and
+// records the transfer. The emails to both users are written to the outbox
+// with the transfer, so they are sent even if the broker is down.
+func (r *TicketRepository) TransferTicket(ticketID, fromUserID, toUserID int, newCode, fromEmail, toEmail string) (*models.Ticket, error) {
+	return r.transferTicket(ticketID, fromUserID, toUserID, newCode, "active", transferEmails(ticketID, newCode, fromEmail, toEmail)...)
+}
+
+// ResellTicket re-issues a listed ticket to the user who bought it on the
+// resale market. Like a transfer, the ticket gets a new code and the change
+// of holder is recorded. The ticket is active again afterwards.
+func (r *TicketRepository) ResellTicket(ticketID, sellerUserID, buyerUserID int, newCode string) (*models.Ticket, error) {
+	return r.transferTicket(ticketID, sellerUserID, buyerUserID, newCode, "listed")
+}
+
+func (r *TicketRepository) transferTicket(ticketID, fromUserID, toUserID int, newCode, fromStatus string, notices ...events.Event) (*models.Ticket, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var ticket models.Ticket
+	err = tx.QueryRowx(
+		`UPDATE ticket SET user_id=$3, ticket_code=$4, status='active'
+		WHERE ticket_id=$1 AND user_id=$2 AND status=$5 RETURNING *`,
+		ticketID, fromUserID, toUserID, newCode, fromStatus,
+	).StructScan(&ticket)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotTransferable
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO ticket_transfers (ticket_id, from_user_id, to_user_id) VALUES ($1, $2, $3)",
+		ticketID, fromUserID, toUserID,
+	); err != nil {
+		return nil, err
+	}
+	for _, notice := range notices {
+		if err := insertEvent(tx, notice); err != nil {
+			return nil, err
+		}
+	}
+	return &ticket, tx.Commit()
+}
+
+// ErrNotListable is returned when a ticket is not held by the user, or is
+// not in the state, that listing or unlisting it requires.
+var ErrNotListable = errors.New("ticket cannot be listed or unlisted")
+
+// ListTicket offers a user's active ticket on the resale market.
+func (r *TicketRepository) ListTicket(ticketID, userID int) (*models.Ticket, error) {
+	return r.setListingStatus(ticketID, userID, "active", "listed")
+}
+
+// UnlistTicket takes a user's listed ticket off the resale market, so it can
+// be used again.
+func (r *TicketRepository) UnlistTicket(ticketID, userID int) (*models.Ticket, error) {
+	return r.setListingStatus(ticketID, userID, "listed", "active")
+}
+
+func (r *TicketRepository) setListingStatus(ticketID, userID int, from, to string) (*models.Ticket, error) {
+	var ticket models.Ticket
+	err := r.db.QueryRowx(
+		"UPDATE ticket SET status=$4 WHERE ticket_id=$1 AND user_id=$2 AND status=$3 RETURNING *",
+		ticketID, userID, from, to,
+	).StructScan(&ticket)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotListable
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ticket, nil
+}
+
+// GetTransfers retrieves the transfers of a ticket, oldest first.
+func (r *TicketRepository) GetTransfers(ticketID int) ([]models.TicketTransfer, error) {
+	transfers := []models.TicketTransfer{}
+	err := r.db.Select(&transfers, "SELECT * FROM ticket_transfers WHERE ticket_id=$1 ORDER BY transfer_id", ticketID)
+	if err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
 // GetEventsWithTickets retrieves all events that have at least one ticket
 func (r *TicketRepository) GetEventsWithTickets() ([]EventWithTickets, error) {
 	var events []EventWithTickets
@@ -114,3 +295,135 @@ func (r *TicketRepository) GetEventsWithTickets() ([]EventWithTickets, error) {
 	}
 	return events, nil
 }
+
+// GetTicketsChangedSince retrieves the tickets of an event that changed since
+// the sync point since, oldest change first, along with the sync point to
+// pass next time. Since 0 retrieves every ticket.
+//
+// A change takes its version when the ticket is updated, not when it
+// commits, so it can become visible after a change with a higher version
+// and syncing by version would skip it. The sync point is instead the oldest
+// transaction still running when the tickets are read: changes made by older
+// transactions are all in this read, and any later change has a transaction
+// ID at least as high. Changes of transactions that were running at the
+// sync point are sent again next time.
+func (r *TicketRepository) GetTicketsChangedSince(eventID int, since int64) ([]models.Ticket, int64, error) {
+	// Both queries read the same snapshot
+	tx, err := r.db.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var next int64
+	if err := tx.Get(&next, "SELECT pg_snapshot_xmin(pg_current_snapshot())::text::bigint"); err != nil {
+		return nil, 0, err
+	}
+	var tickets []models.Ticket
+	err = tx.Select(&tickets,
+		"SELECT * FROM ticket WHERE event_id=$1 AND changed_xid >= $2::text::xid8 ORDER BY version",
+		eventID, since,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tickets, next, tx.Commit()
+}
+
+// Results of recording an offline check-in.
+const (
+	// OfflineCheckedIn means the scan is the ticket's check-in.
+	OfflineCheckedIn = "checked_in"
+	// OfflineDuplicate means the ticket was checked in earlier elsewhere.
+	OfflineDuplicate = "duplicate"
+	// OfflineNotActive means the ticket was held or cancelled.
+	OfflineNotActive = "not_active"
+	// OfflineNotFound means no ticket has the scanned code.
+	OfflineNotFound = "not_found"
+)
+
+// OfflineCheckInResult is the outcome of recording an offline check-in.
+type OfflineCheckInResult struct {
+	Result string
+	// Ticket is the ticket after the scan was recorded, nil if not found
+	Ticket *models.Ticket
+	// FirstCheckIn is set when the scan moved the ticket from active to used
+	FirstCheckIn bool
+}
+
+// RecordOfflineCheckIn records a check-in a gate made while offline. When
+// two gates scanned the same ticket, the earliest scan is its check-in and
+// the other one is kept in checkin_conflicts, whichever was uploaded first.
+// Uploading the same scan again gives the same result.
+func (r *TicketRepository) RecordOfflineCheckIn(scan models.OfflineCheckIn) (*OfflineCheckInResult, error) {
+	// Postgres keeps microseconds, so compare scans at that precision
+	scannedAt := scan.ScannedAt.UTC().Truncate(time.Microsecond)
+
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var ticket models.Ticket
+	err = tx.Get(&ticket, "SELECT * FROM ticket WHERE ticket_code=CAST($1 AS UUID) FOR UPDATE", scan.TicketCode)
+	if err == sql.ErrNoRows {
+		return &OfflineCheckInResult{Result: OfflineNotFound}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &OfflineCheckInResult{Result: OfflineCheckedIn, Ticket: &ticket}
+	switch {
+	case ticket.Status == "active":
+		result.FirstCheckIn = true
+
+	case ticket.Status != "used":
+		result.Result = OfflineNotActive
+		return result, nil
+
+	case ticket.CheckedInAt != nil && ticket.CheckedInAt.Equal(scannedAt) && ticket.GateID != nil && *ticket.GateID == scan.GateID:
+		// The same scan uploaded again
+		return result, nil
+
+	case ticket.CheckedInAt != nil && ticket.GateID != nil && scannedAt.Before(*ticket.CheckedInAt):
+		// This scan came first, so the recorded check-in is the duplicate
+		if err := insertCheckInConflict(tx, ticket.TicketID, *ticket.GateID, ticket.ScannerID, *ticket.CheckedInAt); err != nil {
+			return nil, err
+		}
+
+	default:
+		if err := insertCheckInConflict(tx, ticket.TicketID, scan.GateID, &scan.ScannerID, scannedAt); err != nil {
+			return nil, err
+		}
+		result.Result = OfflineDuplicate
+		return result, tx.Commit()
+	}
+
+	err = tx.QueryRowx(
+		`UPDATE ticket SET status='used', checked_in_at=$2, gate_id=$3, scanner_id=NULLIF($4, '')
+		WHERE ticket_id=$1 RETURNING *`,
+		ticket.TicketID, scannedAt, scan.GateID, scan.ScannerID,
+	).StructScan(&ticket)
+	if err != nil {
+		return nil, err
+	}
+	// Payments due at the door are collected once, on the first check-in
+	if result.FirstCheckIn {
+		if err := insertCheckIn(tx, &ticket); err != nil {
+			return nil, err
+		}
+	}
+	return result, tx.Commit()
+}
+
+func insertCheckInConflict(tx *sqlx.Tx, ticketID int, gateID string, scannerID *string, scannedAt time.Time) error {
+	_, err := tx.Exec(
+		`INSERT INTO checkin_conflicts (ticket_id, gate_id, scanner_id, scanned_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+		ON CONFLICT (ticket_id, gate_id, scanned_at) DO NOTHING`,
+		ticketID, gateID, scannerID, scannedAt,
+	)
+	return err
+}
@@ -0,0 +1,420 @@
+package repos
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"ticket-service/internal/db/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"tixie.local/broker/events"
+)
+
+// newTestRepository connects to the database in TICKET_TEST_DATABASE_URL and
+// loads the schema into a throwaway Postgres schema. The tests are skipped
+// when the variable is not set.
+func newTestRepository(t *testing.T) *TicketRepository {
+	t.Helper()
+
+	dsn := os.Getenv("TICKET_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TICKET_TEST_DATABASE_URL not set, skipping database test")
+	}
+
+	admin, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("ticket_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	db, err := sqlx.Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ddl, err := os.ReadFile("../init/ticket.sql")
+	if err != nil {
+		t.Fatalf("failed to read schema: %v", err)
+	}
+	if _, err := db.Exec(string(ddl)); err != nil {
+		t.Fatalf("failed to load schema: %v", err)
+	}
+
+	return NewTicketRepository(db)
+}
+
+// outboxCheckIns returns the gates of the TicketCheckedIn messages written to
+// the outbox for a ticket, oldest first.
+func outboxCheckIns(t *testing.T, repo *TicketRepository, ticketID int) []string {
+	t.Helper()
+	var gates []string
+	err := repo.db.Select(&gates,
+		`SELECT payload->'data'->>'gate_id' FROM outbox
+		WHERE payload->>'type' = $1 AND (payload->'data'->>'ticket_id')::int = $2
+		ORDER BY outbox_id`,
+		events.TypeTicketCheckedIn, ticketID,
+	)
+	if err != nil {
+		t.Fatalf("failed to read outbox: %v", err)
+	}
+	return gates
+}
+
+func TestCheckIn_AdmitsATicketOnce(t *testing.T) {
+	repo := newTestRepository(t)
+	const code = "123e4567-e89b-12d3-a456-426614174000"
+
+	var wg sync.WaitGroup
+	admitted := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(gate string) {
+			defer wg.Done()
+			_, ok, err := repo.CheckIn(code, gate, "scanner-1", 0, 0)
+			if err != nil {
+				t.Errorf("CheckIn at %s: %v", gate, err)
+			}
+			if ok {
+				admitted <- gate
+			}
+		}(fmt.Sprintf("G%d", i))
+	}
+	wg.Wait()
+	close(admitted)
+
+	var gates []string
+	for gate := range admitted {
+		gates = append(gates, gate)
+	}
+	if len(gates) != 1 {
+		t.Fatalf("ticket was admitted at %v, want exactly one gate", gates)
+	}
+
+	ticket, ok, err := repo.CheckIn(code, "G99", "scanner-2", 0, 0)
+	if err != nil {
+		t.Fatalf("CheckIn: %v", err)
+	}
+	if ok || ticket.Status != "used" {
+		t.Fatalf("used ticket was admitted again: %+v", ticket)
+	}
+	if ticket.GateID == nil || *ticket.GateID != gates[0] || ticket.CheckedInAt == nil {
+		t.Errorf("check-in not recorded: gate %v at %v, want gate %s", ticket.GateID, ticket.CheckedInAt, gates[0])
+	}
+
+	// The admitting scan alone is published, whatever the broker's state
+	if published := outboxCheckIns(t, repo, ticket.TicketID); len(published) != 1 || published[0] != gates[0] {
+		t.Errorf("outbox check-ins = %v, want [%s]", published, gates[0])
+	}
+}
+
+func TestCreateTicket_IsIdempotentPerReservationKey(t *testing.T) {
+	repo := newTestRepository(t)
+	key := "reservation-saga-42"
+
+	first, err := repo.CreateTicket(&models.Ticket{
+		EventID: 1, UserID: 7, Status: "held", ReservationKey: &key,
+		TicketCode: "0b7e4f2c-1a9d-4c36-8e5b-2f6a3d9c1e70",
+	})
+	if err != nil {
+		t.Fatalf("CreateTicket: %v", err)
+	}
+	again, err := repo.CreateTicket(&models.Ticket{
+		EventID: 1, UserID: 7, Status: "held", ReservationKey: &key,
+		TicketCode: "5c1d8a3e-7f2b-4e90-a6d4-9b8c0e1f2a35",
+	})
+	if err != nil {
+		t.Fatalf("CreateTicket retry: %v", err)
+	}
+	if again.TicketID != first.TicketID || again.TicketCode != first.TicketCode {
+		t.Errorf("retry created ticket %+v, want %+v", again, first)
+	}
+
+	found, err := repo.GetTicketByReservationKey(key)
+	if err != nil {
+		t.Fatalf("GetTicketByReservationKey: %v", err)
+	}
+	if found == nil || found.TicketID != first.TicketID {
+		t.Errorf("found %+v, want ticket %d", found, first.TicketID)
+	}
+	if missing, err := repo.GetTicketByReservationKey("reservation-saga-43"); err != nil || missing != nil {
+		t.Errorf("unknown key found %+v, %v; want nil", missing, err)
+	}
+}
+
+func TestUpdateTicketStatus_MarkingUsedRecordsCheckInOnce(t *testing.T) {
+	repo := newTestRepository(t)
+
+	for i := 0; i < 2; i++ {
+		if _, err := repo.UpdateTicketStatus(1, "used"); err != nil {
+			t.Fatalf("UpdateTicketStatus: %v", err)
+		}
+	}
+	if published := outboxCheckIns(t, repo, 1); len(published) != 1 {
+		t.Errorf("outbox check-ins = %v, want one", published)
+	}
+}
+
+func TestCheckIn_RejectsTicketsThatAreNotActive(t *testing.T) {
+	repo := newTestRepository(t)
+
+	ticket, ok, err := repo.CheckIn("456789ab-cdef-1234-5678-901234567890", "G1", "", 0, 0)
+	if err != nil {
+		t.Fatalf("CheckIn: %v", err)
+	}
+	if ok || ticket == nil || ticket.Status != "cancelled" {
+		t.Errorf("cancelled ticket: got %+v, admitted %v", ticket, ok)
+	}
+
+	ticket, ok, err = repo.CheckIn("00000000-0000-0000-0000-000000000000", "G1", "", 0, 0)
+	if err != nil || ok || ticket != nil {
+		t.Errorf("unknown ticket: got %+v, admitted %v, err %v", ticket, ok, err)
+	}
+}
+
+func TestCheckIn_RejectsTicketsThatDoNotMatchTheSignedClaims(t *testing.T) {
+	repo := newTestRepository(t)
+	const code = "123e4567-e89b-12d3-a456-426614174000"
+
+	for _, claims := range []struct{ ticketID, eventID int }{{3, 1}, {1, 2}} {
+		ticket, ok, err := repo.CheckIn(code, "G1", "", claims.ticketID, claims.eventID)
+		if err != nil {
+			t.Fatalf("CheckIn: %v", err)
+		}
+		if ok || ticket == nil || ticket.Status != "active" {
+			t.Errorf("claims %+v: got %+v, admitted %v; want the ticket left active", claims, ticket, ok)
+		}
+	}
+	if published := outboxCheckIns(t, repo, 1); len(published) != 0 {
+		t.Errorf("outbox check-ins = %v, want none", published)
+	}
+
+	if _, ok, err := repo.CheckIn(code, "G1", "", 1, 1); err != nil || !ok {
+		t.Errorf("matching claims: admitted %v, err %v; want admitted", ok, err)
+	}
+}
+
+func TestGetTicketsChangedSince_ReturnsOnlyNewerChanges(t *testing.T) {
+	repo := newTestRepository(t)
+
+	tickets, version, err := repo.GetTicketsChangedSince(2, 0)
+	if err != nil {
+		t.Fatalf("GetTicketsChangedSince: %v", err)
+	}
+	if len(tickets) != 2 {
+		t.Fatalf("event 2 has %d tickets, want 2", len(tickets))
+	}
+
+	if changed, _, err := repo.GetTicketsChangedSince(2, version); err != nil || len(changed) != 0 {
+		t.Fatalf("nothing changed, got %d tickets (%v)", len(changed), err)
+	}
+
+	cancelled, err := repo.UpdateTicketStatus(tickets[0].TicketID, "cancelled")
+	if err != nil {
+		t.Fatalf("UpdateTicketStatus: %v", err)
+	}
+	changed, _, err := repo.GetTicketsChangedSince(2, version)
+	if err != nil {
+		t.Fatalf("GetTicketsChangedSince: %v", err)
+	}
+	if len(changed) != 1 || changed[0].TicketID != cancelled.TicketID || changed[0].Status != "cancelled" {
+		t.Errorf("changes since %d = %+v, want the cancelled ticket", version, changed)
+	}
+}
+
+func TestGetTicketsChangedSince_KeepsChangesThatCommitOutOfOrder(t *testing.T) {
+	repo := newTestRepository(t)
+	_, version, err := repo.GetTicketsChangedSince(2, 0)
+	if err != nil {
+		t.Fatalf("GetTicketsChangedSince: %v", err)
+	}
+
+	// A slow transaction takes the lower version but commits last
+	slow, err := repo.db.Beginx()
+	if err != nil {
+		t.Fatalf("Beginx: %v", err)
+	}
+	defer slow.Rollback()
+	var slowTicket models.Ticket
+	err = slow.Get(&slowTicket, "UPDATE ticket SET status='cancelled' WHERE ticket_code='a1b2c3d4-e5f6-7890-abcd-ef1234567890' RETURNING *")
+	if err != nil {
+		t.Fatalf("failed to cancel ticket: %v", err)
+	}
+	fast, err := repo.UpdateTicketStatus(5, "cancelled")
+	if err != nil {
+		t.Fatalf("UpdateTicketStatus: %v", err)
+	}
+	if fast.Version <= slowTicket.Version {
+		t.Fatalf("fast change has version %d, want it above the slow one's %d", fast.Version, slowTicket.Version)
+	}
+
+	// A scanner syncs while the slow transaction is still running
+	changed, version, err := repo.GetTicketsChangedSince(2, version)
+	if err != nil {
+		t.Fatalf("GetTicketsChangedSince: %v", err)
+	}
+	if len(changed) != 1 || changed[0].TicketID != fast.TicketID {
+		t.Fatalf("changes = %+v, want only ticket %d", changed, fast.TicketID)
+	}
+
+	if err := slow.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	changed, _, err = repo.GetTicketsChangedSince(2, version)
+	if err != nil {
+		t.Fatalf("GetTicketsChangedSince: %v", err)
+	}
+	found := false
+	for _, ticket := range changed {
+		found = found || (ticket.TicketID == slowTicket.TicketID && ticket.Status == "cancelled")
+	}
+	if !found {
+		t.Errorf("changes since %d = %+v, want the change that committed last", version, changed)
+	}
+}
+
+func TestRecordOfflineCheckIn_EarliestScanWins(t *testing.T) {
+	repo := newTestRepository(t)
+	const code = "a1b2c3d4-e5f6-7890-abcd-ef1234567890"
+	early := time.Date(2026, 10, 16, 19, 0, 0, 0, time.UTC)
+	late := early.Add(3 * time.Minute)
+
+	lateScan := models.OfflineCheckIn{TicketCode: code, GateID: "North", ScannerID: "n-1", ScannedAt: late}
+	res, err := repo.RecordOfflineCheckIn(lateScan)
+	if err != nil {
+		t.Fatalf("RecordOfflineCheckIn: %v", err)
+	}
+	if res.Result != OfflineCheckedIn || !res.FirstCheckIn {
+		t.Fatalf("first upload: got %s (first %v), want the check-in", res.Result, res.FirstCheckIn)
+	}
+
+	// A gate that was offline longer uploads an earlier scan of the ticket
+	res, err = repo.RecordOfflineCheckIn(models.OfflineCheckIn{TicketCode: code, GateID: "South", ScannerID: "s-1", ScannedAt: early})
+	if err != nil {
+		t.Fatalf("RecordOfflineCheckIn: %v", err)
+	}
+	if res.Result != OfflineCheckedIn || res.FirstCheckIn {
+		t.Fatalf("earlier scan: got %s (first %v), want it to take over the check-in", res.Result, res.FirstCheckIn)
+	}
+	if res.Ticket.GateID == nil || *res.Ticket.GateID != "South" || !res.Ticket.CheckedInAt.Equal(early) {
+		t.Errorf("check-in is at %v %v, want South at %v", res.Ticket.GateID, res.Ticket.CheckedInAt, early)
+	}
+
+	// Uploading the later scan again reports it as the duplicate it is
+	for i := 0; i < 2; i++ {
+		res, err = repo.RecordOfflineCheckIn(lateScan)
+		if err != nil {
+			t.Fatalf("RecordOfflineCheckIn: %v", err)
+		}
+		if res.Result != OfflineDuplicate {
+			t.Errorf("later scan: got %s, want %s", res.Result, OfflineDuplicate)
+		}
+	}
+
+	var conflicts int
+	if err := repo.db.Get(&conflicts, "SELECT COUNT(*) FROM checkin_conflicts WHERE ticket_id=$1", res.Ticket.TicketID); err != nil {
+		t.Fatalf("count conflicts: %v", err)
+	}
+	if conflicts != 1 {
+		t.Errorf("recorded %d conflicts, want 1", conflicts)
+	}
+
+	// Only the first check-in is published, payments are collected once
+	if published := outboxCheckIns(t, repo, res.Ticket.TicketID); len(published) != 1 || published[0] != "North" {
+		t.Errorf("outbox check-ins = %v, want [North]", published)
+	}
+}
+
+func TestTransferTicket_RotatesCodeAndKeepsHistory(t *testing.T) {
+	repo := newTestRepository(t)
+
+	before, err := repo.GetTicketByID(1)
+	if err != nil || before == nil {
+		t.Fatalf("GetTicketByID: %v %v", before, err)
+	}
+
+	const newCode = "11111111-2222-3333-4444-555555555555"
+	after, err := repo.TransferTicket(1, 1, 9, newCode, "from@example.com", "to@example.com")
+	if err != nil {
+		t.Fatalf("TransferTicket: %v", err)
+	}
+	if after.UserID != 9 || after.TicketCode != newCode || after.TicketCode == before.TicketCode {
+		t.Errorf("transferred ticket = %+v, want user 9 with code %s", after, newCode)
+	}
+
+	// The previous holder no longer has the ticket to give away
+	if _, err := repo.TransferTicket(1, 1, 10, "66666666-7777-8888-9999-000000000000", "from@example.com", "other@example.com"); err != ErrNotTransferable {
+		t.Errorf("second transfer by the previous holder: error = %v, want %v", err, ErrNotTransferable)
+	}
+
+	// Both holders are emailed once, through the outbox
+	var recipients []string
+	err = repo.db.Select(&recipients,
+		`SELECT payload->'data'->>'recipient_email' FROM outbox
+		WHERE payload->>'type' = $1 ORDER BY outbox_id`,
+		events.TypeNotificationEmail,
+	)
+	if err != nil {
+		t.Fatalf("failed to read outbox: %v", err)
+	}
+	if want := []string{"to@example.com", "from@example.com"}; !reflect.DeepEqual(recipients, want) {
+		t.Errorf("outbox emails = %v, want %v", recipients, want)
+	}
+
+	transfers, err := repo.GetTransfers(1)
+	if err != nil {
+		t.Fatalf("GetTransfers: %v", err)
+	}
+	if len(transfers) != 1 || transfers[0].FromUserID != 1 || transfers[0].ToUserID != 9 {
+		t.Errorf("transfers = %+v, want one from user 1 to user 9", transfers)
+	}
+}
+
+func TestResellTicket_OnlySellsListedTickets(t *testing.T) {
+	repo := newTestRepository(t)
+
+	const newCode = "11111111-2222-3333-4444-555555555555"
+	if _, err := repo.ResellTicket(1, 1, 9, newCode); err != ErrNotTransferable {
+		t.Fatalf("reselling an unlisted ticket: error = %v, want %v", err, ErrNotTransferable)
+	}
+
+	if _, err := repo.ListTicket(1, 2); err != ErrNotListable {
+		t.Errorf("listing someone else's ticket: error = %v, want %v", err, ErrNotListable)
+	}
+	listed, err := repo.ListTicket(1, 1)
+	if err != nil {
+		t.Fatalf("ListTicket: %v", err)
+	}
+	if listed.Status != "listed" {
+		t.Errorf("listed ticket has status %s", listed.Status)
+	}
+
+	// A listed ticket cannot be let in or given away
+	if _, ok, err := repo.CheckIn(listed.TicketCode, "G1", "", 0, 0); err != nil || ok {
+		t.Errorf("CheckIn of a listed ticket = %v, %v, want not checked in", ok, err)
+	}
+	if _, err := repo.TransferTicket(1, 1, 10, "66666666-7777-8888-9999-000000000000", "from@example.com", "to@example.com"); err != ErrNotTransferable {
+		t.Errorf("transferring a listed ticket: error = %v, want %v", err, ErrNotTransferable)
+	}
+
+	sold, err := repo.ResellTicket(1, 1, 9, newCode)
+	if err != nil {
+		t.Fatalf("ResellTicket: %v", err)
+	}
+	if sold.UserID != 9 || sold.Status != "active" || sold.TicketCode != newCode {
+		t.Errorf("resold ticket = %+v, want active for user 9 with code %s", sold, newCode)
+	}
+	if _, err := repo.UnlistTicket(1, 1); err != ErrNotListable {
+		t.Errorf("unlisting a sold ticket: error = %v, want %v", err, ErrNotListable)
+	}
+}
@@ -0,0 +1,33 @@
+package qr
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestPNG(t *testing.T) {
+	data, err := PNG("ticket_code:123e4567-e89b-12d3-a456-426614174000", 256)
+	if err != nil {
+		t.Fatalf("PNG failed: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("not a PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 256 || b.Dy() != 256 {
+		t.Errorf("expected a 256x256 image, got %v", b)
+	}
+}
+
+func TestSVG(t *testing.T) {
+	data, err := SVG("ticket_code:123e4567-e89b-12d3-a456-426614174000")
+	if err != nil {
+		t.Fatalf("SVG failed: %v", err)
+	}
+	svg := string(data)
+	if !strings.HasPrefix(svg, "<svg") || !strings.HasSuffix(svg, "</svg>") || !strings.Contains(svg, "h1v1h-1z") {
+		t.Errorf("unexpected SVG: %.120s", svg)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 	circuitbreaker "tixie.local/common"
+	"tixie.local/common/paymentmethod"
 )
 
 type Handler struct {
@@ -176,6 +177,13 @@ func (h *Handler) CreateVendorEvent(c *gin.Context) {
 	}
 	event.VendorID = vendorID
 
+	methods, err := paymentmethod.ParseAll(event.PaymentMethods)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	event.PaymentMethods = methods
+
 	jsonData, err := json.Marshal(event)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error marshalling event data"})
@@ -211,3 +219,98 @@ func (h *Handler) CreateVendorEvent(c *gin.Context) {
 
 	c.JSON(http.StatusCreated, gin.H{"message": "Event created successfully"})
 }
+
+// AddVendorEventTickets adds tickets to one of the vendor's events. Users on
+// the event's waitlist are offered them before they go on general sale.
+func (h *Handler) AddVendorEventTickets(c *gin.Context) {
+	vendorID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid vendor ID"})
+		return
+	}
+	eventID, err := strconv.Atoi(c.Param("event_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	var input struct {
+		TicketsToAdd int `json:"tickets_to_add" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tickets_to_add must be greater than zero"})
+		return
+	}
+
+	eventURL := fmt.Sprintf("http://event-service:8080/v1/%d", eventID)
+	jsonData, err := json.Marshal(input)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error marshalling tickets data"})
+		return
+	}
+
+	// Another vendor's event, or none at all, is an answer rather than a
+	// failure of event-service, so it is kept out of the breaker's count.
+	var notFound, notOwned bool
+	var inventory struct {
+		TicketsLeft int `json:"tickets_left"`
+	}
+	err = h.eventServiceBreaker.Execute(func() error {
+		resp, err := http.Get(eventURL)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			notFound = true
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("event service returned status: %d", resp.StatusCode)
+		}
+		var event struct {
+			VendorID int `json:"vendor_id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+			return err
+		}
+		if event.VendorID != vendorID {
+			notOwned = true
+			return nil
+		}
+
+		req, err := http.NewRequest(http.MethodPatch, eventURL+"/tickets/add", bytes.NewBuffer(jsonData))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		addResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer addResp.Body.Close()
+
+		if addResp.StatusCode != http.StatusOK {
+			return fmt.Errorf("event service returned status: %d", addResp.StatusCode)
+		}
+		return json.NewDecoder(addResp.Body).Decode(&inventory)
+	})
+
+	if err != nil {
+		if errors.Is(err, circuitbreaker.ErrCircuitBreakerOpen) || errors.Is(err, circuitbreaker.ErrTooManyRequests) {
+			log.Printf("Circuit breaker error when calling event service: %v", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Event service is temporarily unavailable"})
+			return
+		}
+		log.Printf("Error calling event service: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add tickets"})
+		return
+	}
+	if notFound || notOwned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tickets added successfully", "tickets_left": inventory.TicketsLeft})
+}
@@ -18,5 +18,10 @@ func SetupRoutes(r *gin.Engine, repo *repos.VendorRepository) {
 		vendors.DELETE("/:id", handler.DeleteVendor)
 		vendors.POST("/authenticate", handler.AuthenticateVendor)
 		vendors.POST("/:id/events", handler.CreateVendorEvent)
+		vendors.PATCH("/:id/events/:event_id/tickets", handler.AddVendorEventTickets)
+		vendors.GET("/:id/events/:event_id/ticket-types", handler.GetVendorTicketTypes)
+		vendors.POST("/:id/events/:event_id/ticket-types", handler.CreateVendorTicketType)
+		vendors.PUT("/:id/events/:event_id/ticket-types/:type_id", handler.UpdateVendorTicketType)
+		vendors.DELETE("/:id/events/:event_id/ticket-types/:type_id", handler.DeleteVendorTicketType)
 	}
 }
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	circuitbreaker "tixie.local/common"
+)
+
+// GetVendorTicketTypes lists the ticket types of one of the vendor's events.
+func (h *Handler) GetVendorTicketTypes(c *gin.Context) {
+	h.forwardToVendorEvent(c, http.MethodGet, "/ticket-types", nil)
+}
+
+// CreateVendorTicketType adds a ticket type, e.g. early bird or VIP, to one
+// of the vendor's events.
+func (h *Handler) CreateVendorTicketType(c *gin.Context) {
+	body, ok := ticketTypeBody(c)
+	if !ok {
+		return
+	}
+	h.forwardToVendorEvent(c, http.MethodPost, "/ticket-types", body)
+}
+
+// UpdateVendorTicketType replaces the settings of a ticket type of one of
+// the vendor's events.
+func (h *Handler) UpdateVendorTicketType(c *gin.Context) {
+	typeID, err := strconv.Atoi(c.Param("type_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket type ID"})
+		return
+	}
+	body, ok := ticketTypeBody(c)
+	if !ok {
+		return
+	}
+	h.forwardToVendorEvent(c, http.MethodPut, fmt.Sprintf("/ticket-types/%d", typeID), body)
+}
+
+// DeleteVendorTicketType removes a ticket type that never sold from one of
+// the vendor's events.
+func (h *Handler) DeleteVendorTicketType(c *gin.Context) {
+	typeID, err := strconv.Atoi(c.Param("type_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket type ID"})
+		return
+	}
+	h.forwardToVendorEvent(c, http.MethodDelete, fmt.Sprintf("/ticket-types/%d", typeID), nil)
+}
+
+// ticketTypeBody reads the ticket type to pass on to event-service, which
+// validates it.
+func ticketTypeBody(c *gin.Context) ([]byte, bool) {
+	var input map[string]interface{}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket type input"})
+		return nil, false
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error marshalling ticket type data"})
+		return nil, false
+	}
+	return body, true
+}
+
+// forwardToVendorEvent sends a request for path under one of the vendor's
+// events to event-service and relays its answer. Events of other vendors are
+// reported as not found.
+func (h *Handler) forwardToVendorEvent(c *gin.Context, method, path string, body []byte) {
+	vendorID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid vendor ID"})
+		return
+	}
+	eventID, err := strconv.Atoi(c.Param("event_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	eventURL := fmt.Sprintf("http://event-service:8080/v1/%d", eventID)
+
+	// Answers such as a missing event or an invalid ticket type are not
+	// failures of event-service, so they are kept out of the breaker's count.
+	var notFound, notOwned bool
+	var status int
+	var respBody []byte
+	err = h.eventServiceBreaker.Execute(func() error {
+		resp, err := http.Get(eventURL)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			notFound = true
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("event service returned status: %d", resp.StatusCode)
+		}
+		var event struct {
+			VendorID int `json:"vendor_id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+			return err
+		}
+		if event.VendorID != vendorID {
+			notOwned = true
+			return nil
+		}
+
+		req, err := http.NewRequest(method, eventURL+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		fwdResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer fwdResp.Body.Close()
+
+		if fwdResp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("event service returned status: %d", fwdResp.StatusCode)
+		}
+		status = fwdResp.StatusCode
+		respBody, err = io.ReadAll(fwdResp.Body)
+		return err
+	})
+
+	if err != nil {
+		if errors.Is(err, circuitbreaker.ErrCircuitBreakerOpen) || errors.Is(err, circuitbreaker.ErrTooManyRequests) {
+			log.Printf("Circuit breaker error when calling event service: %v", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Event service is temporarily unavailable"})
+			return
+		}
+		log.Printf("Error calling event service: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to manage ticket types"})
+		return
+	}
+	if notFound || notOwned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+
+	if len(respBody) == 0 {
+		c.Status(status)
+		return
+	}
+	c.Data(status, "application/json; charset=utf-8", respBody)
+}
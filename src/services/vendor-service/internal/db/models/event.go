@@ -1,7 +1,17 @@
 package models
+
+import "encoding/json"
+
 type Event struct {
     VendorID int    `json:"vendor_id"`
     Name     string `json:"name"`
     Date     string `json:"date"`
     Location string `json:"location"`
+    // Price is a decimal amount of Currency, passed on to event-service
+    // unchanged.
+    Price    json.Number `json:"price"`
+    Currency string      `json:"currency,omitempty"`
+    // PaymentMethods are the paymentmethod constants buyers may pay with,
+    // e.g. card or cash_on_arrival. Empty means card only.
+    PaymentMethods []string `json:"payment_methods,omitempty"`
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"tixie.local/common/admission"
+	"tixie.local/common/ticketsig"
+	"waiting-room/internal/api"
+	"waiting-room/internal/onsale"
+	"waiting-room/internal/queue"
+)
+
+const (
+	// defaultAdmissionTTL is how long an admitted user has to buy tickets
+	// when ADMISSION_TTL is not set.
+	defaultAdmissionTTL = 10 * time.Minute
+	// admitInterval is how often users are admitted from the queues.
+	admitInterval = time.Second
+	// onSaleCacheTTL is how long an event's on-sale settings are trusted
+	// before they are fetched from event-service again.
+	onSaleCacheTTL = 10 * time.Second
+)
+
+func main() {
+	// Queue and admission tokens are signed with WAITING_ROOM_SIGNING_KEY;
+	// reservation-service trusts its public key through
+	// WAITING_ROOM_VERIFY_KEYS.
+	signer, err := ticketsig.ParseSigner(os.Getenv("WAITING_ROOM_SIGNING_KEY"))
+	if err != nil {
+		log.Fatalf("Invalid WAITING_ROOM_SIGNING_KEY: %v", err)
+	}
+	keyring := ticketsig.NewKeyring()
+	if err := keyring.Add(signer.KeyID(), signer.PublicKey()); err != nil {
+		log.Fatalf("Invalid WAITING_ROOM_SIGNING_KEY: %v", err)
+	}
+
+	admissionTTL := defaultAdmissionTTL
+	if v := os.Getenv("ADMISSION_TTL"); v != "" {
+		if admissionTTL, err = time.ParseDuration(v); err != nil || admissionTTL <= 0 {
+			log.Fatalf("Invalid ADMISSION_TTL %q: must be a positive duration", v)
+		}
+	}
+
+	// Every replica must serve the same queues, so Redis is only optional
+	// when running a single one.
+	var store queue.Store
+	if url := os.Getenv("REDIS_URL"); url != "" {
+		redisStore, err := queue.NewRedisStoreFromURL(url)
+		if err != nil {
+			log.Fatalf("Failed to connect to Redis: %v", err)
+		}
+		defer redisStore.Close()
+		store = redisStore
+	} else {
+		log.Printf("Warning: REDIS_URL is not set, queues are kept in memory")
+		store = queue.NewMemoryStore()
+	}
+
+	onSales := onsale.NewClient(os.Getenv("EVENT_SERVICE_URL"), onSaleCacheTTL)
+	room := queue.NewRoom(store, onSales, admission.NewIssuer(signer), admission.NewVerifier(keyring), admissionTTL)
+	room.Start(admitInterval)
+
+	r := gin.Default()
+	api.SetupRoutes(r, room)
+
+	if err := r.Run(":8080"); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	circuitbreaker "tixie.local/common"
+	"waiting-room/internal/onsale"
+	"waiting-room/internal/queue"
+)
+
+// statusInterval is how often a user's status is pushed over a WebSocket.
+const statusInterval = 2 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+type ClientConnection struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+type Handler struct {
+	room *queue.Room
+}
+
+// NewHandler creates a new Handler serving the queues of room.
+func NewHandler(room *queue.Room) *Handler {
+	return &Handler{room: room}
+}
+
+// JoinQueue puts a user in the queue of a protected on-sale. The returned
+// queue token is what the user polls their status with.
+func (h *Handler) JoinQueue(c *gin.Context) {
+	var input struct {
+		EventID int `json:"event_id" binding:"required,gt=0"`
+		UserID  int `json:"user_id" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	token, status, err := h.room.Join(c.Request.Context(), input.EventID, input.UserID)
+	if err != nil {
+		c.JSON(queueErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"queue_token": token, "status": status})
+}
+
+// GetQueueStatus returns the position and estimated wait of the holder of a
+// queue token, and their admission token once they are admitted.
+func (h *Handler) GetQueueStatus(c *gin.Context) {
+	status, err := h.room.Status(c.Request.Context(), c.Query("token"))
+	if err != nil {
+		c.JSON(queueErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// GetQueueStatusWS pushes the status of the holder of a queue token over a
+// WebSocket until they are admitted, then closes the connection.
+func (h *Handler) GetQueueStatusWS(c *gin.Context) {
+	token := c.Query("token")
+	// The token is checked before upgrading, so a bad one gets a plain
+	// HTTP error.
+	if _, err := h.room.Status(c.Request.Context(), token); err != nil {
+		c.JSON(queueErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade connection: %v", err)
+		return
+	}
+	defer ws.Close()
+
+	client := &ClientConnection{conn: ws, mu: sync.Mutex{}}
+
+	// Reading is needed to notice the client going away.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	for {
+		done, err := h.sendStatus(ctx, client, token)
+		if err != nil {
+			log.Printf("Failed to send queue status: %v", err)
+			return
+		}
+		if done {
+			client.close()
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendStatus writes the token holder's status, or the reason it is no longer
+// available, and reports whether there is nothing more to send.
+func (h *Handler) sendStatus(ctx context.Context, client *ClientConnection, token string) (bool, error) {
+	status, err := h.room.Status(ctx, token)
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if err != nil {
+		if queueErrorStatus(err) >= http.StatusInternalServerError {
+			// Keep the user in line through a passing outage.
+			log.Printf("Failed to get queue status: %v", err)
+			return false, nil
+		}
+		return true, client.conn.WriteJSON(gin.H{"error": err.Error()})
+	}
+	return status.Admitted, client.conn.WriteJSON(status)
+}
+
+func (client *ClientConnection) close() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	client.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+func queueErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, onsale.ErrEventNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, onsale.ErrNotProtected):
+		return http.StatusConflict
+	case errors.Is(err, queue.ErrClosed):
+		return http.StatusGone
+	case errors.Is(err, queue.ErrInvalidToken):
+		return http.StatusUnauthorized
+	case circuitbreaker.IsCircuitBreakerError(err):
+		status, _ := circuitbreaker.HandleCircuitBreakerError(err)
+		return status
+	default:
+		return http.StatusInternalServerError
+	}
+}
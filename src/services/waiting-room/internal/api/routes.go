@@ -0,0 +1,22 @@
+package api
+
+import (
+	"waiting-room/internal/queue"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetupRoutes(r *gin.Engine, room *queue.Room) {
+
+	handler := NewHandler(room)
+
+	// API routes for the queues of protected on-sales
+	queues := r.Group("/v1/queue")
+	{
+		queues.POST("", handler.JoinQueue)
+
+		queues.GET("/status", handler.GetQueueStatus)
+
+		queues.GET("/ws", handler.GetQueueStatusWS)
+	}
+}
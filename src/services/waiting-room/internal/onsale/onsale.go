@@ -0,0 +1,130 @@
+// Package onsale looks up which on-sales the waiting room protects.
+package onsale
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	circuitbreaker "tixie.local/common"
+)
+
+var (
+	// ErrEventNotFound is returned for events event-service does not know.
+	ErrEventNotFound = errors.New("event not found")
+	// ErrNotProtected is returned for events whose on-sale has no queue.
+	ErrNotProtected = errors.New("event on-sale is not protected by the waiting room")
+)
+
+// OnSale is an event's protected on-sale: until Until users buy tickets
+// through the queue, which admits RatePerMinute of them a minute.
+type OnSale struct {
+	EventID       int
+	RatePerMinute int
+	Until         time.Time
+}
+
+// Open reports whether the on-sale is still protected at now.
+func (o OnSale) Open(now time.Time) bool {
+	return now.Before(o.Until)
+}
+
+type eventDetails struct {
+	QueueRatePerMinute *int       `json:"queue_rate_per_minute"`
+	QueueUntil         *time.Time `json:"queue_until"`
+}
+
+type cached struct {
+	onSale    OnSale
+	err       error
+	fetchedAt time.Time
+}
+
+// Client fetches on-sales from event-service. Answers are cached for a short
+// while, as every status poll of every user in a queue needs one.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	breaker    *circuitbreaker.Breaker
+	ttl        time.Duration
+
+	mu    sync.Mutex
+	cache map[int]cached
+}
+
+// NewClient creates a Client for the event-service at baseURL that caches
+// answers for ttl.
+func NewClient(baseURL string, ttl time.Duration) *Client {
+	return &Client{
+		baseURL:    baseURL,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		breaker:    circuitbreaker.NewBreaker("event-service"),
+		ttl:        ttl,
+		cache:      make(map[int]cached),
+	}
+}
+
+// Get returns the event's on-sale, or ErrNotProtected if it has no queue.
+func (c *Client) Get(eventID int, now time.Time) (OnSale, error) {
+	c.mu.Lock()
+	entry, ok := c.cache[eventID]
+	c.mu.Unlock()
+	if ok && now.Sub(entry.fetchedAt) < c.ttl {
+		return entry.onSale, entry.err
+	}
+
+	onSale, err := c.fetch(eventID)
+	if err != nil && err != ErrEventNotFound && err != ErrNotProtected {
+		return OnSale{}, err
+	}
+
+	c.mu.Lock()
+	c.cache[eventID] = cached{onSale: onSale, err: err, fetchedAt: now}
+	c.mu.Unlock()
+	return onSale, err
+}
+
+func (c *Client) fetch(eventID int) (OnSale, error) {
+	// A missing event is an answer, not a failure of event-service, so it
+	// is kept out of the breaker's failure count.
+	notFound := false
+	result := c.breaker.Execute(func() (interface{}, error) {
+		resp, err := c.httpClient.Get(fmt.Sprintf("%s/v1/%d", c.baseURL, eventID))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			notFound = true
+			return nil, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("event service returned status %d", resp.StatusCode)
+		}
+
+		var details eventDetails
+		if err := json.NewDecoder(resp.Body).Decode(&details); err != nil {
+			return nil, err
+		}
+		return &details, nil
+	})
+	if result.Error != nil {
+		return OnSale{}, result.Error
+	}
+	if notFound {
+		return OnSale{}, ErrEventNotFound
+	}
+
+	details, ok := result.Data.(*eventDetails)
+	if !ok {
+		return OnSale{}, fmt.Errorf("failed to parse event response")
+	}
+	if details.QueueRatePerMinute == nil || details.QueueUntil == nil {
+		return OnSale{}, ErrNotProtected
+	}
+	return OnSale{EventID: eventID, RatePerMinute: *details.QueueRatePerMinute, Until: *details.QueueUntil}, nil
+}
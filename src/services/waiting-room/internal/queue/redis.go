@@ -0,0 +1,122 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// eventsKey is the set of events with a queue.
+const eventsKey = "waitingroom:events"
+
+// slotTTL is how long a slot is remembered after it advanced a queue, well
+// past the time replicas could still tick for it.
+const slotTTL = time.Minute
+
+// joinScript hands out the next number of an event's queue, unless the user
+// already has one.
+var joinScript = redis.NewScript(`
+local position = redis.call('HGET', KEYS[2], ARGV[1])
+if position then
+	return tonumber(position)
+end
+position = redis.call('INCR', KEYS[1])
+redis.call('HSET', KEYS[2], ARGV[1], position)
+redis.call('SADD', KEYS[3], ARGV[2])
+return position
+`)
+
+// advanceScript admits ARGV[1] more users, up to the number that joined,
+// unless the slot in KEYS[3] already advanced the queue. Admissions are kept
+// as a fraction, so rates below one user per tick add up.
+var advanceScript = redis.NewScript(`
+local admitted = tonumber(redis.call('GET', KEYS[2]) or '0')
+if redis.call('SET', KEYS[3], '1', 'NX', 'EX', ARGV[2]) then
+	local joined = tonumber(redis.call('GET', KEYS[1]) or '0')
+	admitted = math.min(admitted + tonumber(ARGV[1]), joined)
+	redis.call('SET', KEYS[2], tostring(admitted))
+end
+return math.floor(admitted)
+`)
+
+// RedisStore keeps queues in Redis, so every replica of the waiting room
+// serves the same queues.
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore creates a new RedisStore.
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+// NewRedisStoreFromURL connects to the Redis server at url, e.g.
+// "redis://redis-server:6379/0".
+func NewRedisStoreFromURL(url string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return NewRedisStore(client), nil
+}
+
+// Close closes the connection to Redis.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisStore) Join(ctx context.Context, eventID, userID int) (int64, error) {
+	keys := []string{key(eventID, "joined"), key(eventID, "users"), eventsKey}
+	return joinScript.Run(ctx, s.client, keys, userID, eventID).Int64()
+}
+
+func (s *RedisStore) Admitted(ctx context.Context, eventID int) (int64, error) {
+	admitted, err := s.client.Get(ctx, key(eventID, "admitted")).Float64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return int64(admitted), err
+}
+
+func (s *RedisStore) Advance(ctx context.Context, eventID int, by float64, slot int64) (int64, error) {
+	keys := []string{key(eventID, "joined"), key(eventID, "admitted"), key(eventID, "slot:"+strconv.FormatInt(slot, 10))}
+	return advanceScript.Run(ctx, s.client, keys, by, int(slotTTL.Seconds())).Int64()
+}
+
+func (s *RedisStore) Events(ctx context.Context) ([]int, error) {
+	members, err := s.client.SMembers(ctx, eventsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	eventIDs := make([]int, 0, len(members))
+	for _, member := range members {
+		eventID, err := strconv.Atoi(member)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event id %q in %s", member, eventsKey)
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, nil
+}
+
+func (s *RedisStore) Remove(ctx context.Context, eventID int) error {
+	pipe := s.client.TxPipeline()
+	pipe.Del(ctx, key(eventID, "joined"), key(eventID, "users"), key(eventID, "admitted"))
+	pipe.SRem(ctx, eventsKey, eventID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// key returns the Redis key of part of an event's queue. The event id is a
+// hash tag, so all keys of a queue live on the same node of a cluster.
+func key(eventID int, part string) string {
+	return fmt.Sprintf("waitingroom:{%d}:%s", eventID, part)
+}
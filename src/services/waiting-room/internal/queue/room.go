@@ -0,0 +1,198 @@
+// Package queue keeps the queues of the waiting room and admits users from
+// them at each on-sale's rate.
+package queue
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"tixie.local/common/admission"
+	"waiting-room/internal/onsale"
+)
+
+var (
+	// ErrClosed is returned for the queue of an on-sale that is no longer
+	// protected; tickets can be bought without queueing.
+	ErrClosed = errors.New("the on-sale is no longer protected by the waiting room")
+	// ErrInvalidToken is returned for strings that are not queue tokens
+	// issued by the waiting room.
+	ErrInvalidToken = errors.New("invalid queue token")
+)
+
+// OnSales looks up the protected on-sale of an event.
+type OnSales interface {
+	Get(eventID int, now time.Time) (onsale.OnSale, error)
+}
+
+// Status is where a user stands in an event's queue.
+type Status struct {
+	EventID int `json:"event_id"`
+	// Position is how many users are still to be admitted up to and
+	// including this user. It is 0 once the user is admitted.
+	Position             int64 `json:"position"`
+	EstimatedWaitSeconds int64 `json:"estimated_wait_seconds"`
+	Admitted             bool  `json:"admitted"`
+	// AdmissionToken lets an admitted user buy tickets; it is sent to
+	// reservation-service in the X-Admission-Token header.
+	AdmissionToken     string     `json:"admission_token,omitempty"`
+	AdmissionExpiresAt *time.Time `json:"admission_expires_at,omitempty"`
+}
+
+// Room hands out places in the queues of protected on-sales and admits users
+// from them.
+type Room struct {
+	store        Store
+	onSales      OnSales
+	issuer       *admission.Issuer
+	verifier     *admission.Verifier
+	admissionTTL time.Duration
+	now          func() time.Time
+}
+
+// NewRoom creates a Room. Tokens are signed by issuer and checked with
+// verifier, which must trust the issuer's key; admission tokens are valid for
+// admissionTTL.
+func NewRoom(store Store, onSales OnSales, issuer *admission.Issuer, verifier *admission.Verifier, admissionTTL time.Duration) *Room {
+	return &Room{
+		store:        store,
+		onSales:      onSales,
+		issuer:       issuer,
+		verifier:     verifier,
+		admissionTTL: admissionTTL,
+		now:          time.Now,
+	}
+}
+
+// Join puts the user in the event's queue and returns their queue token and
+// status. Joining again returns the user's original place.
+func (r *Room) Join(ctx context.Context, eventID, userID int) (string, Status, error) {
+	now := r.now()
+	onSale, err := r.onSales.Get(eventID, now)
+	if err != nil {
+		return "", Status{}, err
+	}
+	if !onSale.Open(now) {
+		return "", Status{}, ErrClosed
+	}
+
+	position, err := r.store.Join(ctx, eventID, userID)
+	if err != nil {
+		return "", Status{}, err
+	}
+
+	claims := admission.Claims{
+		Kind:      admission.KindQueue,
+		EventID:   eventID,
+		UserID:    userID,
+		Position:  position,
+		IssuedAt:  now,
+		ExpiresAt: onSale.Until,
+	}
+	token, err := r.issuer.Issue(claims)
+	if err != nil {
+		return "", Status{}, err
+	}
+
+	status, err := r.status(ctx, claims, onSale, now)
+	if err != nil {
+		return "", Status{}, err
+	}
+	return token, status, nil
+}
+
+// Status returns the status of the holder of a queue token. Once the holder
+// is admitted the status carries an admission token.
+func (r *Room) Status(ctx context.Context, queueToken string) (Status, error) {
+	now := r.now()
+	claims, err := r.verifier.Verify(queueToken, now)
+	if errors.Is(err, admission.ErrExpired) {
+		// Queue tokens expire when their on-sale stops being protected.
+		return Status{}, ErrClosed
+	}
+	if err != nil || claims.Kind != admission.KindQueue {
+		return Status{}, ErrInvalidToken
+	}
+
+	onSale, err := r.onSales.Get(claims.EventID, now)
+	if err != nil {
+		return Status{}, err
+	}
+	return r.status(ctx, claims, onSale, now)
+}
+
+func (r *Room) status(ctx context.Context, claims admission.Claims, onSale onsale.OnSale, now time.Time) (Status, error) {
+	admitted, err := r.store.Admitted(ctx, claims.EventID)
+	if err != nil {
+		return Status{}, err
+	}
+
+	status := Status{EventID: claims.EventID}
+	if claims.Position > admitted {
+		status.Position = claims.Position - admitted
+		status.EstimatedWaitSeconds = int64(math.Ceil(float64(status.Position) * 60 / float64(onSale.RatePerMinute)))
+		return status, nil
+	}
+
+	expiresAt := now.Add(r.admissionTTL)
+	token, err := r.issuer.Issue(admission.Claims{
+		Kind:      admission.KindAdmission,
+		EventID:   claims.EventID,
+		UserID:    claims.UserID,
+		IssuedAt:  now,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return Status{}, err
+	}
+	status.Admitted = true
+	status.AdmissionToken = token
+	status.AdmissionExpiresAt = &expiresAt
+	return status, nil
+}
+
+// Tick admits the users of every protected on-sale that are due in the
+// interval ending now, and drops the queues of on-sales that are over.
+func (r *Room) Tick(ctx context.Context, interval time.Duration) {
+	now := r.now()
+	eventIDs, err := r.store.Events(ctx)
+	if err != nil {
+		log.Printf("Failed to list queues: %v", err)
+		return
+	}
+
+	for _, eventID := range eventIDs {
+		onSale, err := r.onSales.Get(eventID, now)
+		switch {
+		case errors.Is(err, onsale.ErrNotProtected), errors.Is(err, onsale.ErrEventNotFound), err == nil && !onSale.Open(now):
+			if err := r.store.Remove(ctx, eventID); err != nil {
+				log.Printf("Failed to drop the queue of event %d: %v", eventID, err)
+			}
+			continue
+		case err != nil:
+			log.Printf("Failed to look up the on-sale of event %d: %v", eventID, err)
+			continue
+		}
+
+		by := float64(onSale.RatePerMinute) * interval.Seconds() / 60
+		slot := now.UnixNano() / int64(interval)
+		if _, err := r.store.Advance(ctx, eventID, by, slot); err != nil {
+			log.Printf("Failed to advance the queue of event %d: %v", eventID, err)
+		}
+	}
+}
+
+// Start admits users in a background goroutine, every interval.
+func (r *Room) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			r.Tick(context.Background(), interval)
+		}
+	}()
+	log.Printf("Waiting room started, admitting every %s", interval)
+}
@@ -0,0 +1,129 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"tixie.local/common/admission"
+	"tixie.local/common/ticketsig"
+	"waiting-room/internal/onsale"
+)
+
+type fakeOnSales map[int]onsale.OnSale
+
+func (f fakeOnSales) Get(eventID int, _ time.Time) (onsale.OnSale, error) {
+	onSale, ok := f[eventID]
+	if !ok {
+		return onsale.OnSale{}, onsale.ErrNotProtected
+	}
+	return onSale, nil
+}
+
+func newRoom(t *testing.T, onSales fakeOnSales, now *time.Time) (*Room, *admission.Verifier) {
+	t.Helper()
+	signingKey, publicKey, err := ticketsig.GenerateKey("room-1")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signer, err := ticketsig.ParseSigner(signingKey)
+	if err != nil {
+		t.Fatalf("ParseSigner: %v", err)
+	}
+	keyring, err := ticketsig.ParseKeyring(publicKey)
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	verifier := admission.NewVerifier(keyring)
+
+	room := NewRoom(NewMemoryStore(), onSales, admission.NewIssuer(signer), verifier, 10*time.Minute)
+	room.now = func() time.Time { return *now }
+	return room, verifier
+}
+
+func TestRoomAdmitsAtTheOnSaleRate(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	onSales := fakeOnSales{7: {EventID: 7, RatePerMinute: 30, Until: now.Add(time.Hour)}}
+	room, verifier := newRoom(t, onSales, &now)
+
+	var tokens []string
+	for userID := 1; userID <= 3; userID++ {
+		token, status, err := room.Join(ctx, 7, userID)
+		if err != nil {
+			t.Fatalf("Join(%d): %v", userID, err)
+		}
+		if status.Position != int64(userID) || status.Admitted {
+			t.Fatalf("Join(%d) status = %+v, want position %d", userID, status, userID)
+		}
+		tokens = append(tokens, token)
+	}
+
+	// Joining again keeps the user's place.
+	if _, status, err := room.Join(ctx, 7, 2); err != nil || status.Position != 2 {
+		t.Fatalf("Join again = %+v, %v, want position 2", status, err)
+	}
+
+	// 30 a minute is one every two seconds.
+	if status, _ := room.Status(ctx, tokens[2]); status.EstimatedWaitSeconds != 6 {
+		t.Errorf("estimated wait = %d, want 6", status.EstimatedWaitSeconds)
+	}
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Second)
+		room.Tick(ctx, time.Second)
+	}
+	// A second replica ticking for the same second admits nobody more.
+	room.Tick(ctx, time.Second)
+
+	status, err := room.Status(ctx, tokens[0])
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if !status.Admitted || status.Position != 0 {
+		t.Fatalf("first user status = %+v, want admitted", status)
+	}
+	if _, err := verifier.VerifyFor(status.AdmissionToken, admission.KindAdmission, 7, 1, now); err != nil {
+		t.Errorf("admission token: %v", err)
+	}
+
+	status, err = room.Status(ctx, tokens[1])
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if status.Admitted || status.Position != 1 || status.AdmissionToken != "" {
+		t.Errorf("second user status = %+v, want position 1", status)
+	}
+}
+
+func TestRoomRefusesClosedOnSales(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	onSales := fakeOnSales{7: {EventID: 7, RatePerMinute: 60, Until: now.Add(time.Minute)}}
+	room, _ := newRoom(t, onSales, &now)
+
+	if _, _, err := room.Join(ctx, 8, 1); !errors.Is(err, onsale.ErrNotProtected) {
+		t.Errorf("Join unprotected event = %v, want ErrNotProtected", err)
+	}
+	if _, err := room.Status(ctx, "not-a-token"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Status of garbage = %v, want ErrInvalidToken", err)
+	}
+
+	token, _, err := room.Join(ctx, 7, 1)
+	if err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if _, _, err := room.Join(ctx, 7, 2); !errors.Is(err, ErrClosed) {
+		t.Errorf("Join after the on-sale = %v, want ErrClosed", err)
+	}
+	if _, err := room.Status(ctx, token); !errors.Is(err, ErrClosed) {
+		t.Errorf("Status after the on-sale = %v, want ErrClosed", err)
+	}
+
+	room.Tick(ctx, time.Second)
+	if eventIDs, _ := room.store.Events(ctx); len(eventIDs) != 0 {
+		t.Errorf("queues after the on-sale = %v, want none", eventIDs)
+	}
+}
@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Store keeps the queues of protected on-sales. A queue hands out numbers in
+// the order users join and admits everyone up to a number that advances at
+// the event's rate.
+type Store interface {
+	// Join returns the user's number in the event's queue, handing out the
+	// next one if the user has none yet.
+	Join(ctx context.Context, eventID, userID int) (int64, error)
+	// Admitted returns the highest number admitted to the event.
+	Admitted(ctx context.Context, eventID int) (int64, error)
+	// Advance admits up to by more users to the event, but never more than
+	// have joined, and returns the highest number admitted. Only the first
+	// call for a slot advances the queue, so replicas that tick at the same
+	// time do not admit users faster than the rate.
+	Advance(ctx context.Context, eventID int, by float64, slot int64) (int64, error)
+	// Events returns the events with a queue.
+	Events(ctx context.Context) ([]int, error)
+	// Remove drops the event's queue once its on-sale is over.
+	Remove(ctx context.Context, eventID int) error
+}
+
+// MemoryStore keeps queues in process memory. It suits a single replica and
+// tests.
+type MemoryStore struct {
+	mu     sync.Mutex
+	queues map[int]*memoryQueue
+}
+
+type memoryQueue struct {
+	users    map[int]int64
+	joined   int64
+	admitted float64
+	lastSlot int64
+}
+
+// NewMemoryStore creates a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{queues: make(map[int]*memoryQueue)}
+}
+
+func (s *MemoryStore) queue(eventID int) *memoryQueue {
+	q, ok := s.queues[eventID]
+	if !ok {
+		q = &memoryQueue{users: make(map[int]int64)}
+		s.queues[eventID] = q
+	}
+	return q
+}
+
+func (s *MemoryStore) Join(_ context.Context, eventID, userID int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queue(eventID)
+	if position, ok := q.users[userID]; ok {
+		return position, nil
+	}
+	q.joined++
+	q.users[userID] = q.joined
+	return q.joined, nil
+}
+
+func (s *MemoryStore) Admitted(_ context.Context, eventID int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.queues[eventID]
+	if !ok {
+		return 0, nil
+	}
+	return int64(q.admitted), nil
+}
+
+func (s *MemoryStore) Advance(_ context.Context, eventID int, by float64, slot int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queue(eventID)
+	if slot > q.lastSlot {
+		q.lastSlot = slot
+		q.admitted += by
+		if q.admitted > float64(q.joined) {
+			q.admitted = float64(q.joined)
+		}
+	}
+	return int64(q.admitted), nil
+}
+
+func (s *MemoryStore) Events(_ context.Context) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	eventIDs := make([]int, 0, len(s.queues))
+	for eventID := range s.queues {
+		eventIDs = append(eventIDs, eventID)
+	}
+	sort.Ints(eventIDs)
+	return eventIDs, nil
+}
+
+func (s *MemoryStore) Remove(_ context.Context, eventID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.queues, eventID)
+	return nil
+}